@@ -13,44 +13,89 @@ import (
 // RenderPJSIP builds pjsip.conf contents.
 func RenderPJSIP(cfg config.Config, contacts []model.Contact) ([]byte, error) {
 	var b strings.Builder
+	writePJSIPShared(&b, cfg)
+	static := staticContacts(cfg)
+	for _, c := range contacts {
+		if c.PhonebookOnly {
+			continue
+		}
+		writePJSIPContact(&b, cfg, c, static)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String()), nil
+}
 
-	// Build a lookup for static AOR contacts, keyed by extension.
-	staticContactByExt := map[string]string{}
-	if len(cfg.Asterisk.StaticContacts) > 0 {
-		for _, sc := range cfg.Asterisk.StaticContacts {
-			if sc.Ext != "" && sc.Contact != "" {
-				staticContactByExt[sc.Ext] = sc.Contact
-			}
+// RenderPJSIPSplit renders the same sections as RenderPJSIP, but returns the
+// shared part (globals, transports, templates, edge endpoint) separately
+// from each SIP contact's sections, keyed by extension, so operators can
+// #include one file per contact.
+func RenderPJSIPSplit(cfg config.Config, contacts []model.Contact) ([]byte, map[string][]byte, error) {
+	var shared strings.Builder
+	writePJSIPShared(&shared, cfg)
+	shared.WriteByte('\n')
+	static := staticContacts(cfg)
+	perContact := map[string][]byte{}
+	for _, c := range contacts {
+		if c.PhonebookOnly {
+			continue
+		}
+		var b strings.Builder
+		writePJSIPContact(&b, cfg, c, static)
+		b.WriteByte('\n')
+		perContact[c.Extension] = []byte(b.String())
+	}
+	return []byte(shared.String()), perContact, nil
+}
+
+// staticContacts builds a lookup for static AOR contacts, keyed by extension.
+func staticContacts(cfg config.Config) map[string]string {
+	byExt := map[string]string{}
+	for _, sc := range cfg.Asterisk.StaticContacts {
+		if sc.Ext != "" && sc.Contact != "" {
+			byExt[sc.Ext] = sc.Contact
 		}
 	}
+	return byExt
+}
 
-	writeSection(&b, "global", func() {
-		writeKV(&b, "type", "global")
-		writeOptions(&b, cfg.Global)
+// writePJSIPShared writes every pjsip.conf section that is not tied to one
+// contact.
+func writePJSIPShared(b *strings.Builder, cfg config.Config) {
+	writeSection(b, "global", func() {
+		writeKV(b, "type", "global")
+		writeOptions(b, cfg.Global)
 		if _, ok := cfg.Global["endpoint_identifier_order"]; !ok {
-			writeKV(&b, "endpoint_identifier_order", "username,ip,anonymous")
+			writeKV(b, "endpoint_identifier_order", "username,ip,anonymous")
 		}
 	})
 
-	for _, transport := range cfg.Transports {
+	transports, templates := cfg.Transports, cfg.EndpointTemplates
+	if cfg.Asterisk.StableOrder {
+		transports = append([]config.Transport(nil), transports...)
+		sort.SliceStable(transports, func(i, j int) bool { return transports[i].Name < transports[j].Name })
+		templates = append([]config.EndpointConfig(nil), templates...)
+		sort.SliceStable(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	}
+
+	for _, transport := range transports {
 		section := transport.Name
-		writeSection(&b, section, func() {
-			writeKV(&b, "type", "transport")
+		writeSection(b, section, func() {
+			writeKV(b, "type", "transport")
 			if transport.Protocol != "" {
-				writeKV(&b, "protocol", transport.Protocol)
+				writeKV(b, "protocol", transport.Protocol)
 			}
 			if transport.Bind != "" {
-				writeKV(&b, "bind", transport.Bind)
+				writeKV(b, "bind", transport.Bind)
 			}
-			writeNetworkDefaults(&b, cfg.Network, transport.Extra)
-			writeMap(&b, transport.Extra)
+			writeNetworkDefaults(b, cfg.Network, transport.Extra)
+			writeMap(b, transport.Extra)
 		})
 	}
 
-	for _, tmpl := range cfg.EndpointTemplates {
-		writeTemplateSection(&b, tmpl.Name, func() {
-			writeKV(&b, "type", "endpoint")
-			writeEndpointOptions(&b, tmpl.Extra)
+	for _, tmpl := range templates {
+		writeTemplateSection(b, tmpl.Name, func() {
+			writeKV(b, "type", "endpoint")
+			writeEndpointOptions(b, tmpl.Extra)
 		})
 	}
 
@@ -68,63 +113,114 @@ func RenderPJSIP(cfg config.Config, contacts []model.Contact) ([]byte, error) {
 			}
 		}
 		// Render a minimal endpoint suitable for edge proxy ingress.
-		writeSection(&b, name, func() {
-			writeKV(&b, "type", "endpoint")
+		writeSection(b, name, func() {
+			writeKV(b, "type", "endpoint")
 			// Security model: no auth; identify by IP below.
-			writeKV(&b, "context", inboundCtx)
-			writeKV(&b, "disallow", "all")
+			writeKV(b, "context", inboundCtx)
+			writeKV(b, "disallow", "all")
 			// Allow codecs: reuse first endpoint template allow if available; else default.
 			allowed := defaultAllowFromTemplates(cfg)
 			for _, c := range allowed {
-				writeKV(&b, "allow", c)
+				writeKV(b, "allow", c)
 			}
 			// NAT-friendly defaults matching templates
-			writeKV(&b, "direct_media", "no")
-			writeKV(&b, "rtp_symmetric", "yes")
-			writeKV(&b, "force_rport", "yes")
-			writeKV(&b, "rewrite_contact", "yes")
+			writeKV(b, "direct_media", "no")
+			writeKV(b, "rtp_symmetric", "yes")
+			writeKV(b, "force_rport", "yes")
+			writeKV(b, "rewrite_contact", "yes")
 			// Use first transport name if defined
 			if len(cfg.Transports) > 0 {
-				writeKV(&b, "transport", cfg.Transports[0].Name)
+				writeKV(b, "transport", cfg.Transports[0].Name)
 			}
 		})
 		// Identify mapping for the edge source IP/host to the endpoint.
-		writeSection(&b, name, func() {
-			writeKV(&b, "type", "identify")
-			writeKV(&b, "endpoint", name)
-			writeKV(&b, "match", cfg.Asterisk.EdgeIn.Match)
+		writeSection(b, name, func() {
+			writeKV(b, "type", "identify")
+			writeKV(b, "endpoint", name)
+			writeKV(b, "match", cfg.Asterisk.EdgeIn.Match)
 		})
 	}
+}
 
-	for _, c := range contacts {
-		if c.PhonebookOnly {
+// writePJSIPContact writes a contact's endpoint, auth, and AOR sections.
+func writePJSIPContact(b *strings.Builder, cfg config.Config, c model.Contact, static map[string]string) {
+	fmt.Fprintf(b, "\n; Auth & AOR for extension %s\n", c.Extension)
+	writeInheritedSection(b, c.Extension, c.Endpoint.Template, func() {
+		writeKV(b, "type", "endpoint")
+		writeKV(b, "auth", c.Extension)
+		writeKV(b, "aors", c.Extension)
+		if c.Endpoint.Transport != "" {
+			writeKV(b, "transport", c.Endpoint.Transport)
+		}
+		if c.Endpoint.Context != "" {
+			writeKV(b, "context", c.Endpoint.Context)
+		}
+		if cfg.Asterisk.BLF {
+			writeKV(b, "allow_subscribe", "yes")
+			writeKV(b, "subscribe_context", blfContext(cfg))
+		}
+	})
+	writeSection(b, c.Extension, func() {
+		writeKV(b, "type", "auth")
+		writeKV(b, "auth_type", "userpass")
+		writeKV(b, "username", c.Auth.Username)
+		writeKV(b, "password", c.Auth.Password)
+	})
+	writeSection(b, c.Extension, func() {
+		writeKV(b, "type", "aor")
+		writeKV(b, "max_contacts", c.AOR.MaxContacts)
+		writeKV(b, "remove_existing", c.AOR.RemoveExisting)
+		writeKV(b, "qualify_frequency", c.AOR.QualifyFrequency)
+		if c.AOR.QualifyTimeout > 0 {
+			writeKV(b, "qualify_timeout", c.AOR.QualifyTimeout)
+		}
+		if c.AOR.MinimumExpiration > 0 {
+			writeKV(b, "minimum_expiration", c.AOR.MinimumExpiration)
+		}
+		if c.AOR.MaximumExpiration > 0 {
+			writeKV(b, "maximum_expiration", c.AOR.MaximumExpiration)
+		}
+		if c.AOR.DefaultExpiration > 0 {
+			writeKV(b, "default_expiration", c.AOR.DefaultExpiration)
+		}
+		if uri, ok := static[c.Extension]; ok {
+			writeKV(b, "contact", uri)
+		}
+	})
+}
+
+// Combine joins rendered pjsip.conf, extensions.conf and voicemail.conf into
+// one file for setups that keep all of their Asterisk config together. Each
+// part sits under a banner naming the file it stands for; an empty
+// voicemail.conf, as rendered when no contact has a mailbox, is left out.
+func Combine(pjsip, extensions, voicemail []byte) []byte {
+	var b strings.Builder
+	for _, part := range []struct {
+		name string
+		body []byte
+	}{
+		{"pjsip.conf", pjsip},
+		{"extensions.conf", extensions},
+		{"voicemail.conf", voicemail},
+	} {
+		if part.name == "voicemail.conf" && len(part.body) == 0 {
 			continue
 		}
-		fmt.Fprintf(&b, "\n; Auth & AOR for extension %s\n", c.Extension)
-		writeInheritedSection(&b, c.Extension, c.Endpoint.Template, func() {
-			writeKV(&b, "type", "endpoint")
-			writeKV(&b, "auth", c.Extension)
-			writeKV(&b, "aors", c.Extension)
-		})
-		writeSection(&b, c.Extension, func() {
-			writeKV(&b, "type", "auth")
-			writeKV(&b, "auth_type", "userpass")
-			writeKV(&b, "username", c.Auth.Username)
-			writeKV(&b, "password", c.Auth.Password)
-		})
-		writeSection(&b, c.Extension, func() {
-			writeKV(&b, "type", "aor")
-			writeKV(&b, "max_contacts", c.AOR.MaxContacts)
-			writeKV(&b, "remove_existing", c.AOR.RemoveExisting)
-			writeKV(&b, "qualify_frequency", c.AOR.QualifyFrequency)
-			if uri, ok := staticContactByExt[c.Extension]; ok {
-				writeKV(&b, "contact", uri)
-			}
-		})
+		fmt.Fprintf(&b, ";\n; ==== %s ====\n;\n", part.name)
+		b.Write(part.body)
+		if !strings.HasSuffix(b.String(), "\n") {
+			b.WriteByte('\n')
+		}
 	}
+	return []byte(b.String())
+}
 
-	b.WriteByte('\n')
-	return []byte(b.String()), nil
+// blfContext is the dialplan context holding BLF hints.
+func blfContext(cfg config.Config) string {
+	if cfg.Dialplan.Context != "" {
+		return cfg.Dialplan.Context
+	}
+	return "internal"
 }
 
 // defaultAllowFromTemplates returns the allow list from the first endpoint template,
@@ -188,6 +284,20 @@ func RenderExtensions(cfg config.Config, contacts []model.Contact) ([]byte, erro
 		addDialplanContext(ctx)
 		applicationByContext[ctx] = append(applicationByContext[ctx], application)
 	}
+	// Contacts with their own context get a section of their own, which
+	// the main context includes so everyone else can still dial them.
+	contactsByContext := map[string][]model.Contact{}
+	for _, c := range contacts {
+		if c.PhonebookOnly {
+			continue
+		}
+		ctx := c.Endpoint.Context
+		if ctx == "" {
+			ctx = mainContext
+		}
+		addDialplanContext(ctx)
+		contactsByContext[ctx] = append(contactsByContext[ctx], c)
+	}
 
 	messageContext := cfg.Dialplan.Messages.Context
 	if messageContext == "" {
@@ -221,25 +331,51 @@ func RenderExtensions(cfg config.Config, contacts []model.Contact) ([]byte, erro
 		addInclude(messageContext)
 	}
 
-	writeSection(&b, mainContext, func() {
-		for _, include := range includes {
-			fmt.Fprintf(&b, "include => %s\n", include)
+	vm := cfg.Dialplan.Voicemail
+	if vm.Context == "" {
+		vm.Context = "default"
+	}
+	hasVoicemail := false
+	for _, c := range contacts {
+		if c.Voicemail != nil && !c.PhonebookOnly {
+			hasVoicemail = true
+			break
 		}
-		for _, c := range contacts {
-			if c.PhonebookOnly {
-				continue
+	}
+
+	writeContext := func(context string) {
+		for _, c := range contactsByContext[context] {
+			if c.Voicemail != nil {
+				writeDialExtension(&b, c.Extension, voicemailDial(cfg.Dialplan.Dial, vm.RingSeconds))
+				fmt.Fprintf(&b, " same => n,VoiceMail(%s@%s,u)\n", c.Extension, vm.Context)
+				fmt.Fprintln(&b, " same => n,Hangup()")
+			} else {
+				writeDialExtension(&b, c.Extension, cfg.Dialplan.Dial)
 			}
-			fmt.Fprintf(&b, "exten => %s,1,Dial(PJSIP/%s)\n", c.Extension, c.Extension)
+			if cfg.Asterisk.BLF {
+				fmt.Fprintf(&b, "exten => %s,hint,PJSIP/%s\n", c.Extension, c.Extension)
+			}
+		}
+		if hasVoicemail && vm.MainExtension != "" && context == mainContext {
+			fmt.Fprintf(&b, "exten => %s,1,VoiceMailMain(${CALLERID(num)}@%s)\n", vm.MainExtension, vm.Context)
+			fmt.Fprintln(&b, " same => n,Hangup()")
 		}
-		for _, conference := range conferenceByContext[mainContext] {
+		for _, conference := range conferenceByContext[context] {
 			writeConferenceExtension(&b, conference)
 		}
-		for _, application := range applicationByContext[mainContext] {
+		for _, application := range applicationByContext[context] {
 			writeApplicationExtension(&b, application)
 		}
-		if cfg.Dialplan.Messages.Enabled && messageContext == mainContext {
+		if cfg.Dialplan.Messages.Enabled && messageContext == context {
 			writeMessageRouting(&b, messagePattern)
 		}
+	}
+
+	writeSection(&b, mainContext, func() {
+		for _, include := range includes {
+			fmt.Fprintf(&b, "include => %s\n", include)
+		}
+		writeContext(mainContext)
 	})
 
 	for _, context := range dialplanContextOrder {
@@ -247,16 +383,11 @@ func RenderExtensions(cfg config.Config, contacts []model.Contact) ([]byte, erro
 			continue
 		}
 		writeSection(&b, context, func() {
-			for _, conference := range conferenceByContext[context] {
-				writeConferenceExtension(&b, conference)
-			}
-			for _, application := range applicationByContext[context] {
-				writeApplicationExtension(&b, application)
-			}
+			writeContext(context)
 		})
 	}
 
-	if cfg.Dialplan.Messages.Enabled && messageContext != mainContext {
+	if _, written := seenDialplanContext[messageContext]; cfg.Dialplan.Messages.Enabled && messageContext != mainContext && !written {
 		writeSection(&b, messageContext, func() {
 			writeMessageRouting(&b, messagePattern)
 		})
@@ -266,6 +397,63 @@ func RenderExtensions(cfg config.Config, contacts []model.Contact) ([]byte, erro
 	return []byte(b.String()), nil
 }
 
+func writeDialExtension(b *strings.Builder, ext string, dial config.Dial) {
+	prefix := fmt.Sprintf("exten => %s,1", ext)
+	for _, step := range dial.PreDial {
+		fmt.Fprintf(b, "%s,%s\n", prefix, strings.TrimSpace(step))
+		prefix = " same => n"
+	}
+	args := "PJSIP/" + ext
+	if dial.Options != "" {
+		args += "," + dial.Options
+	}
+	fmt.Fprintf(b, "%s,Dial(%s)\n", prefix, args)
+}
+
+// voicemailDial gives the Dial a ring timeout so unanswered calls fall
+// through to VoiceMail. A timeout already set in the options is kept.
+func voicemailDial(dial config.Dial, ringSeconds int) config.Dial {
+	if ringSeconds <= 0 {
+		ringSeconds = 20
+	}
+	if dial.Options == "" || strings.HasPrefix(dial.Options, ",") {
+		dial.Options = strconv.Itoa(ringSeconds) + dial.Options
+	}
+	return dial
+}
+
+// RenderVoicemail builds voicemail.conf contents with a mailbox for each SIP
+// contact that has a voicemail block. It returns nil when there are none, so
+// deployments without voicemail get no file.
+func RenderVoicemail(cfg config.Config, contacts []model.Contact) ([]byte, error) {
+	context := cfg.Dialplan.Voicemail.Context
+	if context == "" {
+		context = "default"
+	}
+	var b strings.Builder
+	for _, c := range contacts {
+		if c.Voicemail == nil || c.PhonebookOnly {
+			continue
+		}
+		if b.Len() == 0 {
+			writeSection(&b, context, func() {})
+		}
+		// Commas separate the mailbox fields, so they cannot appear in the
+		// name.
+		name := strings.ReplaceAll(strings.TrimSpace(c.FirstName+" "+c.LastName), ",", "")
+		fields := c.Voicemail.PIN + "," + name
+		if c.Voicemail.Email != "" {
+			fields += "," + c.Voicemail.Email
+		}
+		fmt.Fprintf(&b, "%s => %s\n", c.Extension, fields)
+	}
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	b.WriteByte('\n')
+	return []byte(b.String()), nil
+}
+
 func writeConferenceExtension(b *strings.Builder, conference config.Conference) {
 	fmt.Fprintf(b, "exten => %s,1,Answer()\n", conference.Extension)
 	fmt.Fprintf(b, " same => n,ConfBridge(%s)\n", conference.Room)
@@ -425,6 +613,8 @@ func flatten(v any) []string {
 		}
 		return out
 	default:
+		// config validation rejects maps and other types with no
+		// key=value spelling, so this only sees internal callers' values.
 		return []string{fmt.Sprint(val)}
 	}
 }
@@ -23,6 +23,54 @@ func TestRenderPJSIPMatchesGolden(t *testing.T) {
 	}
 }
 
+func TestRenderPJSIPPerContactTransportMatchesGolden(t *testing.T) {
+	cfg := sampleConfig()
+	cfg.Transports = append(cfg.Transports, config.Transport{
+		Name:     "transport-tls",
+		Protocol: "tls",
+		Bind:     "0.0.0.0:5061",
+	})
+	contacts := sampleContacts()
+	contacts[1].Endpoint.Transport = "transport-tls"
+	got, err := RenderPJSIP(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	want := readGolden(t, "testdata/asterisk/pjsip_transport.conf")
+	if string(got) != string(want) {
+		t.Fatalf("pjsip.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestRenderPJSIPStableOrderMatchesGolden(t *testing.T) {
+	cfg := sampleConfig()
+	cfg.Asterisk.StableOrder = true
+	cfg.Transports = append(cfg.Transports, config.Transport{
+		Name:     "transport-tls",
+		Protocol: "tls",
+		Bind:     "0.0.0.0:5061",
+	})
+	cfg.EndpointTemplates = append(cfg.EndpointTemplates, config.EndpointConfig{
+		Name:  "basic-template",
+		Extra: map[string]any{"context": "internal"},
+	})
+	got, err := RenderPJSIP(cfg, sampleContacts())
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	want := readGolden(t, "testdata/asterisk/pjsip_sorted.conf")
+	if string(got) != string(want) {
+		t.Fatalf("pjsip.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+
+	// Reordering config.yaml must not change the output.
+	cfg.Transports[0], cfg.Transports[1] = cfg.Transports[1], cfg.Transports[0]
+	cfg.EndpointTemplates[0], cfg.EndpointTemplates[1] = cfg.EndpointTemplates[1], cfg.EndpointTemplates[0]
+	if again, _ := RenderPJSIP(cfg, sampleContacts()); string(again) != string(got) {
+		t.Fatalf("expected the same pjsip.conf after reordering config, got:\n%s", again)
+	}
+}
+
 func TestRenderExtensionsMatchesGolden(t *testing.T) {
 	cfg := sampleConfig()
 	contacts := sampleContacts()
@@ -36,6 +84,37 @@ func TestRenderExtensionsMatchesGolden(t *testing.T) {
 	}
 }
 
+func TestRenderExtensionsPerContactContextsMatchesGolden(t *testing.T) {
+	cfg := sampleConfig()
+	contacts := sampleContacts()
+	contacts[1].Endpoint.Context = "guests"
+	for _, ext := range []string{"103", "104"} {
+		c := sampleContacts()[0]
+		c.Extension = ext
+		c.Endpoint.Context = "restricted"
+		contacts = append(contacts, c)
+	}
+	got, err := RenderExtensions(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	want := readGolden(t, "testdata/asterisk/extensions_contexts.conf")
+	if string(got) != string(want) {
+		t.Fatalf("extensions.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+
+	pjsip, err := RenderPJSIP(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	if !contains(string(pjsip), "[102](endpoint-template)\ntype=endpoint\nauth=102\naors=102\ncontext=guests\n") {
+		t.Fatalf("expected the guest endpoint to start calls in its context:\n%s", pjsip)
+	}
+	if contains(string(pjsip), "aors=101\ncontext=") {
+		t.Fatalf("contacts without a context should keep the template's:\n%s", pjsip)
+	}
+}
+
 func TestRenderExtensionsWithConferencesAndMessages(t *testing.T) {
 	cfg := sampleConfig()
 	cfg.Dialplan.Includes = []string{"legacy"}
@@ -106,6 +185,134 @@ exten => 5653,1,Answer()
 	}
 }
 
+func TestRenderExtensionsWithDialOptionsAndPreDial(t *testing.T) {
+	cfg := sampleConfig()
+	cfg.Dialplan.Dial = config.Dial{
+		Options: ",tT",
+		PreDial: []string{"Set(CALLERID(name)=Office)", "Answer()"},
+	}
+
+	got, err := RenderExtensions(cfg, sampleContacts())
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	want := `[internal]
+exten => 101,1,Set(CALLERID(name)=Office)
+ same => n,Answer()
+ same => n,Dial(PJSIP/101,,tT)
+exten => 102,1,Set(CALLERID(name)=Office)
+ same => n,Answer()
+ same => n,Dial(PJSIP/102,,tT)
+
+`
+	if string(got) != want {
+		t.Fatalf("extensions.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestRenderExtensionsWithVoicemail(t *testing.T) {
+	cfg := sampleConfig()
+	cfg.Asterisk.BLF = true
+	cfg.Dialplan.Voicemail = config.Voicemail{Context: "office", RingSeconds: 15, MainExtension: "*97"}
+	contacts := sampleContacts()
+	contacts[0].Voicemail = &model.ContactVoicemail{PIN: "4321", Email: "alpha@example.com"}
+
+	got, err := RenderExtensions(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	want := `[internal]
+exten => 101,1,Dial(PJSIP/101,15)
+ same => n,VoiceMail(101@office,u)
+ same => n,Hangup()
+exten => 101,hint,PJSIP/101
+exten => 102,1,Dial(PJSIP/102)
+exten => 102,hint,PJSIP/102
+exten => *97,1,VoiceMailMain(${CALLERID(num)}@office)
+ same => n,Hangup()
+
+`
+	if string(got) != want {
+		t.Fatalf("extensions.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+
+	// A timeout in the dial options wins over ring_seconds.
+	cfg.Dialplan.Dial.Options = "30,tT"
+	got, err = RenderExtensions(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	if !contains(string(got), "exten => 101,1,Dial(PJSIP/101,30,tT)\n") {
+		t.Fatalf("expected the configured timeout kept, got:\n%s", got)
+	}
+
+	// Without any mailbox the output is exactly what it was before.
+	got, err = RenderExtensions(sampleConfig(), sampleContacts())
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	if want := readGolden(t, "testdata/asterisk/extensions.conf"); string(got) != string(want) {
+		t.Fatalf("extensions.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestRenderVoicemailMatchesGolden(t *testing.T) {
+	cfg := sampleConfig()
+	contacts := sampleContacts()
+	if got, err := RenderVoicemail(cfg, contacts); err != nil || got != nil {
+		t.Fatalf("expected no voicemail.conf without mailboxes, got %q, %v", got, err)
+	}
+
+	contacts[0].Voicemail = &model.ContactVoicemail{PIN: "4321", Email: "alpha@example.com"}
+	contacts[1].LastName = "User, Jr."
+	contacts[1].Voicemail = &model.ContactVoicemail{PIN: "0102"}
+	contacts = append(contacts, model.Contact{
+		FirstName:     "Lobby",
+		Extension:     "103",
+		PhonebookOnly: true,
+		Voicemail:     &model.ContactVoicemail{PIN: "1"},
+	})
+	got, err := RenderVoicemail(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderVoicemail() error = %v", err)
+	}
+	want := readGolden(t, "testdata/asterisk/voicemail.conf")
+	if string(got) != string(want) {
+		t.Fatalf("voicemail.conf mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestBLFRendersHintsAndSubscriptions(t *testing.T) {
+	cfg := sampleConfig()
+	cfg.Asterisk.BLF = true
+
+	extensions, err := RenderExtensions(cfg, sampleContacts())
+	if err != nil {
+		t.Fatalf("RenderExtensions() error = %v", err)
+	}
+	want := `[internal]
+exten => 101,1,Dial(PJSIP/101)
+exten => 101,hint,PJSIP/101
+exten => 102,1,Dial(PJSIP/102)
+exten => 102,hint,PJSIP/102
+
+`
+	if string(extensions) != want {
+		t.Fatalf("extensions.conf mismatch\nGot:\n%s\nWant:\n%s", extensions, want)
+	}
+
+	pjsip, err := RenderPJSIP(cfg, sampleContacts())
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	got := string(pjsip)
+	for _, line := range []string{"aors=101\nallow_subscribe=yes\nsubscribe_context=internal\n", "aors=102\nallow_subscribe=yes\nsubscribe_context=internal\n"} {
+		if !contains(got, line) {
+			t.Fatalf("expected endpoint subscription options %q in:\n%s", line, got)
+		}
+	}
+}
+
 func TestPhonebookOnlyContactDoesNotRenderPJSIPOrDialplan(t *testing.T) {
 	cfg := sampleConfig()
 	cfg.Dialplan.Conferences = []config.Conference{{Extension: "2600", Room: "2600", Context: "conferences"}}
@@ -251,3 +458,61 @@ func readGolden(t *testing.T, rel string) []byte {
 	}
 	return data
 }
+
+func TestRenderPJSIPWritesOptionalAOROptions(t *testing.T) {
+	contacts := sampleContacts()
+	contacts[0].AOR.QualifyTimeout = 2.5
+	contacts[0].AOR.MaximumExpiration = 600
+
+	pjsip, err := RenderPJSIP(sampleConfig(), contacts)
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	got := string(pjsip)
+	if !contains(got, "qualify_frequency=30\nqualify_timeout=2.5\nmaximum_expiration=600\n") {
+		t.Fatalf("expected qualify_timeout and maximum_expiration on the AOR:\n%s", got)
+	}
+	if contains(got, "minimum_expiration") || contains(got, "default_expiration") {
+		t.Fatalf("unset AOR options should be left to Asterisk:\n%s", got)
+	}
+}
+
+func TestRenderPJSIPSplitMatchesRenderPJSIP(t *testing.T) {
+	cfg := sampleConfig()
+	contacts := sampleContacts()
+	whole, err := RenderPJSIP(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderPJSIP() error = %v", err)
+	}
+	shared, perContact, err := RenderPJSIPSplit(cfg, contacts)
+	if err != nil {
+		t.Fatalf("RenderPJSIPSplit() error = %v", err)
+	}
+	if len(perContact) != len(contacts) {
+		t.Fatalf("expected one file per SIP contact, got %d", len(perContact))
+	}
+	// Joining the pieces in contact order must give back pjsip.conf.
+	joined := strings.TrimSuffix(string(shared), "\n")
+	for _, c := range contacts {
+		joined += strings.TrimSuffix(string(perContact[c.Extension]), "\n")
+	}
+	if joined+"\n" != string(whole) {
+		t.Fatalf("split output does not reassemble pjsip.conf:\n%s", joined)
+	}
+	if contains(string(shared), "type=auth") {
+		t.Fatalf("shared part should not hold contact sections:\n%s", shared)
+	}
+}
+
+func TestCombineLabelsEachFile(t *testing.T) {
+	got := string(Combine([]byte("[global]\ntype=global\n"), []byte("[internal]"), nil))
+	want := ";\n; ==== pjsip.conf ====\n;\n[global]\ntype=global\n;\n; ==== extensions.conf ====\n;\n[internal]\n"
+	if got != want {
+		t.Fatalf("Combine() = %q, want %q", got, want)
+	}
+
+	got = string(Combine([]byte("[global]\n"), []byte("[internal]\n"), []byte("[default]\n100 => 1234\n")))
+	if !strings.HasSuffix(got, ";\n; ==== voicemail.conf ====\n;\n[default]\n100 => 1234\n") {
+		t.Fatalf("expected voicemail.conf as the last part, got %q", got)
+	}
+}
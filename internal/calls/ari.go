@@ -0,0 +1,574 @@
+package calls
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultARIApp is the Stasis application name the event stream registers
+// when ARIConfig.App is empty.
+const DefaultARIApp = "phonebook"
+
+// maxARIMessage bounds one event; channel snapshots are a few kilobytes.
+const maxARIMessage = 1 << 20
+
+// ARIConfig configures the ARI (Asterisk REST Interface) connection used in
+// place of AMI.
+type ARIConfig struct {
+	// URL is the base of Asterisk's HTTP server, such as
+	// http://127.0.0.1:8088. An https URL connects over TLS.
+	URL      string
+	Username string
+	Password string
+	// App is the Stasis application to register; empty means
+	// DefaultARIApp. Events for every channel, endpoint and device are
+	// requested, so no dialplan has to send calls to it.
+	App            string
+	ConnectTimeout time.Duration
+	ReconnectDelay time.Duration
+	// PingInterval is how often the client pings the event stream; a
+	// connection silent for two intervals is treated as dead.
+	PingInterval          time.Duration
+	TLSInsecureSkipVerify bool
+}
+
+// RunARI connects to the ARI event stream, feeds its events through the
+// same model as RunAMI, and reconnects until ctx cancellation.
+func (s *Service) RunARI(ctx context.Context, cfg ARIConfig) error {
+	if cfg.URL == "" {
+		return errors.New("ARI URL is required")
+	}
+	if cfg.Username == "" || cfg.Password == "" {
+		return errors.New("ARI username and password are required")
+	}
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("ARI URL: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return fmt.Errorf("ARI URL %q must be http:// or https://host[:port]", cfg.URL)
+	}
+	if cfg.App == "" {
+		cfg.App = DefaultARIApp
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 5 * time.Second
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 5 * time.Second
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = 30 * time.Second
+	}
+	if s.opts.PresenceTTL > 0 {
+		go s.runSweeper(ctx)
+	}
+
+	for {
+		err := s.runARIConnection(ctx, cfg, base)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			s.logger.Warn("ARI connection closed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.ReconnectDelay):
+		}
+	}
+}
+
+func (s *Service) runARIConnection(ctx context.Context, cfg ARIConfig, base *url.URL) error {
+	conn, reader, err := dialARI(ctx, cfg, base)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s.logger.Info("ARI connected", "url", base.Redacted(), "app", cfg.App)
+
+	var writeMu sync.Mutex
+	send := func(opcode byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(cfg.ConnectTimeout))
+		return writeARIFrame(conn, opcode, payload)
+	}
+
+	client := ariHTTPClient(cfg)
+	refresh := func() {
+		rows, err := fetchARIEndpoints(ctx, client, cfg, base)
+		if err != nil {
+			s.logger.Warn("ARI endpoint listing failed", "err", err)
+			return
+		}
+		s.SeedPresence(rows)
+	}
+	go refresh()
+
+	closeConn := make(chan struct{})
+	defer close(closeConn)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = send(0x8, []byte{0x03, 0xe8})
+			_ = conn.Close()
+		case <-closeConn:
+		}
+	}()
+
+	// Endpoint events only report changes, so the listing is repeated the
+	// way AMI's PJSIPShowEndpoints is, keeping presences inside their TTL.
+	refreshTicker := time.NewTicker(15 * time.Second)
+	defer refreshTicker.Stop()
+	pingTicker := time.NewTicker(cfg.PingInterval)
+	defer pingTicker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-closeConn:
+				return
+			case <-refreshTicker.C:
+				refresh()
+			case <-pingTicker.C:
+				if err := send(0x9, nil); err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	translator := newARITranslator()
+	var message []byte
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(2 * cfg.PingInterval)); err != nil {
+			return err
+		}
+		opcode, fin, payload, err := readARIFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case 0x9:
+			if err := send(0xA, payload); err != nil {
+				return err
+			}
+		case 0x8:
+			_ = send(0x8, payload)
+			return errors.New("ARI closed the event stream")
+		case 0x1, 0x0:
+			message = append(message, payload...)
+			if len(message) > maxARIMessage {
+				return fmt.Errorf("ARI event exceeds %d bytes", maxARIMessage)
+			}
+			if !fin {
+				continue
+			}
+			events, err := translator.translate(message)
+			message = nil
+			if err != nil {
+				s.logger.Debug("ignoring malformed ARI event", "err", err)
+				continue
+			}
+			for _, event := range events {
+				s.HandleAMIEvent(event)
+			}
+		}
+	}
+}
+
+// dialARI opens the /ari/events WebSocket and returns the connection with a
+// reader positioned after the handshake. Like dialAMI, only the handshake
+// runs under ConnectTimeout.
+func dialARI(ctx context.Context, cfg ARIConfig, base *url.URL) (net.Conn, *bufio.Reader, error) {
+	host := base.Host
+	if base.Port() == "" {
+		port := "80"
+		if base.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(base.Hostname(), port)
+	}
+	dialer := net.Dialer{Timeout: cfg.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(cfg.ConnectTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if base.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         base.Hostname(),
+			InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("ARI TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	events := ariURL(base, "/ari/events")
+	events.RawQuery = url.Values{"app": {cfg.App}, "subscribeAll": {"true"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, events.String(), nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = resp.Body.Close()
+		_ = conn.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, nil, errors.New("ARI rejected the username or password; check ari.conf")
+		}
+		return nil, nil, fmt.Errorf("ARI event stream: unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != ariAcceptKey(key) {
+		_ = conn.Close()
+		return nil, nil, errors.New("ARI event stream: bad Sec-WebSocket-Accept")
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// ariURL joins path onto the base URL, keeping any prefix Asterisk is
+// served under (http.conf prefix=).
+func ariURL(base *url.URL, path string) *url.URL {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + path
+	u.RawQuery = ""
+	u.User = nil
+	return &u
+}
+
+func ariAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// readARIFrame reads one frame. Servers never mask their frames, so a
+// masked one is a protocol error.
+func readARIFrame(r *bufio.Reader) (opcode byte, fin bool, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, false, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[1]&0x80 != 0 {
+		return 0, false, nil, errors.New("ARI sent a masked frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, false, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxARIMessage {
+		return 0, false, nil, fmt.Errorf("ARI frame of %d bytes exceeds %d", length, maxARIMessage)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, false, nil, err
+	}
+	return opcode, fin, payload, nil
+}
+
+// writeARIFrame writes one unfragmented frame, masked as RFC 6455 requires
+// of clients.
+func writeARIFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | (opcode & 0x0f)}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, 0x80|byte(length))
+	case length <= 65535:
+		header = append(header, 0x80|126, byte(length>>8), byte(length))
+	default:
+		header = append(header, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[len(header)-8:], uint64(length))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	header = append(header, mask[:]...)
+	masked := make([]byte, length)
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	_, err := w.Write(append(header, masked...))
+	return err
+}
+
+func ariHTTPClient(cfg ARIConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLSInsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Timeout: cfg.ConnectTimeout, Transport: transport}
+}
+
+// fetchARIEndpoints lists every endpoint as EndpointStatus rows for
+// SeedPresence.
+func fetchARIEndpoints(ctx context.Context, client *http.Client, cfg ARIConfig, base *url.URL) ([]map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ariURL(base, "/ari/endpoints").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /ari/endpoints: %s", resp.Status)
+	}
+	var endpoints []ariEndpoint
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxARIMessage)).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("GET /ari/endpoints: %w", err)
+	}
+	rows := make([]map[string]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		rows = append(rows, ep.event())
+	}
+	return rows, nil
+}
+
+type ariChannel struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Caller struct {
+		Name   string `json:"name"`
+		Number string `json:"number"`
+	} `json:"caller"`
+	Dialplan struct {
+		Exten string `json:"exten"`
+	} `json:"dialplan"`
+}
+
+type ariEndpoint struct {
+	Technology string   `json:"technology"`
+	Resource   string   `json:"resource"`
+	State      string   `json:"state"`
+	ChannelIDs []string `json:"channel_ids"`
+}
+
+// event renders the endpoint the way AMI reports an EndpointStatus change.
+func (ep ariEndpoint) event() map[string]string {
+	return map[string]string{
+		"Event":          "EndpointStatus",
+		"Endpoint":       ep.Resource,
+		"Status":         ep.State,
+		"ActiveChannels": strconv.Itoa(len(ep.ChannelIDs)),
+	}
+}
+
+type ariEvent struct {
+	Type        string       `json:"type"`
+	Channel     *ariChannel  `json:"channel"`
+	Caller      *ariChannel  `json:"caller"`
+	Peer        *ariChannel  `json:"peer"`
+	DialString  string       `json:"dialstring"`
+	DialStatus  string       `json:"dialstatus"`
+	Cause       int          `json:"cause"`
+	CauseTxt    string       `json:"cause_txt"`
+	Endpoint    *ariEndpoint `json:"endpoint"`
+	DeviceState *struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+	} `json:"device_state"`
+}
+
+// ariTranslator turns ARI events into the AMI-shaped events HandleAMIEvent
+// understands. ARI channels carry no Linkedid, so the translator derives
+// one: a channel created by a Dial is linked to the channel that dialed it,
+// and events for linked channels carry that channel's id as Linkedid.
+type ariTranslator struct {
+	links  map[string]string
+	causes map[string]string
+}
+
+func newARITranslator() *ariTranslator {
+	return &ariTranslator{links: map[string]string{}, causes: map[string]string{}}
+}
+
+func (t *ariTranslator) translate(raw []byte) ([]map[string]string, error) {
+	var ev ariEvent
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return nil, err
+	}
+	switch ev.Type {
+	case "StasisStart", "ChannelCreated":
+		if ev.Channel == nil {
+			return nil, nil
+		}
+		out := t.channelEvent("Newchannel", ev.Channel)
+		out["CallerIDNum"] = ev.Channel.Caller.Number
+		out["Exten"] = ev.Channel.Dialplan.Exten
+		out["ChannelStateDesc"] = ev.Channel.State
+		return []map[string]string{out}, nil
+	case "ChannelStateChange":
+		if ev.Channel == nil {
+			return nil, nil
+		}
+		if strings.EqualFold(ev.Channel.State, "Up") {
+			return []map[string]string{t.channelEvent("BridgeEnter", ev.Channel)}, nil
+		}
+		out := t.channelEvent("Newstate", ev.Channel)
+		out["ChannelStateDesc"] = ev.Channel.State
+		return []map[string]string{out}, nil
+	case "Dial":
+		// Only the first Dial event, without a dialstatus, starts a dial;
+		// later ones report progress and the answer arrives as a state
+		// change.
+		if ev.Peer == nil || ev.Caller == nil || ev.DialStatus != "" {
+			return nil, nil
+		}
+		link := t.links[ev.Caller.ID]
+		if link == "" {
+			link = ev.Caller.ID
+		}
+		t.links[ev.Peer.ID] = link
+		return []map[string]string{{
+			"Event":        "DialBegin",
+			"Linkedid":     link,
+			"Uniqueid":     ev.Peer.ID,
+			"SrcUniqueid":  ev.Caller.ID,
+			"SrcChannel":   ev.Caller.Name,
+			"DestUniqueid": ev.Peer.ID,
+			"DestChannel":  ev.Peer.Name,
+			"CallerIDNum":  ev.Caller.Caller.Number,
+			"DialString":   ev.DialString,
+		}}, nil
+	case "ChannelHangupRequest":
+		if ev.Channel != nil && ev.Cause != 0 {
+			t.causes[ev.Channel.ID] = ariCauseText(ev.Cause)
+		}
+		return nil, nil
+	case "ChannelDestroyed":
+		// StasisEnd is not a hangup: the channel may carry on in the
+		// dialplan after leaving the application.
+		if ev.Channel == nil {
+			return nil, nil
+		}
+		cause := ev.CauseTxt
+		if cause == "" {
+			cause = t.causes[ev.Channel.ID]
+		}
+		if cause == "" && ev.Cause != 0 {
+			cause = ariCauseText(ev.Cause)
+		}
+		out := t.channelEvent("Hangup", ev.Channel)
+		out["Cause-txt"] = cause
+		delete(t.links, ev.Channel.ID)
+		delete(t.causes, ev.Channel.ID)
+		return []map[string]string{out}, nil
+	case "EndpointStateChange":
+		if ev.Endpoint == nil {
+			return nil, nil
+		}
+		return []map[string]string{ev.Endpoint.event()}, nil
+	case "DeviceStateChanged":
+		if ev.DeviceState == nil {
+			return nil, nil
+		}
+		return []map[string]string{{
+			"Event":  "DeviceStateChange",
+			"Device": ev.DeviceState.Name,
+			"State":  ev.DeviceState.State,
+		}}, nil
+	}
+	return nil, nil
+}
+
+func (t *ariTranslator) channelEvent(name string, ch *ariChannel) map[string]string {
+	out := map[string]string{
+		"Event":    name,
+		"Uniqueid": ch.ID,
+		"Channel":  ch.Name,
+	}
+	if link := t.links[ch.ID]; link != "" {
+		out["Linkedid"] = link
+	}
+	return out
+}
+
+// ariCauseText names the Q.850 causes hangup classification looks for; ARI
+// reports only the number on most events.
+func ariCauseText(code int) string {
+	switch code {
+	case 16:
+		return "Normal Clearing"
+	case 17:
+		return "User busy"
+	case 18:
+		return "No user responding"
+	case 19:
+		return "User alerting, no answer"
+	case 21:
+		return "Call Rejected"
+	case 34:
+		return "Circuit/channel congestion"
+	}
+	return strconv.Itoa(code)
+}
@@ -0,0 +1,187 @@
+package calls
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeARI serves /ari/endpoints and upgrades /ari/events, then writes
+// events to the client, sending a ping first so the test sees the
+// client's pong.
+func fakeARI(t *testing.T, events []string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ari/endpoints", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "phonebook" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, `[{"technology":"PJSIP","resource":"2601","state":"online","channel_ids":[]},`+
+			`{"technology":"PJSIP","resource":"2603","state":"offline","channel_ids":[]}]`)
+	})
+	mux.HandleFunc("/ari/events", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "phonebook" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("app") != DefaultARIApp || r.URL.Query().Get("subscribeAll") != "true" {
+			t.Errorf("unexpected events query %q", r.URL.RawQuery)
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + ariAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		writeServerFrame(rw.Writer, 0x9, []byte("hi"))
+		_ = rw.Flush()
+		if opcode, payload := readClientFrame(t, rw.Reader); opcode != 0xA || string(payload) != "hi" {
+			t.Errorf("expected a pong echoing the ping, got opcode %x %q", opcode, payload)
+		}
+		for _, ev := range events {
+			writeServerFrame(rw.Writer, 0x1, []byte(ev))
+		}
+		_ = rw.Flush()
+		// Hold the stream open until the client goes away.
+		_, _ = io.Copy(io.Discard, rw)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeServerFrame(w *bufio.Writer, opcode byte, payload []byte) {
+	_ = w.WriteByte(0x80 | opcode)
+	if len(payload) <= 125 {
+		_ = w.WriteByte(byte(len(payload)))
+	} else {
+		_ = w.WriteByte(126)
+		_ = binary.Write(w, binary.BigEndian, uint16(len(payload)))
+	}
+	_, _ = w.Write(payload)
+}
+
+func readClientFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Errorf("read client frame: %v", err)
+		return 0, nil
+	}
+	if header[1]&0x80 == 0 {
+		t.Errorf("expected the client frame to be masked")
+	}
+	var mask [4]byte
+	_, _ = io.ReadFull(r, mask[:])
+	payload := make([]byte, header[1]&0x7f)
+	_, _ = io.ReadFull(r, payload)
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestRunARIFeedsCallsAndPresence(t *testing.T) {
+	srv := fakeARI(t, []string{
+		`{"type":"ChannelCreated","channel":{"id":"1.1","name":"PJSIP/2601-00000001","state":"Ring","caller":{"number":"2601"},"dialplan":{"exten":"2602"}}}`,
+		`{"type":"ChannelCreated","channel":{"id":"1.2","name":"PJSIP/2602-00000002","state":"Down","caller":{"number":"2602"},"dialplan":{"exten":"s"}}}`,
+		`{"type":"Dial","dialstring":"2602","caller":{"id":"1.1","name":"PJSIP/2601-00000001","caller":{"number":"2601"}},"peer":{"id":"1.2","name":"PJSIP/2602-00000002"}}`,
+		`{"type":"Dial","dialstatus":"ANSWER","caller":{"id":"1.1"},"peer":{"id":"1.2"}}`,
+		`{"type":"ChannelStateChange","channel":{"id":"1.2","name":"PJSIP/2602-00000002","state":"Up"}}`,
+		`{"type":"EndpointStateChange","endpoint":{"technology":"PJSIP","resource":"2602","state":"online","channel_ids":["1.2"]}}`,
+		`{"type":"ChannelHangupRequest","cause":16,"channel":{"id":"1.1","name":"PJSIP/2601-00000001"}}`,
+		`{"type":"ChannelDestroyed","cause":16,"channel":{"id":"1.1","name":"PJSIP/2601-00000001"}}`,
+		`{"type":"ChannelDestroyed","cause":16,"cause_txt":"Normal Clearing","channel":{"id":"1.2","name":"PJSIP/2602-00000002"}}`,
+	})
+
+	svc := NewService(Options{}, testLogger{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.RunARI(ctx, ARIConfig{URL: srv.URL, Username: "phonebook", Password: "secret", ReconnectDelay: time.Hour})
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("RunARI() error = %v", err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var snap Snapshot
+	for {
+		snap = svc.Snapshot()
+		if len(snap.History) > 0 && len(snap.Presences) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the call and presences, got %+v", snap)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(snap.Active) != 0 || len(snap.History) != 1 {
+		t.Fatalf("expected both legs to end as one call, got %d active and %d history", len(snap.Active), len(snap.History))
+	}
+	got := snap.History[0]
+	if got.ID != "1.1" || got.From != "2601" || got.To != "2602" || got.State != "answered" || got.EndReason != "Normal Clearing" {
+		t.Fatalf("unexpected history record %+v", got)
+	}
+	states := map[string]string{}
+	for _, p := range snap.Presences {
+		states[p.ID] = p.State
+	}
+	if states["2601"] != "connected" || states["2602"] != "in-use" || states["2603"] != "disconnected" {
+		t.Fatalf("unexpected presences %v", states)
+	}
+}
+
+func TestARIStasisEndKeepsTheCallUp(t *testing.T) {
+	svc := NewService(Options{}, testLogger{})
+	translator := newARITranslator()
+	feed := func(raw string) {
+		t.Helper()
+		events, err := translator.translate([]byte(raw))
+		if err != nil {
+			t.Fatalf("translate %s: %v", raw, err)
+		}
+		for _, ev := range events {
+			svc.HandleAMIEvent(ev)
+		}
+	}
+
+	feed(`{"type":"ChannelCreated","channel":{"id":"1.1","name":"PJSIP/2601-00000001","state":"Ring","caller":{"number":"2601"},"dialplan":{"exten":"2602"}}}`)
+	feed(`{"type":"StasisStart","channel":{"id":"1.1","name":"PJSIP/2601-00000001","state":"Ring","caller":{"number":"2601"},"dialplan":{"exten":"2602"}}}`)
+	feed(`{"type":"StasisEnd","channel":{"id":"1.1","name":"PJSIP/2601-00000001"}}`)
+	feed(`{"type":"ChannelStateChange","channel":{"id":"1.1","name":"PJSIP/2601-00000001","state":"Up"}}`)
+	if snap := svc.Snapshot(); len(snap.Active) != 1 || len(snap.History) != 0 {
+		t.Fatalf("expected the channel to stay up after leaving Stasis, got %d active and %d history", len(snap.Active), len(snap.History))
+	}
+
+	feed(`{"type":"ChannelHangupRequest","cause":16,"channel":{"id":"1.1","name":"PJSIP/2601-00000001"}}`)
+	feed(`{"type":"ChannelDestroyed","channel":{"id":"1.1","name":"PJSIP/2601-00000001"}}`)
+	snap := svc.Snapshot()
+	if len(snap.Active) != 0 || len(snap.History) != 1 {
+		t.Fatalf("expected ChannelDestroyed to end the call, got %d active and %d history", len(snap.Active), len(snap.History))
+	}
+	if got := snap.History[0].EndReason; got != "Normal Clearing" {
+		t.Fatalf("expected the hangup request's cause, got %q", got)
+	}
+}
+
+func TestRunARIRequiresCredentials(t *testing.T) {
+	svc := NewService(Options{}, testLogger{})
+	if err := svc.RunARI(context.Background(), ARIConfig{URL: "http://127.0.0.1:8088"}); err == nil {
+		t.Fatal("expected an error without credentials")
+	}
+	if err := svc.RunARI(context.Background(), ARIConfig{URL: "ws://127.0.0.1:8088", Username: "u", Password: "p"}); err == nil {
+		t.Fatal("expected an error for a non-HTTP URL")
+	}
+}
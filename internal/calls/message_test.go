@@ -3,8 +3,17 @@ package calls
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/testutil"
 )
 
 func TestWriteAMIMessageSendUsesBase64Body(t *testing.T) {
@@ -46,3 +55,202 @@ func TestWaitAMIActionResponseFailure(t *testing.T) {
 		t.Fatalf("expected permission denied error, got %v", err)
 	}
 }
+
+func TestWaitAMILoginReportsPermissionFailure(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("Response: Error\r\nMessage: Permission denied\r\n\r\n"))
+	if _, err := waitAMILogin(reader); err == nil || !strings.Contains(err.Error(), "manager.conf") {
+		t.Fatalf("expected actionable permission error, got %v", err)
+	}
+}
+
+func TestRunAMISeedsPresenceFromEndpointListing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, _ = io.WriteString(conn, "Asterisk Call Manager/9.0.0\r\n")
+		_, _ = readAMIMessage(reader)
+		_, _ = io.WriteString(conn, "Response: Success\r\nMessage: Authentication accepted\r\n\r\n")
+		if action, _ := readAMIMessage(reader); action["Action"] != "PJSIPShowEndpoints" {
+			return
+		}
+		_, _ = io.WriteString(conn, "Response: Success\r\nEventList: start\r\nMessage: A listing of Endpoints follows\r\n\r\n"+
+			"Event: EndpointList\r\nObjectName: 1001\r\nDeviceState: Not in use\r\nActiveChannels: 0\r\n\r\n"+
+			"Event: EndpointList\r\nObjectName: 1002\r\nDeviceState: Unavailable\r\nActiveChannels: 0\r\n\r\n"+
+			"Event: ContactStatusDetail\r\nAOR: 1003\r\nURI: sip:1003@192.0.2.10:5060\r\nStatus: Reachable\r\n\r\n"+
+			"Event: EndpointListComplete\r\nEventList: Complete\r\nListItems: 3\r\n\r\n")
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+
+	svc := NewService(Options{}, testutil.NewTestLogger())
+	updates, unsubscribe := svc.Subscribe()
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = svc.RunAMI(ctx, AMIConfig{Addr: ln.Addr().String(), Username: "dashboard", Password: "secret"})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-updates:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a notification once the listing completed")
+	}
+	want := map[string]string{"1001": "connected", "1002": "disconnected", "1003": "connected"}
+	snap := svc.Snapshot()
+	if len(snap.Presences) != len(want) {
+		t.Fatalf("expected every listed endpoint seeded, got %+v", snap.Presences)
+	}
+	for _, p := range snap.Presences {
+		if want[p.ID] != p.State {
+			t.Fatalf("expected %s %s, got %+v", p.ID, want[p.ID], p)
+		}
+	}
+	select {
+	case <-updates:
+		t.Fatal("expected the listing applied with a single notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A quiet PBX sends no call events for hours, which says nothing about the
+// user's read= classes, so the session must not warn about them.
+func TestRunAMIDoesNotWarnOnQuietSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, _ = io.WriteString(conn, "Asterisk Call Manager/9.0.0\r\n")
+		_, _ = readAMIMessage(reader)
+		_, _ = io.WriteString(conn, "Response: Success\r\nMessage: Authentication accepted\r\n\r\n")
+		_, _ = io.WriteString(conn, "Event: FullyBooted\r\nPrivilege: system,all\r\n\r\n")
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+
+	logger := testutil.NewTestLogger()
+	svc := NewService(Options{}, logger)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_ = svc.RunAMI(ctx, AMIConfig{Addr: ln.Addr().String(), Username: "dashboard", Password: "secret"})
+
+	for _, e := range logger.Entries() {
+		if e.Level == "warn" {
+			t.Fatalf("expected no warning on a quiet session, got %+v", e)
+		}
+	}
+}
+
+func TestSendAMIMessageOverTLS(t *testing.T) {
+	certSrv := httptest.NewTLSServer(nil)
+	defer certSrv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certSrv.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	got := make(chan map[string]string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := io.WriteString(conn, "Asterisk Call Manager/9.0.0\r\n"); err != nil {
+					return
+				}
+				login, _ := readAMIMessage(reader)
+				got <- login
+				_, _ = io.WriteString(conn, "Response: Success\r\nMessage: Authentication accepted\r\n\r\n")
+				send, _ := readAMIMessage(reader)
+				got <- send
+				_, _ = io.WriteString(conn, "Response: Success\r\nActionID: "+send["ActionID"]+"\r\n\r\n")
+				_, _ = io.Copy(io.Discard, reader)
+			}()
+		}
+	}()
+
+	cfg := AMIConfig{
+		Addr:                  ln.Addr().String(),
+		Username:              "dashboard",
+		Password:              "secret",
+		TLS:                   true,
+		TLSInsecureSkipVerify: true,
+	}
+	msg := Message{Destination: "pjsip:1001", From: "sip:operator@example.test", Body: "hi"}
+	if err := SendAMIMessage(context.Background(), cfg, msg); err != nil {
+		t.Fatalf("SendAMIMessage() error = %v", err)
+	}
+	if login := <-got; login["Secret"] != "secret" {
+		t.Fatalf("expected the login over TLS, got %v", login)
+	}
+	if send := <-got; send["Action"] != "MessageSend" {
+		t.Fatalf("expected MessageSend over TLS, got %v", send)
+	}
+
+	// Without skipping verification the self-signed certificate is refused.
+	cfg.TLSInsecureSkipVerify = false
+	var certErr *tls.CertificateVerificationError
+	if err := SendAMIMessage(context.Background(), cfg, msg); !errors.As(err, &certErr) {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+}
+
+func TestSendAMIMessageTimesOutOnSilentPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, useTLS := range []bool{false, true} {
+		cfg := AMIConfig{
+			Addr:           ln.Addr().String(),
+			Username:       "dashboard",
+			Password:       "secret",
+			ConnectTimeout: 100 * time.Millisecond,
+			TLS:            useTLS,
+		}
+		start := time.Now()
+		err := SendAMIMessage(context.Background(), cfg, Message{Destination: "pjsip:1001", From: "sip:op@example.test", Body: "hi"})
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("TLS=%v: expected a timeout, got %v", useTLS, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("TLS=%v: took %v to give up", useTLS, elapsed)
+		}
+	}
+}
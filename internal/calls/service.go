@@ -2,7 +2,9 @@ package calls
 
 import (
 	"bufio"
+	"container/heap"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/csv"
 	"errors"
@@ -26,10 +28,198 @@ type Logger interface {
 
 // Options configure the service retention behavior.
 type Options struct {
+	// MaxHistory caps the completed calls kept. Zero uses
+	// DefaultMaxHistory.
 	MaxHistory int
-	Retention  time.Duration
+	// Retention drops completed calls that ended longer ago than this.
+	// Zero uses DefaultRetention.
+	Retention time.Duration
+	// IgnoredTargets are dialed extensions never reported as a call's "to"
+	// party. Nil uses DefaultIgnoredTargets; an empty slice ignores none.
+	IgnoredTargets []string
+	// ShortCallThreshold reclassifies answered calls that talked for less
+	// than this long as DispositionShort. Zero disables the check.
+	ShortCallThreshold time.Duration
+	// PresenceTTL downgrades a presence to "unknown" once no AMI event has
+	// mentioned it for this long, and drops it after twice as long. Zero
+	// uses DefaultPresenceTTL; a negative value keeps presences forever.
+	PresenceTTL time.Duration
+	// CDRColumns locates fields in the CDR CSV. The zero value uses
+	// DefaultCDRColumns.
+	CDRColumns CDRColumns
 }
 
+// CDRColumns maps the CDR fields LoadCDR reads to CSV columns. Each value is
+// either a zero-based column index ("9") or a header name ("start") matched
+// without case against the file's first row. Start and End are required;
+// any other field left empty reads as blank.
+type CDRColumns struct {
+	// Src is the caller (Master.csv "src").
+	Src string
+	// Dst is the dialed extension ("dst").
+	Dst string
+	// Start is when the call began, as "2006-01-02 15:04:05" ("start").
+	Start string
+	// End is when the call ended, in the same layout ("end").
+	End string
+	// Duration is the call length in seconds ("duration").
+	Duration string
+	// BillSec is the talk time in seconds after answer ("billsec").
+	BillSec string
+	// Disposition is the outcome, such as ANSWERED ("disposition").
+	Disposition string
+	// UniqueID identifies the call ("uniqueid").
+	UniqueID string
+}
+
+// DefaultCDRColumns is the classic 17-column Master.csv layout cdr_csv
+// writes without a custom cdr.conf.
+var DefaultCDRColumns = CDRColumns{
+	Src:         "1",
+	Dst:         "2",
+	Start:       "9",
+	End:         "11",
+	Duration:    "12",
+	BillSec:     "13",
+	Disposition: "14",
+	UniqueID:    "16",
+}
+
+// ParseCDRColumns reads a comma-separated field=column list such as
+// "src=0,dst=1,start=4,end=5" or "start=calldate,end=enddate". Field names
+// are the lowercase CDRColumns field names. start and end must be listed,
+// so a partial spec fails here rather than on every LoadCDR.
+func ParseCDRColumns(spec string) (CDRColumns, error) {
+	var cols CDRColumns
+	fields := map[string]*string{
+		"src": &cols.Src, "dst": &cols.Dst, "start": &cols.Start, "end": &cols.End,
+		"duration": &cols.Duration, "billsec": &cols.BillSec, "disposition": &cols.Disposition, "uniqueid": &cols.UniqueID,
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, column, ok := strings.Cut(pair, "=")
+		field := fields[strings.ToLower(strings.TrimSpace(name))]
+		if !ok || field == nil || strings.TrimSpace(column) == "" {
+			return CDRColumns{}, fmt.Errorf("invalid CDR column %q: want field=column with field one of src, dst, start, end, duration, billsec, disposition, uniqueid", pair)
+		}
+		*field = strings.TrimSpace(column)
+	}
+	if !cols.byName() {
+		if _, err := cols.resolve(nil); err != nil {
+			return CDRColumns{}, err
+		}
+	} else if cols.Start == "" || cols.End == "" {
+		return CDRColumns{}, errors.New("CDR columns for start and end are required")
+	}
+	return cols, nil
+}
+
+// cdrLayout is a CDRColumns resolved to indices; -1 marks an unmapped field.
+type cdrLayout struct {
+	src, dst, start, end, duration, billsec, disposition, uniqueID int
+	// width is the fewest columns a row needs to hold every mapped field.
+	width int
+}
+
+// resolve turns cols into indices, looking names up in header. header is
+// nil when every column is an index.
+func (cols CDRColumns) resolve(header []string) (cdrLayout, error) {
+	layout := cdrLayout{}
+	for _, f := range []struct {
+		name, column string
+		dst          *int
+	}{
+		{"src", cols.Src, &layout.src},
+		{"dst", cols.Dst, &layout.dst},
+		{"start", cols.Start, &layout.start},
+		{"end", cols.End, &layout.end},
+		{"duration", cols.Duration, &layout.duration},
+		{"billsec", cols.BillSec, &layout.billsec},
+		{"disposition", cols.Disposition, &layout.disposition},
+		{"uniqueid", cols.UniqueID, &layout.uniqueID},
+	} {
+		*f.dst = -1
+		column := strings.TrimSpace(f.column)
+		switch {
+		case column == "":
+			if f.name == "start" || f.name == "end" {
+				return cdrLayout{}, fmt.Errorf("CDR column for %s is required", f.name)
+			}
+			continue
+		case isDigits(column):
+			*f.dst, _ = strconv.Atoi(column)
+		default:
+			for i, name := range header {
+				if strings.EqualFold(strings.TrimSpace(name), column) {
+					*f.dst = i
+					break
+				}
+			}
+			if *f.dst < 0 {
+				return cdrLayout{}, fmt.Errorf("CDR header has no column %q for %s", column, f.name)
+			}
+		}
+		if *f.dst+1 > layout.width {
+			layout.width = *f.dst + 1
+		}
+	}
+	return layout, nil
+}
+
+// byName reports whether any column is a header name.
+func (cols CDRColumns) byName() bool {
+	for _, column := range []string{cols.Src, cols.Dst, cols.Start, cols.End, cols.Duration, cols.BillSec, cols.Disposition, cols.UniqueID} {
+		if column = strings.TrimSpace(column); column != "" && !isDigits(column) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// field returns row[i] trimmed, or "" for an unmapped field.
+func (l cdrLayout) field(row []string, i int) string {
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// DefaultPresenceTTL comfortably covers several of the 15s endpoint
+// refreshes RunAMI requests, so only endpoints Asterisk stopped listing (or a
+// lost PBX) expire.
+const DefaultPresenceTTL = 2 * time.Minute
+
+// Default history limits: the last 100 completed calls from the past week.
+const (
+	DefaultMaxHistory = 100
+	DefaultRetention  = 7 * 24 * time.Hour
+)
+
+// presenceUnknown is the state of a presence whose TTL has lapsed.
+const presenceUnknown = "unknown"
+
+// DispositionShort is the history state for answered calls whose talk time
+// fell below Options.ShortCallThreshold.
+const DispositionShort = "short"
+
+// DefaultIgnoredTargets are Asterisk's special dialplan extensions: s (start),
+// h (hangup), and i (invalid). They show up as Exten on channels that are
+// running dialplan rather than calling anyone, so by default they never stand
+// in for a real destination.
+var DefaultIgnoredTargets = []string{"s", "h", "i"}
+
 // AMIConfig configures AMI connection settings.
 type AMIConfig struct {
 	Addr           string
@@ -37,6 +227,13 @@ type AMIConfig struct {
 	Password       string
 	ConnectTimeout time.Duration
 	ReconnectDelay time.Duration
+	// TLS connects to a TLS-only manager port (tls.bindaddr in
+	// manager.conf, usually 5039). The certificate is checked against
+	// TLSServerName, or the host part of Addr when that is empty, unless
+	// TLSInsecureSkipVerify is set.
+	TLS                   bool
+	TLSInsecureSkipVerify bool
+	TLSServerName         string
 }
 
 // Message describes an out-of-call SIP MESSAGE sent through AMI MessageSend.
@@ -67,14 +264,21 @@ type HistoryCall struct {
 	Start       time.Time `json:"start"`
 	End         time.Time `json:"end"`
 	DurationSec int64     `json:"duration_sec"`
+	TalkSec     int64     `json:"talk_sec"`
 }
 
-// Presence represents AMI-observed endpoint/contact presence.
+// Presence represents AMI-observed endpoint/contact presence. Updated is the
+// last state change; LastSeen is the last presence event of any kind.
 type Presence struct {
-	ID      string    `json:"id"`
-	State   string    `json:"state"`
-	Detail  string    `json:"detail,omitempty"`
-	Updated time.Time `json:"updated"`
+	ID       string    `json:"id"`
+	State    string    `json:"state"`
+	Detail   string    `json:"detail,omitempty"`
+	Updated  time.Time `json:"updated"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// endpoint is the name the presence was recorded under, kept so
+	// SetPresenceAliases can re-key it.
+	endpoint string
 }
 
 // Snapshot is a read model for HTTP/UI clients.
@@ -88,12 +292,17 @@ type Snapshot struct {
 type activeCall struct {
 	Call
 	channels map[string]struct{}
+	answered time.Time
+	// provisional marks a call keyed by a channel's Uniqueid or name
+	// because its first events carried no Linkedid; see reconcileLocked.
+	provisional bool
 }
 
 // Service tracks active and historical calls from AMI.
 type Service struct {
-	logger Logger
-	opts   Options
+	logger  Logger
+	opts    Options
+	ignored map[string]struct{}
 
 	mu       sync.RWMutex
 	active   map[string]*activeCall
@@ -101,6 +310,10 @@ type Service struct {
 	presence map[string]Presence
 	updated  time.Time
 
+	// aliases maps AMI endpoint names to the extensions their presence is
+	// recorded under.
+	aliases map[string]string
+
 	subs   map[int]chan struct{}
 	nextID int
 }
@@ -108,14 +321,29 @@ type Service struct {
 // NewService creates a call service.
 func NewService(opts Options, logger Logger) *Service {
 	if opts.MaxHistory <= 0 {
-		opts.MaxHistory = 100
+		opts.MaxHistory = DefaultMaxHistory
 	}
 	if opts.Retention <= 0 {
-		opts.Retention = 7 * 24 * time.Hour
+		opts.Retention = DefaultRetention
+	}
+	if opts.PresenceTTL == 0 {
+		opts.PresenceTTL = DefaultPresenceTTL
+	}
+	if opts.CDRColumns == (CDRColumns{}) {
+		opts.CDRColumns = DefaultCDRColumns
+	}
+	ignoredTargets := opts.IgnoredTargets
+	if ignoredTargets == nil {
+		ignoredTargets = DefaultIgnoredTargets
+	}
+	ignored := make(map[string]struct{}, len(ignoredTargets))
+	for _, target := range ignoredTargets {
+		ignored[strings.TrimSpace(target)] = struct{}{}
 	}
 	return &Service{
 		logger:   logger,
 		opts:     opts,
+		ignored:  ignored,
 		active:   make(map[string]*activeCall),
 		presence: make(map[string]Presence),
 		subs:     make(map[int]chan struct{}),
@@ -177,7 +405,55 @@ func (s *Service) Subscribe() (<-chan struct{}, func()) {
 	return ch, cancel
 }
 
-// LoadCDR loads historical calls from CDR CSV, keeping only retention/max limits.
+// HistoryLimits returns the effective MaxHistory and Retention, after
+// defaults.
+func (s *Service) HistoryLimits() (int, time.Duration) {
+	return s.opts.MaxHistory, s.opts.Retention
+}
+
+// SetPresenceAliases replaces the endpoint name to extension map consulted
+// before an endpoint name is cleaned into a presence ID, for endpoints whose
+// names, such as GUIDs, say nothing about the contact behind them. Presences
+// already recorded are re-keyed under the new map, so an added or removed
+// alias shows on the dashboard without waiting for the next event.
+func (s *Service) SetPresenceAliases(aliases map[string]string) {
+	next := make(map[string]string, len(aliases))
+	for endpoint, ext := range aliases {
+		next[strings.TrimSpace(endpoint)] = strings.TrimSpace(ext)
+	}
+	s.mu.Lock()
+	s.aliases = next
+	changed := false
+	for id, p := range s.presence {
+		target := presenceIDForCandidate(next, p.endpoint)
+		if p.endpoint == "" || target == "" || target == id {
+			continue
+		}
+		delete(s.presence, id)
+		// Two endpoints may now share an extension; the latest wins.
+		if current, ok := s.presence[target]; !ok || current.LastSeen.Before(p.LastSeen) {
+			p.ID = target
+			s.presence[target] = p
+		}
+		changed = true
+	}
+	if changed {
+		s.updated = time.Now().UTC()
+	}
+	subs := s.copySubsLocked()
+	s.mu.Unlock()
+
+	if changed {
+		notify(subs)
+	}
+}
+
+// LoadCDR loads historical calls from CDR CSV, keeping only retention/max
+// limits, and merges them with the history recorded live: a CDR row
+// replaces the live call with the same ID, and live calls that ended after
+// the newest row are kept, since Asterisk may not have written them yet
+// (cdr.conf batch=yes). Older live calls without a matching row are
+// dropped, as the CSV already covers them under another leg's ID.
 func (s *Service) LoadCDR(path string) (int, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -188,11 +464,37 @@ func (s *Service) LoadCDR(path string) (int, error) {
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
+	buffered := bufio.NewReader(file)
+	// Skip a UTF-8 byte order mark so the first column parses cleanly.
+	if bom, err := buffered.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		_, _ = buffered.Discard(3)
+	}
+	reader := csv.NewReader(buffered)
 	reader.FieldsPerRecord = -1
 
+	// Name-based columns come from the header row; with indices alone a
+	// header, if present, fails the timestamp parse and is skipped.
+	var header []string
+	if s.opts.CDRColumns.byName() {
+		header, err = reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	layout, err := s.opts.CDRColumns.resolve(header)
+	if err != nil {
+		return 0, err
+	}
+
 	cutoff := time.Now().Add(-s.opts.Retention)
-	var loaded []HistoryCall
+	// Only the MaxHistory most recent calls survive pruning, so keep just
+	// those in a min-heap by end time; memory stays bounded however large
+	// the CSV grows.
+	recent := &historyHeap{}
+	reader.ReuseRecord = true
 	for {
 		row, err := reader.Read()
 		if err != nil {
@@ -201,45 +503,112 @@ func (s *Service) LoadCDR(path string) (int, error) {
 			}
 			return 0, err
 		}
-		if len(row) < 17 {
+		if len(row) < layout.width {
 			continue
 		}
-		start, err := parseCDRTime(row[9])
+		start, err := parseCDRTime(row[layout.start])
 		if err != nil {
 			continue
 		}
-		end, err := parseCDRTime(row[11])
+		end, err := parseCDRTime(row[layout.end])
 		if err != nil {
 			continue
 		}
 		if end.Before(cutoff) {
 			continue
 		}
-		duration, _ := strconv.ParseInt(strings.TrimSpace(row[12]), 10, 64)
-		loaded = append(loaded, HistoryCall{
-			ID:          strings.TrimSpace(row[16]),
-			From:        strings.TrimSpace(row[1]),
-			To:          strings.TrimSpace(row[2]),
-			State:       strings.TrimSpace(row[14]),
-			EndReason:   strings.TrimSpace(row[14]),
+		duration, _ := strconv.ParseInt(layout.field(row, layout.duration), 10, 64)
+		billsec, _ := strconv.ParseInt(layout.field(row, layout.billsec), 10, 64)
+		disposition := layout.field(row, layout.disposition)
+		state := disposition
+		if strings.EqualFold(disposition, "ANSWERED") && s.isShortCall(time.Duration(billsec)*time.Second) {
+			state = DispositionShort
+		}
+		call := HistoryCall{
+			ID:          layout.field(row, layout.uniqueID),
+			From:        layout.field(row, layout.src),
+			To:          layout.field(row, layout.dst),
+			State:       state,
+			EndReason:   disposition,
 			Start:       start.UTC(),
 			End:         end.UTC(),
 			DurationSec: duration,
-		})
+			TalkSec:     billsec,
+		}
+		if recent.Len() < s.opts.MaxHistory {
+			heap.Push(recent, call)
+		} else if call.End.After((*recent)[0].End) {
+			(*recent)[0] = call
+			heap.Fix(recent, 0)
+		}
 	}
 
-	sort.Slice(loaded, func(i, j int) bool {
-		return loaded[i].End.After(loaded[j].End)
-	})
+	loaded := []HistoryCall(*recent)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	var newest time.Time
+	ids := make(map[string]bool, len(loaded))
+	for _, call := range loaded {
+		if call.End.After(newest) {
+			newest = call.End
+		}
+		if call.ID != "" {
+			ids[call.ID] = true
+		}
+	}
+	for _, call := range s.history {
+		if !ids[call.ID] && call.End.After(newest) {
+			loaded = append(loaded, call)
+		}
+	}
+	sort.SliceStable(loaded, func(i, j int) bool {
+		return loaded[i].End.After(loaded[j].End)
+	})
 	s.history = loaded
 	s.pruneLocked(time.Now())
 	s.updated = time.Now().UTC()
 	return len(s.history), nil
 }
 
+// WatchCDR reloads the CDR CSV at path every interval while its size or
+// modification time differs from the last look, until ctx is done. The
+// first look happens one interval in, since callers load it at startup.
+func (s *Service) WatchCDR(ctx context.Context, path string, interval time.Duration) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				s.logger.Warn("failed to stat CDR file", "path", path, "err", err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+		last = info
+		loaded, err := s.LoadCDR(path)
+		if err != nil {
+			s.logger.Warn("failed to reload CDR history", "path", path, "err", err)
+			continue
+		}
+		s.logger.Debug("reloaded historical calls from CDR", "count", loaded, "path", path)
+		s.mu.Lock()
+		subs := s.copySubsLocked()
+		s.mu.Unlock()
+		notify(subs)
+	}
+}
+
 func parseCDRTime(raw string) (time.Time, error) {
 	const layout = "2006-01-02 15:04:05"
 	value := strings.TrimSpace(raw)
@@ -284,6 +653,9 @@ func (s *Service) RunAMI(ctx context.Context, cfg AMIConfig) error {
 	if cfg.ReconnectDelay <= 0 {
 		cfg.ReconnectDelay = 5 * time.Second
 	}
+	if s.opts.PresenceTTL > 0 {
+		go s.runSweeper(ctx)
+	}
 
 	for {
 		err := s.runAMIConnection(ctx, cfg)
@@ -302,8 +674,7 @@ func (s *Service) RunAMI(ctx context.Context, cfg AMIConfig) error {
 }
 
 func (s *Service) runAMIConnection(ctx context.Context, cfg AMIConfig) error {
-	dialer := net.Dialer{Timeout: cfg.ConnectTimeout}
-	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	conn, err := dialAMI(ctx, cfg)
 	if err != nil {
 		return err
 	}
@@ -322,14 +693,17 @@ func (s *Service) runAMIConnection(ctx context.Context, cfg AMIConfig) error {
 	if err := writeAMILogin(conn, cfg); err != nil {
 		return err
 	}
-	if err := waitAMILogin(reader); err != nil {
+	if _, err := waitAMILogin(reader); err != nil {
+		return err
+	}
+	// Events can be minutes apart, so only the login has a deadline.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
 		return err
 	}
 	if err := sendShowEndpoints(); err != nil {
 		return err
 	}
 	s.logger.Info("AMI connected", "addr", cfg.Addr)
-
 	closeConn := make(chan struct{})
 	go func() {
 		select {
@@ -358,12 +732,31 @@ func (s *Service) runAMIConnection(ctx context.Context, cfg AMIConfig) error {
 		}
 	}()
 
+	// PJSIPShowEndpoints answers with one EndpointList row per endpoint,
+	// plus ContactStatusDetail rows on some versions, then a completion
+	// event. Rows are collected and applied together once the list ends,
+	// which also seeds presence for endpoints that never send an event.
+	var listing []map[string]string
+	seeded := false
 	for {
 		msg, err := readAMIMessage(reader)
 		if err != nil {
 			return err
 		}
-		if msg["Event"] != "" {
+		if msg["Event"] == "" {
+			continue
+		}
+		switch strings.ToLower(msg["Event"]) {
+		case "endpointlist", "contactstatusdetail":
+			listing = append(listing, msg)
+		case "endpointlistcomplete", "pjsipshowendpointscomplete":
+			s.SeedPresence(listing)
+			if !seeded {
+				s.logger.Info("AMI endpoint presence seeded", "rows", len(listing))
+				seeded = true
+			}
+			listing = nil
+		default:
 			s.HandleAMIEvent(msg)
 		}
 	}
@@ -410,8 +803,7 @@ func SendAMIMessage(ctx context.Context, cfg AMIConfig, msg Message) error {
 		}
 	}
 
-	dialer := net.Dialer{Timeout: cfg.ConnectTimeout}
-	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	conn, err := dialAMI(ctx, cfg)
 	if err != nil {
 		return err
 	}
@@ -424,7 +816,7 @@ func SendAMIMessage(ctx context.Context, cfg AMIConfig, msg Message) error {
 	if err := writeAMILoginEventsOff(conn, cfg); err != nil {
 		return err
 	}
-	if err := waitAMILogin(reader); err != nil {
+	if _, err := waitAMILogin(reader); err != nil {
 		return err
 	}
 	actionID := fmt.Sprintf("phonebook-broadcast-%d", time.Now().UnixNano())
@@ -438,6 +830,41 @@ func SendAMIMessage(ctx context.Context, cfg AMIConfig, msg Message) error {
 	return nil
 }
 
+// dialAMI connects to cfg.Addr, over TLS when cfg.TLS is set, and sets a
+// ConnectTimeout deadline on the connection so a peer that accepts but never
+// sends the banner or login response cannot stall the caller. Callers that
+// keep the connection open clear the deadline after logging in.
+func dialAMI(ctx context.Context, cfg AMIConfig) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: cfg.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(cfg.ConnectTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !cfg.TLS {
+		return conn, nil
+	}
+	serverName := cfg.TLSServerName
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(cfg.Addr); err == nil {
+			serverName = host
+		}
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("AMI TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
 func writeAMILoginEventsOff(conn net.Conn, cfg AMIConfig) error {
 	login := fmt.Sprintf(
 		"Action: Login\r\nUsername: %s\r\nSecret: %s\r\nEvents: off\r\n\r\n",
@@ -491,17 +918,22 @@ func writeAMIPJSIPShowEndpoints(conn net.Conn) error {
 	return err
 }
 
-func waitAMILogin(reader *bufio.Reader) error {
+// waitAMILogin reads until the login response and returns it. A permission
+// failure is reported distinctly from bad credentials.
+func waitAMILogin(reader *bufio.Reader) (map[string]string, error) {
 	for {
 		msg, err := readAMIMessage(reader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if resp := msg["Response"]; resp != "" {
 			if strings.EqualFold(resp, "Success") {
-				return nil
+				return msg, nil
+			}
+			if strings.Contains(strings.ToLower(msg["Message"]), "permission") {
+				return nil, fmt.Errorf("AMI login refused, check the user's permit/read settings in manager.conf: %s", msg["Message"])
 			}
-			return fmt.Errorf("AMI login failed: %s", msg["Message"])
+			return nil, fmt.Errorf("AMI login failed: %s", msg["Message"])
 		}
 	}
 }
@@ -545,12 +977,19 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 	if linkedID != "" {
 		call = s.active[linkedID]
 	}
+	if explicitLinkedID(event) != "" {
+		if merged, ok := s.reconcileLocked(call, linkedID, event); ok {
+			call = merged
+			changed = true
+		}
+	}
 	ensureCall := func() {
 		if linkedID == "" {
 			return
 		}
 		if call == nil {
 			call = s.getOrCreateCallLocked(linkedID, now)
+			call.provisional = explicitLinkedID(event) == ""
 		}
 	}
 
@@ -569,7 +1008,7 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 			changed = true
 		}
 		if to := firstNonEmpty(
-			cleanTarget(eventValue(event, "Exten")),
+			s.cleanTarget(eventValue(event, "Exten")),
 			cleanNumber(eventValue(event, "ConnectedLineNum", "ConnectedLineNum")),
 		); call.To == "" && to != "" {
 			call.To = to
@@ -643,6 +1082,9 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 	case "bridgeenter":
 		ensureCall()
 		call.State = "active"
+		if call.answered.IsZero() {
+			call.answered = now
+		}
 		if channel := channelKey(event); channel != "" {
 			call.channels[channel] = struct{}{}
 		}
@@ -662,6 +1104,10 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 			delete(call.channels, channel)
 			changed = true
 		}
+		// A leg tracked by name before its Uniqueid was known.
+		if name := eventValue(event, "Channel"); name != "" {
+			delete(call.channels, name)
+		}
 		if len(call.channels) == 0 {
 			endReason := strings.TrimSpace(firstNonEmpty(eventValue(event, "Cause-txt"), eventValue(event, "Cause"), eventValue(event, "DialStatus")))
 			state := "completed"
@@ -675,6 +1121,13 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 					state = "answered"
 				}
 			}
+			var talk time.Duration
+			if !call.answered.IsZero() {
+				talk = now.Sub(call.answered)
+				if state == "answered" && s.isShortCall(talk) {
+					state = DispositionShort
+				}
+			}
 			h := HistoryCall{
 				ID:          call.ID,
 				From:        call.From,
@@ -684,25 +1137,15 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 				Start:       call.Start.UTC(),
 				End:         now,
 				DurationSec: int64(now.Sub(call.Start).Seconds()),
+				TalkSec:     int64(talk.Seconds()),
 			}
 			s.history = append([]HistoryCall{h}, s.history...)
 			delete(s.active, call.ID)
 			changed = true
 		}
-	case "contactstatus", "endpointstatus", "devicestatechange", "peerstatus", "endpointlist":
-		if id, ok := presenceIDFor(event); ok {
-			state, detail := presenceStateFor(eventType, event)
-			prev, hasPrev := s.presence[id]
-			next := Presence{
-				ID:      id,
-				State:   state,
-				Detail:  detail,
-				Updated: now,
-			}
-			if !hasPrev || prev.State != next.State || prev.Detail != next.Detail {
-				s.presence[id] = next
-				changed = true
-			}
+	case "contactstatus", "endpointstatus", "devicestatechange", "peerstatus", "endpointlist", "contactstatusdetail":
+		if s.observePresenceLocked(eventType, event, now) {
+			changed = true
 		}
 	}
 
@@ -722,6 +1165,56 @@ func (s *Service) HandleAMIEvent(event map[string]string) {
 	}
 }
 
+// runSweeper expires stale presences until ctx is done. It ticks at half the
+// TTL so nothing outlives its window by much.
+func (s *Service) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.PresenceTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.SweepPresence(now)
+		}
+	}
+}
+
+// SweepPresence marks presences not seen within PresenceTTL of now as
+// "unknown" and removes those not seen for twice that, notifying subscribers
+// if anything changed.
+func (s *Service) SweepPresence(now time.Time) {
+	if s.opts.PresenceTTL <= 0 {
+		return
+	}
+	now = now.UTC()
+	s.mu.Lock()
+	changed := false
+	for id, p := range s.presence {
+		idle := now.Sub(p.LastSeen)
+		switch {
+		case idle >= 2*s.opts.PresenceTTL:
+			delete(s.presence, id)
+			changed = true
+		case idle >= s.opts.PresenceTTL && p.State != presenceUnknown:
+			p.State = presenceUnknown
+			p.Detail = ""
+			p.Updated = now
+			s.presence[id] = p
+			changed = true
+		}
+	}
+	if changed {
+		s.updated = now
+	}
+	subs := s.copySubsLocked()
+	s.mu.Unlock()
+
+	if changed {
+		notify(subs)
+	}
+}
+
 func (s *Service) getOrCreateCallLocked(id string, now time.Time) *activeCall {
 	if existing, ok := s.active[id]; ok {
 		return existing
@@ -773,9 +1266,7 @@ func notify(channels []chan struct{}) {
 
 func linkedIDFor(event map[string]string) string {
 	id := strings.TrimSpace(firstNonEmpty(
-		eventValue(event, "Linkedid", "LinkedID", "LinkedId"),
-		eventValue(event, "DestLinkedid", "DestLinkedID", "DestLinkedId"),
-		eventValue(event, "SrcLinkedid", "SrcLinkedID", "SrcLinkedId"),
+		explicitLinkedID(event),
 		eventValue(event, "Uniqueid", "UniqueID", "UniqueId"),
 		eventValue(event, "DestUniqueid", "DestUniqueID", "DestUniqueId"),
 		eventValue(event, "SrcUniqueid", "SrcUniqueID", "SrcUniqueId"),
@@ -791,6 +1282,129 @@ func linkedIDFor(event map[string]string) string {
 	return channel
 }
 
+// explicitLinkedID returns the Linkedid an event carries, if any, as opposed
+// to the Uniqueid or channel name linkedIDFor falls back to.
+func explicitLinkedID(event map[string]string) string {
+	return strings.TrimSpace(firstNonEmpty(
+		eventValue(event, "Linkedid", "LinkedID", "LinkedId"),
+		eventValue(event, "DestLinkedid", "DestLinkedID", "DestLinkedId"),
+		eventValue(event, "SrcLinkedid", "SrcLinkedID", "SrcLinkedId"),
+	))
+}
+
+// reconcileLocked folds provisional calls, tracked under a Uniqueid or
+// channel name that event names, into the call for its real linkedID.
+// Early events of a transfer or pickup leg often lack Linkedid, so the leg
+// would otherwise stay a second active call. call is the one already
+// tracked under linkedID, or nil, in which case the first provisional call
+// found is re-keyed instead. It returns the call now under linkedID and
+// whether anything was merged.
+func (s *Service) reconcileLocked(call *activeCall, linkedID string, event map[string]string) (*activeCall, bool) {
+	merged := false
+	for _, key := range fallbackKeys(event) {
+		other, ok := s.active[key]
+		if !ok || key == linkedID || !other.provisional {
+			continue
+		}
+		delete(s.active, key)
+		merged = true
+		if call == nil {
+			other.ID = linkedID
+			other.provisional = false
+			s.active[linkedID] = other
+			call = other
+			continue
+		}
+		for channel := range other.channels {
+			call.channels[channel] = struct{}{}
+		}
+		// The leg that started first is the caller's, so its parties win.
+		if other.Start.Before(call.Start) {
+			call.Start = other.Start
+			call.From = firstNonEmpty(other.From, call.From)
+			call.To = firstNonEmpty(other.To, call.To)
+		}
+		if !other.answered.IsZero() && (call.answered.IsZero() || other.answered.Before(call.answered)) {
+			call.answered = other.answered
+		}
+		if other.Updated.After(call.Updated) {
+			call.State = other.State
+		}
+		call.From = firstNonEmpty(call.From, other.From)
+		call.To = firstNonEmpty(call.To, other.To)
+	}
+	return call, merged
+}
+
+// fallbackKeys lists the Uniqueids and channel names linkedIDFor may have
+// keyed an event's channels by before their Linkedid was known.
+func fallbackKeys(event map[string]string) []string {
+	var keys []string
+	for _, names := range [][]string{
+		{"Uniqueid", "UniqueID", "UniqueId"},
+		{"DestUniqueid", "DestUniqueID", "DestUniqueId"},
+		{"SrcUniqueid", "SrcUniqueID", "SrcUniqueId"},
+		{"Channel"},
+		{"DestChannel"},
+		{"SrcChannel"},
+	} {
+		if key := eventValue(event, names...); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SeedPresence applies the rows of one PJSIPShowEndpoints listing at once,
+// so a roster of hundreds of endpoints notifies subscribers a single time.
+func (s *Service) SeedPresence(rows []map[string]string) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	changed := false
+	for _, row := range rows {
+		eventType := strings.ToLower(strings.TrimSpace(eventValue(row, "Event")))
+		if s.observePresenceLocked(eventType, row, now) {
+			changed = true
+		}
+	}
+	if changed {
+		s.updated = now
+	}
+	subs := s.copySubsLocked()
+	s.mu.Unlock()
+
+	if changed {
+		notify(subs)
+	}
+}
+
+// observePresenceLocked records one presence-bearing event and reports
+// whether the endpoint's state or detail changed.
+func (s *Service) observePresenceLocked(eventType string, event map[string]string, now time.Time) bool {
+	id, endpoint, ok := presenceIDFor(event, s.aliases)
+	if !ok {
+		return false
+	}
+	state, detail := presenceStateFor(eventType, event)
+	prev, hasPrev := s.presence[id]
+	if hasPrev && prev.State == state && prev.Detail == detail {
+		// Refresh activity without notifying; qualify events arrive
+		// constantly and the next real change carries the new time.
+		prev.LastSeen = now
+		s.presence[id] = prev
+		return false
+	}
+	s.presence[id] = Presence{
+		ID:       id,
+		State:    state,
+		Detail:   detail,
+		Updated:  now,
+		LastSeen: now,
+		endpoint: endpoint,
+	}
+	return true
+}
+
 func channelKey(event map[string]string) string {
 	return strings.TrimSpace(firstNonEmpty(
 		eventValue(event, "Uniqueid", "UniqueID", "UniqueId"),
@@ -798,7 +1412,11 @@ func channelKey(event map[string]string) string {
 	))
 }
 
-func presenceIDFor(event map[string]string) (string, bool) {
+// presenceIDFor picks the presence ID an event is about and returns it with
+// the candidate it came from. A candidate named in aliases, directly or as
+// the endpoint of a "PJSIP/<endpoint>" device, maps to its extension; others
+// are cleaned into a number or name.
+func presenceIDFor(event map[string]string, aliases map[string]string) (string, string, bool) {
 	candidates := []string{
 		eventValue(event, "EndpointName", "Endpoint", "AOR", "ObjectName", "Peer"),
 		eventValue(event, "URI", "Contact"),
@@ -806,9 +1424,31 @@ func presenceIDFor(event map[string]string) (string, bool) {
 		eventValue(event, "Device"),
 	}
 	for _, candidate := range candidates {
-		id := cleanPresenceID(candidate)
-		if id != "" {
-			return id, true
+		if id := presenceIDForCandidate(aliases, candidate); id != "" {
+			return id, strings.TrimSpace(candidate), true
+		}
+	}
+	return "", "", false
+}
+
+func presenceIDForCandidate(aliases map[string]string, candidate string) string {
+	if ext, ok := presenceAlias(aliases, candidate); ok {
+		return ext
+	}
+	return cleanPresenceID(candidate)
+}
+
+func presenceAlias(aliases map[string]string, raw string) (string, bool) {
+	if len(aliases) == 0 {
+		return "", false
+	}
+	raw = strings.TrimSpace(raw)
+	if ext, ok := aliases[raw]; ok && raw != "" {
+		return ext, true
+	}
+	if _, endpoint, found := strings.Cut(raw, "/"); found {
+		if ext, ok := aliases[endpoint]; ok && endpoint != "" {
+			return ext, true
 		}
 	}
 	return "", false
@@ -876,6 +1516,10 @@ func presenceStateFor(eventType string, event map[string]string) (string, string
 	}
 	normalized := normalizePresenceValue(raw)
 	switch {
+	case normalized == "notinuse":
+		// DeviceState of an idle endpoint, as every EndpointList row
+		// without calls reports it.
+		return "connected", detail
 	case strings.Contains(normalized, "inuse"), strings.Contains(normalized, "busy"), strings.Contains(normalized, "onhold"), strings.Contains(normalized, "ring"), strings.Contains(normalized, "dial"):
 		return "in-use", detail
 	case isDisconnectedPresenceValue(raw):
@@ -938,14 +1582,23 @@ func channelPeer(channel string) string {
 	return channel
 }
 
-func cleanTarget(raw string) string {
-	raw = cleanNumber(raw)
-	switch raw {
-	case "", "s", "h", "i":
+func (s *Service) cleanTarget(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if _, ok := s.ignored[raw]; ok {
 		return ""
-	default:
-		return raw
 	}
+	// cleanNumber strips letters, so a special extension an operator chose
+	// not to ignore is kept verbatim.
+	for _, special := range DefaultIgnoredTargets {
+		if raw == special {
+			return raw
+		}
+	}
+	cleaned := cleanNumber(raw)
+	if _, ok := s.ignored[cleaned]; ok {
+		return ""
+	}
+	return cleaned
 }
 
 func cleanNumber(raw string) string {
@@ -996,9 +1649,29 @@ func eventValue(event map[string]string, keys ...string) string {
 
 func isPresenceEvent(eventType string) bool {
 	switch strings.ToLower(strings.TrimSpace(eventType)) {
-	case "contactstatus", "endpointstatus", "devicestatechange", "peerstatus", "endpointlist":
+	case "contactstatus", "endpointstatus", "devicestatechange", "peerstatus", "endpointlist", "contactstatusdetail":
 		return true
 	default:
 		return false
 	}
 }
+
+// historyHeap is a min-heap of history calls ordered by end time.
+type historyHeap []HistoryCall
+
+func (h historyHeap) Len() int           { return len(h) }
+func (h historyHeap) Less(i, j int) bool { return h[i].End.Before(h[j].End) }
+func (h historyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *historyHeap) Push(x any)        { *h = append(*h, x.(HistoryCall)) }
+
+func (h *historyHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+func (s *Service) isShortCall(talk time.Duration) bool {
+	return s.opts.ShortCallThreshold > 0 && talk < s.opts.ShortCallThreshold
+}
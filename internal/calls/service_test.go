@@ -1,6 +1,11 @@
 package calls
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,6 +54,43 @@ func TestHandleAMIEventLifecycle(t *testing.T) {
 	}
 }
 
+func TestShortCallThresholdReclassifiesBriefAnsweredCalls(t *testing.T) {
+	run := func(threshold time.Duration, bridged bool) HistoryCall {
+		svc := NewService(Options{ShortCallThreshold: threshold}, testLogger{})
+		svc.HandleAMIEvent(map[string]string{
+			"Event":       "Newchannel",
+			"Linkedid":    "abc",
+			"Uniqueid":    "u1",
+			"CallerIDNum": "2601",
+			"Exten":       "2602",
+		})
+		if bridged {
+			svc.HandleAMIEvent(map[string]string{
+				"Event":    "BridgeEnter",
+				"Linkedid": "abc",
+				"Uniqueid": "u1",
+			})
+		}
+		svc.HandleAMIEvent(map[string]string{
+			"Event":     "Hangup",
+			"Linkedid":  "abc",
+			"Uniqueid":  "u1",
+			"Cause-txt": "Normal Clearing",
+		})
+		return svc.Snapshot().History[0]
+	}
+
+	if got := run(0, true); got.State != "answered" {
+		t.Fatalf("expected answered without threshold, got %q", got.State)
+	}
+	if got := run(time.Hour, true); got.State != DispositionShort {
+		t.Fatalf("expected %q below threshold, got %q", DispositionShort, got.State)
+	}
+	if got := run(time.Hour, false); got.State != "answered" {
+		t.Fatalf("expected never-bridged call to keep answered, got %q", got.State)
+	}
+}
+
 func TestParseDialString(t *testing.T) {
 	if got := parseDialString("PJSIP/8081,30"); got != "8081" {
 		t.Fatalf("expected 8081, got %q", got)
@@ -97,6 +139,98 @@ func TestLinkedIDForFallsBackToDestinationFieldsAndChannel(t *testing.T) {
 	}
 }
 
+func TestHandleAMIEventMergesLegsOnceLinkedidArrives(t *testing.T) {
+	svc := NewService(Options{}, testLogger{})
+	// The pickup leg's first event carries neither Linkedid nor Uniqueid.
+	svc.HandleAMIEvent(map[string]string{
+		"Event":       "Newchannel",
+		"Channel":     "PJSIP/2601-00000001",
+		"CallerIDNum": "2601",
+		"Exten":       "2602",
+	})
+	start := svc.Snapshot().Active[0].Start
+	time.Sleep(5 * time.Millisecond)
+	svc.HandleAMIEvent(map[string]string{
+		"Event":    "Newchannel",
+		"Linkedid": "1700.1",
+		"Uniqueid": "1700.2",
+		"Channel":  "PJSIP/2602-00000002",
+		"Exten":    "2602",
+	})
+	if active := svc.Snapshot().Active; len(active) != 2 {
+		t.Fatalf("expected the split legs as two active calls, got %+v", active)
+	}
+
+	svc.HandleAMIEvent(map[string]string{
+		"Event":    "BridgeEnter",
+		"Linkedid": "1700.1",
+		"Uniqueid": "1700.3",
+		"Channel":  "PJSIP/2601-00000001",
+	})
+	active := svc.Snapshot().Active
+	if len(active) != 1 {
+		t.Fatalf("expected the legs merged into one call, got %+v", active)
+	}
+	if got := active[0]; got.ID != "1700.1" || got.From != "2601" || got.To != "2602" || !got.Start.Equal(start) || got.State != "active" {
+		t.Fatalf("expected the merged call under the Linkedid with the earliest start, got %+v (start %s)", got, start)
+	}
+
+	svc.HandleAMIEvent(map[string]string{"Event": "Hangup", "Linkedid": "1700.1", "Uniqueid": "1700.3", "Channel": "PJSIP/2601-00000001"})
+	if len(svc.Snapshot().Active) != 1 {
+		t.Fatal("expected the call to stay active while the other leg is up")
+	}
+	svc.HandleAMIEvent(map[string]string{"Event": "Hangup", "Linkedid": "1700.1", "Uniqueid": "1700.2", "Channel": "PJSIP/2602-00000002", "Cause-txt": "Normal Clearing"})
+	snap := svc.Snapshot()
+	if len(snap.Active) != 0 || len(snap.History) != 1 || snap.History[0].ID != "1700.1" || !snap.History[0].Start.Equal(start) {
+		t.Fatalf("expected one finished call, got active %+v, history %+v", snap.Active, snap.History)
+	}
+}
+
+func TestHandleAMIEventRekeysLegWhenLinkedidArrives(t *testing.T) {
+	svc := NewService(Options{}, testLogger{})
+	svc.HandleAMIEvent(map[string]string{"Event": "Newchannel", "Uniqueid": "u1", "CallerIDNum": "2601", "Exten": "2602"})
+	svc.HandleAMIEvent(map[string]string{"Event": "Hangup", "Linkedid": "l1", "Uniqueid": "u1", "Cause-txt": "Normal Clearing"})
+	snap := svc.Snapshot()
+	if len(snap.Active) != 0 || len(snap.History) != 1 || snap.History[0].ID != "l1" || snap.History[0].From != "2601" {
+		t.Fatalf("expected the leg re-keyed to its Linkedid and ended, got active %+v, history %+v", snap.Active, snap.History)
+	}
+}
+
+func TestIgnoredTargetsAreConfigurable(t *testing.T) {
+	newCall := func(svc *Service, exten string) string {
+		svc.HandleAMIEvent(map[string]string{
+			"Event":       "Newchannel",
+			"Linkedid":    "call-" + exten,
+			"Uniqueid":    "u-" + exten,
+			"CallerIDNum": "2601",
+			"Exten":       exten,
+		})
+		for _, call := range svc.Snapshot().Active {
+			if call.ID == "call-"+exten {
+				return call.To
+			}
+		}
+		t.Fatalf("call for exten %q not tracked", exten)
+		return ""
+	}
+
+	defaults := NewService(Options{}, testLogger{})
+	if got := newCall(defaults, "s"); got != "" {
+		t.Fatalf("expected default service to ignore s, got %q", got)
+	}
+
+	custom := NewService(Options{IgnoredTargets: []string{"700"}}, testLogger{})
+	if got := newCall(custom, "s"); got != "s" {
+		t.Fatalf("expected s to be kept when not ignored, got %q", got)
+	}
+	if got := newCall(custom, "700"); got != "" {
+		t.Fatalf("expected configured target 700 to be ignored, got %q", got)
+	}
+	if got := newCall(custom, "2602"); got != "2602" {
+		t.Fatalf("expected ordinary target to pass through, got %q", got)
+	}
+}
+
 func TestHandleAMIEventPresenceContactStatus(t *testing.T) {
 	svc := NewService(Options{MaxHistory: 100, Retention: 7 * 24 * time.Hour}, testLogger{})
 	svc.HandleAMIEvent(map[string]string{
@@ -118,6 +252,69 @@ func TestHandleAMIEventPresenceContactStatus(t *testing.T) {
 	}
 }
 
+func TestSweepPresenceExpiresStaleEndpoints(t *testing.T) {
+	svc := NewService(Options{PresenceTTL: time.Minute}, testLogger{})
+	svc.HandleAMIEvent(map[string]string{
+		"Event":    "ContactStatus",
+		"AOR":      "2601",
+		"Status":   "Reachable",
+		"Endpoint": "2601",
+	})
+	seen := svc.Snapshot().Presences[0].LastSeen
+
+	svc.SweepPresence(seen.Add(30 * time.Second))
+	if got := svc.Snapshot().Presences[0].State; got != "connected" {
+		t.Fatalf("expected presence kept within TTL, got %q", got)
+	}
+
+	svc.SweepPresence(seen.Add(time.Minute))
+	if got := svc.Snapshot().Presences[0].State; got != "unknown" {
+		t.Fatalf("expected presence downgraded after TTL, got %q", got)
+	}
+
+	svc.SweepPresence(seen.Add(2 * time.Minute))
+	if got := svc.Snapshot().Presences; len(got) != 0 {
+		t.Fatalf("expected presence removed after twice the TTL, got %+v", got)
+	}
+
+	forever := NewService(Options{PresenceTTL: -1}, testLogger{})
+	forever.HandleAMIEvent(map[string]string{
+		"Event":    "ContactStatus",
+		"AOR":      "2601",
+		"Status":   "Reachable",
+		"Endpoint": "2601",
+	})
+	forever.SweepPresence(time.Now().Add(24 * time.Hour))
+	if got := forever.Snapshot().Presences; len(got) != 1 || got[0].State != "connected" {
+		t.Fatalf("expected negative TTL to keep presences, got %+v", got)
+	}
+}
+
+func TestHandleAMIEventPresenceRefreshesLastSeenWithoutStateChange(t *testing.T) {
+	svc := NewService(Options{MaxHistory: 100, Retention: 7 * 24 * time.Hour}, testLogger{})
+	event := map[string]string{
+		"Event":    "ContactStatus",
+		"AOR":      "2601",
+		"Status":   "Reachable",
+		"Endpoint": "2601",
+	}
+	svc.HandleAMIEvent(event)
+	first := svc.Snapshot().Presences[0]
+	if first.LastSeen.IsZero() || !first.LastSeen.Equal(first.Updated) {
+		t.Fatalf("expected initial last seen to match updated, got %+v", first)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	svc.HandleAMIEvent(event)
+	second := svc.Snapshot().Presences[0]
+	if !second.Updated.Equal(first.Updated) {
+		t.Fatalf("expected unchanged state to keep updated %v, got %v", first.Updated, second.Updated)
+	}
+	if !second.LastSeen.After(first.LastSeen) {
+		t.Fatalf("expected last seen to advance past %v, got %v", first.LastSeen, second.LastSeen)
+	}
+}
+
 func TestHandleAMIEventPresenceDeviceState(t *testing.T) {
 	svc := NewService(Options{MaxHistory: 100, Retention: 7 * 24 * time.Hour}, testLogger{})
 	svc.HandleAMIEvent(map[string]string{
@@ -179,3 +376,233 @@ func TestHandleAMIEventPresenceEndpointListStatusOverridesIdleDeviceState(t *tes
 		t.Fatalf("expected detail Unavailable, got %q", snap.Presences[0].Detail)
 	}
 }
+
+func TestHandleAMIEventPresenceUsesAliases(t *testing.T) {
+	svc := NewService(Options{MaxHistory: 100, Retention: 7 * 24 * time.Hour}, testLogger{})
+	svc.SetPresenceAliases(map[string]string{"pjsip-7f3a9c": "2601"})
+	svc.HandleAMIEvent(map[string]string{
+		"Event":       "EndpointList",
+		"ObjectName":  "pjsip-7f3a9c",
+		"DeviceState": "Not in use",
+	})
+	svc.HandleAMIEvent(map[string]string{
+		"Event":  "DeviceStateChange",
+		"Device": "PJSIP/pjsip-7f3a9c",
+		"State":  "INUSE",
+	})
+
+	snap := svc.Snapshot()
+	if len(snap.Presences) != 1 || snap.Presences[0].ID != "2601" || snap.Presences[0].State != "in-use" {
+		t.Fatalf("expected both events recorded under the aliased extension, got %+v", snap.Presences)
+	}
+}
+
+func TestSetPresenceAliasesRekeysRecordedPresences(t *testing.T) {
+	svc := NewService(Options{MaxHistory: 100, Retention: 7 * 24 * time.Hour}, testLogger{})
+	svc.HandleAMIEvent(map[string]string{
+		"Event":       "EndpointList",
+		"ObjectName":  "pjsip-7f3a9c",
+		"DeviceState": "Not in use",
+	})
+	if snap := svc.Snapshot(); len(snap.Presences) != 1 || snap.Presences[0].ID == "2601" {
+		t.Fatalf("expected the unaliased endpoint under its own name, got %+v", snap.Presences)
+	}
+
+	updates, unsubscribe := svc.Subscribe()
+	defer unsubscribe()
+	svc.SetPresenceAliases(map[string]string{"pjsip-7f3a9c": "2601"})
+	snap := svc.Snapshot()
+	if len(snap.Presences) != 1 || snap.Presences[0].ID != "2601" || snap.Presences[0].State != "connected" {
+		t.Fatalf("expected the recorded presence re-keyed to the alias, got %+v", snap.Presences)
+	}
+	select {
+	case <-updates:
+	default:
+		t.Fatal("expected subscribers to be notified of the re-key")
+	}
+
+	svc.SetPresenceAliases(nil)
+	if snap := svc.Snapshot(); len(snap.Presences) != 1 || snap.Presences[0].ID == "2601" {
+		t.Fatalf("expected removing the alias to restore the endpoint name, got %+v", snap.Presences)
+	}
+}
+
+// writeCDR writes n synthetic CDR rows, one minute apart and ending now, in
+// the given index order.
+func writeCDR(tb testing.TB, n int, order func(i int) int) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "Master.csv")
+	now := time.Now().UTC()
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		idx := order(i)
+		end := now.Add(-time.Duration(n-idx) * time.Minute)
+		start := end.Add(-30 * time.Second)
+		fmt.Fprintf(&b, "\"\",\"2601\",\"%d\",\"internal\",\"\",\"PJSIP/2601-1\",\"\",\"Dial\",\"\",\"%s\",\"%s\",\"%s\",30,25,\"ANSWERED\",\"DOCUMENTATION\",\"call-%d\"\n",
+			idx, start.Format("2006-01-02 15:04:05"), start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"), idx)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		tb.Fatalf("write CDR: %v", err)
+	}
+	return path
+}
+
+func TestLoadCDRKeepsMostRecentCalls(t *testing.T) {
+	// Rows out of order: odd indexes first, then even ones.
+	path := writeCDR(t, 10, func(i int) int {
+		if i < 5 {
+			return 2*i + 1
+		}
+		return 2 * (i - 5)
+	})
+	svc := NewService(Options{MaxHistory: 3, Retention: 24 * time.Hour}, testLogger{})
+	loaded, err := svc.LoadCDR(path)
+	if err != nil {
+		t.Fatalf("LoadCDR() error = %v", err)
+	}
+	if loaded != 3 {
+		t.Fatalf("expected 3 calls, got %d", loaded)
+	}
+	var ids []string
+	for _, h := range svc.Snapshot().History {
+		ids = append(ids, h.ID)
+	}
+	if strings.Join(ids, ",") != "call-9,call-8,call-7" {
+		t.Fatalf("expected the three most recent calls newest first, got %v", ids)
+	}
+}
+
+func TestLoadCDRCustomColumns(t *testing.T) {
+	end := time.Now().UTC().Add(-time.Minute)
+	start := end.Add(-40 * time.Second)
+	row := fmt.Sprintf("%s,%s,2601,2602,ANSWERED,40,35,call-1\n", start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"))
+	path := filepath.Join(t.TempDir(), "Custom.csv")
+	if err := os.WriteFile(path, []byte("Start,End,Src,Dst,Disposition,Duration,BillSec,UniqueID\n"+row), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	byIndex, err := ParseCDRColumns("start=0,end=1,src=2,dst=3,disposition=4,duration=5,billsec=6,uniqueid=7")
+	if err != nil {
+		t.Fatalf("ParseCDRColumns() error = %v", err)
+	}
+	byName, err := ParseCDRColumns("start=start, end=end, src=src, dst=dst, disposition=disposition, billsec=BILLSEC, uniqueid=uniqueid")
+	if err != nil {
+		t.Fatalf("ParseCDRColumns() error = %v", err)
+	}
+	for name, cols := range map[string]CDRColumns{"index": byIndex, "header": byName} {
+		svc := NewService(Options{CDRColumns: cols}, testLogger{})
+		if loaded, err := svc.LoadCDR(path); err != nil || loaded != 1 {
+			t.Fatalf("%s: LoadCDR() = %d, %v", name, loaded, err)
+		}
+		h := svc.Snapshot().History[0]
+		if h.ID != "call-1" || h.From != "2601" || h.To != "2602" || h.State != "ANSWERED" || h.TalkSec != 35 {
+			t.Fatalf("%s: unexpected call %+v", name, h)
+		}
+		if name == "header" && h.DurationSec != 0 {
+			t.Fatalf("expected an unmapped duration to read as zero, got %d", h.DurationSec)
+		}
+	}
+
+	svc := NewService(Options{CDRColumns: CDRColumns{Start: "calldate", End: "end"}}, testLogger{})
+	if _, err := svc.LoadCDR(path); err == nil || !strings.Contains(err.Error(), "calldate") {
+		t.Fatalf("expected an error naming the missing header, got %v", err)
+	}
+	if _, err := ParseCDRColumns("caller=1"); err == nil {
+		t.Fatal("expected an unknown field to fail")
+	}
+	for _, spec := range []string{"src=0", "src=src,start=calldate"} {
+		if _, err := ParseCDRColumns(spec); err == nil {
+			t.Fatalf("expected %q without start and end to fail", spec)
+		}
+	}
+}
+
+func TestWatchCDRReloadsChangedFile(t *testing.T) {
+	path := writeCDR(t, 2, func(i int) int { return i })
+	svc := NewService(Options{MaxHistory: 10, Retention: 24 * time.Hour}, testLogger{})
+	if _, err := svc.LoadCDR(path); err != nil {
+		t.Fatalf("LoadCDR() error = %v", err)
+	}
+	updates, unsubscribe := svc.Subscribe()
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.WatchCDR(ctx, path, 10*time.Millisecond)
+	// Let the watcher take its first look at the unchanged file.
+	time.Sleep(50 * time.Millisecond)
+
+	grown := writeCDR(t, 4, func(i int) int { return i })
+	raw, err := os.ReadFile(grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-updates:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a notification after the CDR file changed")
+	}
+	if n := len(svc.Snapshot().History); n != 4 {
+		t.Fatalf("expected the reloaded history, got %d calls", n)
+	}
+}
+
+func TestLoadCDRMergesWithLiveHistory(t *testing.T) {
+	path := writeCDR(t, 3, func(i int) int { return i })
+	svc := NewService(Options{MaxHistory: 10, Retention: 24 * time.Hour}, testLogger{})
+	hangup := func(linkedID, to string) {
+		svc.HandleAMIEvent(map[string]string{"Event": "Newchannel", "Linkedid": linkedID, "Uniqueid": linkedID, "CallerIDNum": "2601", "Exten": to})
+		svc.HandleAMIEvent(map[string]string{"Event": "Hangup", "Linkedid": linkedID, "Uniqueid": linkedID})
+	}
+	// call-2 is also in the CSV; live-1 ended after its newest row, as
+	// with cdr.conf batch=yes before the batch is written.
+	hangup("call-2", "2602")
+	hangup("live-1", "2603")
+
+	if _, err := svc.LoadCDR(path); err != nil {
+		t.Fatalf("LoadCDR() error = %v", err)
+	}
+	var ids []string
+	for _, h := range svc.Snapshot().History {
+		ids = append(ids, h.ID)
+		if h.ID == "call-2" && h.State != "ANSWERED" {
+			t.Fatalf("expected the CDR row to replace the live call-2, got %+v", h)
+		}
+	}
+	if strings.Join(ids, ",") != "live-1,call-2,call-1,call-0" {
+		t.Fatalf("expected the live call kept ahead of the CDR rows, each ID once, got %v", ids)
+	}
+
+	// Once the CSV covers live-1 under another leg's ID, the live entry
+	// goes.
+	raw, err := os.ReadFile(writeCDR(t, 5, func(i int) int { return i }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().UTC().Add(time.Minute).Format("2006-01-02 15:04:05")
+	raw = append(raw, fmt.Sprintf("\"\",\"2601\",\"2603\",\"internal\",\"\",\"PJSIP/2601-2\",\"\",\"Dial\",\"\",\"%s\",\"%s\",\"%s\",0,0,\"ANSWERED\",\"DOCUMENTATION\",\"leg-2\"\n", later, later, later)...)
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.LoadCDR(path); err != nil {
+		t.Fatalf("LoadCDR() error = %v", err)
+	}
+	for _, h := range svc.Snapshot().History {
+		if h.ID == "live-1" {
+			t.Fatalf("expected live-1 dropped once a newer CDR row exists, got %+v", svc.Snapshot().History)
+		}
+	}
+}
+
+func BenchmarkLoadCDRLarge(b *testing.B) {
+	path := writeCDR(b, 200000, func(i int) int { return i })
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svc := NewService(Options{MaxHistory: 100, Retention: 365 * 24 * time.Hour}, testLogger{})
+		if _, err := svc.LoadCDR(path); err != nil {
+			b.Fatalf("LoadCDR() error = %v", err)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package config
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/n3wscott/phonebook/internal/model"
 	"gopkg.in/yaml.v3"
 )
 
@@ -27,6 +31,110 @@ type Config struct {
 	Dialplan          Dialplan         `yaml:"dialplan"`
 	Server            Server           `yaml:"server"`
 	Asterisk          Asterisk         `yaml:"asterisk"`
+	Phonebook         Phonebook        `yaml:"phonebook"`
+	Extension         Extension        `yaml:"extension"`
+	Output            Output           `yaml:"output"`
+	ContactsDB        ContactsDB       `yaml:"contacts_db"`
+	ContactsDirs      []string         `yaml:"contacts_dirs"`
+	Limits            Limits           `yaml:"limits"`
+
+	// PresenceAliases maps AMI endpoint names to contact extensions, for
+	// endpoints named by GUID or anything else the calls dashboard cannot
+	// match to a contact.
+	PresenceAliases map[string]string `yaml:"presence_aliases"`
+	// ExternalContacts is a YAML file, relative to the base data
+	// directory, mapping outside numbers to the names the calls dashboard
+	// shows for them. Empty reads none.
+	ExternalContacts string `yaml:"external_contacts"`
+	// ProvisionTemplates is a directory of <model>.cfg.tmpl files,
+	// relative to the base data directory. When set, every build checks
+	// each contact's mac and model against it, and generate provision
+	// uses it unless --template is given.
+	ProvisionTemplates string `yaml:"provision_templates"`
+}
+
+// Limits guard against oversized input, such as a runaway generator filling
+// contacts/, failing the build instead of exhausting memory.
+type Limits struct {
+	// MaxContacts fails the build once more contacts than this are loaded.
+	// Zero means DefaultMaxContacts.
+	MaxContacts int `yaml:"max_contacts"`
+	// MaxFileBytes rejects a contacts/ file larger than this before it is
+	// read. Zero means DefaultMaxFileBytes.
+	MaxFileBytes int64 `yaml:"max_file_bytes"`
+}
+
+// Default limits, far above any real deployment.
+const (
+	DefaultMaxContacts  = 100000
+	DefaultMaxFileBytes = 16 << 20
+)
+
+// ContactsDB reads extra contacts from a SQLite database through the sqlite3
+// command-line shell. Rows go through the same normalization as contacts/
+// entries and are layered on top of them. The shell binary itself comes
+// from the --sqlite3 flag, never from config.yaml.
+type ContactsDB struct {
+	// Path is the database file, relative to the base data directory. The
+	// --contacts-db flag overrides it; with neither set the database is not
+	// read.
+	Path string `yaml:"path"`
+	// Table is read with SELECT *. Set Table or Query, not both.
+	Table string `yaml:"table"`
+	// Query is a single read-only SELECT statement.
+	Query string `yaml:"query"`
+	// Columns maps contact fields (ext, first_name, ...) to result column
+	// names; unmapped fields are read from a column of the same name.
+	Columns map[string]string `yaml:"columns"`
+}
+
+// Resolve returns the database file to read: override when set, else Path
+// relative to baseDir. It returns "" when no database is configured.
+func (d ContactsDB) Resolve(baseDir, override string) string {
+	if override != "" {
+		return override
+	}
+	if d.Path == "" {
+		return ""
+	}
+	return filepath.Join(baseDir, d.Path)
+}
+
+// Statement returns the SQL the contacts database is queried with.
+func (d ContactsDB) Statement() string {
+	if d.Query != "" {
+		return d.Query
+	}
+	return "SELECT * FROM " + d.Table
+}
+
+// Output controls line endings of every generated artifact.
+type Output struct {
+	// Newline is "lf" (default) or "crlf".
+	Newline string `yaml:"newline"`
+	// TrailingNewline, when set, makes every artifact end in exactly one
+	// newline (true) or none (false). Unset keeps each renderer's own
+	// ending.
+	TrailingNewline *bool `yaml:"trailing_newline"`
+}
+
+// Apply rewrites a rendered artifact to the configured line endings. The
+// zero Output returns data unchanged.
+func (o Output) Apply(data []byte) []byte {
+	if o.Newline != "crlf" && o.TrailingNewline == nil {
+		return data
+	}
+	out := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if o.TrailingNewline != nil {
+		out = bytes.TrimRight(out, "\n")
+		if *o.TrailingNewline {
+			out = append(out, '\n')
+		}
+	}
+	if o.Newline == "crlf" {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	return out
 }
 
 // Network aggregates transport-related addresses.
@@ -58,6 +166,31 @@ type Dialplan struct {
 	Conferences  []Conference  `yaml:"conferences"`
 	Applications []Application `yaml:"applications"`
 	Messages     Messages      `yaml:"messages"`
+	Dial         Dial          `yaml:"dial"`
+	Voicemail    Voicemail     `yaml:"voicemail"`
+}
+
+// Dial customizes the per-contact direct-dial extensions.
+type Dial struct {
+	// Options is appended verbatim after the channel, e.g. ",tT" renders
+	// Dial(PJSIP/101,,tT).
+	Options string `yaml:"options"`
+	// PreDial lists priorities to run before Dial, e.g. "Answer()".
+	PreDial []string `yaml:"pre_dial"`
+}
+
+// Voicemail configures the mailboxes of contacts with a voicemail block.
+type Voicemail struct {
+	// Context is the voicemail.conf context the mailboxes are written to
+	// (default "default").
+	Context string `yaml:"context"`
+	// RingSeconds is how long a contact's phone rings before the call goes
+	// to voicemail (default 20). It only applies when dialplan.dial.options
+	// does not already set a Dial timeout.
+	RingSeconds int `yaml:"ring_seconds"`
+	// MainExtension, when set, is dialed to check messages with
+	// VoiceMailMain for the caller's own mailbox.
+	MainExtension string `yaml:"main_extension"`
 }
 
 // Conference defines a conference bridge extension.
@@ -85,12 +218,83 @@ type Messages struct {
 type Server struct {
 	Addr     string `yaml:"addr"`
 	BasePath string `yaml:"base_path"`
+	// ContactSort is the default order for debug and API contact listings:
+	// extension (default), name, group, or source.
+	ContactSort string `yaml:"contact_sort"`
+	// Headers are added to every HTTP response. Headers a handler sets
+	// itself, such as Content-Type or ETag, take precedence.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Phonebook controls XML phonebook generation.
+type Phonebook struct {
+	SpeedDial SlotRange `yaml:"speed_dial"`
+	// Lines is how many SIP accounts the deployment's phones have; an
+	// account_index above it is rejected. Zero means the defaults'
+	// MaxAccountIndex.
+	Lines int `yaml:"lines"`
+	// WarnSparseLines warns when a contact's phones skip lines below the
+	// highest account_index they use, such as a lone index 5.
+	WarnSparseLines bool `yaml:"warn_sparse_lines"`
+	// AutoAccountIndex gives phones without their own account_index the
+	// next free line instead of the contact's account_index.
+	AutoAccountIndex bool `yaml:"auto_account_index"`
+	// ExtensionFallback lists a contact's ext as its phone number when it
+	// has no phones. Unset means true.
+	ExtensionFallback *bool `yaml:"extension_fallback"`
+}
+
+// UseExtensionFallback reports whether contacts without phones are listed
+// under their ext.
+func (p Phonebook) UseExtensionFallback() bool {
+	return p.ExtensionFallback == nil || *p.ExtensionFallback
+}
+
+// MaxAccountIndex is the highest account_index a Grandstream GXP accepts,
+// and the default for defaults.yaml max_account_index.
+const MaxAccountIndex = 6
+
+// Extension controls which contact ext values are accepted.
+type Extension struct {
+	// AllowAlphanumeric accepts named SIP accounts such as "frontdesk" as
+	// ext. Such contacts must list their dialable number under phones.
+	AllowAlphanumeric bool `yaml:"allow_alphanumeric"`
+	// Pattern is a regular expression every ext must match in full.
+	Pattern string `yaml:"pattern"`
+	// MinLength and MaxLength bound the ext length; zero leaves a side open.
+	MinLength int `yaml:"min_length"`
+	MaxLength int `yaml:"max_length"`
+	// Min and Max bound the numeric value of an ext; nil leaves a side open.
+	Min *int `yaml:"min"`
+	Max *int `yaml:"max"`
+	// Strict fails the build on an ext that breaks the constraints above
+	// instead of logging a warning.
+	Strict bool `yaml:"strict"`
+	// WarnPhoneMismatch warns when a contact's only phone number differs
+	// from its numeric ext, for sites where they should always agree.
+	WarnPhoneMismatch bool `yaml:"warn_phone_mismatch"`
+}
+
+// SlotRange bounds the speed-dial slot numbers contacts may claim.
+type SlotRange struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
 }
 
 // Asterisk-specific options for generators.
 type Asterisk struct {
 	StaticContacts []StaticContact `yaml:"static_contacts"`
 	EdgeIn         EdgeIn          `yaml:"edge_in"`
+	// BLF emits dialplan hints and enables endpoint subscriptions so phones
+	// can watch each other's device state on busy-lamp-field keys.
+	BLF bool `yaml:"blf"`
+	// KeepBooleanStrings writes string option values such as "true" or
+	// "off" as given instead of rewriting them to yes/no.
+	KeepBooleanStrings bool `yaml:"keep_boolean_strings"`
+	// StableOrder writes transports and endpoint templates sorted by name
+	// instead of in config.yaml order, so reordering the file does not
+	// change pjsip.conf.
+	StableOrder bool `yaml:"stable_order"`
 }
 
 // StaticContact binds an extension to an explicit AOR contact URI.
@@ -114,13 +318,22 @@ type Defaults struct {
 	AOR      AORDefaults
 	Auth     AuthDefaults
 	Endpoint EndpointDefaults
+
+	// MaxAccountIndex is the highest account_index the deployment's phones
+	// accept, such as 16 for Fanvil handsets; phonebook.lines may not
+	// exceed it.
+	MaxAccountIndex int
 }
 
 // AORDefaults applies to contact AOR blocks.
 type AORDefaults struct {
-	MaxContacts      int
-	RemoveExisting   bool
-	QualifyFrequency int
+	MaxContacts       int
+	RemoveExisting    bool
+	QualifyFrequency  int
+	QualifyTimeout    float64
+	MinimumExpiration int
+	MaximumExpiration int
+	DefaultExpiration int
 }
 
 // AuthDefaults configures auth fallback behavior.
@@ -145,41 +358,78 @@ var builtinDefaults = Defaults{
 	Endpoint: EndpointDefaults{
 		Template: "endpoint-template",
 	},
+	MaxAccountIndex: MaxAccountIndex,
 }
 
 // Load reads config.yaml and defaults.yaml from dir.
 func Load(dir string) (Config, Defaults, []FileMeta, error) {
-	configPath := filepath.Join(dir, "config.yaml")
-	data, err := os.ReadFile(configPath)
+	return LoadOverlay([]string{dir})
+}
+
+// LoadOverlay reads config.yaml and defaults.yaml from a base directory and
+// any number of overlay directories, in order. Only the base must have a
+// config.yaml. Later files are deep-merged over earlier ones: maps merge key
+// by key, lists of named entries (transports, endpoint_templates, ...) merge
+// by name, and any other value is replaced.
+func LoadOverlay(dirs []string) (Config, Defaults, []FileMeta, error) {
+	if len(dirs) == 0 {
+		return Config{}, Defaults{}, nil, errors.New("no data directory given")
+	}
+	metas := []FileMeta{}
+
+	merged := map[string]any{}
+	for i, dir := range dirs {
+		configPath := filepath.Join(dir, "config.yaml")
+		layer, err := readLayer(configPath, "config.yaml", i == 0)
+		if err != nil {
+			return Config{}, Defaults{}, nil, err
+		}
+		if layer == nil {
+			continue
+		}
+		merged = mergeMaps(merged, layer)
+		if info, err := os.Stat(configPath); err == nil {
+			metas = append(metas, FileMeta{Path: configPath, ModTime: info.ModTime()})
+		}
+	}
+	templateMetas, err := mergeTemplateFiles(merged, dirs)
 	if err != nil {
-		return Config{}, Defaults{}, nil, fmt.Errorf("read config.yaml: %w", err)
+		return Config{}, Defaults{}, nil, err
 	}
+	metas = append(metas, templateMetas...)
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return Config{}, Defaults{}, nil, fmt.Errorf("parse config.yaml: %w", err)
+	if err := decodeMerged(merged, &cfg); err != nil {
+		return Config{}, Defaults{}, nil, &ParseError{Path: "config.yaml", Err: err}
 	}
 	cfg.normalize()
 
-	metas := []FileMeta{}
-	if info, err := os.Stat(configPath); err == nil {
-		metas = append(metas, FileMeta{Path: configPath, ModTime: info.ModTime()})
-	}
-
 	defs := builtinDefaults
-	defPath := filepath.Join(dir, "defaults.yaml")
-	if raw, err := os.ReadFile(defPath); err == nil {
-		var file defaultsFile
-		if err := yaml.Unmarshal(raw, &file); err != nil {
-			return Config{}, Defaults{}, nil, fmt.Errorf("parse defaults.yaml: %w", err)
+	mergedDefs := map[string]any{}
+	for _, dir := range dirs {
+		defPath := filepath.Join(dir, "defaults.yaml")
+		layer, err := readLayer(defPath, "defaults.yaml", false)
+		if err != nil {
+			return Config{}, Defaults{}, nil, err
 		}
-		defs = mergeDefaults(builtinDefaults, file)
+		if layer == nil {
+			continue
+		}
+		mergedDefs = mergeMaps(mergedDefs, layer)
 		if info, err := os.Stat(defPath); err == nil {
 			metas = append(metas, FileMeta{Path: defPath, ModTime: info.ModTime()})
 		}
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return Config{}, Defaults{}, nil, fmt.Errorf("read defaults.yaml: %w", err)
+	}
+	if len(mergedDefs) > 0 {
+		var file defaultsFile
+		if err := decodeMerged(mergedDefs, &file); err != nil {
+			return Config{}, Defaults{}, nil, &ParseError{Path: "defaults.yaml", Err: err}
+		}
+		defs = mergeDefaults(builtinDefaults, file)
 	}
 
+	if cfg.Phonebook.Lines == 0 {
+		cfg.Phonebook.Lines = defs.MaxAccountIndex
+	}
 	if err := validate(cfg, defs); err != nil {
 		return Config{}, Defaults{}, nil, err
 	}
@@ -187,6 +437,102 @@ func Load(dir string) (Config, Defaults, []FileMeta, error) {
 	return cfg, defs, metas, nil
 }
 
+// readLayer parses one YAML file into a map. A missing optional file yields
+// nil. Parse errors carry the full path so a mistake in an overlay points at
+// the right directory.
+func readLayer(path, name string, required bool) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !required && errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if errors.Is(err, os.ErrNotExist) && name == "config.yaml" {
+			return nil, fmt.Errorf("%w at %s", ErrMissingConfig, path)
+		}
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	layer := map[string]any{}
+	if err := yaml.Unmarshal(CleanSource(data), &layer); err != nil {
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	return layer, nil
+}
+
+func decodeMerged(merged map[string]any, out any) error {
+	raw, err := yaml.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(raw, out)
+}
+
+// mergeMaps deep-merges src over dst and returns dst.
+func mergeMaps(dst, src map[string]any) map[string]any {
+	for k, v := range src {
+		dst[k] = mergeValue(dst[k], v)
+	}
+	return dst
+}
+
+func mergeValue(dst, src any) any {
+	switch s := src.(type) {
+	case map[string]any:
+		if d, ok := dst.(map[string]any); ok {
+			return mergeMaps(d, s)
+		}
+	case []any:
+		if d, ok := dst.([]any); ok && namedList(d) && namedList(s) {
+			return mergeNamed(d, s)
+		}
+	}
+	return src
+}
+
+// namedList reports whether every entry is a map with a string "name".
+func namedList(list []any) bool {
+	for _, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return false
+		}
+		if _, ok := m["name"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeNamed(dst, src []any) []any {
+	index := make(map[string]int, len(dst))
+	for i, item := range dst {
+		index[item.(map[string]any)["name"].(string)] = i
+	}
+	for _, item := range src {
+		m := item.(map[string]any)
+		name := m["name"].(string)
+		if i, ok := index[name]; ok {
+			dst[i] = mergeMaps(dst[i].(map[string]any), m)
+			continue
+		}
+		index[name] = len(dst)
+		dst = append(dst, m)
+	}
+	return dst
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// CleanSource strips a leading UTF-8 byte order mark and converts CRLF line
+// endings to LF. Windows editors commonly add both, and a BOM makes the YAML
+// parser fail on the first key with a confusing error.
+func CleanSource(data []byte) []byte {
+	data = bytes.TrimPrefix(data, utf8BOM)
+	if bytes.IndexByte(data, '\r') >= 0 {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	}
+	return data
+}
+
 func (c *Config) normalize() {
 	if c.Global == nil {
 		c.Global = map[string]any{}
@@ -207,6 +553,16 @@ func (c *Config) normalize() {
 			c.EndpointTemplates[i].Extra["allow"] = defaultAllowCodecs()
 		}
 	}
+	if !c.Asterisk.KeepBooleanStrings {
+		normalizeBooleans(c.Global)
+		normalizeBooleans(c.Network.Extra)
+		for i := range c.Transports {
+			normalizeBooleans(c.Transports[i].Extra)
+		}
+		for i := range c.EndpointTemplates {
+			normalizeBooleans(c.EndpointTemplates[i].Extra)
+		}
+	}
 	if c.Server.Addr == "" {
 		c.Server.Addr = ":8080"
 	}
@@ -214,12 +570,32 @@ func (c *Config) normalize() {
 	if c.Dialplan.Context == "" {
 		c.Dialplan.Context = "internal"
 	}
+	if c.Phonebook.SpeedDial.Min == 0 {
+		c.Phonebook.SpeedDial.Min = 1
+	}
+	if c.Phonebook.SpeedDial.Max == 0 {
+		c.Phonebook.SpeedDial.Max = 99
+	}
+	if c.Limits.MaxContacts == 0 {
+		c.Limits.MaxContacts = DefaultMaxContacts
+	}
+	if c.Limits.MaxFileBytes == 0 {
+		c.Limits.MaxFileBytes = DefaultMaxFileBytes
+	}
+	c.ContactsDB.Table = strings.TrimSpace(c.ContactsDB.Table)
+	c.ContactsDB.Query = strings.TrimSpace(c.ContactsDB.Query)
 	if c.Dialplan.Messages.Context == "" {
 		c.Dialplan.Messages.Context = "messages"
 	}
 	if c.Dialplan.Messages.Pattern == "" {
 		c.Dialplan.Messages.Pattern = "_X."
 	}
+	if c.Dialplan.Voicemail.Context == "" {
+		c.Dialplan.Voicemail.Context = "default"
+	}
+	if c.Dialplan.Voicemail.RingSeconds == 0 {
+		c.Dialplan.Voicemail.RingSeconds = 20
+	}
 	for i := range c.Dialplan.Conferences {
 		if c.Dialplan.Conferences[i].Context == "" {
 			c.Dialplan.Conferences[i].Context = "conferences"
@@ -230,10 +606,54 @@ func (c *Config) normalize() {
 	}
 }
 
+// normalizeBooleans rewrites boolean-looking strings among pjsip option
+// values to bools, which render as yes/no. YAML only reads unquoted
+// true/false as booleans, so "yes", "off" or a quoted "true" would otherwise
+// reach pjsip.conf verbatim; Asterisk accepts them all, but mixed spellings
+// hide real differences in a diff.
+func normalizeBooleans(m map[string]any) {
+	for key, v := range m {
+		m[key] = booleanValue(v)
+	}
+}
+
+func booleanValue(v any) any {
+	switch val := v.(type) {
+	case string:
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "yes", "true", "on":
+			return true
+		case "no", "false", "off":
+			return false
+		}
+	case []any:
+		for i := range val {
+			val[i] = booleanValue(val[i])
+		}
+	}
+	return v
+}
+
 func defaultAllowCodecs() []string {
 	return []string{"ulaw", "opus", "g722"}
 }
 
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func sanitizeBasePath(p string) string {
 	if p == "" {
 		return "/"
@@ -274,9 +694,13 @@ func pathCleanPreserve(p string) string {
 
 type defaultsFile struct {
 	AOR struct {
-		MaxContacts      *int  `yaml:"max_contacts"`
-		RemoveExisting   *bool `yaml:"remove_existing"`
-		QualifyFrequency *int  `yaml:"qualify_frequency"`
+		MaxContacts       *int     `yaml:"max_contacts"`
+		RemoveExisting    *bool    `yaml:"remove_existing"`
+		QualifyFrequency  *int     `yaml:"qualify_frequency"`
+		QualifyTimeout    *float64 `yaml:"qualify_timeout"`
+		MinimumExpiration *int     `yaml:"minimum_expiration"`
+		MaximumExpiration *int     `yaml:"maximum_expiration"`
+		DefaultExpiration *int     `yaml:"default_expiration"`
 	} `yaml:"aor"`
 	Auth struct {
 		UsernameEqualsExt *bool `yaml:"username_equals_ext"`
@@ -284,6 +708,7 @@ type defaultsFile struct {
 	Endpoint struct {
 		Template *string `yaml:"template"`
 	} `yaml:"endpoint"`
+	MaxAccountIndex *int `yaml:"max_account_index"`
 }
 
 func mergeDefaults(base Defaults, override defaultsFile) Defaults {
@@ -297,41 +722,352 @@ func mergeDefaults(base Defaults, override defaultsFile) Defaults {
 	if override.AOR.RemoveExisting != nil {
 		out.AOR.RemoveExisting = *override.AOR.RemoveExisting
 	}
+	if override.AOR.QualifyTimeout != nil {
+		out.AOR.QualifyTimeout = *override.AOR.QualifyTimeout
+	}
+	if override.AOR.MinimumExpiration != nil {
+		out.AOR.MinimumExpiration = *override.AOR.MinimumExpiration
+	}
+	if override.AOR.MaximumExpiration != nil {
+		out.AOR.MaximumExpiration = *override.AOR.MaximumExpiration
+	}
+	if override.AOR.DefaultExpiration != nil {
+		out.AOR.DefaultExpiration = *override.AOR.DefaultExpiration
+	}
 	if override.Auth.UsernameEqualsExt != nil {
 		out.Auth.UsernameEqualsExt = *override.Auth.UsernameEqualsExt
 	}
 	if override.Endpoint.Template != nil {
 		out.Endpoint.Template = *override.Endpoint.Template
 	}
+	if override.MaxAccountIndex != nil {
+		out.MaxAccountIndex = *override.MaxAccountIndex
+	}
 	return out
 }
 
 func validate(cfg Config, defs Defaults) error {
 	if len(cfg.Transports) == 0 {
-		return errors.New("config.yaml must define at least one transport")
+		return invalidf("transports", "config.yaml must define at least one transport")
 	}
 	if defs.Endpoint.Template == "" {
-		return errors.New("defaults endpoint template is required")
+		return invalidf("endpoint.template", "defaults endpoint template is required")
 	}
 
 	names := map[string]struct{}{}
 	for _, tmpl := range cfg.EndpointTemplates {
 		if tmpl.Name == "" {
-			return errors.New("endpoint template missing name")
+			return invalidf("endpoint_templates.name", "endpoint template missing name")
 		}
 		names[tmpl.Name] = struct{}{}
 	}
+	if err := validateOptionValues(cfg); err != nil {
+		return err
+	}
 	if _, ok := names[defs.Endpoint.Template]; !ok {
-		return fmt.Errorf("endpoint template %q referenced by defaults not found in config.yaml", defs.Endpoint.Template)
+		return invalidf("endpoint.template", "endpoint template %q referenced by defaults not found in config.yaml", defs.Endpoint.Template)
 	}
 	for _, conf := range cfg.Dialplan.Conferences {
 		if conf.Extension == "" {
-			return errors.New("dialplan conference extension is required")
+			return invalidf("dialplan.conferences.extension", "dialplan conference extension is required")
+		}
+	}
+	if _, err := model.ParseSortKey(cfg.Server.ContactSort); err != nil {
+		return &ValidationError{Field: "server.contact_sort", Err: fmt.Errorf("server.contact_sort: %w", err)}
+	}
+	for name, value := range cfg.Server.Headers {
+		if !validHeaderName(name) {
+			return invalidf("server.headers", "server.headers: invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return invalidf("server.headers", "server.headers: %s value must be a single line", name)
+		}
+	}
+	if strings.ContainsAny(cfg.Dialplan.Dial.Options, "\r\n") {
+		return invalidf("dialplan.dial.options", "dialplan.dial.options must not contain newlines")
+	}
+	for _, step := range cfg.Dialplan.Dial.PreDial {
+		if strings.TrimSpace(step) == "" || strings.ContainsAny(step, "\r\n") {
+			return invalidf("dialplan.dial.pre_dial", "dialplan.dial.pre_dial step %q must be a single non-empty line", step)
+		}
+	}
+	if cfg.Dialplan.Voicemail.RingSeconds < 0 {
+		return invalidf("dialplan.voicemail.ring_seconds", "dialplan.voicemail.ring_seconds %d must be positive", cfg.Dialplan.Voicemail.RingSeconds)
+	}
+	if strings.ContainsAny(cfg.Dialplan.Voicemail.Context, "[]@,;\r\n \t") {
+		return invalidf("dialplan.voicemail.context", "dialplan.voicemail.context %q is not a valid voicemail context", cfg.Dialplan.Voicemail.Context)
+	}
+	if strings.ContainsAny(cfg.Dialplan.Voicemail.MainExtension, ",;\r\n \t") {
+		return invalidf("dialplan.voicemail.main_extension", "dialplan.voicemail.main_extension %q is not a valid extension", cfg.Dialplan.Voicemail.MainExtension)
+	}
+	switch cfg.Output.Newline {
+	case "", "lf", "crlf":
+	default:
+		return invalidf("output.newline", "output.newline %q must be lf or crlf", cfg.Output.Newline)
+	}
+	if err := validateExtension(cfg.Extension); err != nil {
+		return err
+	}
+	if r := cfg.Phonebook.SpeedDial; r.Min < 1 || r.Max < r.Min {
+		return invalidf("phonebook.speed_dial", "phonebook.speed_dial range %d-%d is invalid", r.Min, r.Max)
+	}
+	if defs.MaxAccountIndex < 1 {
+		return invalidf("max_account_index", "defaults max_account_index %d must be at least 1", defs.MaxAccountIndex)
+	}
+	if n := cfg.Phonebook.Lines; n < 1 || n > defs.MaxAccountIndex {
+		return invalidf("phonebook.lines", "phonebook.lines %d outside 1-%d (max_account_index)", n, defs.MaxAccountIndex)
+	}
+	if err := validateContactsDB(cfg.ContactsDB); err != nil {
+		return err
+	}
+	for endpoint, ext := range cfg.PresenceAliases {
+		if strings.TrimSpace(endpoint) == "" || strings.TrimSpace(ext) == "" {
+			return invalidf("presence_aliases", "presence_aliases maps %q to %q; both the endpoint name and the extension are required", endpoint, ext)
+		}
+	}
+	seenDirs := map[string]bool{"contacts": true}
+	for _, dir := range cfg.ContactsDirs {
+		if !filepath.IsLocal(dir) {
+			return invalidf("contacts_dirs", "contacts_dirs entry %q must be a relative path inside the data root", dir)
+		}
+		if _, err := filepath.Match(dir, ""); err != nil {
+			return invalidf("contacts_dirs", "contacts_dirs entry %q is not a valid pattern", dir)
+		}
+		clean := filepath.Clean(dir)
+		if seenDirs[clean] {
+			return invalidf("contacts_dirs", "contacts_dirs entry %q is listed twice (contacts/ is always read)", dir)
+		}
+		seenDirs[clean] = true
+	}
+	if path := cfg.ProvisionTemplates; path != "" && !filepath.IsLocal(path) {
+		return invalidf("provision_templates", "provision_templates %q must be a relative path inside the data root", path)
+	}
+	if path := cfg.ExternalContacts; path != "" {
+		if !filepath.IsLocal(path) {
+			return invalidf("external_contacts", "external_contacts %q must be a relative path inside the data root", path)
+		}
+		for dir := range seenDirs {
+			if matchesParent(dir, path) {
+				return invalidf("external_contacts", "external_contacts %q must not sit inside %s, where it would be read as contacts", path, dir)
+			}
+		}
+	}
+	if cfg.Limits.MaxContacts < 1 {
+		return invalidf("limits.max_contacts", "limits.max_contacts %d must be positive", cfg.Limits.MaxContacts)
+	}
+	if cfg.Limits.MaxFileBytes < 1 {
+		return invalidf("limits.max_file_bytes", "limits.max_file_bytes %d must be positive", cfg.Limits.MaxFileBytes)
+	}
+	if cfg.Asterisk.BLF {
+		if err := validateBLF(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateExtension(e Extension) error {
+	if e.Pattern != "" {
+		if _, err := regexp.Compile(e.Pattern); err != nil {
+			return &ValidationError{Field: "extension.pattern", Err: fmt.Errorf("extension.pattern: %w", err)}
+		}
+	}
+	if e.MinLength < 0 || e.MaxLength < 0 || (e.MaxLength > 0 && e.MaxLength < e.MinLength) {
+		return invalidf("extension.min_length", "extension length range %d-%d is invalid", e.MinLength, e.MaxLength)
+	}
+	if e.Min != nil && e.Max != nil && *e.Max < *e.Min {
+		return invalidf("extension.min", "extension range %d-%d is invalid", *e.Min, *e.Max)
+	}
+	return nil
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateContactsDB(d ContactsDB) error {
+	if d.Table != "" && d.Query != "" {
+		return invalidf("contacts_db", "contacts_db: set table or query, not both")
+	}
+	if d.Table != "" && !sqlIdentifier.MatchString(d.Table) {
+		return invalidf("contacts_db.table", "contacts_db.table %q must be a plain table name", d.Table)
+	}
+	if d.Path != "" && d.Table == "" && d.Query == "" {
+		return invalidf("contacts_db", "contacts_db.path needs a table or query")
+	}
+	if d.Path != "" && !filepath.IsLocal(d.Path) {
+		return invalidf("contacts_db.path", "contacts_db.path %q must be a relative path inside the data root", d.Path)
+	}
+	if d.Query != "" {
+		if err := checkSelect(d.Query); err != nil {
+			return invalidf("contacts_db.query", "contacts_db.query: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkSelect accepts a single SELECT statement, optionally ending in a
+// semicolon. The sqlite3 shell would otherwise run every statement and
+// dot-command it is handed, so anything after the first statement, and any
+// line starting with a dot, is rejected. Semicolons inside quoted strings,
+// identifiers and comments do not end the statement.
+func checkSelect(query string) error {
+	q := strings.TrimSpace(query)
+	if len(q) < len("select") || !strings.EqualFold(q[:len("select")], "select") ||
+		(len(q) > len("select") && isIdentByte(q[len("select")])) {
+		return errors.New("must be a SELECT statement")
+	}
+	for _, line := range strings.Split(q, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ".") {
+			return errors.New("must not contain sqlite3 dot-commands")
+		}
+	}
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(q[i+1:], end)
+			if j < 0 {
+				return errors.New("has an unterminated quote")
+			}
+			i += j + 1
+		case c == '-' && strings.HasPrefix(q[i:], "--"):
+			j := strings.IndexByte(q[i:], '\n')
+			if j < 0 {
+				return nil
+			}
+			i += j
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			j := strings.Index(q[i+2:], "*/")
+			if j < 0 {
+				return errors.New("has an unterminated comment")
+			}
+			i += j + 3
+		case c == ';':
+			if rest := strings.TrimSpace(q[i+1:]); rest != "" {
+				return errors.New("must be a single statement")
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// validateBLF rejects endpoint templates that would defeat asterisk.blf: hints
+// are written to the dialplan context, so subscriptions must be allowed and
+// resolve there.
+func validateBLF(cfg Config) error {
+	for _, tmpl := range cfg.EndpointTemplates {
+		if v, ok := tmpl.Extra["allow_subscribe"]; ok && isFalseOption(v) {
+			return invalidf("asterisk.blf", "asterisk.blf requires allow_subscribe, but endpoint template %q disables it", tmpl.Name)
+		}
+		if v, ok := tmpl.Extra["subscribe_context"]; ok {
+			if ctx := strings.TrimSpace(fmt.Sprint(v)); ctx != cfg.Dialplan.Context {
+				return invalidf("asterisk.blf", "asterisk.blf writes hints to context %q, but endpoint template %q sets subscribe_context %q", cfg.Dialplan.Context, tmpl.Name, ctx)
+			}
+		}
+	}
+	return nil
+}
+
+// validateOptionValues rejects pjsip option values that have no key=value
+// spelling, such as a mistakenly nested map, which would otherwise be
+// written into pjsip.conf as Go syntax.
+func validateOptionValues(cfg Config) error {
+	type section struct {
+		field, name string
+		options     map[string]any
+	}
+	sections := []section{
+		{"global", "global", cfg.Global},
+		{"network", "network", cfg.Network.Extra},
+	}
+	for _, t := range cfg.Transports {
+		sections = append(sections, section{"transports", "transport " + t.Name, t.Extra})
+	}
+	for _, tmpl := range cfg.EndpointTemplates {
+		sections = append(sections, section{"endpoint_templates", "endpoint template " + tmpl.Name, tmpl.Extra})
+	}
+	for _, sec := range sections {
+		keys := make([]string, 0, len(sec.options))
+		for key := range sec.options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := checkOptionValue(sec.options[key], true); err != nil {
+				return invalidf(sec.field+"."+key, "%s option %s %v", sec.name, key, err)
+			}
 		}
 	}
 	return nil
 }
 
+func checkOptionValue(v any, top bool) error {
+	switch val := v.(type) {
+	case nil, bool, int, int64, uint64, []string:
+		return nil
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return errors.New("is not a finite number")
+		}
+		// YAML reads integers beyond uint64 as floats, which cannot hold
+		// every digit.
+		if math.Abs(val) >= 1<<53 {
+			return errors.New("is too large to write exactly; quote it")
+		}
+		return nil
+	case string:
+		if strings.ContainsAny(val, "\r\n") {
+			return errors.New("must be a single line")
+		}
+		return nil
+	case []any:
+		if !top {
+			return errors.New("nests a list inside a list")
+		}
+		for _, item := range val {
+			if err := checkOptionValue(item, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		return errors.New("is a nested map; pjsip options must be scalars or lists of scalars")
+	default:
+		return fmt.Errorf("has unsupported type %T", v)
+	}
+}
+
+// matchesParent reports whether pattern, a contacts_dirs entry, matches path
+// or one of its parent directories.
+func matchesParent(pattern, path string) bool {
+	for p := filepath.Clean(path); p != "."; p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isFalseOption(v any) bool {
+	switch val := v.(type) {
+	case bool:
+		return !val
+	case string:
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "no", "false", "off", "0":
+			return true
+		}
+	}
+	return false
+}
+
 // TemplateNames returns configured template names.
 func (c Config) TemplateNames() []string {
 	out := make([]string, 0, len(c.EndpointTemplates))
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMissingConfig is returned when the base data directory has no
+// config.yaml.
+var ErrMissingConfig = errors.New("config.yaml not found")
+
+// ParseError reports a YAML file that could not be decoded.
+type ParseError struct {
+	// Path is the file that failed, as given to the loader.
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string { return fmt.Sprintf("parse %s: %v", e.Path, e.Err) }
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ValidationError reports a setting that parsed but is not allowed. Its
+// message is the underlying error's, which already names the setting.
+type ValidationError struct {
+	// Field is the dotted YAML key at fault, such as "server.contact_sort",
+	// or empty when the rule spans several settings.
+	Field string
+	Err   error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+func invalidf(field, format string, args ...any) error {
+	return &ValidationError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// Error kinds returned by ErrorKind.
+const (
+	KindMissingConfig = "missing_config"
+	KindParse         = "parse"
+	KindValidation    = "validation"
+)
+
+// ErrorKind classifies a build error as KindMissingConfig, KindParse or
+// KindValidation, or returns "" for anything else (I/O, rendering).
+func ErrorKind(err error) string {
+	var parseErr *ParseError
+	var validationErr *ValidationError
+	switch {
+	case errors.Is(err, ErrMissingConfig):
+		return KindMissingConfig
+	case errors.As(err, &parseErr):
+		return KindParse
+	case errors.As(err, &validationErr):
+		return KindValidation
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// templatesDir holds one endpoint template per YAML file, next to
+// config.yaml in every layer.
+const templatesDir = "templates"
+
+// templateFile is an endpoint template read from templates/, in the
+// generic map form used for overlay merging.
+type templateFile struct {
+	name string
+	path string
+	body map[string]any
+}
+
+// readTemplateDir loads templates/*.yaml and *.yml from dir in file name
+// order. A template's name defaults to its file name without the extension.
+// A missing directory and empty files are skipped; two files in the same
+// directory naming the same template are an error.
+func readTemplateDir(dir string) ([]templateFile, []FileMeta, error) {
+	root := filepath.Join(dir, templatesDir)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("read %s: %w", root, err)
+	}
+	var files []templateFile
+	var metas []FileMeta
+	seen := map[string]string{}
+	for _, ent := range entries {
+		ext := strings.ToLower(filepath.Ext(ent.Name()))
+		if ent.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(root, ent.Name())
+		body, err := readLayer(path, path, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		metas = append(metas, FileMeta{Path: path, ModTime: info.ModTime()})
+		if len(body) == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(ent.Name(), filepath.Ext(ent.Name()))
+		if raw, ok := body["name"]; ok {
+			s, ok := raw.(string)
+			if !ok || strings.TrimSpace(s) == "" {
+				return nil, nil, invalidf("endpoint_templates.name", "%s: endpoint template name must be a non-empty string", path)
+			}
+			name = s
+		}
+		body["name"] = name
+		if prev, ok := seen[name]; ok {
+			return nil, nil, invalidf("endpoint_templates.name", "endpoint template %q defined in both %s and %s", name, prev, path)
+		}
+		seen[name] = path
+		files = append(files, templateFile{name: name, path: path, body: body})
+	}
+	return files, metas, nil
+}
+
+// mergeTemplateFiles appends the templates/ files of every layer to the
+// merged config's endpoint_templates. A later layer's file deep-merges over
+// an earlier layer's file of the same name, like named lists in config.yaml,
+// but a name may not come from both config.yaml and a templates/ file.
+func mergeTemplateFiles(merged map[string]any, dirs []string) ([]FileMeta, error) {
+	var metas []FileMeta
+	var fromFiles []any
+	paths := map[string]string{}
+	for _, dir := range dirs {
+		files, layerMetas, err := readTemplateDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, layerMetas...)
+		layer := make([]any, 0, len(files))
+		for _, f := range files {
+			layer = append(layer, f.body)
+			paths[f.name] = f.path
+		}
+		fromFiles = mergeNamed(fromFiles, layer)
+	}
+	if len(fromFiles) == 0 {
+		return metas, nil
+	}
+
+	inline, _ := merged["endpoint_templates"].([]any)
+	for _, item := range inline {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if name, ok := m["name"].(string); ok {
+			if path, dup := paths[name]; dup {
+				return nil, invalidf("endpoint_templates.name", "endpoint template %q defined in both config.yaml and %s", name, path)
+			}
+		}
+	}
+	merged["endpoint_templates"] = append(inline, fromFiles...)
+	return metas, nil
+}
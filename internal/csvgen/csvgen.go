@@ -0,0 +1,67 @@
+// Package csvgen exports contacts as CSV for spreadsheet audits.
+package csvgen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// Header is the first row of every export.
+var Header = []string{"id", "first_name", "last_name", "extension", "phones", "group_id", "template", "source_path"}
+
+// Build returns one row per contact, hidden and phonebook-only ones
+// included, since the export is for checking the directory against other
+// records. Phones are joined with semicolons. Spreadsheets drop CSV quoting
+// when they open a file, so quotes alone would still turn extension 0100
+// into the number 100: the extension is written as the text formula
+// ="0100" instead. Any other field starting with a formula character gets a
+// leading apostrophe, so a contact name cannot run as a formula.
+func Build(contacts []model.Contact) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(Header)
+	for _, c := range contacts {
+		phones := make([]string, 0, len(c.Phones))
+		for _, p := range c.Phones {
+			phones = append(phones, p.Number)
+		}
+		group := ""
+		if c.GroupID != nil {
+			group = strconv.Itoa(*c.GroupID)
+		}
+		_ = w.Write([]string{
+			neutralize(c.ID),
+			neutralize(c.FirstName),
+			neutralize(c.LastName),
+			textFormula(c.Extension),
+			neutralize(strings.Join(phones, ";")),
+			group,
+			neutralize(c.Endpoint.Template),
+			neutralize(c.SourcePath),
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// textFormula wraps value as ="value", which spreadsheets show as the text
+// itself, leading zeros included.
+func textFormula(value string) string {
+	if value == "" {
+		return ""
+	}
+	return `="` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+// neutralize prefixes an apostrophe to a field a spreadsheet would
+// otherwise evaluate as a formula.
+func neutralize(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
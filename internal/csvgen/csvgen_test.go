@@ -0,0 +1,68 @@
+package csvgen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+func TestBuildKeepsExtensionsAsText(t *testing.T) {
+	group := 2
+	got := Build([]model.Contact{
+		{
+			ID:         "front-desk",
+			FirstName:  "Front",
+			LastName:   `Desk "Main"`,
+			Extension:  "0100",
+			GroupID:    &group,
+			Phones:     []model.Phone{{Number: "0100"}, {Number: "5551234567"}},
+			Endpoint:   model.ContactEndpoint{Template: "endpoint-template"},
+			SourcePath: "contacts/office.yaml",
+		},
+		{ID: "lobby", FirstName: "Lobby", Extension: "0101", Hidden: true},
+	})
+
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and two rows, got:\n%s", got)
+	}
+	if want := `front-desk,Front,"Desk ""Main""","=""0100""",0100;5551234567,2,endpoint-template,contacts/office.yaml`; lines[1] != want {
+		t.Fatalf("unexpected row\nGot:  %s\nWant: %s", lines[1], want)
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(got)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(Header, ",") {
+		t.Fatalf("unexpected header %q", rows[0])
+	}
+	if rows[1][2] != `Desk "Main"` || rows[2][3] != `="0101"` || rows[2][5] != "" {
+		t.Fatalf("unexpected rows %q", rows[1:])
+	}
+}
+
+func TestBuildNeutralizesFormulas(t *testing.T) {
+	got := Build([]model.Contact{{
+		ID:        "@evil",
+		FirstName: `=HYPERLINK("http://example.com","x")`,
+		LastName:  "-2+3",
+		Extension: "100",
+		Phones:    []model.Phone{{Number: "+15551234567"}},
+	}})
+	rows, err := csv.NewReader(bytes.NewReader(got)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	for _, i := range []int{0, 1, 2, 4} {
+		if !strings.HasPrefix(rows[1][i], "'") {
+			t.Fatalf("expected %s to be neutralized, got %q", Header[i], rows[1][i])
+		}
+	}
+	if rows[1][1] != `'=HYPERLINK("http://example.com","x")` || rows[1][3] != `="100"` {
+		t.Fatalf("unexpected row %q", rows[1])
+	}
+}
@@ -0,0 +1,263 @@
+// Package diff computes line diffs between generated artifacts and the
+// copies deployed elsewhere.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is what happened to one line going from old to new.
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Add    Op = "add"
+	Remove Op = "remove"
+)
+
+// Line is one line of an edit script. Old and New are 1-based line numbers
+// in each side; a line only present on one side has zero for the other.
+type Line struct {
+	Op   Op     `json:"op"`
+	Old  int    `json:"old,omitempty"`
+	New  int    `json:"new,omitempty"`
+	Text string `json:"text"`
+}
+
+// Split breaks text into lines without their terminators; a final newline
+// does not produce an empty last line.
+func Split(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Lines returns a shortest edit script turning old into new, using Myers'
+// O(ND) algorithm so large configs that differ in a few lines stay cheap.
+// It runs in the linear-space form: each step finds the middle snake of the
+// range left to compare and recurses on both halves, so memory stays
+// O(N+M) even when the two sides share nothing.
+func Lines(old, new []string) []Line {
+	d := &differ{old: old, new: new}
+	d.compare(0, len(old), 0, len(new))
+	return d.script
+}
+
+type differ struct {
+	old, new []string
+	script   []Line
+}
+
+func (d *differ) emit(op Op, x, y int) {
+	switch op {
+	case Equal:
+		d.script = append(d.script, Line{Op: Equal, Old: x + 1, New: y + 1, Text: d.old[x]})
+	case Remove:
+		d.script = append(d.script, Line{Op: Remove, Old: x + 1, Text: d.old[x]})
+	case Add:
+		d.script = append(d.script, Line{Op: Add, New: y + 1, Text: d.new[y]})
+	}
+}
+
+// compare appends the edit script turning old[a0:a1] into new[b0:b1].
+// Common leading and trailing lines are matched first, so either one side
+// is empty or the two differ at both ends and the middle snake splits the
+// range into two strictly smaller ones.
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.old[a0] == d.new[b0] {
+		d.emit(Equal, a0, b0)
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && d.old[a1-suffix-1] == d.new[b1-suffix-1] {
+		suffix++
+	}
+	a1 -= suffix
+	b1 -= suffix
+
+	x, y, ok := d.middle(a0, a1, b0, b1)
+	switch {
+	case ok:
+		d.compare(a0, x, b0, y)
+		d.compare(x, a1, y, b1)
+	default:
+		for x := a0; x < a1; x++ {
+			d.emit(Remove, x, 0)
+		}
+		for y := b0; y < b1; y++ {
+			d.emit(Add, 0, y)
+		}
+	}
+	for i := 0; i < suffix; i++ {
+		d.emit(Equal, a1+i, b1+i)
+	}
+}
+
+// middle finds where a forward search from (a0, b0) and a backward search
+// from (a1, b1) first overlap, and returns that point as the split for
+// compare. It reports false when either side is empty.
+func (d *differ) middle(a0, a1, b0, b1 int) (int, int, bool) {
+	n, m := a1-a0, b1-b0
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	// Room for diagonals -maxD-1 through maxD+1.
+	offset := maxD + 1
+	length := 2*maxD + 3
+	// fwd[k] is the furthest x on diagonal k = x-y reached from the start;
+	// bwd[k] the same counted back from the end. -1 marks unreached.
+	fwd := make([]int, length)
+	bwd := make([]int, length)
+	for i := range fwd {
+		fwd[i] = -1
+		bwd[i] = -1
+	}
+	fwd[offset+1] = 0
+	bwd[offset+1] = 0
+	delta := n - m
+	// With an odd delta the paths meet on a forward step, otherwise on a
+	// backward one.
+	front := delta%2 != 0
+	// Diagonals that ran off an edge of the range are skipped from then on.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for step := 0; step < maxD; step++ {
+		for k := -step + fStart; k <= step-fEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -step || (k != step && fwd[i-1] < fwd[i+1]) {
+				x = fwd[i+1]
+			} else {
+				x = fwd[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.old[a0+x] == d.new[b0+y] {
+				x++
+				y++
+			}
+			fwd[i] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case front:
+				if j := offset + delta - k; j >= 0 && j < length && bwd[j] != -1 {
+					if x >= n-bwd[j] {
+						return a0 + x, b0 + y, true
+					}
+				}
+			}
+		}
+		for k := -step + bStart; k <= step-bEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -step || (k != step && bwd[i-1] < bwd[i+1]) {
+				x = bwd[i+1]
+			} else {
+				x = bwd[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.old[a1-x-1] == d.new[b1-y-1] {
+				x++
+				y++
+			}
+			bwd[i] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !front:
+				if j := offset + delta - k; j >= 0 && j < length && fwd[j] != -1 {
+					fx := fwd[j]
+					fy := fx - (j - offset)
+					if fx >= n-x {
+						return a0 + fx, b0 + fy, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Changes drops the Equal lines from script, never returning nil.
+func Changes(script []Line) []Line {
+	out := []Line{}
+	for _, l := range script {
+		if l.Op != Equal {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// Unified renders script as a unified diff with context lines of context
+// around each change, headed by oldName and newName. It returns "" when the
+// two sides are identical.
+func Unified(oldName, newName string, script []Line, context int) string {
+	var changed []int
+	for i, l := range script {
+		if l.Op != Equal {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for i := 0; i < len(changed); {
+		// Changes no more than 2*context equal lines apart share a hunk.
+		j := i
+		for j+1 < len(changed) && changed[j+1]-changed[j] <= 2*context+1 {
+			j++
+		}
+		start := max(changed[i]-context, 0)
+		end := min(changed[j]+context+1, len(script))
+
+		oldStart, newStart := 1, 1
+		for _, l := range script[:start] {
+			if l.Op != Add {
+				oldStart++
+			}
+			if l.Op != Remove {
+				newStart++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, l := range script[start:end] {
+			if l.Op != Add {
+				oldCount++
+			}
+			if l.Op != Remove {
+				newCount++
+			}
+		}
+		// An empty side is numbered by the line before it.
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, l := range script[start:end] {
+			prefix := " "
+			switch l.Op {
+			case Add:
+				prefix = "+"
+			case Remove:
+				prefix = "-"
+			}
+			b.WriteString(prefix + l.Text + "\n")
+		}
+		i = j + 1
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLinesRebuildsBothSides(t *testing.T) {
+	tests := []struct {
+		name         string
+		old, new     string
+		adds, remove int
+	}{
+		{name: "both empty", old: "", new: ""},
+		{name: "equal", old: "a\nb\nc\n", new: "a\nb\nc\n"},
+		{name: "empty old", old: "", new: "a\nb\n", adds: 2},
+		{name: "empty new", old: "a\nb\n", new: "", remove: 2},
+		{name: "changed middle", old: "a\nb\nc\n", new: "a\nB\nc\n", adds: 1, remove: 1},
+		{name: "insert and delete", old: "[100]\ntype=endpoint\n[101]\n", new: "[100]\ntype=endpoint\nallow=opus\n", adds: 1, remove: 1},
+		{name: "disjoint", old: "x\ny\n", new: "p\nq\nr\n", adds: 3, remove: 2},
+		{name: "shared lines between changes", old: "a\nb\nc\nd\ne\n", new: "b\nX\nd\nY\n", adds: 2, remove: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, new := Split(tt.old), Split(tt.new)
+			script := Lines(old, new)
+			var gotOld, gotNew []string
+			adds, removes := 0, 0
+			for _, l := range script {
+				switch l.Op {
+				case Equal:
+					gotOld = append(gotOld, l.Text)
+					gotNew = append(gotNew, l.Text)
+				case Add:
+					adds++
+					gotNew = append(gotNew, l.Text)
+					if new[l.New-1] != l.Text {
+						t.Fatalf("add at new line %d has text %q", l.New, l.Text)
+					}
+				case Remove:
+					removes++
+					gotOld = append(gotOld, l.Text)
+					if old[l.Old-1] != l.Text {
+						t.Fatalf("remove at old line %d has text %q", l.Old, l.Text)
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotOld, old) || !reflect.DeepEqual(gotNew, new) {
+				t.Fatalf("script does not rebuild inputs: old=%q new=%q", gotOld, gotNew)
+			}
+			if adds != tt.adds || removes != tt.remove {
+				t.Fatalf("expected +%d -%d, got +%d -%d", tt.adds, tt.remove, adds, removes)
+			}
+		})
+	}
+}
+
+func TestLinesLargeInputsStayInLinearSpace(t *testing.T) {
+	big := make([]string, 20000)
+	other := make([]string, len(big))
+	for i := range big {
+		big[i] = fmt.Sprintf("line %d", i)
+		// Every third line differs, so D is in the thousands.
+		other[i] = big[i]
+		if i%3 == 0 {
+			other[i] = fmt.Sprintf("changed %d", i)
+		}
+	}
+	for _, tt := range []struct {
+		name     string
+		old, new []string
+		changes  int
+	}{
+		{name: "against empty", old: nil, new: big, changes: len(big)},
+		{name: "every third line", old: big, new: other, changes: 2 * ((len(big) + 2) / 3)},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		script := Lines(tt.old, tt.new)
+		runtime.ReadMemStats(&after)
+		if got := len(Changes(script)); got != tt.changes {
+			t.Fatalf("%s: expected %d changed lines, got %d", tt.name, tt.changes, got)
+		}
+		// The quadratic version needed gigabytes here.
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+			t.Fatalf("%s: allocated %d MiB", tt.name, alloc>>20)
+		}
+	}
+}
+
+func TestChangesNeverNil(t *testing.T) {
+	lines := strings.Split("a b c", " ")
+	if got := Changes(Lines(lines, lines)); got == nil || len(got) != 0 {
+		t.Fatalf("expected an empty, non-nil slice for identical input, got %#v", got)
+	}
+}
+
+func TestUnifiedGroupsNearbyChanges(t *testing.T) {
+	old := Split("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	new := Split("a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n")
+	got := Unified("old/x.conf", "new/x.conf", Lines(old, new), 1)
+	want := `--- old/x.conf
++++ new/x.conf
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -10,1 +10,2 @@
+ j
++k
+`
+	if got != want {
+		t.Fatalf("Unified() mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+
+	if got := Unified("a", "b", Lines(old, old), 3); got != "" {
+		t.Fatalf("expected no diff for identical input, got %q", got)
+	}
+	if got := Unified("a", "b", Lines(nil, Split("x\n")), 3); got != "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Fatalf("unexpected diff against an empty file: %q", got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,9 +19,9 @@ type Logger interface {
 	Debug(msg string, args ...any)
 }
 
-// Watcher watches a directory tree and debounces change notifications.
+// Watcher watches directory trees and debounces change notifications.
 type Watcher struct {
-	dir      string
+	dirs     []string
 	debounce time.Duration
 	watcher  *fsnotify.Watcher
 	logger   Logger
@@ -29,12 +31,19 @@ type Watcher struct {
 
 // New creates a new recursive watcher rooted at dir.
 func New(dir string, debounce time.Duration, logger Logger) (*Watcher, error) {
+	return NewRoots([]string{dir}, debounce, logger)
+}
+
+// NewRoots creates a recursive watcher over several roots whose changes share
+// one debounced notification. A root that is a file is watched through its
+// parent directory, so files replaced by rename are still seen.
+func NewRoots(dirs []string, debounce time.Duration, logger Logger) (*Watcher, error) {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 	return &Watcher{
-		dir:      dir,
+		dirs:     dirs,
 		debounce: debounce,
 		watcher:  w,
 		logger:   logger,
@@ -42,21 +51,32 @@ func New(dir string, debounce time.Duration, logger Logger) (*Watcher, error) {
 	}, nil
 }
 
-// Start begins processing file events until ctx is cancelled.
-func (w *Watcher) Start(ctx context.Context, onChange func()) error {
-	if err := w.addRecursive(w.dir); err != nil {
-		return err
+// Start begins processing file events until ctx is cancelled. onChange gets
+// the sorted, de-duplicated paths whose events the debounce window folded
+// together.
+func (w *Watcher) Start(ctx context.Context, onChange func(changed []string)) error {
+	for _, dir := range w.dirs {
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			if err := w.addWatch(filepath.Dir(dir)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.addRecursive(dir); err != nil {
+			return err
+		}
 	}
 
 	go w.run(ctx, onChange)
 	return nil
 }
 
-func (w *Watcher) run(ctx context.Context, onChange func()) {
+func (w *Watcher) run(ctx context.Context, onChange func(changed []string)) {
 	defer w.watcher.Close()
 
 	var timer *time.Timer
 	var timerC <-chan time.Time
+	pending := map[string]struct{}{}
 
 	trigger := func() {
 		if timer != nil {
@@ -78,6 +98,7 @@ func (w *Watcher) run(ctx context.Context, onChange func()) {
 				return
 			}
 			w.handleEvent(event)
+			pending[event.Name] = struct{}{}
 			trigger()
 		case err, ok := <-w.watcher.Errors:
 			if !ok {
@@ -89,12 +110,29 @@ func (w *Watcher) run(ctx context.Context, onChange func()) {
 		case <-timerC:
 			timer = nil
 			timerC = nil
-			onChange()
+			// select picks randomly among ready cases; never start a
+			// reload once shutdown has begun.
+			if ctx.Err() != nil {
+				return
+			}
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			sort.Strings(changed)
+			pending = map[string]struct{}{}
+			onChange(changed)
 		}
 	}
 }
 
 func (w *Watcher) handleEvent(event fsnotify.Event) {
+	// A directory that was deleted or moved away takes its subdirectories'
+	// watches with it. Renames on some filesystems arrive without a matching
+	// Remove, so handle both.
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		w.removeWatches(event.Name)
+	}
 	if event.Op&fsnotify.Create == fsnotify.Create {
 		info, err := os.Stat(event.Name)
 		if err == nil && info.IsDir() {
@@ -131,6 +169,24 @@ func (w *Watcher) addWatch(path string) error {
 	return nil
 }
 
+// removeWatches forgets path and every watched directory below it, so
+// create/delete churn does not grow watched over a long run. The kernel has
+// usually dropped a deleted directory's watch already; a renamed one is
+// still live and would otherwise keep reporting from its new location.
+func (w *Watcher) removeWatches(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for dir := range w.watched {
+		if dir != path && !strings.HasPrefix(dir, prefix) {
+			continue
+		}
+		_ = w.watcher.Remove(dir)
+		delete(w.watched, dir)
+		w.logger.Debug("stopped watching directory", "path", dir)
+	}
+}
+
 // Close stops the watcher.
 func (w *Watcher) Close() error {
 	return w.watcher.Close()
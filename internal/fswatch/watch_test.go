@@ -0,0 +1,70 @@
+package fswatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+// isWatched reports whether path currently has a watch.
+func (w *Watcher) isWatched(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.watched[path]
+	return ok
+}
+
+// eventually polls cond until it holds or a second has passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatcherDropsWatchesForRemovedDirectories(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(root, 10*time.Millisecond, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.Start(ctx, func([]string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	nested := filepath.Join(root, "team", "sub")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the nested directory to be watched", func() bool { return w.isWatched(nested) })
+
+	if err := os.RemoveAll(filepath.Join(root, "team")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the removed directories to be forgotten", func() bool {
+		return !w.isWatched(nested) && !w.isWatched(filepath.Join(root, "team"))
+	})
+
+	moved := filepath.Join(root, "moved")
+	if err := os.Mkdir(moved, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the new directory to be watched", func() bool { return w.isWatched(moved) })
+	if err := os.Rename(moved, filepath.Join(t.TempDir(), "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the renamed directory to be forgotten", func() bool { return !w.isWatched(moved) })
+	if !w.isWatched(root) {
+		t.Fatal("expected the root to stay watched")
+	}
+}
@@ -0,0 +1,79 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requireAuth guards h with AuthToken when one is set. Clients present it as
+// a bearer token or, for browsers and WebSockets that cannot set headers, as
+// ?token=. The admin token is accepted too.
+func (s *Server) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authToken != "" && !s.authAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requirePhonebookAuth is requireAuth for the phonebook routes, which also
+// accept BasicAuthUser/BasicAuthPass for phones that cannot send a bearer
+// token. With both configured either one is enough.
+func (s *Server) requirePhonebookAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		basic := s.basicUser != "" || s.basicPass != ""
+		switch {
+		case s.authToken == "" && !basic,
+			s.authToken != "" && s.authAuthorized(r),
+			basic && s.basicAuthorized(r):
+			h(w, r)
+			return
+		}
+		if basic {
+			w.Header().Add("WWW-Authenticate", `Basic realm="phonebook"`)
+		}
+		if s.authToken != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="phonebook"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func (s *Server) basicAuthorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	// Compare both halves so timing does not reveal which one was wrong.
+	userOK := tokenEqual(user, s.basicUser)
+	passOK := tokenEqual(pass, s.basicPass)
+	return ok && userOK && passOK
+}
+
+func (s *Server) authAuthorized(r *http.Request) bool {
+	if s.adminToken != "" && s.adminAuthorized(r) {
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && tokenEqual(strings.TrimSpace(token), s.authToken) {
+		return true
+	}
+	return tokenEqual(r.URL.Query().Get("token"), s.authToken)
+}
+
+func tokenEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// withToken carries a page's own ?token= over to the API and WebSocket paths
+// its script calls, so a dashboard opened with the token keeps working.
+func withToken(r *http.Request, paths ...*string) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return
+	}
+	for _, p := range paths {
+		*p += "?token=" + url.QueryEscape(token)
+	}
+}
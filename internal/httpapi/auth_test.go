@@ -0,0 +1,138 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/calls"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestAuthTokenGuardsReadRoutes(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{
+		Addr:        ":0",
+		BasePath:    "/xml/",
+		AuthToken:   "phones",
+		AdminToken:  "admin",
+		AllowDebug:  true,
+		CallService: calls.NewService(calls.Options{}, logger),
+	}, logger)
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	get := func(path, auth string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for _, path := range []string{"/xml/phonebook.xml", "/xml/yealink.xml", "/xml/debug", "/calls", "/api/calls/active"} {
+		if code := get(path, ""); code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401 without a token, got %d", path, code)
+		}
+		if code := get(path, "Bearer wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401 for a wrong token, got %d", path, code)
+		}
+		if code := get(path, "Bearer phones"); code != http.StatusOK {
+			t.Fatalf("%s: expected 200 with the token, got %d", path, code)
+		}
+		if code := get(path, "Bearer admin"); code != http.StatusOK {
+			t.Fatalf("%s: expected 200 with the admin token, got %d", path, code)
+		}
+	}
+	if code := get("/xml/healthz", ""); code != http.StatusOK {
+		t.Fatalf("expected healthz to stay open, got %d", code)
+	}
+	if code := get("/events/ws?token=wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected the events WebSocket gated, got %d", code)
+	}
+	if code := get("/calls/ws", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected the calls WebSocket gated, got %d", code)
+	}
+}
+
+func TestCallsPageForwardsQueryToken(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AuthToken: "a b", CallService: calls.NewService(calls.Options{}, logger)}, logger)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/calls?token=a+b", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected ?token= to open the dashboard, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	for _, path := range []string{`"/calls/ws?token=a+b"`, `"/api/calls/active?token=a+b"`, `"/api/calls/contacts?token=a+b"`} {
+		if !strings.Contains(body, path) {
+			t.Fatalf("expected the page to call %s, got:\n%s", path, body)
+		}
+	}
+}
+
+func TestBasicAuthGuardsPhonebookRoutes(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{
+		Addr:          ":0",
+		BasePath:      "/",
+		AuthToken:     "phones",
+		BasicAuthUser: "gxp",
+		BasicAuthPass: "pa55",
+		AllowDebug:    true,
+	}, logger)
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	get := func(path string, set func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if set != nil {
+			set(req)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	basic := func(user, pass string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+	}
+	for _, path := range []string{"/phonebook.xml", "/yealink.xml"} {
+		if rr := get(path, basic("gxp", "pa55")); rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 with basic credentials, got %d", path, rr.Code)
+		}
+		if rr := get(path, func(r *http.Request) { r.Header.Set("Authorization", "Bearer phones") }); rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 with the bearer token, got %d", path, rr.Code)
+		}
+		rr := get(path, basic("gxp", "wrong"))
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401 for a wrong password, got %d", path, rr.Code)
+		}
+		if got := rr.Header().Values("WWW-Authenticate"); len(got) != 2 || got[0] != `Basic realm="phonebook"` {
+			t.Fatalf("%s: expected Basic and Bearer challenges, got %q", path, got)
+		}
+	}
+	if rr := get("/debug", basic("gxp", "pa55")); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected basic credentials to stay limited to the phonebooks, got %d", rr.Code)
+	}
+}
+
+func TestBasicAuthAloneLeavesOtherRoutesOpen(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", BasicAuthUser: "gxp", BasicAuthPass: "pa55"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") != `Basic realm="phonebook"` {
+		t.Fatalf("expected a Basic challenge, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/contacts", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected /api/contacts to stay open without an auth token, got %d", rr.Code)
+	}
+}
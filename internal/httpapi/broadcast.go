@@ -48,9 +48,10 @@ type broadcastSendResponse struct {
 	Failed      []broadcastSendFailure `json:"failed"`
 }
 
-func (s *Server) handleBroadcastPage(w http.ResponseWriter, _ *http.Request) {
+func (s *Server) handleBroadcastPage(w http.ResponseWriter, r *http.Request) {
 	contactsPath := "/api/broadcast/contacts"
 	sendPath := "/api/broadcast/send"
+	withToken(r, &contactsPath, &sendPath)
 	page := fmt.Sprintf(broadcastHTML, contactsPath, sendPath)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write([]byte(page))
@@ -1,11 +1,14 @@
 package httpapi
 
 import (
+	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sort"
@@ -26,6 +29,7 @@ type dashboardCall struct {
 	Start       time.Time `json:"start"`
 	End         time.Time `json:"end,omitempty"`
 	DurationSec int64     `json:"duration_sec"`
+	TalkSec     int64     `json:"talk_sec,omitempty"`
 }
 
 type dashboardPayload struct {
@@ -36,15 +40,49 @@ type dashboardPayload struct {
 }
 
 type dashboardContact struct {
-	ID      string    `json:"id"`
-	Name    string    `json:"name,omitempty"`
-	State   string    `json:"state"`
-	Detail  string    `json:"detail,omitempty"`
-	Updated time.Time `json:"updated,omitempty"`
-	Known   bool      `json:"known"`
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	State    string    `json:"state"`
+	Detail   string    `json:"detail,omitempty"`
+	Updated  time.Time `json:"updated,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	Known    bool      `json:"known"`
 }
 
-func (s *Server) handleCallsPage(w http.ResponseWriter, _ *http.Request) {
+type callsActiveResponse struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Active      []dashboardCall `json:"active"`
+}
+
+type callsHistoryResponse struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	History     []dashboardCall `json:"history"`
+	// LatestEnd is the newest End in History, or the request's since when
+	// nothing newer ended; pass it back as ?since= to fetch only later
+	// calls.
+	LatestEnd *time.Time `json:"latest_end,omitempty"`
+}
+
+type callsContactsResponse struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Contacts    []dashboardContact `json:"contacts"`
+}
+
+// callsConfigResponse describes how much history the call service keeps,
+// for the dashboard's History title.
+type callsConfigResponse struct {
+	HistoryMax          int   `json:"history_max"`
+	HistoryRetentionSec int64 `json:"history_retention_sec"`
+}
+
+// callsEventResponse reports the dashboard after an ingested event.
+type callsEventResponse struct {
+	Active   int `json:"active"`
+	History  int `json:"history"`
+	Contacts int `json:"contacts"`
+}
+
+func (s *Server) handleCallsPage(w http.ResponseWriter, r *http.Request) {
 	if s.calls == nil {
 		http.Error(w, "calls dashboard disabled", http.StatusServiceUnavailable)
 		return
@@ -53,8 +91,10 @@ func (s *Server) handleCallsPage(w http.ResponseWriter, _ *http.Request) {
 	activePath := "/api/calls/active"
 	historyPath := "/api/calls/history"
 	contactsPath := "/api/calls/contacts"
+	configPath := "/api/calls/config"
+	withToken(r, &wsPath, &activePath, &historyPath, &contactsPath, &configPath)
 
-	page := fmt.Sprintf(callsDashboardHTML, wsPath, activePath, historyPath, contactsPath)
+	page := fmt.Sprintf(callsDashboardHTML, wsPath, activePath, historyPath, contactsPath, configPath)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write([]byte(page))
 }
@@ -66,22 +106,90 @@ func (s *Server) handleCallsActive(w http.ResponseWriter, _ *http.Request) {
 	}
 	payload := s.buildCallsPayload()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"generated_at": payload.GeneratedAt,
-		"active":       payload.Active,
+	_ = json.NewEncoder(w).Encode(callsActiveResponse{
+		GeneratedAt: payload.GeneratedAt,
+		Active:      payload.Active,
 	})
 }
 
-func (s *Server) handleCallsHistory(w http.ResponseWriter, _ *http.Request) {
+// handleCallsHistory lists completed calls, newest first. ?since=<RFC3339>
+// keeps only calls that ended after it.
+func (s *Server) handleCallsHistory(w http.ResponseWriter, r *http.Request) {
+	if s.calls == nil {
+		http.Error(w, "calls dashboard disabled", http.StatusServiceUnavailable)
+		return
+	}
+	var since *time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		since = &t
+	}
+	payload := s.buildCallsPayload()
+	resp := callsHistoryResponse{GeneratedAt: payload.GeneratedAt, History: payload.History, LatestEnd: since}
+	if since != nil {
+		resp.History = make([]dashboardCall, 0, len(payload.History))
+		for _, call := range payload.History {
+			if call.End.After(*since) {
+				resp.History = append(resp.History, call)
+			}
+		}
+	}
+	for _, call := range resp.History {
+		if resp.LatestEnd == nil || call.End.After(*resp.LatestEnd) {
+			end := call.End
+			resp.LatestEnd = &end
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleCallsEvent feeds one AMI event, posted as a JSON object of AMI
+// keys and values, to the call service, for bridges that already hold an
+// AMI session and for driving the dashboard in tests.
+func (s *Server) handleCallsEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	if s.calls == nil {
 		http.Error(w, "calls dashboard disabled", http.StatusServiceUnavailable)
 		return
 	}
+	var event map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxBodyBytes())).Decode(&event); err != nil {
+		http.Error(w, "invalid JSON event: expected an object of string values", http.StatusBadRequest)
+		return
+	}
+	if len(event) == 0 {
+		http.Error(w, "event is empty", http.StatusBadRequest)
+		return
+	}
+	s.calls.HandleAMIEvent(event)
 	payload := s.buildCallsPayload()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"generated_at": payload.GeneratedAt,
-		"history":      payload.History,
+	_ = json.NewEncoder(w).Encode(callsEventResponse{
+		Active:   len(payload.Active),
+		History:  len(payload.History),
+		Contacts: len(payload.Contacts),
+	})
+}
+
+func (s *Server) handleCallsConfig(w http.ResponseWriter, _ *http.Request) {
+	if s.calls == nil {
+		http.Error(w, "calls dashboard disabled", http.StatusServiceUnavailable)
+		return
+	}
+	maxHistory, retention := s.calls.HistoryLimits()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(callsConfigResponse{
+		HistoryMax:          maxHistory,
+		HistoryRetentionSec: int64(retention / time.Second),
 	})
 }
 
@@ -92,9 +200,9 @@ func (s *Server) handleCallsContacts(w http.ResponseWriter, _ *http.Request) {
 	}
 	payload := s.buildCallsPayload()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"generated_at": payload.GeneratedAt,
-		"contacts":     payload.Contacts,
+	_ = json.NewEncoder(w).Encode(callsContactsResponse{
+		GeneratedAt: payload.GeneratedAt,
+		Contacts:    payload.Contacts,
 	})
 }
 
@@ -103,31 +211,49 @@ func (s *Server) handleCallsWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "calls dashboard disabled", http.StatusServiceUnavailable)
 		return
 	}
-	conn, err := upgradeWebSocket(w, r)
+	conn, err := upgradeWebSocket(w, r, s.wsProtos)
 	if err != nil {
 		return
 	}
 	defer conn.Close()
 
+	interval, idle := s.wsTimings()
+	in := readWebSocket(conn, idle)
+
 	sub, cancel := s.calls.Subscribe()
 	defer cancel()
 
-	if err := s.writeCallsPayloadFrame(conn); err != nil {
+	if err := s.writeCallsPayloadFrame(conn, interval); err != nil {
 		return
 	}
 
-	pingTicker := time.NewTicker(25 * time.Second)
+	pingTicker := time.NewTicker(interval)
 	defer pingTicker.Stop()
 
 	for {
 		select {
 		case <-r.Context().Done():
 			return
+		case <-s.stopping:
+			closeWebSocket(conn, interval)
+			return
+		case <-in.done:
+			if in.closeStatus != nil {
+				_ = conn.SetWriteDeadline(time.Now().Add(interval))
+				_ = writeWebSocketFrame(conn, 0x8, in.closeStatus)
+			}
+			return
+		case payload := <-in.pings:
+			_ = conn.SetWriteDeadline(time.Now().Add(interval))
+			if err := writeWebSocketFrame(conn, 0xa, payload); err != nil {
+				return
+			}
 		case <-sub:
-			if err := s.writeCallsPayloadFrame(conn); err != nil {
+			if err := s.writeCallsPayloadFrame(conn, interval); err != nil {
 				return
 			}
 		case <-pingTicker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(interval))
 			if err := writeWebSocketFrame(conn, 0x9, nil); err != nil {
 				return
 			}
@@ -135,19 +261,134 @@ func (s *Server) handleCallsWS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) writeCallsPayloadFrame(conn net.Conn) error {
+// wsTimings returns the configured ping interval and idle timeout, applying
+// defaults for unset values.
+func (s *Server) wsTimings() (time.Duration, time.Duration) {
+	interval, idle := s.wsPing, s.wsIdle
+	if interval <= 0 {
+		interval = defaultWSPingInterval
+	}
+	if idle <= 0 {
+		idle = defaultWSIdleTimeout
+	}
+	return interval, idle
+}
+
+// maxWSClientFrame bounds one client frame; the feeds are one-way, so
+// clients only send control frames and the odd keepalive.
+const maxWSClientFrame = 4 << 10
+
+// wsInbound is what a client sent on a feed socket, as read by
+// readWebSocket. The handler owns every write, so pongs and the Close reply
+// are left to it.
+type wsInbound struct {
+	// pings carries ping payloads awaiting a pong.
+	pings chan []byte
+	// done is closed once the client is gone: it sent Close, broke the
+	// protocol, went idle, or the connection failed.
+	done chan struct{}
+	// closeStatus is the status code of the client's Close frame, or nil
+	// if it left without one. Set before done is closed.
+	closeStatus []byte
+}
+
+// readWebSocket reads client frames until the client goes away, extending
+// the read deadline by idle for each frame.
+func readWebSocket(conn net.Conn, idle time.Duration) *wsInbound {
+	in := &wsInbound{pings: make(chan []byte, 1), done: make(chan struct{})}
+	go func() {
+		defer close(in.done)
+		r := bufio.NewReader(conn)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(idle))
+			opcode, payload, err := readWebSocketFrame(r)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case 0x8:
+				in.closeStatus = []byte{0x03, 0xe8}
+				if len(payload) >= 2 {
+					in.closeStatus = payload[:2]
+				}
+				return
+			case 0x9:
+				select {
+				case in.pings <- payload:
+				default:
+					// A pong is already due; one answers both.
+				}
+			}
+		}
+	}()
+	return in
+}
+
+// readWebSocketFrame reads one client frame and returns its opcode and
+// unmasked payload. RFC 6455 requires clients to mask every frame, and
+// control frames to carry at most 125 bytes.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket client frame is not masked")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= 0x8 && length > 125 {
+		return 0, nil, errors.New("websocket control frame too long")
+	}
+	if length > maxWSClientFrame {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes exceeds %d", length, maxWSClientFrame)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func (s *Server) writeCallsPayloadFrame(conn net.Conn, timeout time.Duration) error {
 	payload := s.buildCallsPayload()
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
 	return writeWebSocketFrame(conn, 0x1, data)
 }
 
 func (s *Server) buildCallsPayload() dashboardPayload {
 	callSnapshot := s.calls.Snapshot()
 	phonebookSnapshot, _ := s.currentSnapshot()
-	nameLookup := buildNameLookup(phonebookSnapshot.Contacts)
+	s.mu.RLock()
+	external := s.external
+	s.mu.RUnlock()
+	nameLookup := buildNameLookup(phonebookSnapshot.Contacts, external)
+	known := knownParties(phonebookSnapshot.Contacts)
 
 	active := make([]dashboardCall, 0, len(callSnapshot.Active))
 	activeRawIDs := make(map[string]struct{}, len(callSnapshot.Active)*2)
@@ -160,12 +401,14 @@ func (s *Server) buildCallsPayload() dashboardPayload {
 		if toParty != "" {
 			activeRawIDs[toParty] = struct{}{}
 		}
+		from, fromName := s.presentParty(nameLookup, known, fromParty)
+		to, toName := s.presentParty(nameLookup, known, toParty)
 		active = append(active, dashboardCall{
 			ID:          call.ID,
-			From:        fromParty,
-			FromName:    resolveName(nameLookup, fromParty),
-			To:          toParty,
-			ToName:      resolveName(nameLookup, toParty),
+			From:        from,
+			FromName:    fromName,
+			To:          to,
+			ToName:      toName,
 			State:       call.State,
 			Start:       call.Start,
 			DurationSec: int64(time.Since(call.Start).Seconds()),
@@ -174,19 +417,20 @@ func (s *Server) buildCallsPayload() dashboardPayload {
 
 	history := make([]dashboardCall, 0, len(callSnapshot.History))
 	for _, call := range callSnapshot.History {
-		fromParty := canonicalParty(call.From)
-		toParty := canonicalParty(call.To)
+		from, fromName := s.presentParty(nameLookup, known, canonicalParty(call.From))
+		to, toName := s.presentParty(nameLookup, known, canonicalParty(call.To))
 		history = append(history, dashboardCall{
 			ID:          call.ID,
-			From:        fromParty,
-			FromName:    resolveName(nameLookup, fromParty),
-			To:          toParty,
-			ToName:      resolveName(nameLookup, toParty),
+			From:        from,
+			FromName:    fromName,
+			To:          to,
+			ToName:      toName,
 			State:       call.State,
 			EndReason:   call.EndReason,
 			Start:       call.Start,
 			End:         call.End,
 			DurationSec: call.DurationSec,
+			TalkSec:     call.TalkSec,
 		})
 	}
 
@@ -257,23 +501,24 @@ func (s *Server) buildCallsPayload() dashboardPayload {
 		}
 		_, activeNow := activeContactIDs[targetID]
 		contactByID[targetID] = dashboardContact{
-			ID:      targetID,
-			Name:    name,
-			State:   dashboardContactState(p.State, activeNow),
-			Detail:  p.Detail,
-			Updated: p.Updated,
-			Known:   current.Known,
+			ID:       targetID,
+			Name:     name,
+			State:    dashboardContactState(p.State, activeNow),
+			Detail:   p.Detail,
+			Updated:  p.Updated,
+			LastSeen: p.LastSeen,
+			Known:    current.Known,
 		}
 	}
 	for id := range activeContactIDs {
 		current := contactByID[id]
 		if current.ID == "" {
-			name := resolveName(nameLookup, id)
+			shown, name := s.presentParty(nameLookup, known, id)
 			if name == "" {
-				name = id
+				name = shown
 			}
 			current = dashboardContact{
-				ID:    id,
+				ID:    shown,
 				Name:  name,
 				Known: false,
 			}
@@ -311,6 +556,37 @@ func (s *Server) buildCallsPayload() dashboardPayload {
 	}
 }
 
+// presentParty returns how a call party is shown on the dashboard: its
+// number and resolved name, or for a party that matches no contact, the
+// number masked and the unknown-caller label per s.privacy.
+func (s *Server) presentParty(lookup map[string]string, known map[string]struct{}, party string) (string, string) {
+	name := resolveName(lookup, party)
+	if party == "" || name != "" {
+		return party, name
+	}
+	if _, ok := known[party]; ok {
+		return party, ""
+	}
+	return s.privacy.mask(party), s.privacy.UnknownLabel
+}
+
+// knownParties collects the canonical extension and phone numbers of every
+// contact, named or not; parties outside it count as external.
+func knownParties(contacts []model.Contact) map[string]struct{} {
+	known := make(map[string]struct{}, len(contacts)*2)
+	for _, contact := range contacts {
+		if id := canonicalParty(contact.Extension); id != "" {
+			known[id] = struct{}{}
+		}
+		for _, phone := range contact.Phones {
+			if id := canonicalParty(phone.Number); id != "" {
+				known[id] = struct{}{}
+			}
+		}
+	}
+	return known
+}
+
 func dashboardContactState(state string, active bool) string {
 	if active {
 		return "in-call"
@@ -338,22 +614,42 @@ func contactStateWeight(state string) int {
 	}
 }
 
-func buildNameLookup(contacts []model.Contact) map[string]string {
-	lookup := make(map[string]string, len(contacts)*2)
-	for _, contact := range contacts {
-		name := strings.TrimSpace(contact.FirstName + " " + contact.LastName)
-		if name == "" {
+// buildNameLookup maps contact numbers to contact names, then adds the
+// external numbers no contact claims.
+func buildNameLookup(contacts []model.Contact, external map[string]string) map[string]string {
+	index := buildContactLookup(contacts)
+	lookup := make(map[string]string, len(index)+len(external)*2)
+	for key, i := range index {
+		lookup[key] = contactName(contacts[i])
+	}
+	for number, name := range external {
+		addLookupEntry(lookup, sipUser(number), name)
+	}
+	return lookup
+}
+
+// buildContactLookup maps each named contact's extension and phone numbers,
+// raw and normalized, to the contact's index in contacts. The first contact
+// to claim a key keeps it.
+func buildContactLookup(contacts []model.Contact) map[string]int {
+	lookup := make(map[string]int, len(contacts)*2)
+	for i, contact := range contacts {
+		if contactName(contact) == "" {
 			continue
 		}
-		addLookupEntry(lookup, contact.Extension, name)
+		addLookupEntry(lookup, contact.Extension, i)
 		for _, phone := range contact.Phones {
-			addLookupEntry(lookup, phone.Number, name)
+			addLookupEntry(lookup, phone.Number, i)
 		}
 	}
 	return lookup
 }
 
-func addLookupEntry(lookup map[string]string, key, value string) {
+func contactName(contact model.Contact) string {
+	return strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+}
+
+func addLookupEntry[V any](lookup map[string]V, key string, value V) {
 	key = strings.TrimSpace(key)
 	if key == "" {
 		return
@@ -370,16 +666,23 @@ func addLookupEntry(lookup map[string]string, key, value string) {
 }
 
 func resolveName(lookup map[string]string, raw string) string {
+	name, _ := lookupParty(lookup, raw)
+	return name
+}
+
+// lookupParty finds raw in lookup as given, then normalized.
+func lookupParty[V any](lookup map[string]V, raw string) (V, bool) {
+	var zero V
 	if raw == "" {
-		return ""
+		return zero, false
 	}
-	if name, ok := lookup[raw]; ok {
-		return name
+	if v, ok := lookup[raw]; ok {
+		return v, true
 	}
-	if name, ok := lookup[normalizeNumber(raw)]; ok {
-		return name
+	if v, ok := lookup[normalizeNumber(raw)]; ok {
+		return v, true
 	}
-	return ""
+	return zero, false
 }
 
 func normalizeNumber(raw string) string {
@@ -393,6 +696,7 @@ func normalizeNumber(raw string) string {
 }
 
 func canonicalParty(raw string) string {
+	raw = sipUser(strings.TrimSpace(raw))
 	clean := normalizeNumber(raw)
 	if clean != "" {
 		return clean
@@ -400,7 +704,38 @@ func canonicalParty(raw string) string {
 	return strings.TrimSpace(raw)
 }
 
-func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+// sipUser returns the user part of a SIP or SIPS URI, bare or in the
+// `"Name" <sip:user@host>` form, so the host's digits are not read as part
+// of the number. Anything else is returned unchanged.
+func sipUser(raw string) string {
+	lower := strings.ToLower(raw)
+	start := strings.Index(lower, "sips:")
+	if start >= 0 {
+		start += len("sips:")
+	} else if start = strings.Index(lower, "sip:"); start >= 0 {
+		start += len("sip:")
+	} else {
+		return raw
+	}
+	user := raw[start:]
+	if end := strings.IndexAny(user, "@;>?"); end >= 0 {
+		user = user[:end]
+	}
+	if user == "" {
+		return raw
+	}
+	return user
+}
+
+// upgradeWebSocket performs the RFC 6455 server handshake. The subprotocol
+// is chosen from protocols in the client's preference order; extensions are
+// never negotiated, so Sec-WebSocket-Extensions is deliberately not echoed.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, protocols []string) (net.Conn, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("websocket upgrade requires GET, got %s", r.Method)
+	}
 	if !headerHasToken(r.Header.Get("Connection"), "upgrade") || !strings.EqualFold(strings.TrimSpace(r.Header.Get("Upgrade")), "websocket") {
 		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
 		return nil, fmt.Errorf("invalid websocket upgrade request")
@@ -430,6 +765,9 @@ func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error)
 	_, _ = rw.WriteString("Upgrade: websocket\r\n")
 	_, _ = rw.WriteString("Connection: Upgrade\r\n")
 	_, _ = rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
+	if proto := negotiateSubprotocol(r.Header.Values("Sec-WebSocket-Protocol"), protocols); proto != "" {
+		_, _ = rw.WriteString("Sec-WebSocket-Protocol: " + proto + "\r\n")
+	}
 	_, _ = rw.WriteString("\r\n")
 	if err := rw.Flush(); err != nil {
 		_ = conn.Close()
@@ -438,6 +776,25 @@ func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error)
 	return conn, nil
 }
 
+// negotiateSubprotocol returns the first offered subprotocol the server
+// supports, or "" when there is no overlap.
+func negotiateSubprotocol(offered []string, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	for _, value := range offered {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			for _, proto := range supported {
+				if part != "" && part == proto {
+					return part
+				}
+			}
+		}
+	}
+	return ""
+}
+
 func headerHasToken(value, token string) bool {
 	for _, part := range strings.Split(value, ",") {
 		if strings.EqualFold(strings.TrimSpace(part), token) {
@@ -452,6 +809,13 @@ func websocketAcceptKey(key string) string {
 	return base64.StdEncoding.EncodeToString(sum[:])
 }
 
+// closeWebSocket sends a Close frame with status 1001 (going away), waiting
+// at most timeout for the client to take it.
+func closeWebSocket(conn net.Conn, timeout time.Duration) {
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	_ = writeWebSocketFrame(conn, 0x8, append([]byte{0x03, 0xe9}, "server shutting down"...))
+}
+
 func writeWebSocketFrame(conn net.Conn, opcode byte, payload []byte) error {
 	header := []byte{0x80 | (opcode & 0x0f)}
 	length := len(payload)
@@ -620,7 +984,7 @@ const callsDashboardHTML = `<!DOCTYPE html>
         <ul id="active"></ul>
       </section>
       <section class="panel history">
-        <h2>History (last 100 / 7d)</h2>
+        <h2 id="history-title">History</h2>
         <ul id="history"></ul>
       </section>
       <section class="panel">
@@ -634,6 +998,7 @@ const callsDashboardHTML = `<!DOCTYPE html>
     const activeApi = %q;
     const historyApi = %q;
     const contactsApi = %q;
+    const configApi = %q;
     const wsScheme = location.protocol === "https:" ? "wss://" : "ws://";
     const wsURL = wsScheme + location.host + wsPath;
     const activeEl = document.getElementById("active");
@@ -652,6 +1017,32 @@ const callsDashboardHTML = `<!DOCTYPE html>
       return new Date(ts).toLocaleString();
     }
 
+    function fmtAgo(ts) {
+      if (!ts) return "";
+      const secs = Math.max(0, Math.floor((Date.now() - new Date(ts).getTime()) / 1000));
+      if (secs < 60) return secs + "s ago";
+      if (secs < 3600) return Math.floor(secs / 60) + "m ago";
+      if (secs < 86400) return Math.floor(secs / 3600) + "h ago";
+      return fmtWhen(ts);
+    }
+
+    function fmtSpan(secs) {
+      if (secs > 0 && secs %% 86400 === 0) return (secs / 86400) + "d";
+      if (secs > 0 && secs %% 3600 === 0) return (secs / 3600) + "h";
+      if (secs > 0 && secs %% 60 === 0) return (secs / 60) + "m";
+      return secs + "s";
+    }
+
+    async function loadConfig() {
+      try {
+        const config = await (await fetch(configApi)).json();
+        document.getElementById("history-title").textContent =
+          "History (last " + config.history_max + " / " + fmtSpan(config.history_retention_sec) + ")";
+      } catch (_) {
+        // Keep the plain title.
+      }
+    }
+
     function statusForCall(call, isHistory) {
       const state = String(call.state || "").toLowerCase();
       const reason = String(call.end_reason || "").toLowerCase();
@@ -673,6 +1064,9 @@ const callsDashboardHTML = `<!DOCTYPE html>
       if (source.includes("no answer") || source.includes("busy") || source.includes("cancel") || source.includes("timeout")) {
         return { label: "No Answer", className: "status-no-answer" };
       }
+      if (state === "short") {
+        return { label: "Short", className: "status-no-answer" };
+      }
       if (source.includes("answered") || source.includes("normal clearing") || source.includes("completed")) {
         return { label: "Answered", className: "status-answered" };
       }
@@ -723,6 +1117,9 @@ const callsDashboardHTML = `<!DOCTYPE html>
         left.textContent = isHistory ? "Ended: " + fmtWhen(call.end) : "Started: " + fmtWhen(call.start);
         const right = document.createElement("span");
         right.textContent = "Duration: " + (call.duration_sec || 0) + "s";
+        if (isHistory && call.talk_sec) {
+          right.textContent += " · Talk: " + call.talk_sec + "s";
+        }
         meta.appendChild(left);
         meta.appendChild(right);
         li.appendChild(parties);
@@ -781,7 +1178,11 @@ const callsDashboardHTML = `<!DOCTYPE html>
           left.textContent = "";
         }
         const right = document.createElement("span");
-        right.textContent = contact.updated ? ("Seen: " + fmtWhen(contact.updated)) : "";
+        const parts = [];
+        if (contact.last_seen) parts.push("Last seen " + fmtAgo(contact.last_seen));
+        if (contact.updated) parts.push("Changed: " + fmtWhen(contact.updated));
+        right.textContent = parts.join(" · ");
+        right.title = contact.last_seen ? fmtWhen(contact.last_seen) : "";
         meta.appendChild(left);
         meta.appendChild(right);
         li.appendChild(meta);
@@ -841,6 +1242,7 @@ const callsDashboardHTML = `<!DOCTYPE html>
       };
     }
 
+    loadConfig();
     fallbackPoll();
     startPolling();
     startWebSocket();
@@ -1,9 +1,22 @@
 package httpapi
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/n3wscott/phonebook/internal/calls"
 	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
 )
 
 func TestCanonicalParty(t *testing.T) {
@@ -13,6 +26,15 @@ func TestCanonicalParty(t *testing.T) {
 	if got := canonicalParty("unknown"); got != "unknown" {
 		t.Fatalf("expected raw fallback for non-numeric value, got %q", got)
 	}
+	for raw, want := range map[string]string{
+		"sip:+15551234567@10.0.0.5":                 "+15551234567",
+		`"Acme" <sips:2601@pbx.example;user=phone>`: "2601",
+		"SIP:alice@example.com":                     "alice",
+	} {
+		if got := canonicalParty(raw); got != want {
+			t.Fatalf("canonicalParty(%q) = %q, want %q", raw, got, want)
+		}
+	}
 }
 
 func TestBuildNameLookupUsesFirstAndLastName(t *testing.T) {
@@ -29,7 +51,7 @@ func TestBuildNameLookupUsesFirstAndLastName(t *testing.T) {
 			Extension: "9999",
 		},
 	}
-	lookup := buildNameLookup(contacts)
+	lookup := buildNameLookup(contacts, map[string]string{"+1 555 123 4567": "Acme Plumbing", "8081": "Shadowed"})
 	if got := resolveName(lookup, "2601"); got != "Scott Nichols" {
 		t.Fatalf("expected name for extension 2601, got %q", got)
 	}
@@ -39,6 +61,15 @@ func TestBuildNameLookupUsesFirstAndLastName(t *testing.T) {
 	if got := resolveName(lookup, "9999"); got != "" {
 		t.Fatalf("expected empty name for contact with no first/last, got %q", got)
 	}
+	if got := resolveName(lookup, canonicalParty("sip:+15551234567@trunk")); got != "Acme Plumbing" {
+		t.Fatalf("expected the external name for an outside caller, got %q", got)
+	}
+	if got := resolveName(lookup, "8081"); got != "Scott Nichols" {
+		t.Fatalf("expected contacts to win over external_contacts, got %q", got)
+	}
+	if got := resolveName(lookup, "+15550000000"); got != "" {
+		t.Fatalf("expected no name for an unlisted number, got %q", got)
+	}
 }
 
 func TestDashboardContactStateOnlyShowsInUseForActiveCalls(t *testing.T) {
@@ -82,3 +113,379 @@ func TestDashboardContactStateOnlyShowsInUseForActiveCalls(t *testing.T) {
 		})
 	}
 }
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	if got := negotiateSubprotocol([]string{"graphql-ws, calls.v1"}, nil); got != "" {
+		t.Fatalf("expected no subprotocol by default, got %q", got)
+	}
+	if got := negotiateSubprotocol([]string{"graphql-ws, calls.v2", "calls.v1"}, []string{"calls.v1", "calls.v2"}); got != "calls.v2" {
+		t.Fatalf("expected client's first supported choice calls.v2, got %q", got)
+	}
+	if got := negotiateSubprotocol([]string{"graphql-ws"}, []string{"calls.v1"}); got != "" {
+		t.Fatalf("expected no overlap to select nothing, got %q", got)
+	}
+}
+
+func TestUpgradeWebSocketRequiresGET(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/calls/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	rr := httptest.NewRecorder()
+	if _, err := upgradeWebSocket(rr, req, nil); err == nil {
+		t.Fatalf("expected error for POST upgrade")
+	}
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != http.MethodGet {
+		t.Fatalf("expected 405 with Allow: GET, got %d %q", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestCallsWSPingsAndClosesIdleConnection(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{
+		Addr:                  ":0",
+		BasePath:              "/",
+		CallService:           calls.NewService(calls.Options{}, logger),
+		WebSocketPingInterval: 20 * time.Millisecond,
+		WebSocketIdleTimeout:  150 * time.Millisecond,
+	}, logger)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "GET /calls/ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	data, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("expected server to close idle socket, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("idle socket closed after %s, expected ~150ms", elapsed)
+	}
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 101")) {
+		t.Fatalf("expected 101 handshake, got %q", data)
+	}
+	if !bytes.Contains(data, []byte{0x89, 0x00}) {
+		t.Fatalf("expected at least one ping frame before close")
+	}
+}
+
+// hijackRecorder hands the handler one end of an in-memory pipe as its
+// hijacked connection.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// openCallsWS runs handleCallsWS over a pipe and returns the client end,
+// positioned after the handshake, and a channel closed when the handler
+// returns.
+func openCallsWS(t *testing.T, srv *Server) (net.Conn, *bufio.Reader, <-chan struct{}) {
+	t.Helper()
+	serverConn, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	req := httptest.NewRequest(http.MethodGet, "/calls/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.handleCallsWS(hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: serverConn}, req)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read handshake: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	return client, reader, done
+}
+
+// readServerFrame reads one unmasked server frame and returns its first
+// byte and payload.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	n := int(header[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		_, _ = io.ReadFull(r, ext[:])
+		n = int(ext[0])<<8 | int(ext[1])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return header[0], payload
+}
+
+// writeClientFrame writes a masked frame the way a browser does.
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload)), mask[0], mask[1], mask[2], mask[3]}
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+func newCallsWSServer() *Server {
+	logger := testutil.NewTestLogger()
+	return NewServer(Config{
+		Addr:                  ":0",
+		BasePath:              "/",
+		CallService:           calls.NewService(calls.Options{}, logger),
+		WebSocketPingInterval: time.Minute,
+	}, logger)
+}
+
+func TestCallsWSSendsCloseFrameOnShutdown(t *testing.T) {
+	srv := newCallsWSServer()
+	_, reader, done := openCallsWS(t, srv)
+	if op, _ := readServerFrame(t, reader); op != 0x81 {
+		t.Fatalf("expected a text frame first, got 0x%02x", op)
+	}
+
+	srv.beginShutdown()
+	op, payload := readServerFrame(t, reader)
+	if op != 0x88 || len(payload) < 2 || payload[0] != 0x03 || payload[1] != 0xe9 {
+		t.Fatalf("expected a going-away close frame, got 0x%02x %q", op, payload)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected handleCallsWS to return after shutdown")
+	}
+}
+
+func TestCallsWSAnswersPingAndClose(t *testing.T) {
+	srv := newCallsWSServer()
+	client, reader, done := openCallsWS(t, srv)
+	if op, _ := readServerFrame(t, reader); op != 0x81 {
+		t.Fatalf("expected a text frame first, got 0x%02x", op)
+	}
+
+	writeClientFrame(t, client, 0x9, []byte("hello"))
+	if op, payload := readServerFrame(t, reader); op != 0x8a || string(payload) != "hello" {
+		t.Fatalf("expected a pong echoing the ping, got 0x%02x %q", op, payload)
+	}
+	writeClientFrame(t, client, 0x8, []byte{0x03, 0xe8, 'b', 'y', 'e'})
+	if op, payload := readServerFrame(t, reader); op != 0x88 || string(payload) != "\x03\xe8" {
+		t.Fatalf("expected the close status echoed, got 0x%02x %q", op, payload)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected handleCallsWS to return after the client closed")
+	}
+}
+
+func TestReadWebSocketFrameRejectsUnmaskedFrames(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{0x89, 0x02, 'h', 'i'}))
+	if _, _, err := readWebSocketFrame(r); err == nil {
+		t.Fatal("expected an unmasked client frame to be rejected")
+	}
+}
+
+func TestCallsHistorySince(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	now := time.Now().UTC().Truncate(time.Second)
+	row := func(id string, end time.Time) string {
+		ts := end.Format("2006-01-02 15:04:05")
+		return `"","2601","2602","internal","","PJSIP/x-1","","Dial","","` + ts + `","` + ts + `","` + ts + `",30,25,"ANSWERED","DOCUMENTATION","` + id + `"` + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "Master.csv")
+	cdr := row("old", now.Add(-time.Hour)) + row("mid", now.Add(-30*time.Minute)) + row("new", now.Add(-time.Minute))
+	if err := os.WriteFile(path, []byte(cdr), 0o644); err != nil {
+		t.Fatalf("write CDR: %v", err)
+	}
+	svc := calls.NewService(calls.Options{MaxHistory: 10, Retention: 24 * time.Hour}, logger)
+	if _, err := svc.LoadCDR(path); err != nil {
+		t.Fatalf("LoadCDR: %v", err)
+	}
+	handler := NewServer(Config{Addr: ":0", BasePath: "/", CallService: svc}, logger).Handler()
+	get := func(query string) (int, callsHistoryResponse) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/calls/history"+query, nil))
+		var resp callsHistoryResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rr.Code, resp
+	}
+
+	if _, all := get(""); len(all.History) != 3 || all.LatestEnd == nil || !all.LatestEnd.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("expected full history with the newest end, got %+v", all)
+	}
+	cursor := now.Add(-30 * time.Minute).Format(time.RFC3339)
+	_, since := get("?since=" + cursor)
+	if len(since.History) != 1 || since.History[0].ID != "new" {
+		t.Fatalf("expected only calls ending after %s, got %+v", cursor, since.History)
+	}
+	_, empty := get("?since=" + since.LatestEnd.Format(time.RFC3339Nano))
+	if len(empty.History) != 0 || empty.LatestEnd == nil || !empty.LatestEnd.Equal(*since.LatestEnd) {
+		t.Fatalf("expected no calls and an unchanged cursor, got %+v", empty)
+	}
+	if code, _ := get("?since=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed since, got %d", code)
+	}
+}
+
+func TestCallsConfigReportsHistoryLimits(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	svc := calls.NewService(calls.Options{MaxHistory: 250, Retention: 36 * time.Hour}, logger)
+	handler := NewServer(Config{Addr: ":0", BasePath: "/", CallService: svc}, logger).Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/calls/config", nil))
+	var resp callsConfigResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.HistoryMax != 250 || resp.HistoryRetentionSec != 36*3600 {
+		t.Fatalf("expected 250 calls over 36h, got %+v", resp)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/calls?token=abc", nil))
+	if body := rr.Body.String(); !strings.Contains(body, `const configApi = "/api/calls/config?token=abc";`) || strings.Contains(body, "%!") {
+		t.Fatalf("expected the page to load the history limits, got:\n%s", rr.Body.String())
+	}
+}
+
+func TestCallsEventFeedsCallService(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	svc := calls.NewService(calls.Options{}, logger)
+	handler := NewServer(Config{Addr: ":0", BasePath: "/xml/", CallService: svc, AuthToken: "t0k"}, logger).Handler()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer t0k")
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/api/calls/event", `{"Event":"Newchannel","Linkedid":"c1","Uniqueid":"u1","CallerIDNum":"1001","Exten":"1002"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp callsEventResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Active != 1 {
+		t.Fatalf("expected one active call, got %+v (%v)", resp, err)
+	}
+	if active := svc.Snapshot().Active; len(active) != 1 || active[0].From != "1001" {
+		t.Fatalf("expected the posted call in the service, got %+v", active)
+	}
+	if rr := post("/xml/api/calls/event", `{"Event":"Hangup","Linkedid":"c1","Uniqueid":"u1"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected the route under the base path, got %d", rr.Code)
+	}
+	if active := svc.Snapshot().Active; len(active) != 0 {
+		t.Fatalf("expected the hangup to end the call, got %+v", active)
+	}
+
+	for _, body := range []string{`[]`, `{}`, `{"Event":1}`} {
+		if rr := post("/api/calls/event", body); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/calls/event", strings.NewReader(`{"Event":"Newchannel"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the token, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/calls/event?token=t0k", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("expected 405 with Allow: POST, got %d %q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	open := NewServer(Config{Addr: ":0", BasePath: "/xml/", CallService: svc}, logger)
+	for _, h := range []http.Handler{open.Handler(), open.DashboardHandler()} {
+		for _, path := range []string{"/api/calls/event", "/xml/api/calls/event"} {
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"Event":"Newchannel","Linkedid":"c2","Uniqueid":"u2"}`)))
+			if rr.Code != http.StatusNotFound {
+				t.Fatalf("%s: expected 404 without an auth token, got %d", path, rr.Code)
+			}
+		}
+	}
+	if active := svc.Snapshot().Active; len(active) != 0 {
+		t.Fatalf("expected no call injected without a token, got %+v", active)
+	}
+
+	rr = httptest.NewRecorder()
+	disabled := NewServer(Config{Addr: ":0", BasePath: "/"}, logger)
+	disabled.handleCallsEvent(rr, httptest.NewRequest(http.MethodPost, "/api/calls/event", strings.NewReader(`{"Event":"Newchannel"}`)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a call service, got %d", rr.Code)
+	}
+}
+
+func TestCallsPayloadMasksExternalParties(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	start := time.Now().UTC().Add(-time.Hour).Format("2006-01-02 15:04:05")
+	row := func(src, dst, id string) string {
+		return `"","` + src + `","` + dst + `","internal","","PJSIP/x-1","","Dial","","` + start + `","` + start + `","` + start + `",30,25,"ANSWERED","DOCUMENTATION","` + id + `"` + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "Master.csv")
+	cdr := row("2601", "15551234567", "out") + row("15557654321", "2602", "in") + row("2601", "700", "short")
+	if err := os.WriteFile(path, []byte(cdr), 0o644); err != nil {
+		t.Fatalf("write CDR: %v", err)
+	}
+	svc := calls.NewService(calls.Options{MaxHistory: 10, Retention: 24 * time.Hour}, logger)
+	if _, err := svc.LoadCDR(path); err != nil {
+		t.Fatalf("LoadCDR: %v", err)
+	}
+	srv := NewServer(Config{
+		Addr:          ":0",
+		BasePath:      "/",
+		CallService:   svc,
+		CallerPrivacy: CallerPrivacy{MaskDigits: 4, UnknownLabel: "Unknown caller"},
+	}, logger)
+	srv.Update([]model.Contact{
+		{FirstName: "Front", LastName: "Desk", Extension: "2601"},
+		{Extension: "2602"},
+	}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+
+	byID := map[string]dashboardCall{}
+	for _, call := range srv.buildCallsPayload().History {
+		byID[call.ID] = call
+	}
+	if got := byID["out"]; got.From != "2601" || got.FromName != "Front Desk" || got.To != "***4567" || got.ToName != "Unknown caller" {
+		t.Fatalf("expected the external callee masked, got %+v", got)
+	}
+	if got := byID["in"]; got.From != "***4321" || got.FromName != "Unknown caller" || got.To != "2602" || got.ToName != "" {
+		t.Fatalf("expected the external caller masked and the unnamed contact kept, got %+v", got)
+	}
+	if got := byID["short"]; got.To != "700" || got.ToName != "Unknown caller" {
+		t.Fatalf("expected numbers no longer than the kept digits to stay visible, got %+v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/n3wscott/phonebook/internal/diff"
+)
+
+// diffedConfigs are the generated Asterisk files compared against LiveDir,
+// in response order.
+var diffedConfigs = []string{"pjsip.conf", "extensions.conf"}
+
+type configDiffResponse struct {
+	InSync bool             `json:"in_sync"`
+	Files  []configFileDiff `json:"files"`
+}
+
+type configFileDiff struct {
+	Name string `json:"name"`
+	Live string `json:"live"`
+	// Missing is set when the live file does not exist; every generated
+	// line is then reported as added.
+	Missing bool        `json:"missing,omitempty"`
+	Added   int         `json:"added"`
+	Removed int         `json:"removed"`
+	Changes []diff.Line `json:"changes"`
+}
+
+// SetAsteriskConfigs records the generated pjsip.conf and extensions.conf
+// that /api/config/diff compares against the live directory.
+func (s *Server) SetAsteriskConfigs(pjsip, extensions []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.asterisk = map[string][]byte{
+		"pjsip.conf":      append([]byte(nil), pjsip...),
+		"extensions.conf": append([]byte(nil), extensions...),
+	}
+}
+
+// handleConfigDiff reports, per file, how the generated Asterisk configs
+// differ from the copies in LiveDir: what a deploy of the current tree would
+// change on the PBX. Files in sync come back with no changes.
+func (s *Server) handleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.RLock()
+	generated := s.asterisk
+	s.mu.RUnlock()
+
+	resp := configDiffResponse{InSync: true, Files: make([]configFileDiff, 0, len(diffedConfigs))}
+	for _, name := range diffedConfigs {
+		path := filepath.Join(s.liveDir, name)
+		file := configFileDiff{Name: name, Live: path}
+		live, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "read live config failed", http.StatusInternalServerError)
+				return
+			}
+			file.Missing = true
+		}
+		file.Changes = diff.Changes(diff.Lines(diff.Split(string(live)), diff.Split(string(generated[name]))))
+		for _, l := range file.Changes {
+			if l.Op == diff.Add {
+				file.Added++
+			} else {
+				file.Removed++
+			}
+		}
+		if file.Missing || len(file.Changes) > 0 {
+			resp.InSync = false
+		}
+		resp.Files = append(resp.Files, file)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(resp)
+}
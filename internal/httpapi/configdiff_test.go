@@ -0,0 +1,89 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/diff"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestConfigDiff(t *testing.T) {
+	live := t.TempDir()
+	if err := os.WriteFile(filepath.Join(live, "pjsip.conf"), []byte("[100]\ntype=endpoint\ncontext=internal\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret", LiveDir: live}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Ada", Extension: "100"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	srv.SetAsteriskConfigs([]byte("[100]\ntype=endpoint\ncontext=office\n"), []byte("[internal]\n"))
+	handler := srv.Handler()
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/config/diff", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d", rr.Code)
+	}
+
+	rr := get("s3cret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp configDiffResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.InSync || len(resp.Files) != 2 {
+		t.Fatalf("expected two out-of-sync files, got %+v", resp)
+	}
+	pjsip, ext := resp.Files[0], resp.Files[1]
+	if pjsip.Name != "pjsip.conf" || pjsip.Missing || pjsip.Added != 1 || pjsip.Removed != 1 {
+		t.Fatalf("unexpected pjsip diff: %+v", pjsip)
+	}
+	want := []diff.Line{
+		{Op: diff.Remove, Old: 3, Text: "context=internal"},
+		{Op: diff.Add, New: 3, Text: "context=office"},
+	}
+	if len(pjsip.Changes) != len(want) || pjsip.Changes[0] != want[0] || pjsip.Changes[1] != want[1] {
+		t.Fatalf("unexpected pjsip changes: %+v", pjsip.Changes)
+	}
+	if ext.Name != "extensions.conf" || !ext.Missing || ext.Added != 1 || ext.Removed != 0 {
+		t.Fatalf("expected extensions.conf reported missing, got %+v", ext)
+	}
+
+	srv.SetAsteriskConfigs([]byte("[100]\ntype=endpoint\ncontext=internal\n"), []byte("[internal]\n"))
+	if err := os.WriteFile(filepath.Join(live, "extensions.conf"), []byte("[internal]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp = configDiffResponse{}
+	if err := json.Unmarshal(get("s3cret").Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !resp.InSync || len(resp.Files[0].Changes) != 0 || len(resp.Files[1].Changes) != 0 {
+		t.Fatalf("expected configs in sync, got %+v", resp)
+	}
+}
+
+func TestConfigDiffRequiresLiveDir(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	req := httptest.NewRequest(http.MethodGet, "/api/config/diff", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a live dir, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,102 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// apiContact is one contact as GET /api/contacts lists it. Credentials are
+// left out.
+type apiContact struct {
+	ID         string     `json:"id"`
+	FirstName  string     `json:"first_name"`
+	LastName   string     `json:"last_name"`
+	Extension  string     `json:"extension"`
+	Phones     []apiPhone `json:"phones"`
+	GroupID    *int       `json:"group_id,omitempty"`
+	SourcePath string     `json:"source_path"`
+}
+
+type apiPhone struct {
+	Number       string `json:"number"`
+	AccountIndex int    `json:"account_index"`
+}
+
+// renderContactsJSON encodes contacts for /api/contacts once per Update, so
+// polling clients share one body and ETag.
+func renderContactsJSON(contacts []model.Contact) vendorPhonebook {
+	list := make([]apiContact, 0, len(contacts))
+	for _, c := range contacts {
+		phones := make([]apiPhone, 0, len(c.Phones))
+		for _, p := range c.Phones {
+			phones = append(phones, apiPhone{Number: p.Number, AccountIndex: p.AccountIndex})
+		}
+		list = append(list, apiContact{
+			ID:         c.ID,
+			FirstName:  c.FirstName,
+			LastName:   c.LastName,
+			Extension:  c.Extension,
+			Phones:     phones,
+			GroupID:    c.GroupID,
+			SourcePath: c.SourcePath,
+		})
+	}
+	body, _ := json.Marshal(list)
+	body = append(body, '\n')
+	return vendorPhonebook{Body: body, ETag: etagFor(body)}
+}
+
+// handleContacts lists the current snapshot's contacts as a JSON array with
+// the phonebook's ETag/Last-Modified caching, in server.contact_sort order
+// unless ?sort= picks another. Until the first build it answers 503 with a
+// JSON error. When AdminToken is set the caller must present it, since
+// source paths describe the data tree.
+func (s *Server) handleContacts(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken != "" && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	snap, _ := s.currentSnapshot()
+	doc := snap.ContactsJSON
+	if len(doc.Body) == 0 {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Retry-After", startupRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "phonebook is starting: the first build has not finished"})
+		return
+	}
+	if r.URL.Query().Get("sort") != "" {
+		contacts, err := s.sortedContacts(r, snap.Contacts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		doc = renderContactsJSON(contacts)
+	}
+	w.Header().Set("ETag", doc.ETag)
+	w.Header().Set("Last-Modified", snap.LastModified.UTC().Format(http.TimeFormat))
+	if notModified(r, doc.ETag, snap.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writeBody(w, r, doc.Body)
+}
+
+// handleContactsCSV serves the current contacts as CSV for spreadsheet
+// audits, cached per Update like the phonebooks. When AdminToken is set the
+// caller must present it, as for /api/contacts.
+func (s *Server) handleContactsCSV(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken != "" && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	snap, _ := s.currentSnapshot()
+	doc := snap.ContactsCSV
+	w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+	serveDocument(w, r, "text/csv; charset=utf-8", doc.Body, doc.Gzip, doc.ETag, snap.LastModified)
+}
@@ -0,0 +1,145 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestContactsAPI(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, testutil.NewTestLogger())
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/contacts", nil))
+	var notReady map[string]string
+	if rr.Code != http.StatusServiceUnavailable || json.Unmarshal(rr.Body.Bytes(), &notReady) != nil || notReady["error"] == "" {
+		t.Fatalf("expected 503 with a JSON error before the first build, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	group := 2
+	srv.Update([]model.Contact{{
+		ID:         "alpha",
+		FirstName:  "Alpha",
+		LastName:   "Tester",
+		Extension:  "1001",
+		Password:   "s3cret-pw",
+		GroupID:    &group,
+		Phones:     []model.Phone{{Number: "1001", AccountIndex: 1}, {Number: "5551001", AccountIndex: 2}},
+		SourcePath: "contacts/team.yaml",
+	}}, []byte("<AddressBook/>"), time.Unix(100, 0))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/api/contacts", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "s3cret-pw") {
+		t.Fatalf("password leaked: %s", rr.Body.String())
+	}
+	var contacts []apiContact
+	if err := json.Unmarshal(rr.Body.Bytes(), &contacts); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(contacts) != 1 || contacts[0].ID != "alpha" || contacts[0].SourcePath != "contacts/team.yaml" ||
+		len(contacts[0].Phones) != 2 || contacts[0].Phones[1].AccountIndex != 2 || contacts[0].GroupID == nil || *contacts[0].GroupID != 2 {
+		t.Fatalf("unexpected contacts: %+v", contacts)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/contacts", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching ETag, got %d", rr.Code)
+	}
+}
+
+func TestContactsAPIRequiresAdminToken(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/contacts", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rr.Code)
+	}
+}
+
+func TestContactsCSV(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{
+		{ID: "front", FirstName: "Front", Extension: "0100", SourcePath: "contacts/a.yaml"},
+	}, []byte("<AddressBook/>"), time.Unix(1700000000, 0))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/contacts.csv", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected CSV, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Body.String(), `front,Front,,"=""0100""",,,,contacts/a.yaml`) {
+		t.Fatalf("unexpected CSV body:\n%s", rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/xml/contacts.csv", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching ETag, got %d", rr.Code)
+	}
+
+	guarded := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	guarded.Update(nil, []byte("<AddressBook/>"), time.Time{})
+	rr = httptest.NewRecorder()
+	guarded.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/contacts.csv", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", rr.Code)
+	}
+}
+
+func TestContactsExportsFollowContactSort(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	srv.SetContactSort(model.SortByName)
+	srv.Update([]model.Contact{
+		{FirstName: "Amir", LastName: "Khan", Extension: "100"},
+		{FirstName: "Zoe", LastName: "Adams", Extension: "200"},
+	}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	extensions := func(target string) []string {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		var list []apiContact
+		if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%s: %v: %s", target, err, rr.Body.String())
+		}
+		var out []string
+		for _, c := range list {
+			out = append(out, c.Extension)
+		}
+		return out
+	}
+	if got := extensions("/api/contacts"); strings.Join(got, ",") != "200,100" {
+		t.Fatalf("expected name order by default, got %v", got)
+	}
+	if got := extensions("/api/contacts?sort=extension"); strings.Join(got, ",") != "100,200" {
+		t.Fatalf("expected ?sort=extension to override, got %v", got)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/contacts.csv", nil))
+	if body := rr.Body.String(); strings.Index(body, "Adams") > strings.Index(body, "Khan") {
+		t.Fatalf("expected contacts.csv in name order, got:\n%s", body)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/contacts?sort=bogus", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown sort, got %d", rr.Code)
+	}
+}
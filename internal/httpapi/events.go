@@ -0,0 +1,161 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Reload event statuses.
+const (
+	ReloadOK     = "ok"
+	ReloadFailed = "failed"
+)
+
+// maxReloadEvents is how many recent reload events /events/ws replays to a
+// client that just connected.
+const maxReloadEvents = 50
+
+// ReloadEvent describes one rebuild of the served data for /events/ws.
+type ReloadEvent struct {
+	Time time.Time `json:"time"`
+	// Version and Contacts describe the snapshot being served after the
+	// rebuild, which is the previous one when it failed.
+	Version  uint64   `json:"version"`
+	Contacts int      `json:"contacts"`
+	Changed  []string `json:"changed"`
+	Status   string   `json:"status"`
+	// Kind is config.ErrorKind of a failed build, when it has one.
+	Kind  string `json:"kind,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// PublishReload records a rebuild and sends it to /events/ws clients. It
+// fills in the time, if unset, and the current version and contact count, so
+// call it after Update on success. Events after shutdown are dropped.
+func (s *Server) PublishReload(ev ReloadEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if ev.Changed == nil {
+		ev.Changed = []string{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	ev.Version = s.version
+	ev.Contacts = s.snapshot.ContactCount
+	s.events = append(s.events, ev)
+	if len(s.events) > maxReloadEvents {
+		s.events = append([]ReloadEvent(nil), s.events[len(s.events)-maxReloadEvents:]...)
+	}
+	s.eventSeq++
+	notifyLatest(s.eventSubs, s.eventSeq)
+}
+
+// eventsSince returns the recorded events after seq, oldest first, and the
+// sequence number of the newest one. Events that have aged out of the
+// history are skipped.
+func (s *Server) eventsSince(seq uint64) ([]ReloadEvent, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := s.eventSeq - seq
+	if n > uint64(len(s.events)) {
+		n = uint64(len(s.events))
+	}
+	return append([]ReloadEvent(nil), s.events[len(s.events)-int(n):]...), s.eventSeq
+}
+
+// subscribeEvents returns a channel that receives the newest event sequence
+// number after each PublishReload, and a cancel func that closes it.
+func (s *Server) subscribeEvents() (<-chan uint64, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.eventSubs == nil {
+		s.eventSubs = make(map[int]chan uint64)
+	}
+	return s.addSub(s.eventSubs)
+}
+
+// handleEventsWS streams reload events as JSON text frames, one per
+// message, starting with the recent history. When AdminToken is set the
+// caller must present it, since events name the files that changed.
+func (s *Server) handleEventsWS(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken != "" && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r, s.wsProtos)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	interval, idle := s.wsTimings()
+	in := readWebSocket(conn, idle)
+
+	// Subscribe before reading the history so nothing published in
+	// between is missed.
+	sub, cancel := s.subscribeEvents()
+	defer cancel()
+
+	var seq uint64
+	if seq, err = s.writeEventFrames(conn, seq, interval); err != nil {
+		return
+	}
+
+	pingTicker := time.NewTicker(interval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			closeWebSocket(conn, interval)
+			return
+		case <-in.done:
+			if in.closeStatus != nil {
+				_ = conn.SetWriteDeadline(time.Now().Add(interval))
+				_ = writeWebSocketFrame(conn, 0x8, in.closeStatus)
+			}
+			return
+		case payload := <-in.pings:
+			_ = conn.SetWriteDeadline(time.Now().Add(interval))
+			if err := writeWebSocketFrame(conn, 0xa, payload); err != nil {
+				return
+			}
+		case <-sub:
+			if seq, err = s.writeEventFrames(conn, seq, interval); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(interval))
+			if err := writeWebSocketFrame(conn, 0x9, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEventFrames sends the events after seq and returns the new position.
+func (s *Server) writeEventFrames(conn net.Conn, seq uint64, timeout time.Duration) (uint64, error) {
+	events, next := s.eventsSince(seq)
+	for _, ev := range events {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return seq, err
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := writeWebSocketFrame(conn, 0x1, payload); err != nil {
+			return seq, err
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,116 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+// readTextFrame returns the payload of the next unmasked text frame,
+// skipping pings.
+func readTextFrame(t *testing.T, r *bufio.Reader) []byte {
+	t.Helper()
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			t.Fatalf("read frame header: %v", err)
+		}
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				t.Fatalf("read frame length: %v", err)
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				t.Fatalf("read frame length: %v", err)
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatalf("read frame payload: %v", err)
+		}
+		if header[0]&0x0f == 0x1 {
+			return payload
+		}
+	}
+}
+
+func TestEventsWSReplaysHistoryAndStreamsReloads(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, logger)
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	srv.PublishReload(ReloadEvent{Status: ReloadOK})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _ = io.WriteString(conn, "GET /xml/events/ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101 handshake, got %v %v", resp, err)
+	}
+
+	var first ReloadEvent
+	if err := json.Unmarshal(readTextFrame(t, br), &first); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if first.Status != ReloadOK || first.Version != 1 || first.Contacts != 1 || len(first.Changed) != 0 || first.Time.IsZero() {
+		t.Fatalf("expected the startup event replayed, got %+v", first)
+	}
+
+	srv.PublishReload(ReloadEvent{Changed: []string{"contacts/a.yaml"}, Status: ReloadFailed, Kind: "parse", Error: "parse contacts/a.yaml: bad"})
+	var second ReloadEvent
+	if err := json.Unmarshal(readTextFrame(t, br), &second); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if second.Status != ReloadFailed || second.Kind != "parse" || second.Version != 1 || second.Contacts != 1 ||
+		len(second.Changed) != 1 || second.Changed[0] != "contacts/a.yaml" {
+		t.Fatalf("expected the failed reload against the kept snapshot, got %+v", second)
+	}
+}
+
+func TestEventsWSRequiresAdminToken(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, logger)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/events/ws", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rr.Code)
+	}
+}
+
+func TestPublishReloadKeepsRecentHistory(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	for i := 0; i < maxReloadEvents+5; i++ {
+		srv.PublishReload(ReloadEvent{Status: ReloadOK})
+	}
+	events, seq := srv.eventsSince(0)
+	if len(events) != maxReloadEvents || seq != maxReloadEvents+5 {
+		t.Fatalf("expected the last %d of %d events, got %d at %d", maxReloadEvents, maxReloadEvents+5, len(events), seq)
+	}
+	if events, _ := srv.eventsSince(seq - 2); len(events) != 2 {
+		t.Fatalf("expected 2 events after seq %d, got %d", seq-2, len(events))
+	}
+}
@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/xmlgen"
+)
+
+// groupPhonebooks renders one snapshot's phonebooks filtered to a single
+// group_id on first request and keeps them until the next Update replaces
+// the snapshot. group_id is limited to 0-9, so the cache stays small.
+type groupPhonebooks struct {
+	contacts []model.Contact
+	output   config.Output
+
+	mu   sync.Mutex
+	docs map[groupKey]vendorPhonebook
+}
+
+type groupKey struct {
+	format string
+	group  int
+}
+
+func newGroupPhonebooks(contacts []model.Contact, output config.Output) *groupPhonebooks {
+	return &groupPhonebooks{contacts: contacts, output: output, docs: map[groupKey]vendorPhonebook{}}
+}
+
+// parseGroup reads ?group= as a group_id in the range contacts accept.
+func parseGroup(raw string) (int, bool) {
+	group, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || group < 0 || group > 9 {
+		return 0, false
+	}
+	return group, true
+}
+
+// get returns the phonebook in format holding only the contacts in group.
+func (g *groupPhonebooks) get(format string, group int) (vendorPhonebook, error) {
+	key := groupKey{format: format, group: group}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if doc, ok := g.docs[key]; ok {
+		return doc, nil
+	}
+	var members []model.Contact
+	for _, c := range g.contacts {
+		if c.GroupID != nil && *c.GroupID == group {
+			members = append(members, c)
+		}
+	}
+	body, err := xmlgen.Formats[format](members)
+	if err != nil {
+		return vendorPhonebook{}, err
+	}
+	body = g.output.Apply(body)
+	doc := vendorPhonebook{Body: body, Gzip: gzipBody(body), ETag: etagFor(body)}
+	g.docs[key] = doc
+	return doc, nil
+}
@@ -0,0 +1,82 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildDurationBuckets are the upper bounds, in seconds, of the
+// phonebook_build_duration_seconds histogram.
+var buildDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// buildMetrics accumulates RecordBuild calls for /metrics.
+type buildMetrics struct {
+	errors uint64
+	// counts[i] is how many builds took at most buildDurationBuckets[i];
+	// builds slower than every bucket only reach count.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// RecordBuild adds one builder.Build call to the /metrics build duration
+// histogram, counting it as a build error when err is set.
+func (s *Server) RecordBuild(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &s.buildMetrics
+	if m.counts == nil {
+		m.counts = make([]uint64, len(buildDurationBuckets))
+	}
+	if err != nil {
+		m.errors++
+	}
+	seconds := d.Seconds()
+	for i, le := range buildDurationBuckets {
+		if seconds <= le {
+			m.counts[i]++
+		}
+	}
+	m.count++
+	m.sum += seconds
+}
+
+// handleMetrics writes the Prometheus text exposition format. Reloads are
+// the snapshots published so far, including the first build.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	contacts, reloads := s.snapshot.ContactCount, s.version
+	m := s.buildMetrics
+	m.counts = append([]uint64(nil), m.counts...)
+	s.mu.RUnlock()
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("phonebook_contacts_total", "gauge", "Contacts in the served snapshot.", contacts)
+	metric("phonebook_reloads_total", "counter", "Snapshots published since start, including the first build.", reloads)
+	metric("phonebook_build_errors_total", "counter", "Builds that failed; the previous snapshot stays served.", m.errors)
+	if s.calls != nil {
+		metric("phonebook_active_calls", "gauge", "Calls in progress reported by Asterisk.", len(s.calls.Snapshot().Active))
+	}
+
+	const hist = "phonebook_build_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time spent building config, contacts and outputs.\n# TYPE %s histogram\n", hist, hist)
+	for i, le := range buildDurationBuckets {
+		var n uint64
+		if m.counts != nil {
+			n = m.counts[i]
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", hist, strconv.FormatFloat(le, 'g', -1, 64), n)
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", hist, m.count)
+	fmt.Fprintf(&b, "%s_sum %s\n", hist, strconv.FormatFloat(m.sum, 'g', -1, 64))
+	fmt.Fprintf(&b, "%s_count %d\n", hist, m.count)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeBody(w, r, []byte(b.String()))
+}
@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/calls"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	svc := calls.NewService(calls.Options{}, logger)
+	svc.HandleAMIEvent(map[string]string{"Event": "Newchannel", "Linkedid": "c1", "Uniqueid": "u1", "CallerIDNum": "1001", "Exten": "1002"})
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", CallService: svc, EnableMetrics: true}, logger)
+	srv.RecordBuild(30*time.Millisecond, nil)
+	srv.Update([]model.Contact{{Extension: "1001"}, {Extension: "1002"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	srv.RecordBuild(3*time.Second, errors.New("broken yaml"))
+
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("expected Prometheus text, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE phonebook_contacts_total gauge\nphonebook_contacts_total 2\n",
+		"# TYPE phonebook_reloads_total counter\nphonebook_reloads_total 1\n",
+		"phonebook_build_errors_total 1\n",
+		"phonebook_active_calls 1\n",
+		"# TYPE phonebook_build_duration_seconds histogram\n",
+		`phonebook_build_duration_seconds_bucket{le="0.01"} 0` + "\n",
+		`phonebook_build_duration_seconds_bucket{le="0.05"} 1` + "\n",
+		`phonebook_build_duration_seconds_bucket{le="2.5"} 1` + "\n",
+		`phonebook_build_duration_seconds_bucket{le="5"} 2` + "\n",
+		`phonebook_build_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"phonebook_build_duration_seconds_sum 3.03\n",
+		"phonebook_build_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsDisabledByDefault(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without EnableMetrics, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// apiRoute documents one JSON endpoint. Request and Response are zero values
+// of the Go types the handler decodes and encodes, so the schemas in
+// /api/openapi.json are derived from the same structs that produce the
+// responses.
+type apiRoute struct {
+	Path string
+	// UnderBase marks routes mounted under the configured base path.
+	UnderBase bool
+	Method    string
+	Summary   string
+	Request   any
+	Response  any
+}
+
+var apiRoutes = []apiRoute{
+	{Path: "healthz", UnderBase: true, Method: http.MethodGet, Summary: "Snapshot health and counters", Response: healthzResponse{}},
+	{Path: "/api/calls/active", Method: http.MethodGet, Summary: "Calls in progress", Response: callsActiveResponse{}},
+	{Path: "/api/calls/history", Method: http.MethodGet, Summary: "Recently completed calls; ?since=<RFC3339> keeps those that ended after it", Response: callsHistoryResponse{}},
+	{Path: "/api/calls/contacts", Method: http.MethodGet, Summary: "Contacts with live presence", Response: callsContactsResponse{}},
+	{Path: "/api/calls/config", Method: http.MethodGet, Summary: "How much call history is kept", Response: callsConfigResponse{}},
+	{Path: "/api/calls/event", Method: http.MethodPost, Summary: "Feed one AMI event, as a JSON object of AMI keys and values, to the call service (bearer token; only served with an auth token)", Request: map[string]string{}, Response: callsEventResponse{}},
+	{Path: "/api/broadcast/contacts", Method: http.MethodGet, Summary: "Broadcast recipients", Response: broadcastContactsPayload{}},
+	{Path: "/api/broadcast/send", Method: http.MethodPost, Summary: "Send a SIP MESSAGE broadcast", Request: broadcastSendRequest{}, Response: broadcastSendResponse{}},
+	{Path: "/api/contacts", Method: http.MethodGet, Summary: "Current contacts, without credentials (bearer token when an admin token is set)", Response: []apiContact{}},
+	{Path: "/api/resolve", Method: http.MethodGet, Summary: "Resolve ?number= (or a SIP URI) to the matching contact or external name (bearer token when an admin token is set)", Response: resolveResponse{}},
+	{Path: "/api/render", Method: http.MethodPost, Summary: "Render an uploaded data tree (tar or tar.gz body, bearer token)", Response: renderResponse{}},
+	{Path: "/api/reload", Method: http.MethodPost, Summary: "Rebuild from the data directory now (bearer token when an admin token is set)", Response: reloadResponse{}},
+	{Path: "/api/config/diff", Method: http.MethodGet, Summary: "Diff generated Asterisk configs against the live directory (bearer token)", Response: configDiffResponse{}},
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	payload, _ := json.MarshalIndent(s.openAPISpec(), "", "  ")
+	writeBody(w, r, append(payload, '\n'))
+}
+
+// openAPISpec builds an OpenAPI 3 document for apiRoutes. Every route is
+// listed, including ones a given server has disabled.
+func (s *Server) openAPISpec() map[string]any {
+	paths := map[string]any{}
+	for _, route := range apiRoutes {
+		path := route.Path
+		if route.UnderBase {
+			path = s.join(path)
+		}
+		op := map[string]any{
+			"summary": route.Summary,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(route.Response))},
+					},
+				},
+			},
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(route.Request))},
+				},
+			}
+		}
+		paths[path] = map[string]any{strings.ToLower(route.Method): op}
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "phonebook", "version": "1"},
+		"paths":   paths,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json renders t.
+func jsonSchema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,115 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/calls"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestOpenAPISpecMatchesLiveResponses(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	svc := calls.NewService(calls.Options{}, logger)
+	svc.HandleAMIEvent(map[string]string{"Event": "Newchannel", "Linkedid": "c1", "Uniqueid": "u1", "CallerIDNum": "1001", "Exten": "1002"})
+	svc.HandleAMIEvent(map[string]string{"Event": "ContactStatus", "AOR": "1001", "Status": "Reachable", "Endpoint": "1001"})
+	live := t.TempDir()
+	if err := os.WriteFile(filepath.Join(live, "pjsip.conf"), []byte("[global]\ntype=global\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{
+		Addr:        ":0",
+		BasePath:    "/xml/",
+		CallService: svc,
+		Broadcast:   BroadcastConfig{Enabled: true},
+		AdminToken:  "s3cret",
+		LiveDir:     live,
+	}, logger)
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	srv.SetAsteriskConfigs([]byte("[global]\ntype=global\nuser_agent=pb\n"), []byte("[internal]\n"))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for spec, got %d", rr.Code)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema schemaDoc `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decode spec: %v", err)
+	}
+	if _, ok := spec.Paths["/xml/healthz"]; !ok {
+		t.Fatalf("expected healthz under the base path, got %v", spec.Paths)
+	}
+
+	// Routes that need query parameters to answer 200.
+	queries := map[string]string{"/api/resolve": "?number=1001"}
+	for path, ops := range spec.Paths {
+		op, ok := ops["get"]
+		if !ok {
+			continue
+		}
+		schema := op.Responses["200"].Content["application/json"].Schema
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path+queries[path], nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rr.Code)
+		}
+		var body any
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: decode: %v", path, err)
+		}
+		checkSchema(t, path, schema, body)
+	}
+}
+
+type schemaDoc struct {
+	Type       string               `json:"type"`
+	Properties map[string]schemaDoc `json:"properties"`
+	Required   []string             `json:"required"`
+	Items      *schemaDoc           `json:"items"`
+}
+
+// checkSchema fails if value has keys the schema does not document or lacks
+// keys it marks required, recursing through objects and array items.
+func checkSchema(t *testing.T, where string, schema schemaDoc, value any) {
+	t.Helper()
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			prop, ok := schema.Properties[key]
+			if !ok {
+				t.Fatalf("%s: response key %q missing from schema", where, key)
+			}
+			checkSchema(t, where+"."+key, prop, child)
+		}
+		for _, key := range schema.Required {
+			if _, ok := v[key]; !ok {
+				t.Fatalf("%s: required key %q missing from response", where, key)
+			}
+		}
+	case []any:
+		if schema.Type != "array" || schema.Items == nil {
+			t.Fatalf("%s: got an array, schema says %q", where, schema.Type)
+		}
+		for _, item := range v {
+			checkSchema(t, where+"[]", *schema.Items, item)
+		}
+	}
+}
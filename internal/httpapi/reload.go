@@ -0,0 +1,47 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/n3wscott/phonebook/internal/config"
+)
+
+type reloadResponse struct {
+	Version  uint64 `json:"version"`
+	Contacts int    `json:"contacts"`
+	Error    string `json:"error,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+}
+
+// handleReload runs OnReload, the same rebuild the file watcher triggers,
+// for deployments where change notifications are unreliable, such as an
+// NFS-mounted data directory. It reports the snapshot served afterwards,
+// which is the previous one when the rebuild failed. The route sits behind
+// requireAuth, and when AdminToken is set the caller must present it.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.adminToken != "" && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := s.onReload()
+	s.mu.RLock()
+	resp := reloadResponse{Version: s.version, Contacts: s.snapshot.ContactCount}
+	s.mu.RUnlock()
+	status := http.StatusOK
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Kind = config.ErrorKind(err)
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestReloadRunsCallbackAndReportsSnapshot(t *testing.T) {
+	var srv *Server
+	var fail error
+	srv = NewServer(Config{Addr: ":0", BasePath: "/xml/", AllowReload: true, OnReload: func() error {
+		if fail != nil {
+			return fail
+		}
+		srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}, {FirstName: "Beta", Extension: "1002"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+		return nil
+	}}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Alpha", Extension: "1001"}}, []byte("<AddressBook/>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/xml/api/reload", nil))
+	var resp reloadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 JSON, got %d %q (%v)", rr.Code, rr.Body.String(), err)
+	}
+	if resp.Version != 2 || resp.Contacts != 2 || resp.Error != "" {
+		t.Fatalf("expected the rebuilt snapshot, got %+v", resp)
+	}
+
+	fail = &config.ValidationError{Field: "server.addr", Err: errors.New("server.addr is required")}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	resp = reloadResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 JSON, got %d %q (%v)", rr.Code, rr.Body.String(), err)
+	}
+	if resp.Version != 2 || resp.Contacts != 2 || resp.Kind != config.KindValidation || resp.Error == "" {
+		t.Fatalf("expected the kept snapshot and the error, got %+v", resp)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/reload", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("expected 405 with Allow: POST, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestReloadRouteGating(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	onReload := func() error { return nil }
+	tests := []struct {
+		name string
+		cfg  Config
+		auth string
+		want int
+	}{
+		{name: "disabled", cfg: Config{OnReload: onReload}, want: http.StatusNotFound},
+		{name: "no token", cfg: Config{AllowReload: true, OnReload: onReload, AdminToken: "s3cret"}, want: http.StatusUnauthorized},
+		{name: "token", cfg: Config{AllowReload: true, OnReload: onReload, AdminToken: "s3cret"}, auth: "Bearer s3cret", want: http.StatusOK},
+		{name: "no auth token", cfg: Config{AllowReload: true, OnReload: onReload, AuthToken: "t0k"}, want: http.StatusUnauthorized},
+		{name: "auth token", cfg: Config{AllowReload: true, OnReload: onReload, AuthToken: "t0k"}, auth: "Bearer t0k", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Addr, tt.cfg.BasePath = ":0", "/"
+			srv := NewServer(tt.cfg, logger)
+			srv.Update(nil, []byte("<AddressBook/>"), time.Unix(0, 0))
+			req := httptest.NewRequest(http.MethodPost, "/api/reload", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package httpapi
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/project"
+)
+
+type renderResponse struct {
+	Contacts  int               `json:"contacts"`
+	Files     map[string]string `json:"files"`
+	Provision []string          `json:"provision,omitempty"`
+	Warnings  []string          `json:"warnings"`
+	Error     string            `json:"error,omitempty"`
+	// Kind classifies Error (see config.ErrorKind) so clients can tell a
+	// tree without config.yaml from a YAML typo or a rejected setting.
+	Kind string `json:"kind,omitempty"`
+}
+
+// handleRender builds an uploaded data tree (a tar archive, optionally
+// gzipped) in a temp dir and returns the rendered artifacts as JSON. The
+// server's own snapshot and directory are never touched.
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "phonebook-render-")
+	if err != nil {
+		http.Error(w, "create render dir failed", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	limit := s.renderMaxBytes()
+	body := http.MaxBytesReader(w, r.Body, limit)
+	if err := extractTree(body, dir, renderExtractFactor*limit, renderMaxEntries); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, errTreeTooLarge) {
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger := project.NewWarningRecorder(s.logger)
+	state, err := (&project.DirBuilder{Dir: dir, Logger: logger}).Build()
+	resp := renderResponse{Warnings: logger.Warnings()}
+	status := http.StatusOK
+	if err != nil {
+		resp.Error = strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), "")
+		resp.Kind = config.ErrorKind(err)
+		status = http.StatusUnprocessableEntity
+		if resp.Kind == config.KindMissingConfig {
+			// The upload is not a data tree at all.
+			resp.Error = "upload has no config.yaml at its root"
+			status = http.StatusBadRequest
+		}
+	} else {
+		resp.Contacts = len(state.Contacts)
+		resp.Files = map[string]string{
+			"phonebook.xml":   string(state.Phonebook),
+			"pjsip.conf":      string(state.PJSIP),
+			"extensions.conf": string(state.Extensions),
+		}
+		for name := range state.Provision {
+			resp.Provision = append(resp.Provision, name)
+		}
+		sort.Strings(resp.Provision)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(s.adminToken)) == 1
+}
+
+func (s *Server) renderMaxBytes() int64 {
+	if s.renderMax > 0 {
+		return s.renderMax
+	}
+	return defaultRenderMaxBytes
+}
+
+const (
+	// renderExtractFactor bounds the unpacked tree at this many times the
+	// upload limit, which a compressed YAML tree stays well within.
+	renderExtractFactor = 4
+	renderMaxEntries    = 10000
+)
+
+// errTreeTooLarge reports an upload that unpacks past its limits, such as
+// a gzip or tar bomb.
+var errTreeTooLarge = errors.New("archive unpacks too large")
+
+// extractTree unpacks a tar (or tar.gz) stream into dir. Only regular files
+// and directories are written; absolute paths and entries escaping dir are
+// rejected. At most maxEntries entries and maxBytes of file content are
+// unpacked, whatever the compressed size.
+func extractTree(r io.Reader, dir string, maxBytes int64, maxEntries int) error {
+	buffered := bufio.NewReader(r)
+	var src io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	remaining := maxBytes
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entries == maxEntries {
+			return fmt.Errorf("%w: more than %d entries", errTreeTooLarge, maxEntries)
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("entry %q escapes the archive root", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if hdr.Size < 0 || hdr.Size > remaining {
+				return fmt.Errorf("%w: %q would pass %d bytes unpacked", errTreeTooLarge, hdr.Name, maxBytes)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+			if err != nil {
+				return err
+			}
+			// The tar reader already stops at hdr.Size; the limit keeps
+			// that true whatever the header claims.
+			n, err := io.Copy(f, io.LimitReader(tr, hdr.Size))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			remaining -= n
+		}
+	}
+}
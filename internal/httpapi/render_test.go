@@ -0,0 +1,209 @@
+package httpapi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+const renderTestConfig = `transports:
+  - name: "transport-udp"
+    protocol: "udp"
+    bind: "0.0.0.0"
+
+endpoint_templates:
+  - name: "endpoint-template"
+    context: "internal"
+
+dialplan:
+  context: "internal"
+`
+
+const renderTestContacts = `contacts:
+  - id: ada
+    first_name: Ada
+    ext: "100"
+    password: "pw"
+    endpoint:
+      template: endpoint-template
+  - id: broken
+    first_name: Broken
+    ext: "101"
+`
+
+func renderArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatalf("write body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRenderEndpointBuildsUploadedTree(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	handler := srv.Handler()
+	archive := renderArchive(t, map[string]string{
+		"config.yaml":         renderTestConfig,
+		"contacts/users.yaml": renderTestContacts,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/render", bytes.NewReader(archive))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/xml/api/render", bytes.NewReader(archive))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp renderResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Contacts != 1 {
+		t.Fatalf("expected 1 contact, got %d", resp.Contacts)
+	}
+	if !strings.Contains(resp.Files["pjsip.conf"], "[100]") || !strings.Contains(resp.Files["phonebook.xml"], "<FirstName>Ada</FirstName>") {
+		t.Fatalf("unexpected rendered files: %+v", resp.Files)
+	}
+	if len(resp.Warnings) == 0 || !strings.Contains(strings.Join(resp.Warnings, "\n"), "101") {
+		t.Fatalf("expected a warning for the skipped contact, got %v", resp.Warnings)
+	}
+	if _, version := srv.Stats(); version != 0 {
+		t.Fatalf("render must not touch the served snapshot, version=%d", version)
+	}
+}
+
+func TestRenderEndpointIgnoresContactsDB(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	archive := renderArchive(t, map[string]string{
+		"config.yaml":         renderTestConfig + "contacts_db:\n  path: hr.db\n  table: employees\n",
+		"contacts/users.yaml": renderTestContacts,
+		"hr.db":               "",
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/render", bytes.NewReader(archive))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp renderResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Contacts != 1 || !strings.Contains(strings.Join(resp.Warnings, "\n"), "contacts database") {
+		t.Fatalf("expected the database to be skipped with a warning, got %+v", resp)
+	}
+}
+
+func TestRenderEndpointRejectsEscapingEntries(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	archive := renderArchive(t, map[string]string{"../config.yaml": renderTestConfig})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/render", bytes.NewReader(archive))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for escaping entry, got %d", rr.Code)
+	}
+}
+
+func TestRenderEndpointDisabledWithoutToken(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	req := httptest.NewRequest(http.MethodPost, "/api/render", nil)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when no admin token is configured, got %d", rr.Code)
+	}
+}
+
+func TestRenderEndpointClassifiesBuildErrors(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	cases := []struct {
+		name   string
+		files  map[string]string
+		status int
+		kind   string
+	}{
+		{"missing config", map[string]string{"contacts/users.yaml": renderTestContacts}, http.StatusBadRequest, config.KindMissingConfig},
+		{"parse error", map[string]string{"config.yaml": "transports: [\n"}, http.StatusUnprocessableEntity, config.KindParse},
+		{"validation error", map[string]string{"config.yaml": renderTestConfig + "output:\n  newline: cr\n"}, http.StatusUnprocessableEntity, config.KindValidation},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/render", bytes.NewReader(renderArchive(t, tc.files)))
+			req.Header.Set("Authorization", "Bearer s3cret")
+			rr := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rr, req)
+			var resp renderResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if rr.Code != tc.status || resp.Kind != tc.kind || resp.Error == "" {
+				t.Fatalf("expected %d kind %q, got %d %+v", tc.status, tc.kind, rr.Code, resp)
+			}
+		})
+	}
+}
+
+func TestRenderEndpointRejectsArchiveBombs(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret", RenderMaxBytes: 1 << 10}, testutil.NewTestLogger())
+	post := func(archive []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/render", bytes.NewReader(archive))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// 64 KiB of zeros gzips far below the 1 KiB upload limit but unpacks
+	// past four times it.
+	bomb := renderArchive(t, map[string]string{"config.yaml": renderTestConfig, "contacts/pad.yaml": strings.Repeat("\x00", 64<<10)})
+	if len(bomb) > 1<<10 {
+		t.Fatalf("test archive is %d bytes, expected it under the upload limit", len(bomb))
+	}
+	if code := post(bomb); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a gzip bomb, got %d", code)
+	}
+
+	files := map[string]string{}
+	for i := 0; i <= renderMaxEntries; i++ {
+		files["d/"+strconv.Itoa(i)] = ""
+	}
+	srv = NewServer(Config{Addr: ":0", BasePath: "/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	if code := post(renderArchive(t, files)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for too many entries, got %d", code)
+	}
+}
@@ -0,0 +1,54 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type resolveResponse struct {
+	Number    string `json:"number"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Extension string `json:"extension"`
+	GroupID   *int   `json:"group_id,omitempty"`
+}
+
+// handleResolve turns ?number= into the name the calls dashboard shows for
+// it, through the same lookup: extensions and phone numbers of named
+// contacts, then the external contacts, matched as given or with
+// formatting stripped, and a SIP URI reduced to its user part. A contact
+// match also carries the contact's id, extension and group; an external
+// one only its name. The route sits behind requireAuth, and when
+// AdminToken is set the caller must also present that.
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken != "" && !s.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	number := strings.TrimSpace(r.URL.Query().Get("number"))
+	if number == "" {
+		http.Error(w, "number is required", http.StatusBadRequest)
+		return
+	}
+	snap, _ := s.currentSnapshot()
+	s.mu.RLock()
+	external := s.external
+	s.mu.RUnlock()
+	party := sipUser(number)
+	name, ok := lookupParty(buildNameLookup(snap.Contacts, external), party)
+	if !ok {
+		http.Error(w, "no contact matches number", http.StatusNotFound)
+		return
+	}
+	resp := resolveResponse{Number: number, Name: name}
+	// The name lookup prefers contacts, so a contact found for the same
+	// party under the same name is the one it returned.
+	if i, ok := lookupParty(buildContactLookup(snap.Contacts), party); ok && contactName(snap.Contacts[i]) == name {
+		contact := snap.Contacts[i]
+		resp.ID, resp.Extension, resp.GroupID = contact.ID, contact.Extension, contact.GroupID
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,103 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+func TestResolveMatchesNumbersLikeTheDashboard(t *testing.T) {
+	group := 3
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{
+		{ID: "ada", FirstName: "Ada", LastName: "Lovelace", Extension: "1001", GroupID: &group, Phones: []model.Phone{{Number: "+1 (555) 010-0000"}}},
+		{ID: "nameless", Extension: "1002"},
+	}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/resolve"+query, nil))
+		return rr
+	}
+
+	for _, number := range []string{"1001", "%2B15550100000", "%2B1-555-010-0000"} {
+		rr := get("?number=" + number)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", number, rr.Code, rr.Body.String())
+		}
+		var resp resolveResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if resp.ID != "ada" || resp.Name != "Ada Lovelace" || resp.Extension != "1001" || resp.GroupID == nil || *resp.GroupID != 3 {
+			t.Fatalf("%s: unexpected match %+v", number, resp)
+		}
+	}
+	// Contacts without a name are not resolved, as on the dashboard.
+	if rr := get("?number=1002"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unnamed contact, got %d", rr.Code)
+	}
+	if rr := get("?number=9999"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown number, got %d", rr.Code)
+	}
+	if rr := get(""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a number, got %d", rr.Code)
+	}
+}
+
+func TestResolveUsesExternalContactsAndSIPURIs(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{ID: "ada", FirstName: "Ada", Extension: "1001"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	srv.SetExternalContacts(map[string]string{"+15550199000": "Plumber", "1001": "Shadowed"})
+	handler := srv.Handler()
+
+	resolve := func(number string) resolveResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/resolve?number="+url.QueryEscape(number), nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", number, rr.Code, rr.Body.String())
+		}
+		var resp resolveResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return resp
+	}
+
+	if resp := resolve("+1 555 019 9000"); resp.Name != "Plumber" || resp.ID != "" || resp.Extension != "" {
+		t.Fatalf("expected the external name without contact fields, got %+v", resp)
+	}
+	if resp := resolve(`"Ada" <sip:1001@pbx.example.com:5060>`); resp.Name != "Ada" || resp.ID != "ada" || resp.Extension != "1001" {
+		t.Fatalf("expected the SIP URI's user part to resolve to Ada, got %+v", resp)
+	}
+	if resp := resolve("sip:+15550199000@trunk"); resp.Name != "Plumber" {
+		t.Fatalf("expected a SIP URI to resolve through the external contacts, got %+v", resp)
+	}
+}
+
+func TestResolveRequiresAdminTokenWhenSet(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/", AdminToken: "s3cret"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Ada", Extension: "1001"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/resolve?number=1001", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the token, got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/xml/api/resolve?number=1001", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 under the base path with the token, got %d", rr.Code)
+	}
+}
@@ -1,29 +1,57 @@
 package httpapi
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/n3wscott/phonebook/internal/calls"
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/csvgen"
 	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/project"
+	"github.com/n3wscott/phonebook/internal/xmlgen"
 )
 
 // Server exposes phonebook HTTP endpoints.
 type Server struct {
 	addr       string
+	dashAddr   string
 	basePath   string
 	tlsCert    string
 	tlsKey     string
 	allowDebug bool
+	maxBody    int64
+	sortKey    model.SortKey
+	debugMax   int
+	debugBusy  atomic.Bool
+	wsProtos   []string
+	wsPing     time.Duration
+	wsIdle     time.Duration
+	adminToken string
+	authToken  string
+	basicUser  string
+	basicPass  string
+	renderMax  int64
+	liveDir    string
+	grace      time.Duration
+	metrics    bool
+	headers    http.Header
+	output     config.Output
+	privacy    CallerPrivacy
 	logger     Logger
 	calls      *calls.Service
 	broadcast  BroadcastConfig
@@ -31,8 +59,38 @@ type Server struct {
 	mu       sync.RWMutex
 	snapshot snapshot
 	version  uint64
+	subs     map[int]chan uint64
+	nextSub  int
 	httpSrv  *http.Server
+	dashSrv  *http.Server
 	tr069    tr069Stats
+	build    project.BuildStats
+	// external names outside numbers on the calls dashboard; see
+	// SetExternalContacts.
+	external map[string]string
+
+	// ready is closed by the first Update; until then snapshot routes
+	// answer 503.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// closed is set once Start begins shutting down; later Updates are
+	// dropped so a reload racing shutdown cannot publish. stopping is
+	// closed at the same time so WebSocket handlers, whose hijacked
+	// connections http.Server.Shutdown does not track, can say goodbye.
+	closed   bool
+	stopping chan struct{}
+	// asterisk holds the generated configs for /api/config/diff.
+	asterisk map[string][]byte
+	// events is the recent reload history for /events/ws; eventSeq counts
+	// every event published, including ones since dropped from events.
+	events    []ReloadEvent
+	eventSeq  uint64
+	eventSubs map[int]chan uint64
+	// buildMetrics feeds the build counters and histogram on /metrics.
+	buildMetrics buildMetrics
+	// onReload backs POST /api/reload, registered only with canReload.
+	onReload  func() error
+	canReload bool
 }
 
 // Logger abstracts the log methods used here.
@@ -44,15 +102,101 @@ type Logger interface {
 
 // Config bundles HTTP server options.
 type Config struct {
-	Addr        string
-	BasePath    string
-	TLSCert     string
-	TLSKey      string
-	AllowDebug  bool
-	CallService *calls.Service
-	Broadcast   BroadcastConfig
+	Addr string
+	// DashboardAddr, when set, moves the calls dashboard routes (/calls*
+	// and /api/calls/*) off Addr onto their own listener.
+	DashboardAddr string
+	BasePath      string
+	TLSCert       string
+	TLSKey        string
+	AllowDebug    bool
+	CallService   *calls.Service
+	Broadcast     BroadcastConfig
+	// MaxBodyBytes caps request bodies accepted by read-only (GET/HEAD)
+	// routes. Zero uses defaultMaxReadBody.
+	MaxBodyBytes int64
+	// ContactSort is the default order for contact listings; requests may
+	// override it with ?sort=.
+	ContactSort model.SortKey
+	// DebugMaxContacts caps how many contacts the debug page renders. Zero
+	// uses defaultDebugMaxContacts.
+	DebugMaxContacts int
+	// WebSocketSubprotocols lists the subprotocols the calls WebSocket may
+	// select from a client's Sec-WebSocket-Protocol offer. Empty negotiates
+	// none.
+	WebSocketSubprotocols []string
+	// WebSocketPingInterval is how often the calls WebSocket pings clients;
+	// it also bounds each frame write. Zero uses defaultWSPingInterval.
+	WebSocketPingInterval time.Duration
+	// WebSocketIdleTimeout closes a calls WebSocket when nothing (including
+	// pong replies) has been read from the client for this long. Zero uses
+	// defaultWSIdleTimeout.
+	WebSocketIdleTimeout time.Duration
+	// AuthToken, when set, must be presented as a bearer token (or ?token=)
+	// to read the phonebooks, contacts, debug page, reload events, and the
+	// calls and broadcast dashboards. Health checks stay open.
+	AuthToken string
+	// BasicAuthUser and BasicAuthPass, when set, are also accepted as HTTP
+	// Basic credentials on the phonebook routes, for phones such as
+	// Grandstream GXPs that cannot send a bearer token.
+	BasicAuthUser string
+	BasicAuthPass string
+	// AdminToken enables POST /api/render for clients presenting it as a
+	// bearer token. Empty leaves the route unregistered.
+	AdminToken string
+	// RenderMaxBytes caps uploads to /api/render. Zero uses
+	// defaultRenderMaxBytes.
+	RenderMaxBytes int64
+	// LiveDir is the deployed Asterisk config directory that
+	// GET /api/config/diff compares against. The route needs AdminToken too.
+	LiveDir string
+	// StartupGrace is how long a request for the phonebook or provisioning
+	// waits for the first snapshot before getting a 503 with Retry-After.
+	// Zero answers 503 right away.
+	StartupGrace time.Duration
+	// EnableMetrics serves Prometheus metrics on /metrics.
+	EnableMetrics bool
+	// ExtraHeaders are added to every response on both listeners. A
+	// handler's own headers (Content-Type, ETag, Cache-Control, ...) win.
+	ExtraHeaders map[string]string
+	// CallerPrivacy hides external numbers on the calls dashboard and API.
+	CallerPrivacy CallerPrivacy
+	// AllowReload enables POST /api/reload, which runs OnReload to rebuild
+	// and publish a new snapshot. The route needs AdminToken too when that
+	// is set.
+	AllowReload bool
+	OnReload    func() error
+}
+
+// CallerPrivacy controls how call parties that match no contact are shown
+// on the calls dashboard. The zero value shows them unchanged.
+type CallerPrivacy struct {
+	// MaskDigits, when positive, shows only the last MaskDigits digits of
+	// an external number, such as "***1234".
+	MaskDigits int
+	// UnknownLabel is shown as the name of external parties, such as
+	// "Unknown caller". Empty leaves the name blank.
+	UnknownLabel string
 }
 
+func (p CallerPrivacy) mask(party string) string {
+	if p.MaskDigits <= 0 || len(party) <= p.MaskDigits || normalizeNumber(party) != party {
+		return party
+	}
+	return "***" + party[len(party)-p.MaskDigits:]
+}
+
+const (
+	defaultMaxReadBody      = 4 << 10
+	defaultDebugMaxContacts = 500
+	defaultWSPingInterval   = 25 * time.Second
+	defaultWSIdleTimeout    = 60 * time.Second
+	defaultRenderMaxBytes   = 16 << 20
+	// startupRetryAfter is the Retry-After, in seconds, sent while the
+	// first build is still running.
+	startupRetryAfter = "5"
+)
+
 // MessageSender sends one SIP MESSAGE.
 type MessageSender interface {
 	SendMessage(ctx context.Context, msg calls.Message) error
@@ -76,14 +220,35 @@ type BroadcastConfig struct {
 // snapshot contains the data served to clients.
 type snapshot struct {
 	XML            []byte
+	XMLGzip        []byte
 	Contacts       []model.Contact
 	Provision      map[string][]byte
+	Vendor         map[string]vendorPhonebook
+	ContactsJSON   vendorPhonebook
+	ContactsCSV    vendorPhonebook
+	Groups         *groupPhonebooks
 	ContactCount   int
 	ProvisionCount int
 	ETag           string
 	LastModified   time.Time
 }
 
+// vendorPhonebook is a pre-rendered phonebook in a non-Grandstream format.
+type vendorPhonebook struct {
+	Body []byte
+	// Gzip is Body compressed, or nil when that would not be smaller.
+	Gzip []byte
+	ETag string
+}
+
+// vendorRoutes maps the extra phonebook routes served next to phonebook.xml
+// to their xmlgen.Formats names.
+var vendorRoutes = map[string]string{
+	"polycom.xml": "polycom",
+	"fanvil.xml":  "fanvil",
+	"yealink.xml": "yealink",
+}
+
 type tr069Stats struct {
 	Count      uint64
 	LastSeen   time.Time
@@ -95,13 +260,34 @@ type tr069Stats struct {
 func New(cfg Config, logger Logger) *Server {
 	return &Server{
 		addr:       cfg.Addr,
+		dashAddr:   cfg.DashboardAddr,
 		basePath:   cfg.BasePath,
 		tlsCert:    cfg.TLSCert,
 		tlsKey:     cfg.TLSKey,
 		allowDebug: cfg.AllowDebug,
+		maxBody:    cfg.MaxBodyBytes,
+		sortKey:    cfg.ContactSort,
+		debugMax:   cfg.DebugMaxContacts,
+		wsProtos:   append([]string(nil), cfg.WebSocketSubprotocols...),
+		wsPing:     cfg.WebSocketPingInterval,
+		wsIdle:     cfg.WebSocketIdleTimeout,
+		adminToken: cfg.AdminToken,
+		authToken:  cfg.AuthToken,
+		basicUser:  cfg.BasicAuthUser,
+		basicPass:  cfg.BasicAuthPass,
+		renderMax:  cfg.RenderMaxBytes,
+		liveDir:    cfg.LiveDir,
+		grace:      cfg.StartupGrace,
+		metrics:    cfg.EnableMetrics,
+		headers:    headerSet(cfg.ExtraHeaders),
+		privacy:    cfg.CallerPrivacy,
 		logger:     logger,
 		calls:      cfg.CallService,
 		broadcast:  cfg.Broadcast,
+		ready:      make(chan struct{}),
+		stopping:   make(chan struct{}),
+		onReload:   cfg.OnReload,
+		canReload:  cfg.AllowReload,
 	}
 }
 
@@ -113,66 +299,168 @@ func NewServer(cfg Config, logger Logger) *Server {
 // Handler exposes the HTTP handler for use in tests.
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc(s.join("phonebook.xml"), s.handlePhonebook)
-	mux.HandleFunc(s.join("healthz"), s.handleHealthz)
-	mux.HandleFunc("/prov/", s.handleProvision)
+	mux.HandleFunc(s.join("phonebook.xml"), s.readOnly(s.requirePhonebookAuth(s.whenReady(s.handlePhonebook))))
+	for route := range vendorRoutes {
+		mux.HandleFunc(s.join(route), s.readOnly(s.requirePhonebookAuth(s.whenReady(s.handleVendorPhonebook(route)))))
+	}
+	mux.HandleFunc(s.join("contacts.csv"), s.readOnly(s.requireAuth(s.whenReady(s.handleContactsCSV))))
+	mux.HandleFunc(s.join("healthz"), s.readOnly(s.handleHealthz))
+	mux.HandleFunc("/api/openapi.json", s.readOnly(s.handleOpenAPI))
+	mux.HandleFunc("/api/resolve", s.readOnly(s.requireAuth(s.whenReady(s.handleResolve))))
+	mux.HandleFunc("/api/contacts", s.readOnly(s.requireAuth(s.handleContacts)))
+	mux.HandleFunc("/events/ws", s.requireAuth(s.handleEventsWS))
+	mux.HandleFunc("/prov/", s.readOnly(s.whenReady(s.handleProvision)))
 	mux.HandleFunc("/tr069", s.handleTR069)
 	if s.basePath != "/" {
-		mux.HandleFunc(s.join("prov/"), s.handleProvision)
+		mux.HandleFunc(s.join("prov/"), s.readOnly(s.whenReady(s.handleProvision)))
+		mux.HandleFunc(s.join("api/resolve"), s.readOnly(s.requireAuth(s.whenReady(s.handleResolve))))
+		mux.HandleFunc(s.join("api/contacts"), s.readOnly(s.requireAuth(s.handleContacts)))
+		mux.HandleFunc(s.join("events/ws"), s.requireAuth(s.handleEventsWS))
 	}
-	if s.calls != nil {
-		mux.HandleFunc("/calls", s.handleCallsPage)
-		mux.HandleFunc("/calls/ws", s.handleCallsWS)
-		mux.HandleFunc("/api/calls/active", s.handleCallsActive)
-		mux.HandleFunc("/api/calls/history", s.handleCallsHistory)
-		mux.HandleFunc("/api/calls/contacts", s.handleCallsContacts)
+	if s.dashAddr == "" {
+		s.registerCalls(mux)
+	}
+	if s.broadcast.Enabled {
+		mux.HandleFunc("/broadcast", s.readOnly(s.requireAuth(s.handleBroadcastPage)))
+		mux.HandleFunc("/api/broadcast/contacts", s.readOnly(s.requireAuth(s.handleBroadcastContacts)))
+		mux.HandleFunc("/api/broadcast/send", s.requireAuth(s.handleBroadcastSend))
 		if s.basePath != "/" {
-			mux.HandleFunc(s.join("calls"), s.handleCallsPage)
-			mux.HandleFunc(s.join("calls/ws"), s.handleCallsWS)
-			mux.HandleFunc(s.join("api/calls/active"), s.handleCallsActive)
-			mux.HandleFunc(s.join("api/calls/history"), s.handleCallsHistory)
-			mux.HandleFunc(s.join("api/calls/contacts"), s.handleCallsContacts)
+			mux.HandleFunc(s.join("broadcast"), s.readOnly(s.requireAuth(s.handleBroadcastPage)))
+			mux.HandleFunc(s.join("api/broadcast/contacts"), s.readOnly(s.requireAuth(s.handleBroadcastContacts)))
+			mux.HandleFunc(s.join("api/broadcast/send"), s.requireAuth(s.handleBroadcastSend))
 		}
 	}
-	if s.broadcast.Enabled {
-		mux.HandleFunc("/broadcast", s.handleBroadcastPage)
-		mux.HandleFunc("/api/broadcast/contacts", s.handleBroadcastContacts)
-		mux.HandleFunc("/api/broadcast/send", s.handleBroadcastSend)
+	if s.adminToken != "" {
+		mux.HandleFunc("/api/render", s.handleRender)
+		if s.basePath != "/" {
+			mux.HandleFunc(s.join("api/render"), s.handleRender)
+		}
+		if s.liveDir != "" {
+			mux.HandleFunc("/api/config/diff", s.readOnly(s.whenReady(s.handleConfigDiff)))
+			if s.basePath != "/" {
+				mux.HandleFunc(s.join("api/config/diff"), s.readOnly(s.whenReady(s.handleConfigDiff)))
+			}
+		}
+	}
+	if s.canReload && s.onReload != nil {
+		mux.HandleFunc("/api/reload", s.whenReady(s.requireAuth(s.handleReload)))
+		if s.basePath != "/" {
+			mux.HandleFunc(s.join("api/reload"), s.whenReady(s.requireAuth(s.handleReload)))
+		}
+	}
+	if s.metrics {
+		mux.HandleFunc("/metrics", s.readOnly(s.handleMetrics))
 		if s.basePath != "/" {
-			mux.HandleFunc(s.join("broadcast"), s.handleBroadcastPage)
-			mux.HandleFunc(s.join("api/broadcast/contacts"), s.handleBroadcastContacts)
-			mux.HandleFunc(s.join("api/broadcast/send"), s.handleBroadcastSend)
+			mux.HandleFunc(s.join("metrics"), s.readOnly(s.handleMetrics))
 		}
 	}
 	if s.allowDebug {
-		mux.HandleFunc(s.join("debug"), s.handleDebug)
+		mux.HandleFunc(s.join("debug"), s.readOnly(s.requireAuth(s.whenReady(s.handleDebug))))
 	}
-	return mux
+	return s.withHeaders(mux)
+}
+
+// DashboardHandler exposes the calls dashboard routes served on
+// DashboardAddr. It is empty when no call service is configured.
+func (s *Server) DashboardHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.registerCalls(mux)
+	return s.withHeaders(mux)
 }
 
-// Start launches the HTTP server and blocks until it exits.
+func (s *Server) registerCalls(mux *http.ServeMux) {
+	if s.calls == nil {
+		return
+	}
+	mux.HandleFunc("/calls", s.readOnly(s.requireAuth(s.handleCallsPage)))
+	mux.HandleFunc("/calls/ws", s.requireAuth(s.handleCallsWS))
+	mux.HandleFunc("/api/calls/active", s.readOnly(s.requireAuth(s.handleCallsActive)))
+	mux.HandleFunc("/api/calls/history", s.readOnly(s.requireAuth(s.handleCallsHistory)))
+	mux.HandleFunc("/api/calls/contacts", s.readOnly(s.requireAuth(s.handleCallsContacts)))
+	mux.HandleFunc("/api/calls/config", s.readOnly(s.requireAuth(s.handleCallsConfig)))
+	// Injected events change what every dashboard shows, so the route only
+	// exists behind a token, as /api/render does behind the admin token.
+	if s.authToken != "" {
+		mux.HandleFunc("/api/calls/event", s.requireAuth(s.handleCallsEvent))
+	}
+	if s.basePath != "/" {
+		mux.HandleFunc(s.join("calls"), s.readOnly(s.requireAuth(s.handleCallsPage)))
+		mux.HandleFunc(s.join("calls/ws"), s.requireAuth(s.handleCallsWS))
+		mux.HandleFunc(s.join("api/calls/active"), s.readOnly(s.requireAuth(s.handleCallsActive)))
+		mux.HandleFunc(s.join("api/calls/history"), s.readOnly(s.requireAuth(s.handleCallsHistory)))
+		mux.HandleFunc(s.join("api/calls/contacts"), s.readOnly(s.requireAuth(s.handleCallsContacts)))
+		mux.HandleFunc(s.join("api/calls/config"), s.readOnly(s.requireAuth(s.handleCallsConfig)))
+		if s.authToken != "" {
+			mux.HandleFunc(s.join("api/calls/event"), s.requireAuth(s.handleCallsEvent))
+		}
+	}
+}
+
+// Start launches the HTTP server, plus the dashboard listener when
+// DashboardAddr is set, and blocks until either exits. Both are shut down
+// together.
 func (s *Server) Start(ctx context.Context) error {
-	handler := s.Handler()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	srv := &http.Server{
 		Addr:    s.addr,
-		Handler: handler,
+		Handler: s.Handler(),
 	}
 	s.httpSrv = srv
+	servers := []*http.Server{srv}
+	if s.dashAddr != "" {
+		s.dashSrv = &http.Server{
+			Addr:    s.dashAddr,
+			Handler: s.DashboardHandler(),
+		}
+		servers = append(servers, s.dashSrv)
+	}
 
 	go func() {
 		<-ctx.Done()
+		s.beginShutdown()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		_ = srv.Shutdown(shutdownCtx)
+		for _, srv := range servers {
+			_ = srv.Shutdown(shutdownCtx)
+		}
 	}()
 
 	s.logger.Info("serving", "addr", s.addr, "basePath", s.basePath)
+	if s.dashAddr != "" {
+		s.logger.Info("serving calls dashboard", "addr", s.dashAddr)
+	}
 
-	if s.tlsCert != "" && s.tlsKey != "" {
-		return srv.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if s.tlsCert != "" && s.tlsKey != "" {
+				errCh <- srv.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+				return
+			}
+			errCh <- srv.ListenAndServe()
+		}(srv)
+	}
+	err := <-errCh
+	cancel()
+	for range servers[1:] {
+		if other := <-errCh; err == nil || errors.Is(err, http.ErrServerClosed) {
+			err = other
+		}
+	}
+	return err
+}
+
+// beginShutdown stops publishing updates and tells WebSocket handlers to
+// close their connections.
+func (s *Server) beginShutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.stopping)
 	}
-	return srv.ListenAndServe()
 }
 
 // Update replaces the XML/contact snapshot and bumps the version counter.
@@ -181,25 +469,107 @@ func (s *Server) Update(contacts []model.Contact, xml []byte, lastModified time.
 }
 
 // UpdateProvision replaces XML/contact/provisioning snapshots and bumps version.
+// It is a no-op once Start has begun shutting down.
 func (s *Server) UpdateProvision(contacts []model.Contact, xml []byte, provision map[string][]byte, lastModified time.Time) {
+	s.mu.RLock()
+	output := s.output
+	sortKey := s.sortKey
+	s.mu.RUnlock()
+	vendor := make(map[string]vendorPhonebook, len(vendorRoutes))
+	for route, format := range vendorRoutes {
+		body, err := xmlgen.Formats[format](contacts)
+		if err != nil {
+			s.logger.Warn("render phonebook failed", "format", format, "err", err)
+			continue
+		}
+		body = output.Apply(body)
+		vendor[route] = vendorPhonebook{Body: body, Gzip: gzipBody(body), ETag: etagFor(body)}
+	}
+
+	// The exports follow the configured sort, like /debug; the phonebooks
+	// keep the loader's extension order, since phones sort on their own.
+	listed := append([]model.Contact(nil), contacts...)
+	model.SortContacts(listed, sortKey)
+	contactsJSON := renderContactsJSON(listed)
+	csvBody := output.Apply(csvgen.Build(listed))
+	contactsCSV := vendorPhonebook{Body: csvBody, Gzip: gzipBody(csvBody), ETag: etagFor(csvBody)}
+	xmlGzip := gzipBody(xml)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		s.logger.Debug("dropping snapshot update after shutdown")
+		return
+	}
 	if lastModified.IsZero() {
 		lastModified = time.Now().UTC()
 	}
 	etag := etagFor(xml)
 	provCopy := cloneProvision(provision)
+	contactsCopy := append([]model.Contact(nil), contacts...)
 	s.snapshot = snapshot{
 		XML:            append([]byte(nil), xml...),
-		Contacts:       append([]model.Contact(nil), contacts...),
+		XMLGzip:        xmlGzip,
+		Contacts:       contactsCopy,
 		Provision:      provCopy,
+		Vendor:         vendor,
+		ContactsJSON:   contactsJSON,
+		ContactsCSV:    contactsCSV,
+		Groups:         newGroupPhonebooks(contactsCopy, output),
 		ContactCount:   len(contacts),
 		ProvisionCount: len(provCopy),
 		ETag:           etag,
 		LastModified:   lastModified.UTC().Round(time.Second),
 	}
 	s.version++
+	s.readyOnce.Do(func() { close(s.ready) })
+	notifyLatest(s.subs, s.version)
+}
+
+// notifyLatest sends v to every subscriber, keeping only the newest value in
+// each buffer; a slow subscriber should see where we are now, not every step
+// along the way. The caller holds s.mu.
+func notifyLatest(subs map[int]chan uint64, v uint64) {
+	for _, ch := range subs {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the new snapshot version after
+// each Update, and a cancel func that closes it.
+func (s *Server) Subscribe() (<-chan uint64, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subs == nil {
+		s.subs = make(map[int]chan uint64)
+	}
+	return s.addSub(s.subs)
+}
+
+// addSub registers a new channel in subs. The caller holds s.mu.
+func (s *Server) addSub(subs map[int]chan uint64) (<-chan uint64, func()) {
+	id := s.nextSub
+	s.nextSub++
+	ch := make(chan uint64, 1)
+	subs[id] = ch
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := subs[id]; ok {
+			delete(subs, id)
+			close(ch)
+		}
+	}
+	return ch, cancel
 }
 
 func (s *Server) currentSnapshot() (snapshot, uint64) {
@@ -208,37 +578,194 @@ func (s *Server) currentSnapshot() (snapshot, uint64) {
 	return s.snapshot, s.version
 }
 
+// SetContactSort replaces the default order for contact listings, for
+// callers that only learn it from config after the server has started.
+// The /api/contacts and contacts.csv exports pick it up on the next Update.
+func (s *Server) SetContactSort(key model.SortKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sortKey = key
+}
+
+// SetExtraHeaders replaces the headers added to every response, so
+// server.headers in config.yaml follows reloads.
+func (s *Server) SetExtraHeaders(headers map[string]string) {
+	set := headerSet(headers)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headers = set
+}
+
+// SetPresenceAliases passes presence_aliases from config.yaml to the call
+// service, so the map follows reloads. It is a no-op without one.
+func (s *Server) SetPresenceAliases(aliases map[string]string) {
+	if s.calls != nil {
+		s.calls.SetPresenceAliases(aliases)
+	}
+}
+
+// SetExternalContacts replaces the names the calls dashboard shows for
+// outside numbers, so external_contacts follows reloads. Contacts win when
+// both list a number.
+func (s *Server) SetExternalContacts(names map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.external = names
+}
+
+// SetOutput sets the line endings applied to the vendor phonebooks rendered
+// by later Updates, matching output in config.yaml.
+func (s *Server) SetOutput(output config.Output) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.output = output
+}
+
+// SetBuildStats records the timings of the build behind the current snapshot
+// for the debug page.
+func (s *Server) SetBuildStats(stats project.BuildStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.build = stats
+}
+
+func (s *Server) buildStats() project.BuildStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.build
+}
+
+// Contacts returns a copy of the current snapshot's contacts, for other
+// listeners that serve the same directory.
+func (s *Server) Contacts() []model.Contact {
+	snap, _ := s.currentSnapshot()
+	return append([]model.Contact(nil), snap.Contacts...)
+}
+
 // Stats returns the current contact count and version number.
 func (s *Server) Stats() (int, uint64) {
 	snap, version := s.currentSnapshot()
 	return snap.ContactCount, version
 }
 
+// handlePhonebook serves the Grandstream phonebook, or with ?vendor= any
+// of the vendorRoutes formats, so phones of every make can share one URL
+// pattern. ?group= limits it to the contacts with that group_id.
 func (s *Server) handlePhonebook(w http.ResponseWriter, r *http.Request) {
 	snap, _ := s.currentSnapshot()
-	if len(snap.XML) == 0 {
+	query := r.URL.Query()
+	vendor := query.Get("vendor")
+	if vendor == "" {
+		vendor = "grandstream"
+	}
+	route, known := "", vendor == "grandstream"
+	for name, format := range vendorRoutes {
+		if format == vendor {
+			route, known = name, true
+		}
+	}
+	if !known {
+		http.Error(w, "unknown vendor", http.StatusBadRequest)
+		return
+	}
+
+	if query.Has("group") {
+		group, ok := parseGroup(query.Get("group"))
+		if !ok {
+			http.Error(w, "group must be an integer from 0 to 9", http.StatusBadRequest)
+			return
+		}
+		if snap.Groups == nil {
+			http.Error(w, "phonebook not ready", http.StatusServiceUnavailable)
+			return
+		}
+		doc, err := snap.Groups.get(vendor, group)
+		if err != nil {
+			s.logger.Warn("render group phonebook failed", "format", vendor, "group", group, "err", err)
+			http.Error(w, "render failed", http.StatusInternalServerError)
+			return
+		}
+		servePhonebook(w, r, doc.Body, doc.Gzip, doc.ETag, snap.LastModified)
+		return
+	}
+	if route == "" {
+		servePhonebook(w, r, snap.XML, snap.XMLGzip, snap.ETag, snap.LastModified)
+		return
+	}
+	doc := snap.Vendor[route]
+	servePhonebook(w, r, doc.Body, doc.Gzip, doc.ETag, snap.LastModified)
+}
+
+func (s *Server) handleVendorPhonebook(route string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap, _ := s.currentSnapshot()
+		doc := snap.Vendor[route]
+		servePhonebook(w, r, doc.Body, doc.Gzip, doc.ETag, snap.LastModified)
+	}
+}
+
+// servePhonebook writes body, or its pre-compressed gz when the client
+// accepts gzip. Both encodings share one ETag, so a phone's cached copy
+// stays valid whichever it fetched.
+func servePhonebook(w http.ResponseWriter, r *http.Request, body, gz []byte, etag string, lastModified time.Time) {
+	serveDocument(w, r, "application/xml; charset=utf-8", body, gz, etag, lastModified)
+}
+
+// serveDocument is servePhonebook for any pre-rendered content type.
+func serveDocument(w http.ResponseWriter, r *http.Request, contentType string, body, gz []byte, etag string, lastModified time.Time) {
+	if len(body) == 0 {
 		http.Error(w, "phonebook not ready", http.StatusServiceUnavailable)
 		return
 	}
 
-	if match := r.Header.Get("If-None-Match"); match != "" && match == snap.ETag {
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, lastModified) {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
-		if t, err := http.ParseTime(ims); err == nil {
-			if !snap.LastModified.After(t) {
-				w.WriteHeader(http.StatusNotModified)
-				return
+	w.Header().Set("Content-Type", contentType)
+	if gz != nil && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		body = gz
+	}
+	writeBody(w, r, body)
+}
+
+// gzipBody compresses b once per Update so requests never pay for it. It
+// returns nil when compression does not save anything.
+func gzipBody(b []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	_, _ = zw.Write(b)
+	_ = zw.Close()
+	if buf.Len() >= len(b) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding lists gzip (or
+// *) without q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					continue
+				}
 			}
+			return true
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.Header().Set("ETag", snap.ETag)
-	w.Header().Set("Last-Modified", snap.LastModified.UTC().Format(http.TimeFormat))
-	_, _ = w.Write(snap.XML)
+	return false
 }
 
 func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
@@ -268,7 +795,21 @@ func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 	w.Header().Set("Cache-Control", "no-cache")
-	_, _ = w.Write(payload)
+	writeBody(w, r, payload)
+}
+
+// healthzResponse fields stay sorted by JSON key, the order existing clients
+// have always received.
+type healthzResponse struct {
+	Contacts        int    `json:"contacts"`
+	Conflicts       int    `json:"conflicts"`
+	OK              bool   `json:"ok"`
+	ProvisionFiles  int    `json:"provision_files"`
+	TR069Count      uint64 `json:"tr069_count"`
+	TR069LastOUI    string `json:"tr069_last_oui"`
+	TR069LastSeen   string `json:"tr069_last_seen"`
+	TR069LastSerial string `json:"tr069_last_serial"`
+	Version         uint64 `json:"version"`
 }
 
 func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
@@ -276,15 +817,16 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
 	tr069 := s.tr069
 	s.mu.RUnlock()
-	payload := map[string]any{
-		"ok":                len(snap.XML) > 0,
-		"contacts":          snap.ContactCount,
-		"provision_files":   snap.ProvisionCount,
-		"tr069_count":       tr069.Count,
-		"tr069_last_seen":   tr069.LastSeen.UTC().Format(time.RFC3339),
-		"tr069_last_oui":    tr069.LastOUI,
-		"tr069_last_serial": tr069.LastSerial,
-		"version":           version,
+	payload := healthzResponse{
+		OK:              len(snap.XML) > 0,
+		Contacts:        snap.ContactCount,
+		Conflicts:       s.buildStats().Conflicts,
+		ProvisionFiles:  snap.ProvisionCount,
+		TR069Count:      tr069.Count,
+		TR069LastSeen:   tr069.LastSeen.UTC().Format(time.RFC3339),
+		TR069LastOUI:    tr069.LastOUI,
+		TR069LastSerial: tr069.LastSerial,
+		Version:         version,
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	_ = json.NewEncoder(w).Encode(payload)
@@ -292,6 +834,7 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleTR069(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -329,22 +872,244 @@ func (s *Server) handleTR069(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	// Only one debug render at a time; the page is for humans, not loops.
+	if !s.debugBusy.CompareAndSwap(false, true) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "debug view busy", http.StatusTooManyRequests)
+		return
+	}
+	defer s.debugBusy.Store(false)
+
 	snap, version := s.currentSnapshot()
+	contacts, err := s.sortedContacts(r, snap.Contacts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	total := len(contacts)
+	limit := s.debugMax
+	if limit <= 0 {
+		limit = defaultDebugMaxContacts
+	}
+	if total > limit {
+		contacts = contacts[:limit]
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, "<html><body><h1>Contacts (v%[1]d)</h1><ul>", version)
-	for _, c := range snap.Contacts {
+	fmt.Fprintf(w, "<html><body><h1>Contacts (v%[1]d)</h1>", version)
+	if total > limit {
+		fmt.Fprintf(w, "<p>Showing first %d of %d contacts.</p>", limit, total)
+	}
+	fmt.Fprint(w, "<ul>")
+	for _, c := range contacts {
 		phone := ""
 		if len(c.Phones) > 0 {
 			phone = c.Phones[0].Number
 		}
-		fmt.Fprintf(w, "<li>%s %s &ndash; ext %s (%s) &mdash; %s</li>",
+		fmt.Fprintf(w, "<li>%s %s &ndash; ext %s (%s) &mdash; %s",
 			escapeHTML(c.FirstName),
 			escapeHTML(c.LastName),
 			escapeHTML(c.Extension),
 			escapeHTML(phone),
 			escapeHTML(c.SourcePath))
+		if c.Notes != "" {
+			fmt.Fprintf(w, "<pre>%s</pre>", escapeHTML(c.Notes))
+		}
+		fmt.Fprint(w, "</li>")
+	}
+	fmt.Fprintf(w, "</ul><p>Provisioning files: %d</p>", snap.ProvisionCount)
+	writeBuildStats(w, s.buildStats())
+	fmt.Fprint(w, "</body></html>")
+}
+
+// writeBuildStats renders the last build's phase timings as a table; nothing
+// is written before the first SetBuildStats.
+func writeBuildStats(w io.Writer, st project.BuildStats) {
+	if st.Total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h2>Last build</h2><p>%d contacts from %d files in %s", st.Contacts, st.Files, st.Total)
+	if st.ReusedFiles > 0 {
+		fmt.Fprintf(w, " (%d contact files reused)", st.ReusedFiles)
+	}
+	if st.Conflicts > 0 {
+		fmt.Fprintf(w, ", %d duplicate extensions overridden", st.Conflicts)
+	}
+	fmt.Fprint(w, "</p><table>")
+	for _, row := range []struct {
+		phase string
+		took  time.Duration
+	}{
+		{"config load", st.ConfigLoad},
+		{"contact load", st.ContactLoad},
+		{"XML render", st.XMLRender},
+		{"pjsip render", st.PJSIPRender},
+		{"extensions render", st.ExtensionsRender},
+		{"provisioning render", st.ProvisionRender},
+	} {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td></tr>", row.phase, row.took)
+	}
+	fmt.Fprint(w, "</table>")
+}
+
+// sortedContacts returns a sorted copy of contacts using the ?sort= query
+// parameter, or the configured default when absent.
+func (s *Server) sortedContacts(r *http.Request, contacts []model.Contact) ([]model.Contact, error) {
+	s.mu.RLock()
+	key := s.sortKey
+	s.mu.RUnlock()
+	if raw := r.URL.Query().Get("sort"); raw != "" {
+		parsed, err := model.ParseSortKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	}
+	if key == "" {
+		key = model.SortByExtension
+	}
+	out := append([]model.Contact(nil), contacts...)
+	model.SortContacts(out, key)
+	return out, nil
+}
+
+// whenReady holds requests that need a snapshot until the first Update, for
+// up to the configured grace period, and otherwise answers 503 with
+// Retry-After so phones polling during a slow cold start come back later.
+func (s *Server) whenReady(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.ready:
+			h(w, r)
+			return
+		default:
+		}
+		if s.grace > 0 {
+			timer := time.NewTimer(s.grace)
+			defer timer.Stop()
+			select {
+			case <-s.ready:
+				h(w, r)
+				return
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Retry-After", startupRetryAfter)
+		http.Error(w, "phonebook is starting: the first build has not finished", http.StatusServiceUnavailable)
+	}
+}
+
+// withHeaders adds the configured extra headers before h runs, so anything
+// h sets itself replaces them rather than being clobbered.
+func (s *Server) withHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		headers := s.headers
+		s.mu.RUnlock()
+		dst := w.Header()
+		for name, values := range headers {
+			dst[name] = append([]string(nil), values...)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// headerSet canonicalizes a name/value map into an http.Header that is
+// never modified afterwards.
+func headerSet(headers map[string]string) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	out := make(http.Header, len(headers))
+	for name, value := range headers {
+		out.Set(name, value)
 	}
-	fmt.Fprintf(w, "</ul><p>Provisioning files: %d</p></body></html>", snap.ProvisionCount)
+	return out
+}
+
+// readOnly restricts h to GET and HEAD and rejects request bodies larger than
+// the configured limit; read endpoints never need one.
+func (s *Server) readOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := s.maxBodyBytes()
+		if r.ContentLength > limit {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) maxBodyBytes() int64 {
+	if s.maxBody <= 0 {
+		return defaultMaxReadBody
+	}
+	return s.maxBody
+}
+
+// notModified reports whether the conditional request headers match the
+// current representation. If-None-Match takes precedence over
+// If-Modified-Since, as required by RFC 9110.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Values("If-None-Match"); len(match) > 0 {
+		return etagListMatches(strings.Join(match, ","), etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !lastModified.After(t)
+		}
+	}
+	return false
+}
+
+// etagListMatches reports whether an If-None-Match list, such as
+// `"a", W/"b"` or `*`, names etag. If-None-Match uses weak comparison
+// (RFC 9110 section 13.1.2), so W/ prefixes on either side are ignored.
+func etagListMatches(list, etag string) bool {
+	want := strings.TrimPrefix(etag, "W/")
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+		if list[0] == '*' {
+			return true
+		}
+		list = strings.TrimPrefix(list, "W/")
+		if list == "" || list[0] != '"' {
+			// Not an entity tag; skip to the next list member.
+			_, rest, _ := strings.Cut(list, ",")
+			list = rest
+			continue
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if list[:end+2] == want {
+			return true
+		}
+		list = list[end+2:]
+	}
+}
+
+// writeBody sets Content-Length and writes payload, omitting the body for
+// HEAD requests so probing clients get accurate headers only.
+func writeBody(w http.ResponseWriter, r *http.Request, payload []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(payload)
 }
 
 func (s *Server) join(rel string) string {
@@ -381,9 +1146,11 @@ func cloneProvision(in map[string][]byte) map[string][]byte {
 	return out
 }
 
+// etagFor is a weak validator: the identity and gzip encodings of a body
+// share it, which a strong ETag may not.
 func etagFor(b []byte) string {
 	sum := sha256.Sum256(b)
-	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+	return fmt.Sprintf("W/\"%s\"", hex.EncodeToString(sum[:]))
 }
 
 func escapeHTML(input string) string {
@@ -1,15 +1,20 @@
 package httpapi
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/n3wscott/phonebook/internal/calls"
 	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/project"
 	"github.com/n3wscott/phonebook/internal/testutil"
 )
 
@@ -67,10 +72,207 @@ func TestPhonebookHandlerETagAndCaching(t *testing.T) {
 	}
 }
 
+func TestPhonebookIfNoneMatchList(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "John", Extension: "8000"}}, []byte("<AddressBook></AddressBook>"), time.Unix(1700000000, 0))
+	handler := srv.Handler()
+	etag := srv.snapshot.ETag
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("expected a weak ETag, got %q", etag)
+	}
+	strong := strings.TrimPrefix(etag, "W/")
+
+	for _, tc := range []struct {
+		header []string
+		want   int
+	}{
+		{[]string{etag}, http.StatusNotModified},
+		{[]string{strong}, http.StatusNotModified},
+		{[]string{`"a", "b,c", ` + etag}, http.StatusNotModified},
+		{[]string{`"a"`, `W/"b", ` + strong}, http.StatusNotModified},
+		{[]string{"*"}, http.StatusNotModified},
+		{[]string{`"a", W/"b"`}, http.StatusOK},
+		{[]string{`bogus, "a"`}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil)
+		for _, v := range tc.header {
+			req.Header.Add("If-None-Match", v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Fatalf("If-None-Match %q: expected %d, got %d", tc.header, tc.want, rr.Code)
+		}
+	}
+}
+
+func TestPhonebookServesGzipWithSameETag(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	xml := "<AddressBook>" + strings.Repeat("<Contact><FirstName>Alpha</FirstName></Contact>", 50) + "</AddressBook>"
+	srv.Update(nil, []byte(xml), time.Unix(100, 0))
+	handler := srv.Handler()
+
+	get := func(acceptEncoding, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	plain := get("", "")
+	if plain.Header().Get("Content-Encoding") != "" || plain.Body.String() != xml {
+		t.Fatalf("expected identity body without Accept-Encoding, got %q", plain.Header().Get("Content-Encoding"))
+	}
+	zipped := get("deflate, gzip;q=0.8", "")
+	if zipped.Header().Get("Content-Encoding") != "gzip" || zipped.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected gzip with Vary, got headers %v", zipped.Header())
+	}
+	if zipped.Body.Len() >= len(xml) || zipped.Header().Get("Content-Length") != strconv.Itoa(zipped.Body.Len()) {
+		t.Fatalf("expected a smaller body with matching Content-Length, got %d bytes, %s", zipped.Body.Len(), zipped.Header().Get("Content-Length"))
+	}
+	zr, err := gzip.NewReader(zipped.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || string(body) != xml {
+		t.Fatalf("decompressed body mismatch: %v", err)
+	}
+	if zipped.Header().Get("ETag") != plain.Header().Get("ETag") {
+		t.Fatalf("expected one ETag for both encodings, got %s and %s", zipped.Header().Get("ETag"), plain.Header().Get("ETag"))
+	}
+	if rr := get("gzip", plain.Header().Get("ETag")); rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for the identity ETag on a gzip request, got %d", rr.Code)
+	}
+	if rr := get("gzip;q=0", ""); rr.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected gzip;q=0 to get identity, got %q", rr.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestPolycomPhonebookRoute(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, logger)
+	handler := srv.Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/xml/polycom.xml", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before first update, got %d", rr.Code)
+	}
+
+	srv.Update([]model.Contact{{FirstName: "John", LastName: "Doe", Extension: "8000"}}, []byte("<AddressBook/>"), time.Time{})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/polycom.xml", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "<ct>8000</ct>") {
+		t.Fatalf("expected Polycom directory item, got:\n%s", rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	req = httptest.NewRequest(http.MethodGet, "/xml/polycom.xml", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", rr.Code)
+	}
+}
+
+func TestPhonebookVendorQuery(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, logger)
+	srv.Update([]model.Contact{{FirstName: "John", LastName: "Doe", Extension: "8000"}}, []byte("<AddressBook/>"), time.Time{})
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/yealink.xml", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<Name>John Doe</Name>") {
+		t.Fatalf("expected Yealink directory, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+	route := rr.Body.String()
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/phonebook.xml?vendor=yealink", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != route {
+		t.Fatalf("expected ?vendor=yealink to match /yealink.xml, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/phonebook.xml?vendor=grandstream", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "<AddressBook/>" {
+		t.Fatalf("expected the Grandstream phonebook, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/xml/phonebook.xml?vendor=nokia", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown vendor, got %d", rr.Code)
+	}
+}
+
+func TestPhonebookGroupQuery(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, logger)
+	one, three := 1, 3
+	srv.Update([]model.Contact{
+		{FirstName: "Reception", Extension: "1001", GroupID: &one},
+		{FirstName: "Warehouse", Extension: "3001", GroupID: &three},
+		{FirstName: "Ungrouped", Extension: "5001"},
+	}, []byte("<AddressBook/>"), time.Time{})
+	handler := srv.Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	rr := get("/phonebook.xml?group=1")
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "Reception") || strings.Contains(body, "Warehouse") || strings.Contains(body, "Ungrouped") {
+		t.Fatalf("expected only group 1, got %d:\n%s", rr.Code, body)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" || etag == srv.snapshot.ETag {
+		t.Fatalf("expected the filtered phonebook to carry its own ETag, got %q", etag)
+	}
+	if again := get("/phonebook.xml?group=1"); again.Body.String() != body || again.Header().Get("ETag") != etag {
+		t.Fatalf("expected the cached group 1 phonebook, got:\n%s", again.Body.String())
+	}
+	if len(srv.snapshot.Groups.docs) != 1 {
+		t.Fatalf("expected one cached variant, got %d", len(srv.snapshot.Groups.docs))
+	}
+
+	rr = get("/phonebook.xml?group=3&vendor=yealink")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<Name>Warehouse</Name>") || strings.Contains(rr.Body.String(), "Reception") {
+		t.Fatalf("expected group 3 in the Yealink format, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/phonebook.xml"); rr.Body.String() != "<AddressBook/>" {
+		t.Fatalf("expected the unfiltered phonebook without ?group=, got:\n%s", rr.Body.String())
+	}
+	for _, bad := range []string{"abc", "-1", "10", ""} {
+		if rr := get("/phonebook.xml?group=" + bad); rr.Code != http.StatusBadRequest {
+			t.Fatalf("group=%q: expected 400, got %d", bad, rr.Code)
+		}
+	}
+
+	srv.Update([]model.Contact{{FirstName: "Newcomer", Extension: "1002", GroupID: &one}}, []byte("<AddressBook/>"), time.Time{})
+	if rr := get("/phonebook.xml?group=1"); !strings.Contains(rr.Body.String(), "Newcomer") {
+		t.Fatalf("expected the cache dropped on Update, got:\n%s", rr.Body.String())
+	}
+}
+
 func TestHealthEndpoint(t *testing.T) {
 	logger := testutil.NewTestLogger()
 	srv := NewServer(Config{Addr: ":0", BasePath: "/", AllowDebug: false}, logger)
 	srv.Update([]model.Contact{}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	srv.SetBuildStats(project.BuildStats{Conflicts: 2})
 
 	handler := srv.Handler()
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
@@ -81,9 +283,10 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 
 	var body struct {
-		OK       bool   `json:"ok"`
-		Contacts int    `json:"contacts"`
-		Version  uint64 `json:"version"`
+		OK        bool   `json:"ok"`
+		Contacts  int    `json:"contacts"`
+		Conflicts int    `json:"conflicts"`
+		Version   uint64 `json:"version"`
 	}
 	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
 		t.Fatalf("invalid JSON: %v", err)
@@ -91,6 +294,9 @@ func TestHealthEndpoint(t *testing.T) {
 	if !body.OK {
 		t.Fatalf("expected ok=true")
 	}
+	if body.Conflicts != 2 {
+		t.Fatalf("expected the build's conflicts, got %d", body.Conflicts)
+	}
 }
 
 func TestProvisionEndpoint(t *testing.T) {
@@ -216,6 +422,42 @@ func TestCallsEndpointsAreRootMountedWithBasePathCompatibility(t *testing.T) {
 	}
 }
 
+func TestDashboardAddrMovesCallsRoutesToSeparateHandler(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{
+		Addr:          ":0",
+		DashboardAddr: ":0",
+		BasePath:      "/",
+		CallService:   calls.NewService(calls.Options{}, logger),
+	}, logger)
+	srv.Update([]model.Contact{}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+
+	primary := srv.Handler()
+	dashboard := srv.DashboardHandler()
+	for _, path := range []string{"/calls", "/api/calls/active"} {
+		rr := httptest.NewRecorder()
+		primary.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("%s on primary: expected 404, got %d", path, rr.Code)
+		}
+		rr = httptest.NewRecorder()
+		dashboard.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s on dashboard: expected 200, got %d", path, rr.Code)
+		}
+	}
+	rr := httptest.NewRecorder()
+	dashboard.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected phonebook to stay off the dashboard listener, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	primary.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected phonebook on the primary listener, got %d", rr.Code)
+	}
+}
+
 func TestBroadcastEndpointsAreRootMountedWithBasePathCompatibility(t *testing.T) {
 	logger := testutil.NewTestLogger()
 	srv := NewServer(Config{
@@ -249,3 +491,265 @@ func TestBroadcastEndpointsAreRootMountedWithBasePathCompatibility(t *testing.T)
 		t.Fatalf("broadcast page should use root-mounted API paths, got body: %s", body)
 	}
 }
+
+func TestReadOnlyRoutesRejectOtherMethodsAndLargeBodies(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/", MaxBodyBytes: 16}, logger)
+	srv.Update([]model.Contact{}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	req := httptest.NewRequest(http.MethodPost, "/xml/phonebook.xml", strings.NewReader("x"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Allow"); got != "GET, HEAD" {
+		t.Fatalf("expected Allow header, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/xml/phonebook.xml", strings.NewReader(strings.Repeat("x", 64)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+}
+
+func TestPhonebookHandlerHEADOmitsBody(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, logger)
+	xml := []byte("<AddressBook></AddressBook>")
+	srv.Update([]model.Contact{}, xml, time.Unix(1700000000, 0))
+
+	req := httptest.NewRequest(http.MethodHead, "/xml/phonebook.xml", nil)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("expected empty body for HEAD, got %q", rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(xml)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(xml), got)
+	}
+	if rr.Header().Get("ETag") == "" {
+		t.Fatalf("missing ETag header on HEAD")
+	}
+}
+
+func TestPhonebookHandlerHEADConditional(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/xml/"}, logger)
+	srv.Update([]model.Contact{}, []byte("<AddressBook></AddressBook>"), time.Unix(1700000000, 0))
+	handler := srv.Handler()
+
+	req := httptest.NewRequest(http.MethodHead, "/xml/phonebook.xml", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+
+	req = httptest.NewRequest(http.MethodHead, "/xml/phonebook.xml", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for HEAD with matching ETag, got %d", rr.Code)
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Fatalf("expected 304 to carry ETag, got %q", rr.Header().Get("ETag"))
+	}
+
+	// A stale ETag must win over a matching If-Modified-Since.
+	req = httptest.NewRequest(http.MethodHead, "/xml/phonebook.xml", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 when ETag differs, got %d", rr.Code)
+	}
+	if rr.Header().Get("Content-Length") == "" || rr.Body.Len() != 0 {
+		t.Fatalf("expected Content-Length without body, got headers %v body %q", rr.Header(), rr.Body.String())
+	}
+}
+
+func TestDebugHonorsSortParameter(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AllowDebug: true}, logger)
+	srv.Update([]model.Contact{
+		{FirstName: "Amir", LastName: "Khan", Extension: "100"},
+		{FirstName: "Zoe", LastName: "Adams", Extension: "200"},
+	}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/debug?sort=name", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body := rr.Body.String()
+	if strings.Index(body, "Adams") > strings.Index(body, "Khan") {
+		t.Fatalf("expected name order, got %s", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/debug?sort=bogus", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown sort, got %d", rr.Code)
+	}
+}
+
+func TestDebugShowsContactNotes(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AllowDebug: true}, testutil.NewTestLogger())
+	srv.Update([]model.Contact{{FirstName: "Desk", Extension: "100", Notes: "shared desk <do not delete>"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	if !strings.Contains(rr.Body.String(), "<pre>shared desk &lt;do not delete&gt;</pre>") {
+		t.Fatalf("expected escaped notes on the debug page, got %s", rr.Body.String())
+	}
+}
+
+func TestDebugCapsContactsAndRejectsConcurrentRenders(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", AllowDebug: true, DebugMaxContacts: 2}, logger)
+	srv.Update([]model.Contact{
+		{FirstName: "A", Extension: "100"},
+		{FirstName: "B", Extension: "101"},
+		{FirstName: "C", Extension: "102"},
+	}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/debug", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body := rr.Body.String()
+	if !strings.Contains(body, "Showing first 2 of 3 contacts") {
+		t.Fatalf("expected truncation notice, got %s", body)
+	}
+	if strings.Contains(body, "ext 102") {
+		t.Fatalf("expected third contact to be omitted, got %s", body)
+	}
+
+	srv.debugBusy.Store(true)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while a render is in flight, got %d", rr.Code)
+	}
+}
+
+func TestSubscribeReceivesLatestVersion(t *testing.T) {
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, testutil.NewTestLogger())
+	updates, cancel := srv.Subscribe()
+
+	for i := 0; i < 3; i++ {
+		srv.Update(nil, []byte("<AddressBook></AddressBook>"), time.Unix(int64(i), 0))
+	}
+	select {
+	case v := <-updates:
+		if v != 3 {
+			t.Fatalf("expected latest version 3, got %d", v)
+		}
+	default:
+		t.Fatalf("expected a pending version notification")
+	}
+	select {
+	case v := <-updates:
+		t.Fatalf("expected a single coalesced notification, got extra %d", v)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-updates; ok {
+		t.Fatalf("expected channel to be closed after cancel")
+	}
+	srv.Update(nil, nil, time.Time{})
+	cancel()
+}
+
+func TestPhonebookWaitsForFirstSnapshot(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/"}, logger)
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != startupRetryAfter {
+		t.Fatalf("expected 503 with Retry-After before the first build, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rr.Body.String(), "first build") {
+		t.Fatalf("expected a startup explanation, got %q", rr.Body.String())
+	}
+
+	srv = NewServer(Config{Addr: ":0", BasePath: "/", StartupGrace: 5 * time.Second}, logger)
+	handler = srv.Handler()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		srv.Update([]model.Contact{{FirstName: "Late", Extension: "100"}}, []byte("<AddressBook>Late</AddressBook>"), time.Unix(0, 0))
+	}()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Late") {
+		t.Fatalf("expected the request to wait for the first snapshot, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestExtraHeadersDoNotClobberHandlerHeaders(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: ":0", BasePath: "/", ExtraHeaders: map[string]string{
+		"X-Site":       "hq",
+		"Content-Type": "text/plain",
+	}}, logger)
+	srv.Update([]model.Contact{{FirstName: "A", Extension: "100"}}, []byte("<AddressBook></AddressBook>"), time.Unix(0, 0))
+	handler := srv.Handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if got := rr.Header().Get("X-Site"); got != "hq" {
+		t.Fatalf("expected X-Site on the phonebook, got %q", got)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.Contains(got, "xml") {
+		t.Fatalf("expected the handler's Content-Type to win, got %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if got := rr.Header().Get("X-Site"); got != "hq" {
+		t.Fatalf("expected X-Site on a 404 as well, got %q", got)
+	}
+
+	srv.SetExtraHeaders(map[string]string{"X-Other": "1"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Header().Get("X-Site") != "" || rr.Header().Get("X-Other") != "1" {
+		t.Fatalf("expected SetExtraHeaders to replace the set, got %v", rr.Header())
+	}
+}
+
+func TestUpdateAfterShutdownIsIgnored(t *testing.T) {
+	logger := testutil.NewTestLogger()
+	srv := NewServer(Config{Addr: "127.0.0.1:0", BasePath: "/"}, logger)
+	srv.Update(nil, []byte("<AddressBook>before</AddressBook>"), time.Unix(0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(ctx) }()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after cancel")
+	}
+
+	_, before := srv.Stats()
+	srv.Update(nil, []byte("<AddressBook>after</AddressBook>"), time.Unix(0, 0))
+	if _, after := srv.Stats(); after != before {
+		t.Fatalf("expected version to stay %d after shutdown, got %d", before, after)
+	}
+	snap, _ := srv.currentSnapshot()
+	if strings.Contains(string(snap.XML), "after") {
+		t.Fatalf("expected snapshot to be left alone after shutdown")
+	}
+}
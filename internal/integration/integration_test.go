@@ -1,14 +1,18 @@
 package integration_test
 
 import (
+	"bytes"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/n3wscott/phonebook/internal/config"
 	"github.com/n3wscott/phonebook/internal/httpapi"
 	"github.com/n3wscott/phonebook/internal/project"
 	"github.com/n3wscott/phonebook/internal/testutil"
@@ -32,7 +36,7 @@ func TestHotReloadFlow(t *testing.T) {
 `)
 
 	logger := testutil.NewTestLogger()
-	builder := &project.Builder{Dir: dir, Logger: logger}
+	builder := &project.DirBuilder{Dir: dir, Logger: logger}
 	state := buildState(t, builder)
 
 	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/xml/"}, logger)
@@ -79,6 +83,167 @@ func TestHotReloadFlow(t *testing.T) {
 	}
 }
 
+func TestBLFRejectsTemplateDisablingSubscriptions(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	writeFile(t, cfgPath, strings.Replace(string(raw), `allow: ["ulaw"]`, `allow: ["ulaw"]
+    allow_subscribe: "no"`, 1)+`
+asterisk:
+  blf: true
+`)
+
+	_, err = (&project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}).Build()
+	if err == nil || !strings.Contains(err.Error(), "allow_subscribe") {
+		t.Fatalf("expected allow_subscribe conflict, got %v", err)
+	}
+}
+
+func TestDialOptionsRejectNewlines(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	writeFile(t, cfgPath, string(raw)+`  dial:
+    options: ",tT\nexten => 999,1,Hangup()"
+`)
+
+	_, err = (&project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}).Build()
+	if err == nil || !strings.Contains(err.Error(), "dialplan.dial.options") {
+		t.Fatalf("expected newline rejection, got %v", err)
+	}
+}
+
+func TestAmbiguousTransportsWarnByName(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	writeFile(t, cfgPath, strings.Replace(string(raw), `    bind: "0.0.0.0"
+`, `    bind: "0.0.0.0"
+  - name: "transport-udp-alt"
+    protocol: "udp"
+    bind: "0.0.0.0:5070"
+`, 1))
+	contactsDir := filepath.Join(dir, "contacts")
+	if err := os.MkdirAll(contactsDir, 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	contactsFile := filepath.Join(contactsDir, "users.yaml")
+	writeFile(t, contactsFile, `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+`)
+
+	logger := testutil.NewTestLogger()
+	buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+	if !hasWarning(logger, "transport-udp,transport-udp-alt") {
+		t.Fatalf("expected ambiguous transport warning naming both transports, got %+v", logger.Entries())
+	}
+
+	writeFile(t, contactsFile, `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+  transport: transport-udp-alt
+`)
+	logger = testutil.NewTestLogger()
+	buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+	if hasWarning(logger, "transport-udp,transport-udp-alt") {
+		t.Fatalf("expected no warning once every contact pins a transport, got %+v", logger.Entries())
+	}
+}
+
+func TestOverlayMergesConfigAndContacts(t *testing.T) {
+	base := t.TempDir()
+	writeConfig(t, base)
+	if err := os.MkdirAll(filepath.Join(base, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(base, "contacts", "users.yaml"), `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+- id: bravo
+  first_name: Bravo
+  ext: "1001"
+  password: "pw2"
+`)
+
+	site := t.TempDir()
+	writeFile(t, filepath.Join(site, "config.yaml"), `network:
+  external_signaling_address: "203.0.113.7"
+transports:
+  - name: "transport-udp"
+    bind: "0.0.0.0:5080"
+`)
+	if err := os.MkdirAll(filepath.Join(site, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(site, "contacts", "site.yaml"), `- id: bravo
+  first_name: Bravo
+  ext: "2001"
+  password: "pw2"
+- id: charlie
+  first_name: Charlie
+  ext: "2002"
+  password: "pw3"
+`)
+
+	logger := testutil.NewTestLogger()
+	state := buildState(t, &project.DirBuilder{Dir: base, Overlays: []string{site}, Logger: logger})
+
+	if len(state.Config.Transports) != 1 || state.Config.Transports[0].Bind != "0.0.0.0:5080" || state.Config.Transports[0].Protocol != "udp" {
+		t.Fatalf("expected the overlay to merge into the named transport, got %+v", state.Config.Transports)
+	}
+	if state.Config.Network.ExternalSignalingAddress != "203.0.113.7" {
+		t.Fatalf("expected overlay network address, got %q", state.Config.Network.ExternalSignalingAddress)
+	}
+	if state.Config.Dialplan.Context != "internal" {
+		t.Fatalf("expected base dialplan to survive the overlay, got %q", state.Config.Dialplan.Context)
+	}
+	var exts []string
+	for _, c := range state.Contacts {
+		exts = append(exts, c.Extension)
+	}
+	if strings.Join(exts, ",") != "1000,2001,2002" {
+		t.Fatalf("expected overlay to move bravo and add charlie, got %v", exts)
+	}
+	for _, c := range state.Contacts {
+		if c.Extension == "2001" && !strings.HasPrefix(c.SourcePath, site) {
+			t.Fatalf("expected overridden contact to come from the overlay, got %s", c.SourcePath)
+		}
+	}
+	if hasWarning(logger, "2001") {
+		t.Fatalf("expected no duplicate warning for an intentional override, got %+v", logger.Entries())
+	}
+}
+
+func hasWarning(logger *testutil.TestLogger, arg string) bool {
+	for _, e := range logger.Entries() {
+		if e.Level != "warn" {
+			continue
+		}
+		for _, a := range e.Args {
+			if a == arg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func writeConfig(t *testing.T, dir string) {
 	t.Helper()
 	cfg := `global:
@@ -122,7 +287,7 @@ func writeFile(t *testing.T, path, contents string) {
 	}
 }
 
-func buildState(t *testing.T, builder *project.Builder) project.State {
+func buildState(t *testing.T, builder project.Builder) project.State {
 	t.Helper()
 	state, err := builder.Build()
 	if err != nil {
@@ -130,3 +295,548 @@ func buildState(t *testing.T, builder *project.Builder) project.State {
 	}
 	return state
 }
+
+func TestBuildStatsReachDebugPage(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "users.yaml"), `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+`)
+
+	logger := testutil.NewTestLogger()
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+	stats := state.Stats
+	if stats.Contacts != 1 || stats.Files != len(state.Files) || stats.Total <= 0 {
+		t.Fatalf("unexpected build stats %+v", stats)
+	}
+	if sum := stats.ConfigLoad + stats.ContactLoad + stats.XMLRender + stats.PJSIPRender + stats.ExtensionsRender + stats.ProvisionRender; sum > stats.Total {
+		t.Fatalf("phases add up to %s, more than total %s", sum, stats.Total)
+	}
+
+	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/", AllowDebug: true}, logger)
+	srv.Update(state.Contacts, state.Phonebook, state.LastUpdate)
+	srv.SetBuildStats(stats)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	body := rr.Body.String()
+	if !strings.Contains(body, "Last build") || !strings.Contains(body, "pjsip render") {
+		t.Fatalf("expected build timings on the debug page, got %s", body)
+	}
+}
+
+func TestServerHeadersFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	writeFile(t, cfgPath, string(raw)+`server:
+  headers:
+    x-content-type-options: nosniff
+`)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	logger := testutil.NewTestLogger()
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+
+	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/"}, logger)
+	srv.SetExtraHeaders(state.Config.Server.Headers)
+	srv.Update(state.Contacts, state.Phonebook, state.LastUpdate)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("expected configured header on the phonebook, got %q", got)
+	}
+
+	writeFile(t, cfgPath, string(raw)+`server:
+  headers:
+    "Bad Name": x
+`)
+	_, err = (&project.DirBuilder{Dir: dir, Logger: logger}).Build()
+	if err == nil || !strings.Contains(err.Error(), "server.headers") {
+		t.Fatalf("expected invalid header name to fail the build, got %v", err)
+	}
+}
+
+func TestEndpointTemplatesFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0o755); err != nil {
+		t.Fatalf("mkdir templates: %v", err)
+	}
+	tmplPath := filepath.Join(dir, "templates", "webrtc.yaml")
+	writeFile(t, tmplPath, `context: "internal"
+webrtc: "yes"
+disallow: ["all"]
+allow: ["opus"]
+`)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "users.yaml"), `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+  endpoint:
+    template: webrtc
+`)
+
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()})
+	if !strings.Contains(string(state.PJSIP), "webrtc=yes") {
+		t.Fatalf("expected the file template in pjsip.conf, got:\n%s", state.PJSIP)
+	}
+	tracked := false
+	for _, meta := range state.Files {
+		tracked = tracked || meta.Path == tmplPath
+	}
+	if !tracked {
+		t.Fatalf("expected %s in the tracked files, got %+v", tmplPath, state.Files)
+	}
+
+	writeFile(t, filepath.Join(dir, "templates", "dup.yaml"), `name: endpoint-template
+context: "other"
+`)
+	_, err := (&project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}).Build()
+	if err == nil || !strings.Contains(err.Error(), `endpoint template "endpoint-template" defined in both config.yaml and`) {
+		t.Fatalf("expected a name collision error, got %v", err)
+	}
+}
+
+func TestOutputNewlineStyle(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "users.yaml"), `- id: alpha
+  first_name: Alpha
+  ext: "1000"
+  password: "pw1"
+`)
+	logger := testutil.NewTestLogger()
+	plain := buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+
+	writeFile(t, cfgPath, string(raw)+`output:
+  newline: crlf
+  trailing_newline: false
+`)
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: logger})
+	for name, body := range map[string][]byte{"phonebook.xml": state.Phonebook, "pjsip.conf": state.PJSIP, "extensions.conf": state.Extensions} {
+		if bytes.Contains(bytes.ReplaceAll(body, []byte("\r\n"), nil), []byte("\n")) {
+			t.Fatalf("%s has a bare LF with newline: crlf:\n%q", name, body)
+		}
+		if bytes.HasSuffix(body, []byte("\n")) {
+			t.Fatalf("%s ends in a newline with trailing_newline: false", name)
+		}
+	}
+	if got := bytes.ReplaceAll(state.PJSIP, []byte("\r\n"), []byte("\n")); !bytes.Equal(got, bytes.TrimRight(plain.PJSIP, "\n")) {
+		t.Fatalf("expected only line endings to change, got:\n%s", got)
+	}
+
+	writeFile(t, cfgPath, string(raw)+`output:
+  newline: cr
+`)
+	_, err = (&project.DirBuilder{Dir: dir, Logger: logger}).Build()
+	if err == nil || !strings.Contains(err.Error(), "output.newline") {
+		t.Fatalf("expected bad newline style to fail, got %v", err)
+	}
+}
+
+func TestBuildErrorsAreTyped(t *testing.T) {
+	build := func(dir string) error {
+		_, err := (&project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}).Build()
+		return err
+	}
+
+	if err := build(t.TempDir()); !errors.Is(err, config.ErrMissingConfig) {
+		t.Fatalf("expected ErrMissingConfig for an empty dir, got %v", err)
+	}
+
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	contacts := filepath.Join(dir, "contacts", "users.yaml")
+	writeFile(t, contacts, "contacts: [\n")
+	var parseErr *config.ParseError
+	if err := build(dir); !errors.As(err, &parseErr) || parseErr.Path != contacts {
+		t.Fatalf("expected a ParseError for %s, got %v", contacts, err)
+	}
+
+	writeFile(t, contacts, "")
+	cfgPath := filepath.Join(dir, "config.yaml")
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	writeFile(t, cfgPath, string(raw)+"phonebook:\n  lines: 9\n")
+	var validationErr *config.ValidationError
+	if err := build(dir); !errors.As(err, &validationErr) || validationErr.Field != "phonebook.lines" {
+		t.Fatalf("expected a ValidationError for phonebook.lines, got %v", err)
+	}
+	if kind := config.ErrorKind(build(dir)); kind != config.KindValidation {
+		t.Fatalf("ErrorKind = %q, want %q", kind, config.KindValidation)
+	}
+}
+
+func TestAuditReportsUnusedConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "config.yaml"), `transports:
+  - name: "transport-udp"
+    protocol: "udp"
+    bind: "0.0.0.0"
+  - name: "transport-tls"
+    protocol: "tls"
+    bind: "0.0.0.0:5061"
+
+endpoint_templates:
+  - name: "endpoint-template"
+    context: "internal"
+  - name: "office"
+    context: "internal"
+    transport: "transport-udp"
+  - name: "legacy"
+    context: "internal"
+
+asterisk:
+  static_contacts:
+    - ext: "999"
+      contact: "sip:999@10.0.0.9"
+`)
+	writeFile(t, filepath.Join(dir, "defaults.yaml"), `endpoint:
+  template: "endpoint-template"
+`)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "users.yaml"), `contacts:
+  - first_name: Desk
+    ext: "100"
+    password: "pw"
+    endpoint:
+      template: office
+`)
+
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()})
+	var got []string
+	for _, f := range project.Audit(state) {
+		got = append(got, f.Kind+":"+f.Name)
+	}
+	want := []string{
+		project.FindingOrphanStaticContact + ":999",
+		project.FindingUnusedDefault + ":endpoint-template",
+		project.FindingUnusedTemplate + ":legacy",
+		project.FindingUnusedTransport + ":transport-tls",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Audit() = %v, want %v", got, want)
+	}
+}
+
+func TestIncrementalBuildMatchesFullBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	for i, ext := range []string{"100", "101", "102"} {
+		writeFile(t, filepath.Join(dir, "contacts", ext+".yaml"), "contacts:\n  - first_name: User"+ext+"\n    ext: \""+ext+"\"\n    password: \"pw\"\n    speed_dial: "+strconv.Itoa(i+1)+"\n")
+	}
+	incremental := &project.DirBuilder{Dir: dir, Incremental: true, Logger: testutil.NewTestLogger()}
+	check := func(wantReused int) {
+		t.Helper()
+		full := buildState(t, &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()})
+		inc := buildState(t, incremental)
+		if inc.Stats.ReusedFiles != wantReused {
+			t.Fatalf("ReusedFiles = %d, want %d", inc.Stats.ReusedFiles, wantReused)
+		}
+		if !bytes.Equal(full.Phonebook, inc.Phonebook) || !bytes.Equal(full.PJSIP, inc.PJSIP) || !bytes.Equal(full.Extensions, inc.Extensions) {
+			t.Fatalf("incremental build output differs from a full build")
+		}
+	}
+	check(0)
+	writeFile(t, filepath.Join(dir, "contacts", "101.yaml"), "contacts:\n  - first_name: Renamed\n    ext: \"101\"\n    password: \"pw\"\n")
+	check(2)
+
+	// A duplicate speed-dial slot spans files, so it must still fail even
+	// though the other file came from the cache.
+	writeFile(t, filepath.Join(dir, "contacts", "101.yaml"), "contacts:\n  - first_name: Renamed\n    ext: \"101\"\n    password: \"pw\"\n    speed_dial: 1\n")
+	if _, err := incremental.Build(); err == nil || !strings.Contains(err.Error(), "speed_dial 1") {
+		t.Fatalf("expected the cross-file speed_dial clash, got %v", err)
+	}
+}
+
+func TestContactNotesStayOutOfGeneratedConfigs(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "desk.yaml"), `contacts:
+  - first_name: Desk
+    ext: "100"
+    password: "pw"
+    notes: |
+      shared desk,
+      do not delete
+  - first_name: Bad
+    ext: "101"
+    password: "pw"
+    notes: [1, 2]
+`)
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()})
+	if len(state.Contacts) != 1 {
+		t.Fatalf("expected non-string notes to skip the contact, got %+v", state.Contacts)
+	}
+	if got := state.Contacts[0].Notes; got != "shared desk,\ndo not delete" {
+		t.Fatalf("unexpected notes %q", got)
+	}
+	for name, out := range map[string][]byte{"phonebook": state.Phonebook, "pjsip": state.PJSIP, "extensions": state.Extensions} {
+		if bytes.Contains(out, []byte("shared desk")) {
+			t.Fatalf("notes leaked into %s:\n%s", name, out)
+		}
+	}
+}
+
+func TestBooleanStringsRenderAsYesNo(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(overlay, "config.yaml"), `endpoint_templates:
+  - name: "endpoint-template"
+    trust_id_inbound: "true"
+    direct_media: "No"
+    rtp_symmetric: on
+    force_rport: yes
+    dtmf_mode: "rfc4733"
+    rtp_timeout: "0"
+`)
+	state := buildState(t, &project.DirBuilder{Dir: dir, Overlays: []string{overlay}, Logger: testutil.NewTestLogger()})
+	pjsip := string(state.PJSIP)
+	for _, want := range []string{"trust_id_inbound=yes\n", "direct_media=no\n", "rtp_symmetric=yes\n", "force_rport=yes\n", "dtmf_mode=rfc4733\n", "rtp_timeout=0\n"} {
+		if !strings.Contains(pjsip, want) {
+			t.Fatalf("expected %q in pjsip.conf:\n%s", want, pjsip)
+		}
+	}
+
+	writeFile(t, filepath.Join(overlay, "config.yaml"), `asterisk:
+  keep_boolean_strings: true
+endpoint_templates:
+  - name: "endpoint-template"
+    trust_id_inbound: "true"
+`)
+	state = buildState(t, &project.DirBuilder{Dir: dir, Overlays: []string{overlay}, Logger: testutil.NewTestLogger()})
+	if !strings.Contains(string(state.PJSIP), "trust_id_inbound=true\n") {
+		t.Fatalf("expected keep_boolean_strings to leave the value alone:\n%s", state.PJSIP)
+	}
+}
+
+func TestOptionValuesWithoutKeyValueSpellingFail(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatalf("mkdir contacts: %v", err)
+	}
+	overlay := t.TempDir()
+	build := func(cfg string) error {
+		writeFile(t, filepath.Join(overlay, "config.yaml"), cfg)
+		_, err := (&project.DirBuilder{Dir: dir, Overlays: []string{overlay}, Logger: testutil.NewTestLogger()}).Build()
+		return err
+	}
+
+	err := build("transports:\n  - name: \"transport-udp\"\n    tls:\n      method: tlsv1_2\n")
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "transports.tls" || !strings.Contains(err.Error(), "transport transport-udp option tls is a nested map") {
+		t.Fatalf("expected a ValidationError naming the transport and key, got %v", err)
+	}
+	err = build("endpoint_templates:\n  - name: \"endpoint-template\"\n    allow: [[ulaw]]\n")
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "endpoint template endpoint-template option allow nests a list") {
+		t.Fatalf("expected nested lists to be rejected, got %v", err)
+	}
+	err = build("global:\n  user_agent: \"a\\nb\"\n")
+	if !errors.As(err, &validationErr) || validationErr.Field != "global.user_agent" {
+		t.Fatalf("expected a multi-line value to be rejected, got %v", err)
+	}
+
+	err = build("global:\n  big: 18446744073709551616\n")
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "too large to write exactly") {
+		t.Fatalf("expected an integer beyond uint64 to be rejected, got %v", err)
+	}
+	for _, value := range []string{".nan", ".inf", "-.Inf"} {
+		err = build("global:\n  timeout: " + value + "\n")
+		if !errors.As(err, &validationErr) || validationErr.Field != "global.timeout" || !strings.Contains(err.Error(), "not a finite number") {
+			t.Fatalf("expected %s to be rejected, got %v", value, err)
+		}
+	}
+	if err := build("global:\n  big: \"18446744073709551616\"\n  max: 18446744073709551615\n"); err != nil {
+		t.Fatalf("large numbers should build, got %v", err)
+	}
+	state := buildState(t, &project.DirBuilder{Dir: dir, Overlays: []string{overlay}, Logger: testutil.NewTestLogger()})
+	for _, want := range []string{"big=18446744073709551616\n", "max=18446744073709551615\n"} {
+		if !strings.Contains(string(state.PJSIP), want) {
+			t.Fatalf("expected %q in pjsip.conf:\n%s", want, state.PJSIP)
+		}
+	}
+}
+
+func TestContactsDirsAreReadAfterContacts(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	for _, sub := range []string{"contacts", filepath.Join("vendor", "team")} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", sub, err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "contacts", "a.yaml"), "- {first_name: Old, ext: \"200\", password: pw}\n- {first_name: Base, ext: \"100\", password: pw}\n")
+	writeFile(t, filepath.Join(dir, "vendor", "team", "b.yaml"), "- {first_name: New, ext: \"200\", password: pw}\n- {first_name: Team, ext: \"300\", password: pw}\n")
+	overlay := t.TempDir()
+	builder := &project.DirBuilder{Dir: dir, Overlays: []string{overlay}, Logger: testutil.NewTestLogger()}
+
+	writeFile(t, filepath.Join(overlay, "config.yaml"), "contacts_dirs: [vendor/team]\n")
+	state := buildState(t, builder)
+	names := map[string]string{}
+	for _, c := range state.Contacts {
+		names[c.Extension] = c.FirstName
+	}
+	if len(names) != 3 || names["100"] != "Base" || names["200"] != "New" || names["300"] != "Team" {
+		t.Fatalf("expected contacts/ plus vendor/team with the later directory winning, got %v", names)
+	}
+
+	var validationErr *config.ValidationError
+	if err := os.MkdirAll(filepath.Join(dir, "contacts", "team"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []string{
+		"contacts_dirs: [../elsewhere]\n",
+		"contacts_dirs: [missing]\n",
+		"contacts_dirs: [contacts]\n",
+		"contacts_dirs: [contacts/team]\n",
+		"contacts_dirs: [vendor/team, vendor]\n",
+		"contacts_dirs: [\"*\"]\n",
+		"contacts_dirs: [\"vendor/[\"]\n",
+	} {
+		writeFile(t, filepath.Join(overlay, "config.yaml"), cfg)
+		if _, err := builder.Build(); !errors.As(err, &validationErr) || validationErr.Field != "contacts_dirs" {
+			t.Fatalf("%s: expected a contacts_dirs ValidationError, got %v", strings.TrimSpace(cfg), err)
+		}
+	}
+}
+
+func TestContactsDirsExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	for _, sub := range []string{"contacts", "vendor/sales/contacts", "vendor/support/contacts", "vendor/docs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", sub, err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "vendor", "sales", "contacts", "a.yaml"), "- {first_name: Sales, ext: \"200\", password: pw}\n")
+	writeFile(t, filepath.Join(dir, "vendor", "support", "contacts", "a.yaml"), "- {first_name: Support, ext: \"200\", password: pw}\n- {first_name: Help, ext: \"300\", password: pw}\n")
+	writeFile(t, filepath.Join(dir, "vendor", "docs", "a.yaml"), "- {first_name: Docs, ext: \"400\", password: pw}\n")
+	cfg, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "config.yaml"), string(cfg)+"contacts_dirs: [\"vendor/*/contacts\"]\n")
+
+	state := buildState(t, &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()})
+	names := map[string]string{}
+	for _, c := range state.Contacts {
+		names[c.Extension] = c.FirstName
+	}
+	if len(names) != 2 || names["200"] != "Support" || names["300"] != "Help" {
+		t.Fatalf("expected both matched directories in path order and vendor/docs left out, got %v", names)
+	}
+}
+
+func TestProvisionReferencesFailTheBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	for _, sub := range []string{"contacts", "prov"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", sub, err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "prov", "t46u.cfg.tmpl"), "account.1.user_name = {{.Extension}}\n")
+	contacts := filepath.Join(dir, "contacts", "a.yaml")
+	builder := &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}
+
+	writeFile(t, contacts, "- {first_name: A, ext: \"100\", password: pw, mac: \"00:15:65:aa:bb:01\", model: t46u}\n"+
+		"- {first_name: B, ext: \"101\", password: pw, mac: \"001565aabb01\"}\n")
+	var validationErr *config.ValidationError
+	if _, err := builder.Build(); !errors.As(err, &validationErr) || validationErr.Field != "mac" {
+		t.Fatalf("expected a duplicate mac ValidationError, got %v", err)
+	}
+
+	writeFile(t, contacts, "- {first_name: A, ext: \"100\", password: pw, mac: \"001565aabb01\", model: t46u}\n"+
+		"- {first_name: B, ext: \"101\", password: pw, mac: \"001565aabb02\", model: t54w}\n")
+	buildState(t, builder)
+
+	cfg, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "config.yaml"), string(cfg)+"provision_templates: prov\n")
+	if _, err := builder.Build(); !errors.As(err, &validationErr) || validationErr.Field != "provision_templates" || !strings.Contains(err.Error(), "t54w") {
+		t.Fatalf("expected the t54w contact without a template to fail the build, got %v", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "prov", "default.cfg.tmpl"), "{{.Nope}}\n")
+	if _, err := builder.Build(); !errors.As(err, &validationErr) || validationErr.Field != "provision_templates" {
+		t.Fatalf("expected an unknown template field to fail the build, got %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "prov", "default.cfg.tmpl"), "account.1.user_name = {{.Extension}}\n")
+	buildState(t, builder)
+}
+
+func TestContactsDBQueryMustBeOneSelect(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "contacts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := &project.DirBuilder{Dir: dir, Logger: testutil.NewTestLogger()}
+	var validationErr *config.ValidationError
+	for _, tc := range []struct{ db, field string }{
+		{"path: /etc/hr.db\n  table: employees", "contacts_db.path"},
+		{"path: ../hr.db\n  table: employees", "contacts_db.path"},
+		{`query: "DELETE FROM employees"`, "contacts_db.query"},
+		{`query: "SELECT 1; DROP TABLE employees"`, "contacts_db.query"},
+		{`query: "SELECT 1\n.shell id"`, "contacts_db.query"},
+		{`query: ".shell id"`, "contacts_db.query"},
+		{`query: "SELECTED"`, "contacts_db.query"},
+	} {
+		writeFile(t, filepath.Join(dir, "config.yaml"), string(cfg)+"contacts_db:\n  "+tc.db+"\n")
+		if _, err := builder.Build(); !errors.As(err, &validationErr) || validationErr.Field != tc.field {
+			t.Fatalf("%s: expected a %s ValidationError, got %v", tc.db, tc.field, err)
+		}
+	}
+	for _, query := range []string{
+		`"SELECT * FROM employees;"`,
+		`"select ext, given AS first_name FROM employees WHERE note != ';' -- people\n"`,
+	} {
+		writeFile(t, filepath.Join(dir, "config.yaml"), string(cfg)+"contacts_db:\n  query: "+query+"\n")
+		buildState(t, builder)
+	}
+}
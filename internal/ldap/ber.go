@@ -0,0 +1,165 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER tag classes and the constructed bit, as LDAP uses them (RFC 4511
+// section 5.1). Every tag LDAP needs fits in the low five bits.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// Universal tags.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = constructed | 0x10
+	tagSet         = constructed | 0x11
+)
+
+// element is one decoded BER TLV. tag is the whole identifier octet.
+type element struct {
+	tag     byte
+	content []byte
+}
+
+var errMalformed = errors.New("malformed BER")
+
+// readElement reads one TLV from r, refusing content longer than max.
+// LDAP forbids the indefinite length form, so it is rejected too.
+func readElement(r *bufio.Reader, max int) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return element{}, fmt.Errorf("%w: multi-byte tag", errMalformed)
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return element{}, fmt.Errorf("%w: unsupported length form", errMalformed)
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, unexpectedEOF(err)
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > max {
+		return element{}, fmt.Errorf("message of %d bytes exceeds %d", length, max)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	return element{tag: tag, content: content}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// children splits a constructed element's content into its TLVs.
+func (e element) children() ([]element, error) {
+	var out []element
+	rest := e.content
+	for len(rest) > 0 {
+		if len(rest) < 2 || rest[0]&0x1f == 0x1f {
+			return nil, errMalformed
+		}
+		tag, length, header := rest[0], int(rest[1]), 2
+		if rest[1]&0x80 != 0 {
+			n := int(rest[1] & 0x7f)
+			if n == 0 || n > 4 || len(rest) < 2+n {
+				return nil, errMalformed
+			}
+			length = 0
+			for _, b := range rest[2 : 2+n] {
+				length = length<<8 | int(b)
+			}
+			header += n
+		}
+		if length < 0 || len(rest)-header < length {
+			return nil, errMalformed
+		}
+		out = append(out, element{tag: tag, content: rest[header : header+length]})
+		rest = rest[header+length:]
+	}
+	return out, nil
+}
+
+// int decodes a two's complement INTEGER or ENUMERATED of up to four bytes.
+func (e element) int() (int, error) {
+	if len(e.content) == 0 || len(e.content) > 4 {
+		return 0, errMalformed
+	}
+	n := int(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+// encode returns the TLV for tag and content.
+func encode(tag byte, content []byte) []byte {
+	n := len(content)
+	var out []byte
+	switch {
+	case n < 0x80:
+		out = append(make([]byte, 0, 2+n), tag, byte(n))
+	case n <= 0xff:
+		out = append(make([]byte, 0, 3+n), tag, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(make([]byte, 0, 4+n), tag, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(make([]byte, 0, 6+n), tag, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+// encodeInt returns the minimal two's complement encoding of n.
+func encodeInt(tag byte, n int) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(n)}, content...)
+		if (n >= -0x80 && n < 0x80) || len(content) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return encode(tag, content)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+// encodeSeq concatenates parts as the content of a constructed element.
+func encodeSeq(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return encode(tag, content)
+}
@@ -0,0 +1,153 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filter choices (RFC 4511 section 4.5.1.7).
+const (
+	filterAnd        = classContext | constructed | 0
+	filterOr         = classContext | constructed | 1
+	filterNot        = classContext | constructed | 2
+	filterEquality   = classContext | constructed | 3
+	filterSubstrings = classContext | constructed | 4
+	filterPresent    = classContext | 7
+)
+
+// filter reports whether an entry matches.
+type filter func(entry) bool
+
+// parseFilter compiles the filters phones send for directory lookups:
+// presence, equality and substring tests combined with and, or and not.
+// Ordering and approximate matches are answered as never matching.
+func parseFilter(e element) (filter, error) {
+	switch e.tag {
+	case filterAnd, filterOr:
+		parts, err := e.children()
+		if err != nil {
+			return nil, err
+		}
+		subs := make([]filter, 0, len(parts))
+		for _, p := range parts {
+			f, err := parseFilter(p)
+			if err != nil {
+				return nil, err
+			}
+			subs = append(subs, f)
+		}
+		if e.tag == filterAnd {
+			return func(en entry) bool {
+				for _, f := range subs {
+					if !f(en) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(en entry) bool {
+			for _, f := range subs {
+				if f(en) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case filterNot:
+		parts, err := e.children()
+		if err != nil || len(parts) != 1 {
+			return nil, errMalformed
+		}
+		sub, err := parseFilter(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(en entry) bool { return !sub(en) }, nil
+	case filterPresent:
+		attr := strings.ToLower(string(e.content))
+		return func(en entry) bool { return attr == "objectclass" || len(en.values(attr)) > 0 }, nil
+	case filterEquality:
+		parts, err := e.children()
+		if err != nil || len(parts) != 2 {
+			return nil, errMalformed
+		}
+		attr := strings.ToLower(string(parts[0].content))
+		want := normalizeValue(attr, string(parts[1].content))
+		return func(en entry) bool {
+			for _, v := range en.values(attr) {
+				if normalizeValue(attr, v) == want {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case filterSubstrings:
+		return parseSubstrings(e)
+	case classContext | constructed | 5, classContext | constructed | 6, classContext | constructed | 8, classContext | constructed | 9:
+		// greaterOrEqual, lessOrEqual, approxMatch, extensibleMatch.
+		return func(entry) bool { return false }, nil
+	}
+	return nil, fmt.Errorf("%w: unknown filter tag 0x%02x", errMalformed, e.tag)
+}
+
+// parseSubstrings compiles SubstringFilter { type, SEQUENCE OF CHOICE {
+// initial [0], any [1], final [2] } }.
+func parseSubstrings(e element) (filter, error) {
+	parts, err := e.children()
+	if err != nil || len(parts) != 2 {
+		return nil, errMalformed
+	}
+	attr := strings.ToLower(string(parts[0].content))
+	pieces, err := parts[1].children()
+	if err != nil {
+		return nil, err
+	}
+	var initial, final string
+	var middle []string
+	for _, p := range pieces {
+		v := normalizeValue(attr, string(p.content))
+		switch p.tag {
+		case classContext | 0:
+			initial = v
+		case classContext | 1:
+			middle = append(middle, v)
+		case classContext | 2:
+			final = v
+		default:
+			return nil, errMalformed
+		}
+	}
+	return func(en entry) bool {
+		for _, raw := range en.values(attr) {
+			v := normalizeValue(attr, raw)
+			if !strings.HasPrefix(v, initial) {
+				continue
+			}
+			v = v[len(initial):]
+			ok := true
+			for _, a := range middle {
+				i := strings.Index(v, a)
+				if i < 0 {
+					ok = false
+					break
+				}
+				v = v[i+len(a):]
+			}
+			if ok && strings.HasSuffix(v, final) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// normalizeValue applies the attribute's matching rule: names compare
+// without case, and telephone numbers also ignore spaces and hyphens.
+func normalizeValue(attr, v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if attr == "telephonenumber" {
+		v = strings.NewReplacer(" ", "", "-", "").Replace(v)
+	}
+	return v
+}
@@ -0,0 +1,479 @@
+// Package ldap answers read-only LDAP searches against the served contacts,
+// for desk phones that look up their directory over LDAP instead of
+// downloading a phonebook file. Only bind, search and unbind are supported.
+// Without Config.Credentials every bind succeeds and the directory is as
+// public as phonebook.xml; with them, searches need a matching simple bind.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// DefaultBaseDN is the suffix of every entry's DN when Config.BaseDN is
+// empty.
+const DefaultBaseDN = "dc=phonebook"
+
+const (
+	// maxMessageBytes bounds one request; phone searches are a few
+	// hundred bytes.
+	maxMessageBytes = 64 << 10
+	// idleTimeout closes connections that send nothing for this long.
+	idleTimeout  = 2 * time.Minute
+	writeTimeout = 10 * time.Second
+)
+
+// Protocol operations (RFC 4511 section 4.2 onwards).
+const (
+	opBindRequest       = classApplication | constructed | 0
+	opBindResponse      = classApplication | constructed | 1
+	opUnbindRequest     = classApplication | 2
+	opSearchRequest     = classApplication | constructed | 3
+	opSearchResultEntry = classApplication | constructed | 4
+	opSearchResultDone  = classApplication | constructed | 5
+	opAbandonRequest    = classApplication | 16
+	opExtendedRequest   = classApplication | constructed | 23
+	opExtendedResponse  = classApplication | constructed | 24
+)
+
+// Result codes.
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+	resultInsufficientAccess = 50
+	resultUnwillingToPerform = 53
+)
+
+// attrNames are the attributes every entry may carry, in the order they are
+// returned.
+var attrNames = []string{"cn", "sn", "givenName", "telephoneNumber"}
+
+// Logger is the subset of slog used by the server.
+type Logger interface {
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Debug(msg string, args ...any)
+}
+
+// Source supplies the contacts to serve and announces rebuilds;
+// httpapi.Server implements it.
+type Source interface {
+	Subscribe() (<-chan uint64, func())
+	Contacts() []model.Contact
+}
+
+// Config bundles LDAP server options.
+type Config struct {
+	Addr string
+	// BaseDN is appended to every entry's uid=<ext> RDN. Empty means
+	// DefaultBaseDN.
+	BaseDN string
+	// Credentials, when set, are the simple binds that unlock searches.
+	// A connection that has not bound with one of them gets
+	// insufficientAccessRights, and a bind with anything else
+	// invalidCredentials.
+	Credentials []Credential
+}
+
+// Credential is a bind name and password. An empty Name accepts the
+// password under any bind name.
+type Credential struct {
+	Name     string
+	Password string
+}
+
+// Server is a read-only LDAP directory of the current contacts.
+type Server struct {
+	addr        string
+	baseDN      string
+	credentials []Credential
+	source      Source
+	logger      Logger
+
+	mu      sync.RWMutex
+	entries []entry
+}
+
+// entry is one contact as a directory entry. attrs is keyed by lowercase
+// attribute name.
+type entry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e entry) values(attr string) []string {
+	return e.attrs[attr]
+}
+
+// New returns a Server for cfg reading contacts from source.
+func New(cfg Config, source Source, logger Logger) *Server {
+	base := cfg.BaseDN
+	if base == "" {
+		base = DefaultBaseDN
+	}
+	return &Server{addr: cfg.Addr, baseDN: base, credentials: cfg.Credentials, source: source, logger: logger}
+}
+
+// Listen opens the configured address, for Serve. Callers listen up front
+// so a port in use fails startup instead of a background goroutine.
+func (s *Server) Listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("serving LDAP directory", "addr", ln.Addr().String(), "base_dn", s.baseDN, "bind_required", len(s.credentials) > 0)
+	return ln, nil
+}
+
+// Start listens on the configured address and serves until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve answers connections from ln until ctx is done, refreshing the
+// directory after every rebuild the source announces. It closes ln and
+// every open connection before returning.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub, unsubscribe := s.source.Subscribe()
+	defer unsubscribe()
+	s.refresh()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-sub:
+				if !ok {
+					return
+				}
+				s.refresh()
+			}
+		}
+	}()
+
+	var (
+		wg     sync.WaitGroup
+		connMu sync.Mutex
+		conns  = map[net.Conn]struct{}{}
+	)
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+		connMu.Lock()
+		defer connMu.Unlock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		connMu.Lock()
+		conns[conn] = struct{}{}
+		connMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(conn)
+			connMu.Lock()
+			delete(conns, conn)
+			connMu.Unlock()
+		}()
+	}
+}
+
+// refresh rebuilds the entries from the source's current contacts.
+func (s *Server) refresh() {
+	contacts := s.source.Contacts()
+	entries := make([]entry, 0, len(contacts))
+	for _, c := range contacts {
+		if en, ok := s.newEntry(c); ok {
+			entries = append(entries, en)
+		}
+	}
+	s.mu.Lock()
+	s.entries = entries
+	s.mu.Unlock()
+	s.logger.Debug("LDAP directory updated", "entries", len(entries))
+}
+
+// newEntry maps a contact the way the XML phonebook lists it: hidden
+// contacts and contacts without a number are left out, and the primary
+// number comes first.
+func (s *Server) newEntry(c model.Contact) (entry, bool) {
+	if c.Hidden {
+		return entry{}, false
+	}
+	var numbers []string
+	for _, p := range c.Phones {
+		if p.Primary {
+			numbers = append([]string{p.Number}, numbers...)
+			continue
+		}
+		numbers = append(numbers, p.Number)
+	}
+	if len(c.Phones) == 0 && !c.ExplicitPhones && c.Extension != "" {
+		numbers = []string{c.Extension}
+	}
+	if len(numbers) == 0 {
+		return entry{}, false
+	}
+	first, last := strings.TrimSpace(c.FirstName), strings.TrimSpace(c.LastName)
+	cn := strings.TrimSpace(first + " " + last)
+	if cn == "" {
+		cn = c.Extension
+	}
+	attrs := map[string][]string{
+		"cn":              {cn},
+		"telephonenumber": numbers,
+	}
+	if last != "" {
+		attrs["sn"] = []string{last}
+	}
+	if first != "" {
+		attrs["givenname"] = []string{first}
+	}
+	return entry{dn: "uid=" + escapeDN(c.Extension) + "," + s.baseDN, attrs: attrs}, true
+}
+
+// handle serves one connection until the client unbinds, goes idle, or
+// sends something this server does not speak.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authorized := len(s.credentials) == 0
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := readElement(r, maxMessageBytes)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("LDAP connection closed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		parts, err := msg.children()
+		if msg.tag != tagSequence || err != nil || len(parts) < 2 || parts[0].tag != tagInteger {
+			s.logger.Debug("LDAP connection sent a malformed message", "remote", conn.RemoteAddr().String())
+			return
+		}
+		id, err := parts[0].int()
+		if err != nil {
+			return
+		}
+		op := parts[1]
+		// The deadline covers everything written for this request, a
+		// search's entries included, since bufio flushes as it fills.
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		switch op.tag {
+		case opBindRequest:
+			// A bind replaces the connection's earlier authorization, even
+			// when it fails (RFC 4511 section 4.2.1).
+			authorized = s.bindAllowed(op)
+			code := resultSuccess
+			if !authorized {
+				code = resultInvalidCredentials
+			}
+			writeMessage(w, id, encodeSeq(opBindResponse, ldapResult(code, "")))
+		case opUnbindRequest:
+			return
+		case opSearchRequest:
+			if !authorized {
+				writeMessage(w, id, encodeSeq(opSearchResultDone, ldapResult(resultInsufficientAccess, "bind first")))
+				break
+			}
+			s.search(w, id, op)
+		case opAbandonRequest:
+			// Searches are answered in full before the next request is read.
+			continue
+		case opExtendedRequest:
+			writeMessage(w, id, encodeSeq(opExtendedResponse, ldapResult(resultProtocolError, "extended operations are not supported")))
+		case classApplication | constructed | 6, classApplication | constructed | 8, classApplication | 10,
+			classApplication | constructed | 12, classApplication | constructed | 14:
+			// Modify, add, delete, modify DN and compare each answer with
+			// the next application tag.
+			resp := classApplication | constructed | (op.tag&0x1f + 1)
+			writeMessage(w, id, encodeSeq(resp, ldapResult(resultUnwillingToPerform, "the directory is read-only")))
+		default:
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// bindAllowed checks a BindRequest { version, name, authentication }
+// against the credentials. Without credentials every bind is allowed;
+// with them only a simple bind matching one is, so anonymous and SASL binds
+// are refused.
+func (s *Server) bindAllowed(op element) bool {
+	if len(s.credentials) == 0 {
+		return true
+	}
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 || parts[2].tag != classContext {
+		return false
+	}
+	name, password := string(parts[1].content), string(parts[2].content)
+	if password == "" {
+		return false
+	}
+	allowed := false
+	for _, c := range s.credentials {
+		// Compare both halves so timing does not reveal which one was
+		// wrong.
+		nameOK := c.Name == "" || subtle.ConstantTimeCompare([]byte(name), []byte(c.Name)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password)) == 1
+		allowed = allowed || nameOK && passOK
+	}
+	return allowed
+}
+
+// search answers a SearchRequest { baseObject, scope, derefAliases,
+// sizeLimit, timeLimit, typesOnly, filter, attributes }. Every entry sits
+// directly under the base DN, so any subtree or one-level search sees all
+// of them; a base-object search, such as a client reading the root DSE,
+// finds none.
+func (s *Server) search(w *bufio.Writer, id int, op element) {
+	done := func(code int, msg string) {
+		writeMessage(w, id, encodeSeq(opSearchResultDone, ldapResult(code, msg)))
+	}
+	parts, err := op.children()
+	if err != nil || len(parts) < 8 {
+		done(resultProtocolError, "malformed search request")
+		return
+	}
+	scope, err1 := parts[1].int()
+	sizeLimit, err2 := parts[3].int()
+	if err1 != nil || err2 != nil {
+		done(resultProtocolError, "malformed search request")
+		return
+	}
+	typesOnly := len(parts[5].content) == 1 && parts[5].content[0] != 0
+	match, err := parseFilter(parts[6])
+	if err != nil {
+		done(resultProtocolError, "unsupported filter")
+		return
+	}
+	wanted, err := requestedAttrs(parts[7])
+	if err != nil {
+		done(resultProtocolError, "malformed attribute list")
+		return
+	}
+	if scope == 0 {
+		done(resultSuccess, "")
+		return
+	}
+
+	s.mu.RLock()
+	entries := s.entries
+	s.mu.RUnlock()
+	sent := 0
+	for _, en := range entries {
+		if !match(en) {
+			continue
+		}
+		if sizeLimit > 0 && sent == sizeLimit {
+			done(resultSizeLimitExceeded, "")
+			return
+		}
+		writeMessage(w, id, encodeEntry(en, wanted, typesOnly))
+		sent++
+	}
+	done(resultSuccess, "")
+}
+
+// requestedAttrs reads the attribute selection: nil for every attribute
+// (an empty list or "*"), otherwise the set of lowercase names asked for.
+func requestedAttrs(e element) (map[string]bool, error) {
+	list, err := e.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	wanted := map[string]bool{}
+	for _, a := range list {
+		name := strings.ToLower(string(a.content))
+		if name == "*" {
+			return nil, nil
+		}
+		wanted[name] = true
+	}
+	return wanted, nil
+}
+
+func encodeEntry(en entry, wanted map[string]bool, typesOnly bool) []byte {
+	var attrs [][]byte
+	for _, name := range attrNames {
+		key := strings.ToLower(name)
+		vals := en.attrs[key]
+		if len(vals) == 0 || (wanted != nil && !wanted[key]) {
+			continue
+		}
+		var encoded [][]byte
+		if !typesOnly {
+			for _, v := range vals {
+				encoded = append(encoded, encodeString(tagOctetString, v))
+			}
+		}
+		attrs = append(attrs, encodeSeq(tagSequence, encodeString(tagOctetString, name), encodeSeq(tagSet, encoded...)))
+	}
+	return encodeSeq(opSearchResultEntry, encodeString(tagOctetString, en.dn), encodeSeq(tagSequence, attrs...))
+}
+
+// ldapResult is the content of an LDAPResult: resultCode, matchedDN and
+// diagnosticMessage.
+func ldapResult(code int, msg string) []byte {
+	var b []byte
+	b = append(b, encodeInt(tagEnumerated, code)...)
+	b = append(b, encodeString(tagOctetString, "")...)
+	return append(b, encodeString(tagOctetString, msg)...)
+}
+
+func writeMessage(w *bufio.Writer, id int, op []byte) {
+	_, _ = w.Write(encodeSeq(tagSequence, encodeInt(tagInteger, id), op))
+}
+
+// escapeDN escapes an attribute value for use in a DN (RFC 4514).
+func escapeDN(v string) string {
+	var b strings.Builder
+	for i, r := range v {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(v)-1 && r == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
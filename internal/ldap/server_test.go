@@ -0,0 +1,342 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/testutil"
+)
+
+type fakeSource struct {
+	mu       sync.Mutex
+	contacts []model.Contact
+	sub      chan uint64
+}
+
+func (f *fakeSource) Subscribe() (<-chan uint64, func()) { return f.sub, func() {} }
+
+func (f *fakeSource) Contacts() []model.Contact {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contacts
+}
+
+func (f *fakeSource) set(contacts []model.Contact) {
+	f.mu.Lock()
+	f.contacts = contacts
+	f.mu.Unlock()
+	f.sub <- 2
+}
+
+// ldapClient speaks just enough LDAP to drive the server.
+type ldapClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+func (c *ldapClient) send(op []byte) int {
+	c.t.Helper()
+	c.id++
+	if _, err := c.conn.Write(encodeSeq(tagSequence, encodeInt(tagInteger, c.id), op)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+	return c.id
+}
+
+// read returns the next message's protocol op.
+func (c *ldapClient) read() element {
+	c.t.Helper()
+	msg, err := readElement(c.r, maxMessageBytes)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	parts, err := msg.children()
+	if err != nil || len(parts) < 2 {
+		c.t.Fatalf("malformed response %x", msg.content)
+	}
+	if id, _ := parts[0].int(); id != c.id {
+		c.t.Fatalf("expected message id %d, got %d", c.id, id)
+	}
+	return parts[1]
+}
+
+// searchResult is one SearchResultEntry as dn plus attribute values.
+type searchResult struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// search runs a subtree search and returns the entries and result code.
+func (c *ldapClient) search(filter []byte, sizeLimit int, attrs ...string) ([]searchResult, int) {
+	c.t.Helper()
+	var names [][]byte
+	for _, a := range attrs {
+		names = append(names, encodeString(tagOctetString, a))
+	}
+	c.send(encodeSeq(opSearchRequest,
+		encodeString(tagOctetString, DefaultBaseDN),
+		encodeInt(tagEnumerated, 2),
+		encodeInt(tagEnumerated, 0),
+		encodeInt(tagInteger, sizeLimit),
+		encodeInt(tagInteger, 0),
+		encode(tagBoolean, []byte{0}),
+		filter,
+		encodeSeq(tagSequence, names...),
+	))
+	var out []searchResult
+	for {
+		op := c.read()
+		parts, _ := op.children()
+		switch op.tag {
+		case opSearchResultEntry:
+			res := searchResult{dn: string(parts[0].content), attrs: map[string][]string{}}
+			list, _ := parts[1].children()
+			for _, a := range list {
+				kv, _ := a.children()
+				vals, _ := kv[1].children()
+				for _, v := range vals {
+					res.attrs[string(kv[0].content)] = append(res.attrs[string(kv[0].content)], string(v.content))
+				}
+			}
+			out = append(out, res)
+		case opSearchResultDone:
+			code, _ := parts[0].int()
+			return out, code
+		default:
+			c.t.Fatalf("unexpected op 0x%02x", op.tag)
+		}
+	}
+}
+
+func present(attr string) []byte {
+	return encodeString(filterPresent, attr)
+}
+
+func TestServerAnswersDirectorySearches(t *testing.T) {
+	source := &fakeSource{sub: make(chan uint64, 1), contacts: []model.Contact{
+		{FirstName: "Alice", LastName: "Smith", Extension: "1001", Phones: []model.Phone{{Number: "1001"}, {Number: "+15551234567", Primary: true}}},
+		{FirstName: "Bob", Extension: "1002"},
+		{FirstName: "Hidden", Extension: "1003", Hidden: true},
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := New(Config{}, source, testutil.NewTestLogger())
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &ldapClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	client.send(encodeSeq(opBindRequest, encodeInt(tagInteger, 3), encodeString(tagOctetString, "cn=phone"), encodeString(classContext, "secret")))
+	if op := client.read(); op.tag != opBindResponse {
+		t.Fatalf("expected a bind response, got 0x%02x", op.tag)
+	}
+
+	entries, code := client.search(present("telephoneNumber"), 0)
+	if code != resultSuccess || len(entries) != 2 {
+		t.Fatalf("expected the two visible contacts, got %d entries, code %d", len(entries), code)
+	}
+	alice := entries[0]
+	if alice.dn != "uid=1001,dc=phonebook" || alice.attrs["cn"][0] != "Alice Smith" || alice.attrs["sn"][0] != "Smith" ||
+		alice.attrs["givenName"][0] != "Alice" || len(alice.attrs["telephoneNumber"]) != 2 || alice.attrs["telephoneNumber"][0] != "+15551234567" {
+		t.Fatalf("unexpected entry %+v", alice)
+	}
+	if bob := entries[1]; bob.attrs["telephoneNumber"][0] != "1002" || bob.attrs["sn"] != nil {
+		t.Fatalf("expected Bob listed under his extension without sn, got %+v", bob)
+	}
+
+	entries, _ = client.search(present("cn"), 0, "cn")
+	if len(entries) != 2 || len(entries[0].attrs) != 1 {
+		t.Fatalf("expected only cn returned, got %+v", entries)
+	}
+
+	// (|(cn=al*)(telephoneNumber=*4567))
+	substr := func(attr string, pieces ...[]byte) []byte {
+		return encodeSeq(filterSubstrings, encodeString(tagOctetString, attr), encodeSeq(tagSequence, pieces...))
+	}
+	filter := encodeSeq(filterOr,
+		substr("cn", encodeString(classContext|0, "al")),
+		substr("telephoneNumber", encodeString(classContext|2, "4567")),
+	)
+	if entries, _ := client.search(filter, 0); len(entries) != 1 || entries[0].attrs["cn"][0] != "Alice Smith" {
+		t.Fatalf("expected the substring search to find Alice, got %+v", entries)
+	}
+	equal := encodeSeq(filterEquality, encodeString(tagOctetString, "telephonenumber"), encodeString(tagOctetString, "+1 555-123-4567"))
+	if entries, _ := client.search(equal, 0); len(entries) != 1 {
+		t.Fatalf("expected telephone numbers to match ignoring spaces and hyphens, got %+v", entries)
+	}
+	if entries, code := client.search(present("cn"), 1); len(entries) != 1 || code != resultSizeLimitExceeded {
+		t.Fatalf("expected one entry and sizeLimitExceeded, got %d entries, code %d", len(entries), code)
+	}
+
+	source.set([]model.Contact{{FirstName: "Carol", Extension: "2001"}})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries, _ := client.search(present("cn"), 0)
+		if len(entries) == 1 && entries[0].attrs["cn"][0] == "Carol" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the directory refreshed after a rebuild, got %+v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.send(encode(classApplication|constructed|8, nil))
+	if op := client.read(); op.tag != classApplication|constructed|9 {
+		t.Fatalf("expected an add response, got 0x%02x", op.tag)
+	} else if parts, _ := op.children(); len(parts) == 0 {
+		t.Fatal("expected an LDAPResult")
+	} else if code, _ := parts[0].int(); code != resultUnwillingToPerform {
+		t.Fatalf("expected unwillingToPerform for a write, got %d", code)
+	}
+}
+
+func TestServerRequiresBindWithCredentials(t *testing.T) {
+	source := &fakeSource{sub: make(chan uint64, 1), contacts: []model.Contact{{FirstName: "Alice", Extension: "1001"}}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := New(Config{Credentials: []Credential{{Name: "cn=phone", Password: "secret"}, {Password: "token"}}}, source, testutil.NewTestLogger())
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &ldapClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	bind := func(name, password string) int {
+		t.Helper()
+		client.send(encodeSeq(opBindRequest, encodeInt(tagInteger, 3), encodeString(tagOctetString, name), encodeString(classContext, password)))
+		op := client.read()
+		parts, _ := op.children()
+		if op.tag != opBindResponse || len(parts) == 0 {
+			t.Fatalf("expected a bind response, got 0x%02x", op.tag)
+		}
+		code, _ := parts[0].int()
+		return code
+	}
+
+	if entries, code := client.search(present("cn"), 0); len(entries) != 0 || code != resultInsufficientAccess {
+		t.Fatalf("expected an unbound search to be refused, got %d entries, code %d", len(entries), code)
+	}
+	for _, c := range []struct{ name, password string }{{"", ""}, {"cn=phone", "wrong"}, {"cn=other", "secret"}} {
+		if code := bind(c.name, c.password); code != resultInvalidCredentials {
+			t.Fatalf("bind %q/%q: expected invalidCredentials, got %d", c.name, c.password, code)
+		}
+	}
+	if code := bind("cn=phone", "secret"); code != resultSuccess {
+		t.Fatalf("expected the configured bind to succeed, got %d", code)
+	}
+	if entries, code := client.search(present("cn"), 0); len(entries) != 1 || code != resultSuccess {
+		t.Fatalf("expected the bound search to list Alice, got %d entries, code %d", len(entries), code)
+	}
+	if code := bind("cn=phone", "wrong"); code != resultInvalidCredentials {
+		t.Fatalf("expected invalidCredentials, got %d", code)
+	}
+	if _, code := client.search(present("cn"), 0); code != resultInsufficientAccess {
+		t.Fatalf("expected a failed rebind to drop access, got code %d", code)
+	}
+	if code := bind("uid=anything", "token"); code != resultSuccess {
+		t.Fatalf("expected the token to bind under any name, got %d", code)
+	}
+}
+
+// deadlineConn records whether anything was written before a write
+// deadline was set.
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+	missed   bool
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.deadline.IsZero() {
+		c.missed = true
+	}
+	return c.Conn.Write(p)
+}
+
+func TestServerSetsWriteDeadlineBeforeEachResponse(t *testing.T) {
+	// Enough entries that the search overflows the write buffer before
+	// the response is flushed.
+	var contacts []model.Contact
+	for i := 0; i < 200; i++ {
+		contacts = append(contacts, model.Contact{FirstName: "Contact", Extension: strconv.Itoa(1000 + i)})
+	}
+	source := &fakeSource{sub: make(chan uint64, 1), contacts: contacts}
+	srv := New(Config{}, source, testutil.NewTestLogger())
+	srv.refresh()
+	server, clientConn := net.Pipe()
+	conn := &deadlineConn{Conn: server}
+	done := make(chan struct{})
+	go func() {
+		srv.handle(conn)
+		close(done)
+	}()
+
+	_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &ldapClient{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}
+	for i := 0; i < 2; i++ {
+		if entries, code := client.search(present("cn"), 0); len(entries) != len(contacts) || code != resultSuccess {
+			t.Fatalf("search %d: got %d entries, code %d", i, len(entries), code)
+		}
+	}
+	client.send(encode(opUnbindRequest, nil))
+	<-done
+	if conn.missed {
+		t.Fatal("expected a write deadline before every response")
+	}
+}
+
+func TestEncodeIntRoundTrips(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 24, -1, -128, -129} {
+		raw := encodeInt(tagInteger, n)
+		el, err := readElement(bufio.NewReader(bytes.NewReader(raw)), 16)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if got, err := el.int(); err != nil || got != n {
+			t.Fatalf("%d: decoded %d, %v", n, got, err)
+		}
+	}
+}
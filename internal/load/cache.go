@@ -0,0 +1,107 @@
+package load
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// Cache keeps each contacts/ file's normalized contacts between loads so an
+// edit to one file only re-parses that file. Entries are matched on path,
+// modification time and size, and the whole cache is dropped whenever the
+// config or defaults change, since they feed every contact's normalization.
+// Cross-file work (dedup, speed-dial checks) always runs on the full set, so
+// the result matches an uncached load. A Cache is safe for concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	key   [sha256.Size]byte
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	modTime  time.Time
+	size     int64
+	contacts []model.Contact
+	skipped  []SkippedContact
+	// warnings are replayed on a hit so every load logs the same thing.
+	warnings []cachedWarning
+}
+
+type cachedWarning struct {
+	msg  string
+	args []any
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{files: map[string]cachedFile{}}
+}
+
+// WithCache makes the loader reuse and refresh c.
+func (l *Loader) WithCache(c *Cache) *Loader {
+	l.cache = c
+	return l
+}
+
+// reset drops every entry unless cfg and defs match the previous load. An
+// unkeyable config disables the cache for this load.
+func (c *Cache) reset(cfg config.Config, defs config.Defaults) bool {
+	raw, err := json.Marshal(struct {
+		Config   config.Config
+		Defaults config.Defaults
+	}{cfg, defs})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.files = map[string]cachedFile{}
+		return false
+	}
+	if key := sha256.Sum256(raw); key != c.key {
+		c.key = key
+		c.files = map[string]cachedFile{}
+	}
+	return true
+}
+
+func (c *Cache) get(fd fileDescriptor) (cachedFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[fd.Path]
+	if !ok || !f.modTime.Equal(fd.ModTime) || f.size != fd.Size {
+		return cachedFile{}, false
+	}
+	return f, true
+}
+
+func (c *Cache) put(fd fileDescriptor, f cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.modTime, f.size = fd.ModTime, fd.Size
+	c.files[fd.Path] = f
+}
+
+// prune forgets files that the latest load no longer found.
+func (c *Cache) prune(seen map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.files {
+		if !seen[path] {
+			delete(c.files, path)
+		}
+	}
+}
+
+// warningRecorder forwards warnings while keeping a copy for the cache.
+type warningRecorder struct {
+	next     Logger
+	warnings []cachedWarning
+}
+
+func (r *warningRecorder) Warn(msg string, args ...any) {
+	r.warnings = append(r.warnings, cachedWarning{msg: msg, args: args})
+	r.next.Warn(msg, args...)
+}
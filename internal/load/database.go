@@ -0,0 +1,181 @@
+package load
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/config"
+)
+
+// dbFields are the contact fields a database row can supply, by the name
+// used in contacts/ YAML. phones is a comma-separated list of numbers.
+var dbFields = []string{
+	"id", "first_name", "last_name", "ext", "password", "account_index",
+	"group_id", "speed_dial", "nickname", "title", "department", "mac",
+	"model", "phonebook_only", "hidden", "transport", "phones", "username",
+	"template", "context", "notes", "ringtone",
+}
+
+// WithContactsDB reads contacts from the SQLite database at path in addition
+// to contacts/, overriding contacts_db.path in config.yaml.
+func (l *Loader) WithContactsDB(path string) *Loader {
+	l.dbPath = path
+	return l
+}
+
+// WithSQLite3 sets the sqlite3 shell the contacts database is queried with.
+// Without it a configured database is skipped with a warning, so a data
+// tree cannot choose a program to run.
+func (l *Loader) WithSQLite3(binary string) *Loader {
+	l.sqlite3 = binary
+	return l
+}
+
+// loadDB queries the contacts database with the sqlite3 binary and returns
+// its rows as raw contacts plus a descriptor for the database file.
+func loadDB(db config.ContactsDB, path, sqlite3 string) (fileDescriptor, []rawContact, error) {
+	if db.Table == "" && db.Query == "" {
+		return fileDescriptor{}, nil, fmt.Errorf("contacts db %s: contacts_db.table or contacts_db.query is required", path)
+	}
+	for field := range db.Columns {
+		if !slices.Contains(dbFields, field) {
+			return fileDescriptor{}, nil, &config.ValidationError{Field: "contacts_db.columns", Err: fmt.Errorf("contacts_db.columns: unknown contact field %q", field)}
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileDescriptor{}, nil, fmt.Errorf("contacts db: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	// -safe refuses ATTACH, extensions and the file and shell functions on
+	// top of the statement checks in config.
+	cmd := exec.Command(sqlite3, "-safe", "-readonly", "-json", path, db.Statement())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fileDescriptor{}, nil, fmt.Errorf("query contacts db %s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// sqlite3 prints nothing at all for an empty result.
+	var rows []map[string]any
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(out))
+		dec.UseNumber()
+		if err := dec.Decode(&rows); err != nil {
+			return fileDescriptor{}, nil, &config.ParseError{Path: path, Err: err}
+		}
+	}
+
+	fd := fileDescriptor{Path: path, ModTime: info.ModTime()}
+	contacts := make([]rawContact, 0, len(rows))
+	for i, row := range rows {
+		rc, err := rowContact(row, db.Columns)
+		if err != nil {
+			return fileDescriptor{}, nil, fmt.Errorf("contacts db %s row %d: %w", path, i+1, err)
+		}
+		contacts = append(contacts, rc)
+	}
+	return fd, contacts, nil
+}
+
+// rowContact maps one result row onto the YAML contact shape. NULL columns
+// count as unset.
+func rowContact(row map[string]any, columns map[string]string) (rawContact, error) {
+	var rc rawContact
+	for _, field := range dbFields {
+		column := field
+		if c, ok := columns[field]; ok {
+			column = c
+		}
+		v, ok := row[column]
+		if !ok || v == nil {
+			continue
+		}
+		text := strings.TrimSpace(fmt.Sprint(v))
+		if text == "" {
+			continue
+		}
+		var err error
+		switch field {
+		case "id":
+			rc.ID = text
+		case "first_name":
+			rc.FirstName = text
+		case "last_name":
+			rc.LastName = text
+		case "ext":
+			rc.Ext = text
+		case "password":
+			rc.Password = text
+		case "nickname":
+			rc.Nickname = text
+		case "title":
+			rc.Title = text
+		case "department":
+			rc.Department = text
+		case "notes":
+			rc.Notes = text
+		case "ringtone":
+			rc.Ringtone = text
+		case "mac":
+			rc.MAC = text
+		case "model":
+			rc.Model = text
+		case "transport":
+			rc.Transport = text
+		case "username":
+			rc.Auth.Username = &text
+		case "template":
+			rc.Endpoint.Template = text
+		case "context":
+			rc.Context = text
+		case "account_index":
+			rc.AccountIndex, err = columnInt(text)
+		case "group_id":
+			rc.GroupID, err = columnInt(text)
+		case "speed_dial":
+			rc.SpeedDial, err = columnInt(text)
+		case "phonebook_only":
+			rc.PhonebookOnly, err = columnBool(text)
+		case "hidden":
+			rc.Hidden, err = columnBool(text)
+		case "phones":
+			for _, n := range strings.Split(text, ",") {
+				if n = strings.TrimSpace(n); n != "" {
+					rc.Phones = append(rc.Phones, rawPhone{Number: n})
+				}
+			}
+		}
+		if err != nil {
+			return rawContact{}, fmt.Errorf("column %s: %w", column, err)
+		}
+	}
+	return rc, nil
+}
+
+func columnInt(text string) (*int, error) {
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an integer", text)
+	}
+	return &n, nil
+}
+
+// columnBool accepts SQLite's 0/1 as well as true/false and yes/no.
+func columnBool(text string) (bool, error) {
+	switch strings.ToLower(text) {
+	case "0", "false", "no":
+		return false, nil
+	case "1", "true", "yes":
+		return true, nil
+	}
+	return false, errors.New("expected 0/1, true/false or yes/no")
+}
@@ -0,0 +1,50 @@
+package load
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/n3wscott/phonebook/internal/config"
+)
+
+// LoadExternalContacts reads the external_contacts file named in cfg from
+// the base data directory dir: a YAML mapping of outside numbers, such as
+// "+15551234567", to display names. It returns nil without error when
+// external_contacts is unset. The file counts against
+// limits.max_file_bytes like a contacts/ file.
+func LoadExternalContacts(cfg config.Config, dir string) (map[string]string, []config.FileMeta, error) {
+	if cfg.ExternalContacts == "" {
+		return nil, nil, nil
+	}
+	path := filepath.Join(dir, cfg.ExternalContacts)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read external_contacts %s: %w", path, err)
+	}
+	fd := fileDescriptor{Path: path, ModTime: info.ModTime(), Size: info.Size()}
+	limit := cfg.Limits.MaxFileBytes
+	if limit == 0 {
+		limit = config.DefaultMaxFileBytes
+	}
+	data, err := readLimited(fd, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw map[string]string
+	if err := yaml.Unmarshal(config.CleanSource(data), &raw); err != nil {
+		return nil, nil, &config.ParseError{Path: path, Err: err}
+	}
+	names := make(map[string]string, len(raw))
+	for number, name := range raw {
+		number, name = strings.TrimSpace(number), strings.TrimSpace(name)
+		if number == "" || name == "" {
+			return nil, nil, &config.ValidationError{Field: "external_contacts", Err: fmt.Errorf("external_contacts %s maps %q to %q; both the number and the name are required", path, number, name)}
+		}
+		names[number] = name
+	}
+	return names, []config.FileMeta{{Path: path, ModTime: fd.ModTime}}, nil
+}
@@ -3,10 +3,14 @@ package load
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -23,68 +27,251 @@ type Logger interface {
 
 // Loader normalizes contacts from contacts/.
 type Loader struct {
-	dir    string
-	logger Logger
+	dirs    []string
+	dbPath  string
+	sqlite3 string
+	cache   *Cache
+	strict  bool
+	logger  Logger
 }
 
 // New returns a Loader.
 func New(dir string, logger Logger) *Loader {
-	return &Loader{dir: dir, logger: logger}
+	return &Loader{dirs: []string{dir}, logger: logger}
+}
+
+// NewOverlay returns a Loader reading contacts/ from a base directory and
+// then from each overlay. An overlay contact replaces an earlier layer's
+// contact with the same id or extension.
+func NewOverlay(dirs []string, logger Logger) *Loader {
+	return &Loader{dirs: dirs, logger: logger}
 }
 
 // Result is the normalized contact list plus metadata.
 type Result struct {
 	Contacts []model.Contact
 	Files    []config.FileMeta
+	// Reused counts contacts/ files served from the Cache without being
+	// parsed again.
+	Reused int
+	// Skipped lists the contacts left out because they failed
+	// normalization.
+	Skipped []SkippedContact
+	// Conflicts lists every extension defined more than once within one
+	// layer, in load order. An overlay replacing a base contact is not a
+	// conflict.
+	Conflicts []ExtensionConflict
 }
 
-// LoadContacts scans contacts/ and returns normalized contacts.
-func (l *Loader) LoadContacts(cfg config.Config, defs config.Defaults) (Result, error) {
-	dir := filepath.Join(l.dir, "contacts")
-	files, err := collectYAML(dir)
-	if err != nil {
-		return Result{}, err
-	}
+// ExtensionConflict is one contact overriding another with the same
+// extension. Winner is the source path of the contact that was kept and
+// Loser the one it replaced; both are the same file for a duplicate within
+// one file.
+type ExtensionConflict struct {
+	Ext    string
+	Winner string
+	Loser  string
+}
 
-	templateSet := make(map[string]struct{}, len(cfg.EndpointTemplates))
-	for _, t := range cfg.EndpointTemplates {
-		templateSet[t.Name] = struct{}{}
+// SkippedContact is one contact entry that failed normalization. Ext is
+// the entry's ext as written, which may be empty.
+type SkippedContact struct {
+	Path string
+	Ext  string
+	Err  error
+}
+
+// SkippedError is returned by a strict Loader when any contact was skipped.
+// It is wrapped in a config.ValidationError.
+type SkippedError struct {
+	Contacts []SkippedContact
+}
+
+func (e *SkippedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid contact(s):", len(e.Contacts))
+	for _, c := range e.Contacts {
+		if c.Ext != "" {
+			fmt.Fprintf(&b, "\n  %s ext %s: %v", c.Path, c.Ext, c.Err)
+		} else {
+			fmt.Fprintf(&b, "\n  %s: %v", c.Path, c.Err)
+		}
 	}
+	return b.String()
+}
+
+// WithStrict makes LoadContacts fail with a SkippedError instead of
+// skipping contacts that do not normalize.
+func (l *Loader) WithStrict(strict bool) *Loader {
+	l.strict = strict
+	return l
+}
+
+// LoadContacts scans contacts/, then the contacts database when one is
+// configured, and returns normalized contacts.
+func (l *Loader) LoadContacts(cfg config.Config, defs config.Defaults) (Result, error) {
+	rules := newRules(cfg, defs)
 
 	dedup := map[string]model.Contact{}
-	metas := make([]config.FileMeta, 0, len(files))
+	layerOf := map[string]int{}
+	metas := []config.FileMeta{}
+	cached := l.cache != nil && l.cache.reset(cfg, defs)
+	seen := map[string]bool{}
+	reused := 0
+	var skipped []SkippedContact
+	var conflicts []ExtensionConflict
+	add := func(c model.Contact, layer int) {
+		// An overlay replacing a base contact by id may also move it to a
+		// new extension.
+		if c.ID != "" && layer > 0 {
+			for ext, prev := range dedup {
+				if prev.ID == c.ID && ext != c.Extension && layerOf[ext] < layer {
+					delete(dedup, ext)
+				}
+			}
+		}
+		if existing, ok := dedup[c.Extension]; ok && layerOf[c.Extension] == layer {
+			l.logger.Warn("duplicate extension detected, overriding", "ext", c.Extension, "prev", existing.SourcePath, "next", c.SourcePath)
+			conflicts = append(conflicts, ExtensionConflict{Ext: c.Extension, Winner: c.SourcePath, Loser: existing.SourcePath})
+		}
+		dedup[c.Extension] = c
+		layerOf[c.Extension] = layer
+	}
 
-	for _, fd := range files {
-		contacts, err := l.parseFile(fd, defs, templateSet)
+	for layer, root := range l.dirs {
+		files, err := collectLayer(root, cfg.ContactsDirs, layer > 0)
 		if err != nil {
 			return Result{}, err
 		}
+
+		for _, fd := range files {
+			contacts, bad, hit, err := l.parseCached(fd, rules, cached)
+			if err != nil {
+				return Result{}, err
+			}
+			skipped = append(skipped, bad...)
+			seen[fd.Path] = true
+			if hit {
+				reused++
+			}
+			metas = append(metas, config.FileMeta{Path: fd.Path, ModTime: fd.ModTime})
+			for _, c := range contacts {
+				add(c, layer)
+			}
+			if err := rules.checkContactCount(len(dedup), fd.Path); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	// The contacts database is the topmost layer, so it wins over YAML for
+	// an extension both define.
+	base := ""
+	if len(l.dirs) > 0 {
+		base = l.dirs[0]
+	}
+	if path := cfg.ContactsDB.Resolve(base, l.dbPath); path != "" && l.sqlite3 == "" {
+		l.logger.Warn("not reading contacts database without a sqlite3 binary", "path", path)
+	} else if path != "" {
+		fd, rawContacts, err := loadDB(cfg.ContactsDB, path, l.sqlite3)
+		if err != nil {
+			return Result{}, err
+		}
+		contacts, bad, err := normalizeAll(l.logger, fd, rawContacts, rules)
+		if err != nil {
+			return Result{}, err
+		}
+		skipped = append(skipped, bad...)
 		metas = append(metas, config.FileMeta{Path: fd.Path, ModTime: fd.ModTime})
 		for _, c := range contacts {
-			if existing, ok := dedup[c.Extension]; ok {
-				l.logger.Warn("duplicate extension detected, overriding", "ext", c.Extension, "prev", existing.SourcePath, "next", c.SourcePath)
-			}
-			dedup[c.Extension] = c
+			add(c, len(l.dirs))
+		}
+		if err := rules.checkContactCount(len(dedup), fd.Path); err != nil {
+			return Result{}, err
 		}
 	}
 
+	if l.strict && len(skipped) > 0 {
+		return Result{}, &config.ValidationError{Err: &SkippedError{Contacts: skipped}}
+	}
+
 	contacts := make([]model.Contact, 0, len(dedup))
 	for _, c := range dedup {
 		contacts = append(contacts, c)
 	}
-	sort.Slice(contacts, func(i, j int) bool {
-		if contacts[i].Extension == contacts[j].Extension {
-			return contacts[i].SourcePath < contacts[j].SourcePath
-		}
-		return contacts[i].Extension < contacts[j].Extension
-	})
+	model.SortContacts(contacts, model.SortByExtension)
+
+	if err := checkSpeedDials(contacts); err != nil {
+		return Result{}, err
+	}
+	if err := checkMACs(contacts); err != nil {
+		return Result{}, err
+	}
+
+	if cached {
+		l.cache.prune(seen)
+	}
+	return Result{Contacts: contacts, Files: metas, Reused: reused, Skipped: skipped, Conflicts: conflicts}, nil
+}
 
-	return Result{Contacts: contacts, Files: metas}, nil
+// rules carries the config-derived checks applied while normalizing contacts.
+type rules struct {
+	defaults     config.Defaults
+	templates    map[string]struct{}
+	transports   map[string]struct{}
+	speedDial    config.SlotRange
+	lines        int
+	sparseWarn   bool
+	autoIndex    bool
+	fallback     bool
+	alnumExt     bool
+	extension    config.Extension
+	extPattern   *regexp.Regexp
+	maxContacts  int
+	maxFileBytes int64
+}
+
+func newRules(cfg config.Config, defs config.Defaults) rules {
+	r := rules{
+		defaults:     defs,
+		templates:    make(map[string]struct{}, len(cfg.EndpointTemplates)),
+		transports:   make(map[string]struct{}, len(cfg.Transports)),
+		speedDial:    cfg.Phonebook.SpeedDial,
+		lines:        cfg.Phonebook.Lines,
+		sparseWarn:   cfg.Phonebook.WarnSparseLines,
+		autoIndex:    cfg.Phonebook.AutoAccountIndex,
+		fallback:     cfg.Phonebook.UseExtensionFallback(),
+		alnumExt:     cfg.Extension.AllowAlphanumeric,
+		extension:    cfg.Extension,
+		maxContacts:  cfg.Limits.MaxContacts,
+		maxFileBytes: cfg.Limits.MaxFileBytes,
+	}
+	if r.lines == 0 {
+		r.lines = r.maxIndex()
+	}
+	if r.maxContacts == 0 {
+		r.maxContacts = config.DefaultMaxContacts
+	}
+	if r.maxFileBytes == 0 {
+		r.maxFileBytes = config.DefaultMaxFileBytes
+	}
+	if cfg.Extension.Pattern != "" {
+		// config.Load has already validated the pattern.
+		r.extPattern = regexp.MustCompile(`^(?:` + cfg.Extension.Pattern + `)$`)
+	}
+	for _, t := range cfg.EndpointTemplates {
+		r.templates[t.Name] = struct{}{}
+	}
+	for _, t := range cfg.Transports {
+		r.transports[t.Name] = struct{}{}
+	}
+	return r
 }
 
 type fileDescriptor struct {
 	Path    string
 	ModTime time.Time
+	Size    int64
 }
 
 func collectYAML(root string) ([]fileDescriptor, error) {
@@ -103,7 +290,7 @@ func collectYAML(root string) ([]fileDescriptor, error) {
 		if err != nil {
 			return err
 		}
-		files = append(files, fileDescriptor{Path: path, ModTime: info.ModTime()})
+		files = append(files, fileDescriptor{Path: path, ModTime: info.ModTime(), Size: info.Size()})
 		return nil
 	})
 	if err != nil {
@@ -118,31 +305,252 @@ func collectYAML(root string) ([]fileDescriptor, error) {
 	return files, nil
 }
 
+// collectLayer lists a data root's contact files: contacts/ first, then each
+// contacts_dirs entry in the order configured, each sorted by path, so later
+// directories win duplicates. Overlay layers may lack any of them.
+func collectLayer(root string, extra []string, optional bool) ([]fileDescriptor, error) {
+	dirs, err := layerDirs(root, extra, optional)
+	if err != nil {
+		return nil, err
+	}
+	var files []fileDescriptor
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) && optional {
+			continue
+		}
+		found, err := collectYAML(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// layerDirs expands contacts_dirs entries, which may be filepath.Glob
+// patterns, into directories under root, after contacts/. A pattern's
+// matches stay in Glob's sorted order. collectYAML walks each directory
+// recursively, so one nested inside another would be read twice and is
+// rejected.
+func layerDirs(root string, extra []string, optional bool) ([]string, error) {
+	dirs := []string{filepath.Join(root, "contacts")}
+	for _, rel := range extra {
+		matches, err := filepath.Glob(filepath.Join(root, rel))
+		if err != nil {
+			return nil, &config.ValidationError{Field: "contacts_dirs", Err: fmt.Errorf("contacts_dirs entry %s: %w", rel, err)}
+		}
+		var found []string
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				found = append(found, m)
+			}
+		}
+		if len(found) == 0 {
+			if optional {
+				continue
+			}
+			return nil, &config.ValidationError{Field: "contacts_dirs", Err: fmt.Errorf("contacts_dirs entry %s: directory %s does not exist", rel, filepath.Join(root, rel))}
+		}
+		for _, dir := range found {
+			for _, prev := range dirs {
+				if within(prev, dir) || within(dir, prev) {
+					return nil, &config.ValidationError{Field: "contacts_dirs", Err: fmt.Errorf("contacts_dirs entry %s: %s overlaps %s, so its contacts would be read twice", rel, dir, prev)}
+				}
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// within reports whether path is dir or lies beneath it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
 func isYAML(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".yaml" || ext == ".yml"
 }
 
-func (l *Loader) parseFile(fd fileDescriptor, defs config.Defaults, templates map[string]struct{}) ([]model.Contact, error) {
-	data, err := os.ReadFile(fd.Path)
+// parseCached returns a file's contacts from the cache when it is unchanged,
+// replaying its warnings, and parses and caches it otherwise.
+func (l *Loader) parseCached(fd fileDescriptor, rules rules, useCache bool) ([]model.Contact, []SkippedContact, bool, error) {
+	if !useCache {
+		contacts, skipped, err := parseFile(l.logger, fd, rules)
+		return contacts, skipped, false, err
+	}
+	if hit, ok := l.cache.get(fd); ok {
+		for _, w := range hit.warnings {
+			l.logger.Warn(w.msg, w.args...)
+		}
+		return hit.contacts, hit.skipped, true, nil
+	}
+	rec := &warningRecorder{next: l.logger}
+	contacts, skipped, err := parseFile(rec, fd, rules)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	l.cache.put(fd, cachedFile{contacts: contacts, skipped: skipped, warnings: rec.warnings})
+	return contacts, skipped, false, nil
+}
+
+func parseFile(logger Logger, fd fileDescriptor, rules rules) ([]model.Contact, []SkippedContact, error) {
+	data, err := readLimited(fd, rules.maxFileBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	rawContacts, err := parseContacts(config.CleanSource(data))
+	if err != nil {
+		return nil, nil, &config.ParseError{Path: fd.Path, Err: err}
+	}
+	return normalizeAll(logger, fd, rawContacts, rules)
+}
+
+// readLimited reads a contacts file, refusing one larger than limit bytes
+// before reading it, or as soon as a file that grew since it was listed
+// passes the limit.
+func readLimited(fd fileDescriptor, limit int64) ([]byte, error) {
+	tooLarge := func() error {
+		return &config.ValidationError{Field: "limits.max_file_bytes", Err: fmt.Errorf("contacts %s is larger than limits.max_file_bytes (%d bytes)", fd.Path, limit)}
+	}
+	if fd.Size > limit {
+		return nil, tooLarge()
+	}
+	f, err := os.Open(fd.Path)
 	if err != nil {
 		return nil, fmt.Errorf("read contacts %s: %w", fd.Path, err)
 	}
-	rawContacts, err := parseContacts(data)
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
 	if err != nil {
-		return nil, fmt.Errorf("parse %s: %w", fd.Path, err)
+		return nil, fmt.Errorf("read contacts %s: %w", fd.Path, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, tooLarge()
 	}
+	return data, nil
+}
+
+// checkContactCount fails the load once more than limits.max_contacts
+// contacts have been gathered, naming the source that crossed the line.
+func (r rules) checkContactCount(n int, path string) error {
+	if n <= r.maxContacts {
+		return nil
+	}
+	return &config.ValidationError{Field: "limits.max_contacts", Err: fmt.Errorf("more than limits.max_contacts (%d) contacts loaded by %s", r.maxContacts, path)}
+}
 
+// normalizeAll normalizes the contacts read from one source, skipping bad
+// entries with a warning and returning them separately.
+func normalizeAll(logger Logger, fd fileDescriptor, rawContacts []rawContact, rules rules) ([]model.Contact, []SkippedContact, error) {
 	out := make([]model.Contact, 0, len(rawContacts))
+	var skipped []SkippedContact
 	for _, rc := range rawContacts {
-		contact, err := rc.Normalize(fd, defs, templates)
+		contact, err := rc.Normalize(fd, rules)
 		if err != nil {
-			l.logger.Warn("skipping contact", "path", fd.Path, "err", err)
+			logger.Warn("skipping contact", "path", fd.Path, "err", err)
+			skipped = append(skipped, SkippedContact{Path: fd.Path, Ext: strings.TrimSpace(rc.Ext), Err: err})
 			continue
 		}
+		if rule := rules.extensionViolation(contact.Extension); rule != "" {
+			if rules.extension.Strict {
+				return nil, nil, &config.ValidationError{Field: "ext", Err: fmt.Errorf("contact %s in %s: ext %s", contact.Extension, fd.Path, rule)}
+			}
+			logger.Warn("extension breaks site convention", "ext", contact.Extension, "path", fd.Path, "rule", rule)
+		}
+		if rules.extension.WarnPhoneMismatch && len(contact.Phones) == 1 && contact.Phones[0].Number != contact.Extension {
+			if _, err := normalizePhone(contact.Extension); err == nil {
+				logger.Warn("phone number differs from extension", "ext", contact.Extension, "phone", contact.Phones[0].Number, "path", fd.Path)
+			}
+		}
+		for i, p := range contact.Phones {
+			if p.Label != "" && !slices.Contains(model.PhoneLabels, p.Label) {
+				logger.Warn("ignoring unknown phone label", "ext", contact.Extension, "phone", p.Number, "label", p.Label, "path", fd.Path)
+				contact.Phones[i].Label = ""
+			}
+		}
+		if len(contact.Phones) == 0 && !contact.Hidden {
+			logger.Warn("contact has no phones and is left out of the phonebook", "ext", contact.Extension, "path", fd.Path)
+		}
+		for _, line := range sharedLines(contact.Phones) {
+			logger.Warn("phones share an account_index", "ext", contact.Extension, "account_index", line.index, "numbers", line.numbers, "path", fd.Path)
+		}
+		if rules.sparseWarn {
+			if gap := unusedLines(contact.Phones); gap != "" {
+				logger.Warn("account_index leaves lines unused", "ext", contact.Extension, "path", fd.Path, "unused", gap)
+			}
+		}
 		out = append(out, contact)
 	}
-	return out, nil
+	return out, skipped, nil
+}
+
+// checkAccountIndex rejects a line number the deployment's phones do not
+// have; field names the YAML key in the error.
+func (r rules) checkAccountIndex(ext, field string, idx int) error {
+	if idx < 1 {
+		return fmt.Errorf("contact %s %s out of range", ext, field)
+	}
+	if max := r.maxIndex(); idx > max {
+		return fmt.Errorf("contact %s %s %d exceeds max_account_index %d", ext, field, idx, max)
+	}
+	if idx > r.lines {
+		return fmt.Errorf("contact %s %s %d exceeds phonebook.lines %d", ext, field, idx, r.lines)
+	}
+	return nil
+}
+
+// maxIndex is the configured max_account_index.
+func (r rules) maxIndex() int {
+	if r.defaults.MaxAccountIndex == 0 {
+		return config.MaxAccountIndex
+	}
+	return r.defaults.MaxAccountIndex
+}
+
+// sharedLine is an account_index claimed by more than one of a contact's
+// phones, with those numbers comma-separated.
+type sharedLine struct {
+	index   int
+	numbers string
+}
+
+// sharedLines reports every line two or more of a contact's phones sit on,
+// in index order. Grandstream handsets misbehave when that happens.
+func sharedLines(phones []model.Phone) []sharedLine {
+	byIndex := map[int][]string{}
+	for _, p := range phones {
+		byIndex[p.AccountIndex] = append(byIndex[p.AccountIndex], p.Number)
+	}
+	var shared []sharedLine
+	for idx, numbers := range byIndex {
+		if len(numbers) > 1 {
+			shared = append(shared, sharedLine{index: idx, numbers: strings.Join(numbers, ",")})
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool { return shared[i].index < shared[j].index })
+	return shared
+}
+
+// unusedLines lists the account_index values below the highest one a
+// contact's phones use that none of them claim, such as "1,2,3,4" for a lone
+// index 5.
+func unusedLines(phones []model.Phone) string {
+	used := map[int]bool{}
+	high := 0
+	for _, p := range phones {
+		used[p.AccountIndex] = true
+		high = max(high, p.AccountIndex)
+	}
+	var gaps []string
+	for idx := 1; idx < high; idx++ {
+		if !used[idx] {
+			gaps = append(gaps, strconv.Itoa(idx))
+		}
+	}
+	return strings.Join(gaps, ",")
 }
 
 func parseContacts(data []byte) ([]rawContact, error) {
@@ -165,25 +573,37 @@ func parseContacts(data []byte) ([]rawContact, error) {
 }
 
 type rawContact struct {
-	ID            string      `yaml:"id"`
-	FirstName     string      `yaml:"first_name"`
-	LastName      string      `yaml:"last_name"`
-	Ext           string      `yaml:"ext"`
-	Password      string      `yaml:"password"`
-	AccountIndex  *int        `yaml:"account_index"`
-	GroupID       *int        `yaml:"group_id"`
-	Nickname      string      `yaml:"nickname"`
-	PhonebookOnly bool        `yaml:"phonebook_only"`
-	Hidden        bool        `yaml:"hidden"`
-	Phones        []rawPhone  `yaml:"phones"`
-	Auth          rawAuth     `yaml:"auth"`
-	AOR           rawAOR      `yaml:"aor"`
-	Endpoint      rawEndpoint `yaml:"endpoint"`
+	ID            string        `yaml:"id"`
+	FirstName     string        `yaml:"first_name"`
+	LastName      string        `yaml:"last_name"`
+	Ext           string        `yaml:"ext"`
+	Password      string        `yaml:"password"`
+	AccountIndex  *int          `yaml:"account_index"`
+	GroupID       *int          `yaml:"group_id"`
+	SpeedDial     *int          `yaml:"speed_dial"`
+	Nickname      string        `yaml:"nickname"`
+	Title         any           `yaml:"title"`
+	Department    any           `yaml:"department"`
+	Notes         any           `yaml:"notes"`
+	Ringtone      string        `yaml:"ringtone"`
+	MAC           string        `yaml:"mac"`
+	Model         string        `yaml:"model"`
+	PhonebookOnly bool          `yaml:"phonebook_only"`
+	Hidden        bool          `yaml:"hidden"`
+	Transport     string        `yaml:"transport"`
+	Context       string        `yaml:"context"`
+	Phones        []rawPhone    `yaml:"phones"`
+	Auth          rawAuth       `yaml:"auth"`
+	AOR           rawAOR        `yaml:"aor"`
+	Endpoint      rawEndpoint   `yaml:"endpoint"`
+	Voicemail     *rawVoicemail `yaml:"voicemail"`
 }
 
 type rawPhone struct {
 	Number       string `yaml:"number"`
 	AccountIndex *int   `yaml:"account_index"`
+	Primary      bool   `yaml:"primary"`
+	Label        string `yaml:"label"`
 }
 
 type rawAuth struct {
@@ -191,20 +611,33 @@ type rawAuth struct {
 }
 
 type rawAOR struct {
-	MaxContacts      *int  `yaml:"max_contacts"`
-	RemoveExisting   *bool `yaml:"remove_existing"`
-	QualifyFrequency *int  `yaml:"qualify_frequency"`
+	MaxContacts       *int     `yaml:"max_contacts"`
+	RemoveExisting    *bool    `yaml:"remove_existing"`
+	QualifyFrequency  *int     `yaml:"qualify_frequency"`
+	QualifyTimeout    *float64 `yaml:"qualify_timeout"`
+	MinimumExpiration *int     `yaml:"minimum_expiration"`
+	MaximumExpiration *int     `yaml:"maximum_expiration"`
+	DefaultExpiration *int     `yaml:"default_expiration"`
 }
 
 type rawEndpoint struct {
 	Template string `yaml:"template"`
 }
 
-func (rc rawContact) Normalize(fd fileDescriptor, defs config.Defaults, templates map[string]struct{}) (model.Contact, error) {
+type rawVoicemail struct {
+	PIN   string `yaml:"pin"`
+	Email string `yaml:"email"`
+}
+
+func (rc rawContact) Normalize(fd fileDescriptor, rules rules) (model.Contact, error) {
+	defs := rules.defaults
 	ext := strings.TrimSpace(rc.Ext)
 	if ext == "" {
 		return model.Contact{}, errors.New("contact missing ext")
 	}
+	if err := rules.checkExtension(ext, len(rc.Phones) > 0); err != nil {
+		return model.Contact{}, err
+	}
 	password := strings.TrimSpace(rc.Password)
 	if password == "" && !rc.PhonebookOnly {
 		return model.Contact{}, fmt.Errorf("contact %s missing password", ext)
@@ -215,20 +648,48 @@ func (rc rawContact) Normalize(fd fileDescriptor, defs config.Defaults, template
 		return model.Contact{}, fmt.Errorf("contact %s missing both first_name and last_name", ext)
 	}
 
+	title, err := metadataString(ext, "title", rc.Title)
+	if err != nil {
+		return model.Contact{}, err
+	}
+	department, err := metadataString(ext, "department", rc.Department)
+	if err != nil {
+		return model.Contact{}, err
+	}
+
+	notes, err := notesString(ext, rc.Notes)
+	if err != nil {
+		return model.Contact{}, err
+	}
+
+	mac, err := normalizeMAC(rc.MAC)
+	if err != nil {
+		return model.Contact{}, fmt.Errorf("contact %s %w", ext, err)
+	}
+
 	group := normalizeGroup(rc.GroupID)
 	if group != nil && (*group < 0 || *group > 9) {
 		return model.Contact{}, fmt.Errorf("contact %s group_id out of range", ext)
 	}
 
+	var speedDial *int
+	if rc.SpeedDial != nil {
+		slot := *rc.SpeedDial
+		if slot < rules.speedDial.Min || slot > rules.speedDial.Max {
+			return model.Contact{}, fmt.Errorf("contact %s speed_dial %d outside %d-%d", ext, slot, rules.speedDial.Min, rules.speedDial.Max)
+		}
+		speedDial = &slot
+	}
+
 	var fallbackIdx int = 1
 	if rc.AccountIndex != nil {
 		fallbackIdx = *rc.AccountIndex
 	}
-	if fallbackIdx < 1 || fallbackIdx > 6 {
-		return model.Contact{}, fmt.Errorf("contact %s account_index out of range", ext)
+	if err := rules.checkAccountIndex(ext, "account_index", fallbackIdx); err != nil {
+		return model.Contact{}, err
 	}
 
-	phones, err := rc.buildPhones(fallbackIdx, ext)
+	phones, err := rc.buildPhones(fallbackIdx, ext, rules)
 	if err != nil {
 		return model.Contact{}, err
 	}
@@ -236,6 +697,9 @@ func (rc rawContact) Normalize(fd fileDescriptor, defs config.Defaults, template
 	var username string
 	var aor model.ContactAOR
 	var template string
+	var transport string
+	var dialContext string
+	var voicemail *model.ContactVoicemail
 	if !rc.PhonebookOnly {
 		username = ext
 		if rc.Auth.Username != nil {
@@ -248,9 +712,13 @@ func (rc rawContact) Normalize(fd fileDescriptor, defs config.Defaults, template
 		}
 
 		aor = model.ContactAOR{
-			MaxContacts:      defs.AOR.MaxContacts,
-			RemoveExisting:   defs.AOR.RemoveExisting,
-			QualifyFrequency: defs.AOR.QualifyFrequency,
+			MaxContacts:       defs.AOR.MaxContacts,
+			RemoveExisting:    defs.AOR.RemoveExisting,
+			QualifyFrequency:  defs.AOR.QualifyFrequency,
+			QualifyTimeout:    defs.AOR.QualifyTimeout,
+			MinimumExpiration: defs.AOR.MinimumExpiration,
+			MaximumExpiration: defs.AOR.MaximumExpiration,
+			DefaultExpiration: defs.AOR.DefaultExpiration,
 		}
 		if rc.AOR.MaxContacts != nil {
 			aor.MaxContacts = *rc.AOR.MaxContacts
@@ -261,41 +729,89 @@ func (rc rawContact) Normalize(fd fileDescriptor, defs config.Defaults, template
 		if rc.AOR.QualifyFrequency != nil {
 			aor.QualifyFrequency = *rc.AOR.QualifyFrequency
 		}
+		if rc.AOR.QualifyTimeout != nil {
+			aor.QualifyTimeout = *rc.AOR.QualifyTimeout
+		}
+		if rc.AOR.MinimumExpiration != nil {
+			aor.MinimumExpiration = *rc.AOR.MinimumExpiration
+		}
+		if rc.AOR.MaximumExpiration != nil {
+			aor.MaximumExpiration = *rc.AOR.MaximumExpiration
+		}
+		if rc.AOR.DefaultExpiration != nil {
+			aor.DefaultExpiration = *rc.AOR.DefaultExpiration
+		}
+		if err := validateAOR(aor); err != nil {
+			return model.Contact{}, fmt.Errorf("contact %s aor: %w", ext, err)
+		}
 
 		template = strings.TrimSpace(rc.Endpoint.Template)
 		if template == "" {
 			template = defs.Endpoint.Template
 		}
-		if _, ok := templates[template]; !ok {
+		if _, ok := rules.templates[template]; !ok {
 			return model.Contact{}, fmt.Errorf("contact %s references unknown endpoint template %q", ext, template)
 		}
+
+		transport = strings.TrimSpace(rc.Transport)
+		if transport != "" {
+			if _, ok := rules.transports[transport]; !ok {
+				return model.Contact{}, fmt.Errorf("contact %s references unknown transport %q", ext, transport)
+			}
+		}
+
+		dialContext = strings.TrimSpace(rc.Context)
+		if dialContext != "" {
+			if err := validateContext(dialContext); err != nil {
+				return model.Contact{}, fmt.Errorf("contact %s context: %w", ext, err)
+			}
+		}
+
+		if rc.Voicemail != nil {
+			voicemail, err = normalizeVoicemail(*rc.Voicemail)
+			if err != nil {
+				return model.Contact{}, fmt.Errorf("contact %s voicemail: %w", ext, err)
+			}
+		}
 	}
 
 	return model.Contact{
-		ID:            strings.TrimSpace(rc.ID),
-		FirstName:     first,
-		LastName:      last,
-		Extension:     ext,
-		Password:      password,
-		GroupID:       group,
-		AccountIndex:  rc.AccountIndex,
-		Phones:        phones,
-		Nickname:      strings.TrimSpace(rc.Nickname),
-		PhonebookOnly: rc.PhonebookOnly,
-		Hidden:        rc.Hidden,
+		ID:             strings.TrimSpace(rc.ID),
+		FirstName:      first,
+		LastName:       last,
+		Extension:      ext,
+		Password:       password,
+		GroupID:        group,
+		AccountIndex:   rc.AccountIndex,
+		SpeedDial:      speedDial,
+		Phones:         phones,
+		Nickname:       strings.TrimSpace(rc.Nickname),
+		Title:          title,
+		Department:     department,
+		Ringtone:       strings.TrimSpace(rc.Ringtone),
+		Notes:          notes,
+		MAC:            mac,
+		Model:          strings.TrimSpace(rc.Model),
+		PhonebookOnly:  rc.PhonebookOnly,
+		Hidden:         rc.Hidden,
+		ExplicitPhones: !rules.fallback,
 		Auth: model.ContactAuth{
 			Username: username,
 			Password: password,
 		},
 		AOR:        aor,
-		Endpoint:   model.ContactEndpoint{Template: template},
+		Endpoint:   model.ContactEndpoint{Template: template, Transport: transport, Context: dialContext},
+		Voicemail:  voicemail,
 		SourcePath: fd.Path,
 		SourceMod:  fd.ModTime,
 	}, nil
 }
 
-func (rc rawContact) buildPhones(fallbackIdx int, ext string) ([]model.Phone, error) {
+func (rc rawContact) buildPhones(fallbackIdx int, ext string, rules rules) ([]model.Phone, error) {
 	if len(rc.Phones) == 0 {
+		if !rules.fallback {
+			return nil, nil
+		}
 		number, err := normalizePhone(ext)
 		if err != nil {
 			return nil, fmt.Errorf("contact %s invalid extension for phonebook: %w", ext, err)
@@ -303,8 +819,25 @@ func (rc rawContact) buildPhones(fallbackIdx int, ext string) ([]model.Phone, er
 		return []model.Phone{{Number: number, AccountIndex: fallbackIdx}}, nil
 	}
 
+	// With phonebook.auto_account_index, phones without an index take the
+	// lowest line from fallbackIdx up that no other phone claims.
+	claimed := map[int]bool{}
+	for _, p := range rc.Phones {
+		if p.AccountIndex != nil {
+			claimed[*p.AccountIndex] = true
+		}
+	}
+	next := fallbackIdx
+
 	phones := make([]model.Phone, 0, len(rc.Phones))
+	primary := false
 	for _, p := range rc.Phones {
+		if p.Primary {
+			if primary {
+				return nil, fmt.Errorf("contact %s marks more than one phone primary", ext)
+			}
+			primary = true
+		}
 		number := strings.TrimSpace(p.Number)
 		if number == "" {
 			return nil, fmt.Errorf("contact %s has empty phone number entry", ext)
@@ -314,17 +847,188 @@ func (rc rawContact) buildPhones(fallbackIdx int, ext string) ([]model.Phone, er
 			return nil, fmt.Errorf("contact %s phone invalid: %w", ext, err)
 		}
 		idx := fallbackIdx
-		if p.AccountIndex != nil {
+		switch {
+		case p.AccountIndex != nil:
 			idx = *p.AccountIndex
+		case rules.autoIndex:
+			for claimed[next] {
+				next++
+			}
+			idx = next
+			claimed[idx] = true
 		}
-		if idx < 1 || idx > 6 {
-			return nil, fmt.Errorf("contact %s phone account_index out of range", ext)
+		if err := rules.checkAccountIndex(ext, "phone account_index", idx); err != nil {
+			return nil, err
 		}
-		phones = append(phones, model.Phone{Number: normalized, AccountIndex: idx})
+		phones = append(phones, model.Phone{Number: normalized, AccountIndex: idx, Primary: p.Primary, Label: strings.ToLower(strings.TrimSpace(p.Label))})
 	}
 	return phones, nil
 }
 
+// metadataString validates a freeform display field: a single-line string, or
+// absent.
+func metadataString(ext, field string, v any) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("contact %s %s must be a plain string", ext, field)
+	}
+	str = strings.TrimSpace(str)
+	if strings.ContainsAny(str, "\r\n") {
+		return "", fmt.Errorf("contact %s %s must be a single line", ext, field)
+	}
+	return str, nil
+}
+
+// contextPattern is what a per-contact dialplan context may be named:
+// letters, digits, "-", "_" and ".", short enough for Asterisk's 80-byte
+// context buffer.
+var contextPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,79}$`)
+
+func validateContext(name string) error {
+	if !contextPattern.MatchString(name) {
+		return fmt.Errorf("%q must be 1-79 letters, digits, '-', '_' or '.'", name)
+	}
+	// extensions.conf reserves these section names for settings.
+	switch strings.ToLower(name) {
+	case "general", "globals":
+		return fmt.Errorf("%q is reserved in extensions.conf", name)
+	}
+	return nil
+}
+
+// normalizeVoicemail checks a voicemail block against what a voicemail.conf
+// mailbox line can hold: a numeric pin and a single address.
+func normalizeVoicemail(raw rawVoicemail) (*model.ContactVoicemail, error) {
+	pin := strings.TrimSpace(raw.PIN)
+	if pin == "" {
+		return nil, errors.New("pin is required")
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return nil, errors.New("pin must be digits only")
+		}
+	}
+	email := strings.TrimSpace(raw.Email)
+	if email != "" && (!strings.Contains(email, "@") || strings.ContainsAny(email, ",|\r\n\t ")) {
+		return nil, fmt.Errorf("email %q must be a single address", email)
+	}
+	return &model.ContactVoicemail{PIN: pin, Email: email}, nil
+}
+
+// maxQualifyFrequency is the largest qualify_frequency Asterisk accepts.
+const maxQualifyFrequency = 86400
+
+// validateAOR checks the merged AOR options against the ranges Asterisk
+// accepts, so a bad value fails here rather than at pjsip reload.
+func validateAOR(aor model.ContactAOR) error {
+	if aor.MaxContacts < 0 {
+		return fmt.Errorf("max_contacts %d must not be negative", aor.MaxContacts)
+	}
+	if aor.QualifyFrequency < 0 || aor.QualifyFrequency > maxQualifyFrequency {
+		return fmt.Errorf("qualify_frequency %d outside 0-%d", aor.QualifyFrequency, maxQualifyFrequency)
+	}
+	if aor.QualifyTimeout < 0 {
+		return fmt.Errorf("qualify_timeout %g must not be negative", aor.QualifyTimeout)
+	}
+	if aor.QualifyFrequency > 0 && aor.QualifyTimeout >= float64(aor.QualifyFrequency) {
+		return fmt.Errorf("qualify_timeout %g must be shorter than qualify_frequency %d", aor.QualifyTimeout, aor.QualifyFrequency)
+	}
+	for _, e := range []struct {
+		name  string
+		value int
+	}{
+		{"minimum_expiration", aor.MinimumExpiration},
+		{"maximum_expiration", aor.MaximumExpiration},
+		{"default_expiration", aor.DefaultExpiration},
+	} {
+		if e.value < 0 {
+			return fmt.Errorf("%s %d must not be negative", e.name, e.value)
+		}
+	}
+	if aor.MinimumExpiration > 0 && aor.MaximumExpiration > 0 && aor.MinimumExpiration > aor.MaximumExpiration {
+		return fmt.Errorf("minimum_expiration %d exceeds maximum_expiration %d", aor.MinimumExpiration, aor.MaximumExpiration)
+	}
+	if d := aor.DefaultExpiration; d > 0 {
+		if aor.MinimumExpiration > 0 && d < aor.MinimumExpiration {
+			return fmt.Errorf("default_expiration %d is below minimum_expiration %d", d, aor.MinimumExpiration)
+		}
+		if aor.MaximumExpiration > 0 && d > aor.MaximumExpiration {
+			return fmt.Errorf("default_expiration %d exceeds maximum_expiration %d", d, aor.MaximumExpiration)
+		}
+	}
+	return nil
+}
+
+// notesString is metadataString without the single-line rule: notes may
+// span lines, which are kept with surrounding whitespace trimmed.
+func notesString(ext string, v any) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("contact %s notes must be a plain string", ext)
+	}
+	return strings.TrimSpace(str), nil
+}
+
+// normalizeMAC accepts a hardware address with optional ":", "-" or "."
+// separators and returns it as 12 lowercase hex digits.
+func normalizeMAC(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(raw) {
+		switch {
+		case (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f'):
+			b.WriteRune(r)
+		case r == ':' || r == '-' || r == '.':
+		default:
+			return "", fmt.Errorf("mac %q has invalid character %q", raw, r)
+		}
+	}
+	if b.Len() != 12 {
+		return "", fmt.Errorf("mac %q must have 12 hex digits", raw)
+	}
+	return b.String(), nil
+}
+
+// checkSpeedDials rejects two contacts claiming the same speed-dial slot;
+// unlike per-contact errors this is not resolvable by skipping one of them.
+func checkSpeedDials(contacts []model.Contact) error {
+	owners := map[int]model.Contact{}
+	for _, c := range contacts {
+		if c.SpeedDial == nil {
+			continue
+		}
+		if prev, ok := owners[*c.SpeedDial]; ok {
+			return &config.ValidationError{Field: "speed_dial", Err: fmt.Errorf("speed_dial %d assigned to both %s (%s) and %s (%s)", *c.SpeedDial, prev.Extension, prev.SourcePath, c.Extension, c.SourcePath)}
+		}
+		owners[*c.SpeedDial] = c
+	}
+	return nil
+}
+
+// checkMACs rejects two contacts provisioning the same phone.
+func checkMACs(contacts []model.Contact) error {
+	owners := map[string]model.Contact{}
+	for _, c := range contacts {
+		if c.MAC == "" {
+			continue
+		}
+		if prev, ok := owners[c.MAC]; ok {
+			return &config.ValidationError{Field: "mac", Err: fmt.Errorf("mac %s assigned to both %s (%s) and %s (%s)", c.MAC, prev.Extension, prev.SourcePath, c.Extension, c.SourcePath)}
+		}
+		owners[c.MAC] = c
+	}
+	return nil
+}
+
 func normalizeGroup(g *int) *int {
 	if g == nil {
 		return nil
@@ -333,6 +1037,57 @@ func normalizeGroup(g *int) *int {
 	return &val
 }
 
+// checkExtension accepts a dialable ext (kept verbatim as a string, so
+// leading zeros survive) or, when allowed, a SIP username made of letters,
+// digits, '.', '_' and '-'. A named ext is not a phonebook number, so such
+// contacts must list phones explicitly.
+func (r rules) checkExtension(ext string, hasPhones bool) error {
+	if _, err := normalizePhone(ext); err == nil {
+		return nil
+	}
+	for _, c := range ext {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '.' && c != '_' && c != '-' {
+			return fmt.Errorf("contact %s ext has invalid character %q", ext, c)
+		}
+	}
+	if !r.alnumExt {
+		return fmt.Errorf("contact %s has an alphanumeric ext; set extension.allow_alphanumeric to allow named SIP accounts", ext)
+	}
+	if !hasPhones {
+		return fmt.Errorf("contact %s has an alphanumeric ext and needs a dialable number under phones", ext)
+	}
+	return nil
+}
+
+// extensionViolation describes the first config extension constraint ext
+// breaks, or returns "" when it satisfies them all.
+func (r rules) extensionViolation(ext string) string {
+	e := r.extension
+	if r.extPattern != nil && !r.extPattern.MatchString(ext) {
+		return fmt.Sprintf("does not match pattern %q", e.Pattern)
+	}
+	if e.MinLength > 0 && len(ext) < e.MinLength {
+		return fmt.Sprintf("is shorter than %d characters", e.MinLength)
+	}
+	if e.MaxLength > 0 && len(ext) > e.MaxLength {
+		return fmt.Sprintf("is longer than %d characters", e.MaxLength)
+	}
+	if e.Min == nil && e.Max == nil {
+		return ""
+	}
+	n, err := strconv.Atoi(ext)
+	if err != nil {
+		return "is not numeric but extension.min/max are set"
+	}
+	if e.Min != nil && n < *e.Min {
+		return fmt.Sprintf("is below %d", *e.Min)
+	}
+	if e.Max != nil && n > *e.Max {
+		return fmt.Sprintf("is above %d", *e.Max)
+	}
+	return ""
+}
+
 func normalizePhone(input string) (string, error) {
 	var b strings.Builder
 	for _, r := range input {
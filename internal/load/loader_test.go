@@ -1,12 +1,17 @@
 package load_test
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/n3wscott/phonebook/internal/config"
 	"github.com/n3wscott/phonebook/internal/load"
+	"github.com/n3wscott/phonebook/internal/model"
 	"github.com/n3wscott/phonebook/internal/testutil"
 )
 
@@ -78,6 +83,10 @@ func TestLoaderDedupLastWins(t *testing.T) {
 	if got := res.Contacts[0].AccountIndex; got == nil || *got != 3 {
 		t.Fatalf("expected later file to win account_index, got %#v", res.Contacts[0].AccountIndex)
 	}
+	want := []load.ExtensionConflict{{Ext: "200", Winner: filepath.Join(root, "contacts/z.yaml"), Loser: filepath.Join(root, "contacts/a.yaml")}}
+	if !reflect.DeepEqual(res.Conflicts, want) {
+		t.Fatalf("expected the override recorded as a conflict, got %+v", res.Conflicts)
+	}
 }
 
 func TestLoaderParsesPhonebookOnlyContactWithoutPassword(t *testing.T) {
@@ -160,6 +169,50 @@ func TestLoaderSkipsInvalid(t *testing.T) {
 	}
 }
 
+func TestLoaderStrictFailsOnSkippedContacts(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/a.yaml", `contacts:
+  - id: good
+    first_name: Good
+    ext: "100"
+    password: "pw"
+  - id: bad
+    first_name: Bad
+    ext: "abc!"
+    password: "pw"
+`)
+	writeContactFile(t, root, "contacts/b.yaml", `contacts:
+  - id: nameless
+    ext: "101"
+    password: "pw"
+    group_id: 12
+`)
+	cfg, defs := testConfig()
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("lenient LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || len(res.Skipped) != 2 {
+		t.Fatalf("expected one contact and two skipped, got %d and %+v", len(res.Contacts), res.Skipped)
+	}
+
+	cache := load.NewCache()
+	for _, pass := range []string{"first", "cached"} {
+		_, err := load.New(root, testutil.NewTestLogger()).WithCache(cache).WithStrict(true).LoadContacts(cfg, defs)
+		var skipped *load.SkippedError
+		if !errors.As(err, &skipped) || config.ErrorKind(err) != config.KindValidation {
+			t.Fatalf("%s load: expected a validation SkippedError, got %v", pass, err)
+		}
+		if len(skipped.Contacts) != 2 || skipped.Contacts[0].Ext != "abc!" || skipped.Contacts[1].Ext != "101" {
+			t.Fatalf("%s load: unexpected skipped contacts %+v", pass, skipped.Contacts)
+		}
+		msg := err.Error()
+		if !strings.Contains(msg, filepath.Join(root, "contacts/a.yaml")+" ext abc!") || !strings.Contains(msg, filepath.Join(root, "contacts/b.yaml")+" ext 101") {
+			t.Fatalf("%s load: expected every file and ext in the error, got %q", pass, msg)
+		}
+	}
+}
+
 func writeContactFile(t *testing.T, root, rel, contents string) {
 	t.Helper()
 	path := filepath.Join(root, rel)
@@ -190,3 +243,949 @@ func testConfig() (config.Config, config.Defaults) {
 	}
 	return cfg, defs
 }
+
+func TestLoaderHandlesBOMAndCRLF(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/windows.yaml", "\xef\xbb\xbfcontacts:\r\n  - id: win\r\n    first_name: Windows\r\n    ext: \"3000\"\r\n    password: \"pw\"\r\n")
+	writeContactFile(t, root, "contacts/empty.yaml", "\xef\xbb\xbf\r\n")
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || res.Contacts[0].Extension != "3000" {
+		t.Fatalf("expected contact 3000, got %+v", res.Contacts)
+	}
+}
+
+func TestLoaderValidatesContactTransport(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: pinned
+    first_name: Pinned
+    ext: "4000"
+    password: "pw"
+    transport: transport-tls
+  - id: stray
+    first_name: Stray
+    ext: "4001"
+    password: "pw"
+    transport: transport-missing
+`)
+	cfg, defs := testConfig()
+	cfg.Transports = []config.Transport{{Name: "transport-tls", Protocol: "tls"}}
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected unknown transport contact to be skipped, got %+v", res.Contacts)
+	}
+	if got := res.Contacts[0].Endpoint.Transport; got != "transport-tls" {
+		t.Fatalf("expected transport-tls, got %q", got)
+	}
+}
+
+func TestLoaderValidatesSpeedDialSlots(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: desk
+    first_name: Front
+    ext: "100"
+    password: "pw"
+    speed_dial: 1
+  - id: far
+    first_name: Far
+    ext: "101"
+    password: "pw"
+    speed_dial: 50
+`)
+	cfg, defs := testConfig()
+	cfg.Phonebook.SpeedDial = config.SlotRange{Min: 1, Max: 10}
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || res.Contacts[0].SpeedDial == nil || *res.Contacts[0].SpeedDial != 1 {
+		t.Fatalf("expected only in-range speed dial contact, got %+v", res.Contacts)
+	}
+
+	writeContactFile(t, root, "contacts/more.yaml", `- id: lobby
+  first_name: Lobby
+  ext: "102"
+  password: "pw"
+  speed_dial: 1
+`)
+	if _, err := loader.LoadContacts(cfg, defs); err == nil || !strings.Contains(err.Error(), "speed_dial 1 assigned to both") {
+		t.Fatalf("expected duplicate speed_dial error, got %v", err)
+	}
+}
+
+func TestLoaderParsesTitleAndDepartment(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: ada
+    first_name: Ada
+    ext: "100"
+    password: "pw"
+    title: " Engineer "
+    department: R&D
+  - id: bad
+    first_name: Bad
+    ext: "101"
+    password: "pw"
+    title:
+      nested: true
+`)
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected non-string title to skip contact, got %+v", res.Contacts)
+	}
+	if c := res.Contacts[0]; c.Title != "Engineer" || c.Department != "R&D" {
+		t.Fatalf("unexpected metadata: title=%q department=%q", c.Title, c.Department)
+	}
+}
+
+func TestLoaderParsesRingtone(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: oncall
+    first_name: On
+    last_name: Call
+    ext: "100"
+    password: "pw"
+    ringtone: " ring3 "
+  - id: plain
+    first_name: Plain
+    ext: "101"
+    password: "pw"
+`)
+	cfg, defs := testConfig()
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 2 || res.Contacts[0].Ringtone != "ring3" || res.Contacts[1].Ringtone != "" {
+		t.Fatalf("unexpected ringtones: %+v", res.Contacts)
+	}
+}
+
+func TestLoaderNormalizesMAC(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: desk
+    first_name: Desk
+    ext: "100"
+    password: "pw"
+    mac: "00:0B:82:AA:BB:CC"
+    model: GXP2170
+  - id: typo
+    first_name: Typo
+    ext: "101"
+    password: "pw"
+    mac: "00:0B:82:AA:BB"
+`)
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected short mac to skip contact, got %+v", res.Contacts)
+	}
+	if c := res.Contacts[0]; c.MAC != "000b82aabbcc" || c.Model != "GXP2170" {
+		t.Fatalf("unexpected mac/model: %q %q", c.MAC, c.Model)
+	}
+}
+
+func TestLoaderRejectsMultiplePrimaryPhones(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: one
+    first_name: One
+    ext: "100"
+    password: "pw"
+    phones:
+      - number: "100"
+      - number: "5551000"
+        primary: true
+  - id: two
+    first_name: Two
+    ext: "101"
+    password: "pw"
+    phones:
+      - number: "101"
+        primary: true
+      - number: "5551001"
+        primary: true
+`)
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || res.Contacts[0].Extension != "100" {
+		t.Fatalf("expected only the single-primary contact, got %+v", res.Contacts)
+	}
+	if phones := res.Contacts[0].Phones; len(phones) != 2 || phones[0].Primary || !phones[1].Primary {
+		t.Fatalf("expected primary flag on second phone, got %+v", phones)
+	}
+}
+
+func TestLoaderReadsPhoneLabels(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: one
+    first_name: One
+    ext: "100"
+    password: "pw"
+    phones:
+      - number: "100"
+        label: Work
+      - number: "5551000"
+        label: pager
+      - number: "5551001"
+`)
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected the contact kept despite an unknown label, got %+v", res.Contacts)
+	}
+	phones := res.Contacts[0].Phones
+	if len(phones) != 3 || phones[0].Label != "work" || phones[1].Label != "" || phones[2].Label != "" {
+		t.Fatalf("expected work, an ignored label and none, got %+v", phones)
+	}
+}
+
+func TestLoaderValidatesNumericAndAlphanumericExtensions(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: bond
+    first_name: James
+    ext: 007
+    password: "pw"
+  - id: desk
+    first_name: Front
+    ext: frontdesk
+    password: "pw"
+    phones:
+      - number: "100"
+  - id: lobby
+    first_name: Lobby
+    ext: lobby
+    password: "pw"
+  - id: bad
+    first_name: Bad
+    ext: "front desk!"
+    password: "pw"
+`)
+	cfg, defs := testConfig()
+	loader := load.New(root, testutil.NewTestLogger())
+	res, err := loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || res.Contacts[0].Extension != "007" || res.Contacts[0].Phones[0].Number != "007" {
+		t.Fatalf("expected only the numeric ext with its leading zeros, got %+v", res.Contacts)
+	}
+
+	cfg.Extension.AllowAlphanumeric = true
+	res, err = loader.LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	var exts []string
+	for _, c := range res.Contacts {
+		exts = append(exts, c.Extension)
+	}
+	if strings.Join(exts, ",") != "007,frontdesk" {
+		t.Fatalf("expected frontdesk accepted and lobby (no phones) skipped, got %v", exts)
+	}
+	if desk := res.Contacts[1]; desk.Auth.Username != "frontdesk" || desk.Phones[0].Number != "100" {
+		t.Fatalf("expected SIP username and phonebook number to stay separate, got %+v", desk)
+	}
+}
+
+func TestLoaderEnforcesExtensionConventions(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: ok
+    first_name: Ok
+    ext: "1001"
+    password: "pw"
+  - id: typo
+    first_name: Typo
+    ext: "10001"
+    password: "pw"
+`)
+	cfg, defs := testConfig()
+	lo, hi := 1000, 1999
+	cfg.Extension = config.Extension{Pattern: `\d{4}`, Min: &lo, Max: &hi}
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 2 {
+		t.Fatalf("expected non-strict mode to keep both contacts, got %d", len(res.Contacts))
+	}
+	warned := false
+	for _, e := range logger.Entries() {
+		if e.Level == "warn" && e.Msg == "extension breaks site convention" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Fatalf("expected a convention warning, got %+v", logger.Entries())
+	}
+
+	cfg.Extension.Strict = true
+	_, err = load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err == nil || !strings.Contains(err.Error(), "contact 10001") || !strings.Contains(err.Error(), "users.yaml") {
+		t.Fatalf("expected strict failure naming the contact and file, got %v", err)
+	}
+}
+
+func TestLoaderWarnsOnPhoneExtensionMismatchWhenEnabled(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: same
+    first_name: Same
+    ext: "1001"
+    password: "pw"
+    phones:
+      - number: "1001"
+  - id: typo
+    first_name: Typo
+    ext: "1002"
+    password: "pw"
+    phones:
+      - number: "1020"
+  - id: did
+    first_name: Did
+    ext: "1003"
+    password: "pw"
+    phones:
+      - number: "1003"
+      - number: "5551003"
+`)
+	mismatches := func(enabled bool) []string {
+		cfg, defs := testConfig()
+		cfg.Extension.WarnPhoneMismatch = enabled
+		logger := testutil.NewTestLogger()
+		if _, err := load.New(root, logger).LoadContacts(cfg, defs); err != nil {
+			t.Fatalf("LoadContacts() error = %v", err)
+		}
+		var exts []string
+		for _, e := range logger.Entries() {
+			if e.Msg == "phone number differs from extension" {
+				exts = append(exts, fmt.Sprint(e.Args[1], "/", e.Args[3]))
+			}
+		}
+		return exts
+	}
+	if got := mismatches(false); len(got) != 0 {
+		t.Fatalf("expected no warnings when disabled, got %v", got)
+	}
+	if got := mismatches(true); len(got) != 1 || got[0] != "1002/1020" {
+		t.Fatalf("expected one warning for 1002/1020, got %v", got)
+	}
+}
+
+func TestLoaderChecksAccountIndexAgainstLines(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: desk
+    first_name: Desk
+    ext: "1001"
+    password: "pw"
+    phones:
+      - number: "1001"
+      - number: "5551001"
+        account_index: 2
+  - id: lone
+    first_name: Lone
+    ext: "1002"
+    password: "pw"
+    account_index: 5
+  - id: far
+    first_name: Far
+    ext: "1003"
+    password: "pw"
+    phones:
+      - number: "1003"
+        account_index: 3
+`)
+	cfg, defs := testConfig()
+	cfg.Phonebook.Lines = 4
+	cfg.Phonebook.WarnSparseLines = true
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 2 {
+		t.Fatalf("expected index 5 to be rejected with phonebook.lines=4, got %v", res.Contacts)
+	}
+	var skipped, sparse []string
+	for _, e := range logger.Entries() {
+		switch e.Msg {
+		case "skipping contact":
+			skipped = append(skipped, fmt.Sprint(e.Args[3]))
+		case "account_index leaves lines unused":
+			sparse = append(sparse, fmt.Sprint(e.Args[1], "/", e.Args[5]))
+		}
+	}
+	if len(skipped) != 1 || !strings.Contains(skipped[0], "contact 1002 account_index 5 exceeds phonebook.lines 4") {
+		t.Fatalf("expected the skip to name the contact and limit, got %v", skipped)
+	}
+	if len(sparse) != 1 || sparse[0] != "1003/1,2" {
+		t.Fatalf("expected a sparse warning for 1003 only, got %v", sparse)
+	}
+}
+
+func TestLoaderAllowsAccountIndexUpToMax(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: fanvil
+    first_name: Fanvil
+    ext: "1001"
+    password: "pw"
+    account_index: 12
+  - id: over
+    first_name: Over
+    ext: "1002"
+    password: "pw"
+    account_index: 17
+`)
+	cfg, defs := testConfig()
+	defs.MaxAccountIndex = 16
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 || *res.Contacts[0].AccountIndex != 12 {
+		t.Fatalf("expected account_index 12 accepted with max_account_index 16, got %+v", res.Contacts)
+	}
+	var skipped []string
+	for _, e := range logger.Entries() {
+		if e.Msg == "skipping contact" {
+			skipped = append(skipped, fmt.Sprint(e.Args[3]))
+		}
+	}
+	if len(skipped) != 1 || !strings.Contains(skipped[0], "contact 1002 account_index 17 exceeds max_account_index 16") {
+		t.Fatalf("expected the skip to name the contact and max, got %v", skipped)
+	}
+}
+
+func TestLoaderWarnsOnSharedAccountIndexAndAutoAssigns(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: desk
+    first_name: Desk
+    ext: "1001"
+    password: "pw"
+    phones:
+      - number: "1001"
+      - number: "5551001"
+      - number: "5552001"
+        account_index: 2
+`)
+	loadDesk := func(auto bool) ([]model.Phone, []string) {
+		cfg, defs := testConfig()
+		cfg.Phonebook.AutoAccountIndex = auto
+		logger := testutil.NewTestLogger()
+		res, err := load.New(root, logger).LoadContacts(cfg, defs)
+		if err != nil {
+			t.Fatalf("LoadContacts() error = %v", err)
+		}
+		if len(res.Contacts) != 1 {
+			t.Fatalf("expected one contact, got %v", res.Contacts)
+		}
+		var shared []string
+		for _, e := range logger.Entries() {
+			if e.Msg == "phones share an account_index" {
+				shared = append(shared, fmt.Sprint(e.Args[3], ":", e.Args[5]))
+			}
+		}
+		return res.Contacts[0].Phones, shared
+	}
+
+	_, shared := loadDesk(false)
+	if len(shared) != 1 || shared[0] != "1:1001,5551001" {
+		t.Fatalf("expected one warning naming line 1 and both numbers, got %v", shared)
+	}
+
+	phones, shared := loadDesk(true)
+	if len(shared) != 0 {
+		t.Fatalf("expected no shared lines after auto-assignment, got %v", shared)
+	}
+	var got []int
+	for _, p := range phones {
+		got = append(got, p.AccountIndex)
+	}
+	if fmt.Sprint(got) != "[1 3 2]" {
+		t.Fatalf("expected unspecified phones to skip the claimed line 2, got %v", got)
+	}
+}
+
+func TestLoaderMergesAndValidatesAOROptions(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: wan
+    first_name: Wan
+    ext: "1001"
+    password: "pw"
+    aor:
+      qualify_timeout: 2.5
+      maximum_expiration: 600
+  - id: slow
+    first_name: Slow
+    ext: "1002"
+    password: "pw"
+    aor:
+      qualify_frequency: 10
+      qualify_timeout: 10
+  - id: inverted
+    first_name: Inverted
+    ext: "1003"
+    password: "pw"
+    aor:
+      minimum_expiration: 900
+      maximum_expiration: 600
+`)
+	cfg, defs := testConfig()
+	defs.AOR.MinimumExpiration = 60
+	defs.AOR.DefaultExpiration = 300
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected only the valid contact, got %v", res.Contacts)
+	}
+	want := model.ContactAOR{
+		MaxContacts:       defs.AOR.MaxContacts,
+		RemoveExisting:    defs.AOR.RemoveExisting,
+		QualifyFrequency:  defs.AOR.QualifyFrequency,
+		QualifyTimeout:    2.5,
+		MinimumExpiration: 60,
+		MaximumExpiration: 600,
+		DefaultExpiration: 300,
+	}
+	if got := res.Contacts[0].AOR; got != want {
+		t.Fatalf("AOR = %+v, want %+v", got, want)
+	}
+	var skipped []string
+	for _, e := range logger.Entries() {
+		if e.Msg == "skipping contact" {
+			skipped = append(skipped, fmt.Sprint(e.Args[3]))
+		}
+	}
+	if len(skipped) != 2 ||
+		!strings.Contains(skipped[0], "contact 1002 aor: qualify_timeout 10 must be shorter than qualify_frequency 10") ||
+		!strings.Contains(skipped[1], "contact 1003 aor: minimum_expiration 900 exceeds maximum_expiration 600") {
+		t.Fatalf("unexpected skip reasons: %v", skipped)
+	}
+}
+
+// fakeSQLite writes a stand-in for the sqlite3 shell that records its
+// arguments and prints rows as JSON.
+func fakeSQLite(t *testing.T, rows string) (binary, argsFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	binary = filepath.Join(dir, "sqlite3")
+	argsFile = filepath.Join(dir, "args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\ncat <<'JSON'\n" + rows + "\nJSON\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake sqlite3: %v", err)
+	}
+	return binary, argsFile
+}
+
+func TestLoaderReadsContactsDB(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: desk
+    first_name: Desk
+    ext: "1001"
+    password: "yaml"
+  - id: lobby
+    first_name: Lobby
+    ext: "1002"
+    password: "pw"
+`)
+	writeContactFile(t, root, "hr.db", "")
+	binary, argsFile := fakeSQLite(t, `[{"ext":1001,"given":"Ada","last_name":"Lovelace","password":"hr","account_index":2,"hidden":0,"phones":"1001, 5551001"},
+{"ext":"1003","given":"Grace","last_name":null,"password":"pw","hidden":1},
+{"ext":"","given":"Nobody"}]`)
+
+	cfg, defs := testConfig()
+	cfg.ContactsDB = config.ContactsDB{
+		Path:    "hr.db",
+		Table:   "employees",
+		Columns: map[string]string{"first_name": "given"},
+	}
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).WithSQLite3(binary).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	wantArgs := "-safe\n-readonly\n-json\n" + filepath.Join(root, "hr.db") + "\nSELECT * FROM employees\n"
+	if string(args) != wantArgs {
+		t.Fatalf("sqlite3 args = %q, want %q", args, wantArgs)
+	}
+
+	if len(res.Contacts) != 3 {
+		t.Fatalf("expected YAML and database contacts merged, got %+v", res.Contacts)
+	}
+	ada := res.Contacts[0]
+	if ada.FirstName != "Ada" || ada.Auth.Password != "hr" || ada.SourcePath != filepath.Join(root, "hr.db") {
+		t.Fatalf("expected the database row to replace YAML 1001, got %+v", ada)
+	}
+	if len(ada.Phones) != 2 || ada.Phones[1].Number != "5551001" || ada.Phones[0].AccountIndex != 2 {
+		t.Fatalf("unexpected phones from database row: %+v", ada.Phones)
+	}
+	if res.Contacts[1].Extension != "1002" || res.Contacts[2].Extension != "1003" || !res.Contacts[2].Hidden {
+		t.Fatalf("unexpected contacts: %+v", res.Contacts)
+	}
+	var skipped int
+	for _, e := range logger.Entries() {
+		if e.Msg == "skipping contact" {
+			skipped++
+		}
+	}
+	if skipped != 1 {
+		t.Fatalf("expected the row without ext to be skipped, got %d skips", skipped)
+	}
+	var tracked bool
+	for _, f := range res.Files {
+		tracked = tracked || f.Path == filepath.Join(root, "hr.db")
+	}
+	if !tracked {
+		t.Fatalf("expected the database file in Files, got %+v", res.Files)
+	}
+
+	cfg.ContactsDB.Columns = map[string]string{"nick": "x"}
+	if _, err := load.New(root, testutil.NewTestLogger()).WithSQLite3(binary).LoadContacts(cfg, defs); err == nil || !strings.Contains(err.Error(), `unknown contact field "nick"`) {
+		t.Fatalf("expected an unknown column mapping to fail, got %v", err)
+	}
+}
+
+func TestLoaderSkipsContactsDBWithoutSQLite3(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", "contacts:\n  - {first_name: Desk, ext: \"1001\", password: pw}\n")
+	writeContactFile(t, root, "hr.db", "")
+	cfg, defs := testConfig()
+	cfg.ContactsDB = config.ContactsDB{Path: "hr.db", Table: "employees"}
+
+	logger := testutil.NewTestLogger()
+	res, err := load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 1 {
+		t.Fatalf("expected only the YAML contact, got %+v", res.Contacts)
+	}
+	var warned bool
+	for _, e := range logger.Entries() {
+		warned = warned || strings.Contains(e.Msg, "without a sqlite3 binary")
+	}
+	if !warned {
+		t.Fatalf("expected a warning for the unread database, got %+v", logger.Entries())
+	}
+}
+
+func TestLoaderCacheMatchesFullLoad(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/a.yaml", `contacts:
+  - id: alpha
+    first_name: Alpha
+    ext: "1001"
+    password: "pw"
+  - id: broken
+    first_name: Broken
+    ext: "1002"
+`)
+	writeContactFile(t, root, "contacts/b.yaml", `contacts:
+  - id: bravo
+    first_name: Bravo
+    ext: "1003"
+    password: "pw"
+    phones:
+      - number: "1003"
+      - number: "5551003"
+`)
+	cfg, defs := testConfig()
+	cache := load.NewCache()
+
+	// compare loads the tree with and without the cache and requires the
+	// same contacts, files and warnings from both.
+	compare := func(wantReused int) {
+		t.Helper()
+		fullLog, cachedLog := testutil.NewTestLogger(), testutil.NewTestLogger()
+		full, err := load.New(root, fullLog).LoadContacts(cfg, defs)
+		if err != nil {
+			t.Fatalf("full LoadContacts() error = %v", err)
+		}
+		cached, err := load.New(root, cachedLog).WithCache(cache).LoadContacts(cfg, defs)
+		if err != nil {
+			t.Fatalf("cached LoadContacts() error = %v", err)
+		}
+		if cached.Reused != wantReused {
+			t.Fatalf("Reused = %d, want %d", cached.Reused, wantReused)
+		}
+		cached.Reused = 0
+		if !reflect.DeepEqual(full, cached) {
+			t.Fatalf("cached load differs from full load:\nfull   %+v\ncached %+v", full, cached)
+		}
+		if !reflect.DeepEqual(fullLog.Entries(), cachedLog.Entries()) {
+			t.Fatalf("cached load logged differently:\nfull   %+v\ncached %+v", fullLog.Entries(), cachedLog.Entries())
+		}
+	}
+
+	compare(0)
+	compare(2)
+
+	writeContactFile(t, root, "contacts/b.yaml", `contacts:
+  - id: bravo
+    first_name: Bravo Renamed
+    ext: "1003"
+    password: "pw"
+`)
+	compare(1)
+
+	if err := os.Remove(filepath.Join(root, "contacts", "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	compare(1)
+
+	cfg.Phonebook.AutoAccountIndex = true
+	compare(0)
+}
+
+func TestLoaderExtensionFallbackCanBeDisabled(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: bare
+    first_name: Bare
+    ext: "1001"
+    password: "pw"
+  - id: listed
+    first_name: Listed
+    ext: "1002"
+    password: "pw"
+    phones:
+      - number: "5551002"
+`)
+	cfg, defs := testConfig()
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if got := res.Contacts[0].Phones; len(got) != 1 || got[0].Number != "1001" {
+		t.Fatalf("expected the ext as fallback phone by default, got %+v", got)
+	}
+
+	off := false
+	cfg.Phonebook.ExtensionFallback = &off
+	logger := testutil.NewTestLogger()
+	res, err = load.New(root, logger).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	bare, listed := res.Contacts[0], res.Contacts[1]
+	if len(bare.Phones) != 0 || !bare.ExplicitPhones {
+		t.Fatalf("expected no synthesized phone, got %+v", bare)
+	}
+	if bare.Auth.Username != "1001" {
+		t.Fatalf("expected the contact to keep its SIP account, got %+v", bare.Auth)
+	}
+	if len(listed.Phones) != 1 || listed.Phones[0].Number != "5551002" {
+		t.Fatalf("expected listed phones unchanged, got %+v", listed.Phones)
+	}
+	warned := false
+	for _, e := range logger.Entries() {
+		warned = warned || e.Msg == "contact has no phones and is left out of the phonebook"
+	}
+	if !warned {
+		t.Fatal("expected a warning for the phoneless contact")
+	}
+}
+
+func TestLoaderValidatesContactContext(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: guest
+    first_name: Guest
+    ext: "1001"
+    password: "pw"
+    context: " guests "
+  - id: plain
+    first_name: Plain
+    ext: "1002"
+    password: "pw"
+  - id: spaced
+    first_name: Spaced
+    ext: "1003"
+    password: "pw"
+    context: "guest rooms"
+  - id: reserved
+    first_name: Reserved
+    ext: "1004"
+    password: "pw"
+    context: "globals"
+`)
+	cfg, defs := testConfig()
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 2 {
+		t.Fatalf("expected invalid contexts to skip their contacts, got %+v", res.Contacts)
+	}
+	if got := res.Contacts[0].Endpoint.Context; got != "guests" {
+		t.Fatalf("Context = %q, want guests", got)
+	}
+	if got := res.Contacts[1].Endpoint.Context; got != "" {
+		t.Fatalf("expected no context by default, got %q", got)
+	}
+}
+
+func TestLoaderParsesVoicemail(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/users.yaml", `contacts:
+  - id: boxed
+    first_name: Boxed
+    ext: "1001"
+    password: "pw"
+    voicemail:
+      pin: 0042
+      email: " boxed@example.com "
+  - id: plain
+    first_name: Plain
+    ext: "1002"
+    password: "pw"
+  - id: letters
+    first_name: Letters
+    ext: "1003"
+    password: "pw"
+    voicemail:
+      pin: "12a4"
+  - id: nopin
+    first_name: NoPin
+    ext: "1004"
+    password: "pw"
+    voicemail:
+      email: nopin@example.com
+  - id: twomail
+    first_name: TwoMail
+    ext: "1005"
+    password: "pw"
+    voicemail:
+      pin: "1234"
+      email: "a@example.com,b@example.com"
+`)
+	cfg, defs := testConfig()
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil {
+		t.Fatalf("LoadContacts() error = %v", err)
+	}
+	if len(res.Contacts) != 2 {
+		t.Fatalf("expected invalid voicemail blocks to skip their contacts, got %+v", res.Contacts)
+	}
+	vm := res.Contacts[0].Voicemail
+	if vm == nil || vm.PIN != "0042" || vm.Email != "boxed@example.com" {
+		t.Fatalf("Voicemail = %+v, want pin 0042 and boxed@example.com", vm)
+	}
+	if vm := res.Contacts[1].Voicemail; vm != nil {
+		t.Fatalf("expected no voicemail by default, got %+v", vm)
+	}
+}
+
+func TestLoaderEnforcesLimits(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "contacts/a.yaml", `- {first_name: Alpha, ext: "1000", password: pw}
+- {first_name: Bravo, ext: "1001", password: pw}
+`)
+	writeContactFile(t, root, "contacts/b.yaml", `- {first_name: Charlie, ext: "1002", password: pw}
+`)
+	cfg, defs := testConfig()
+	cfg.Limits.MaxContacts = 2
+	_, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || verr.Field != "limits.max_contacts" || !strings.Contains(err.Error(), "b.yaml") {
+		t.Fatalf("expected a max_contacts error naming b.yaml, got %v", err)
+	}
+
+	cfg.Limits.MaxContacts = 0
+	cfg.Limits.MaxFileBytes = 64
+	_, err = load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if !errors.As(err, &verr) || verr.Field != "limits.max_file_bytes" || !strings.Contains(err.Error(), "a.yaml") {
+		t.Fatalf("expected a max_file_bytes error naming a.yaml, got %v", err)
+	}
+
+	cfg.Limits = config.Limits{}
+	res, err := load.New(root, testutil.NewTestLogger()).LoadContacts(cfg, defs)
+	if err != nil || len(res.Contacts) != 3 {
+		t.Fatalf("expected the default limits to allow 3 contacts, got %d, %v", len(res.Contacts), err)
+	}
+}
+
+func TestLoadExternalContacts(t *testing.T) {
+	root := t.TempDir()
+	writeContactFile(t, root, "external.yaml", "\ufeff+15551234567: Acme Plumbing\r\n\"0800 123\": \" Bank \"\r\n")
+	cfg, _ := testConfig()
+	if names, metas, err := load.LoadExternalContacts(cfg, root); err != nil || names != nil || metas != nil {
+		t.Fatalf("expected nothing read without external_contacts, got %v %v %v", names, metas, err)
+	}
+
+	cfg.ExternalContacts = "external.yaml"
+	names, metas, err := load.LoadExternalContacts(cfg, root)
+	if err != nil {
+		t.Fatalf("LoadExternalContacts() error = %v", err)
+	}
+	want := map[string]string{"+15551234567": "Acme Plumbing", "0800 123": "Bank"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+	if len(metas) != 1 || metas[0].Path != filepath.Join(root, "external.yaml") {
+		t.Fatalf("expected the file tracked for reloads, got %+v", metas)
+	}
+
+	writeContactFile(t, root, "external.yaml", "+15551234567: \"\"\n")
+	var verr *config.ValidationError
+	if _, _, err := load.LoadExternalContacts(cfg, root); !errors.As(err, &verr) || verr.Field != "external_contacts" {
+		t.Fatalf("expected a validation error for an empty name, got %v", err)
+	}
+	writeContactFile(t, root, "external.yaml", "- not a map\n")
+	var perr *config.ParseError
+	if _, _, err := load.LoadExternalContacts(cfg, root); !errors.As(err, &perr) {
+		t.Fatalf("expected a parse error for a list, got %v", err)
+	}
+	cfg.ExternalContacts = "missing.yaml"
+	if _, _, err := load.LoadExternalContacts(cfg, root); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file to fail, got %v", err)
+	}
+}
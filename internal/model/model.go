@@ -6,43 +6,92 @@ import "time"
 type Phone struct {
 	Number       string
 	AccountIndex int
+	// Primary marks the number phonebook exports list first.
+	Primary bool
+	// Label is one of PhoneLabels, or empty.
+	Label string
 }
 
+// PhoneLabels are the phone labels contacts may use.
+var PhoneLabels = []string{"work", "mobile", "home", "fax"}
+
 // ContactAuth captures SIP auth credentials.
 type ContactAuth struct {
 	Username string
 	Password string
 }
 
-// ContactAOR defines address-of-record options.
+// ContactAOR defines address-of-record options. Zero QualifyTimeout and
+// expiration values are left out of pjsip.conf so Asterisk's own defaults
+// apply.
 type ContactAOR struct {
 	MaxContacts      int
 	RemoveExisting   bool
 	QualifyFrequency int
+	// QualifyTimeout is how long, in seconds, to wait for a qualify reply.
+	QualifyTimeout float64
+	// MinimumExpiration, MaximumExpiration and DefaultExpiration bound the
+	// registration expiry, in seconds, that phones may request.
+	MinimumExpiration int
+	MaximumExpiration int
+	DefaultExpiration int
 }
 
 // ContactEndpoint configures template selection.
 type ContactEndpoint struct {
 	Template string
+	// Transport pins the endpoint to a named transport, overriding the
+	// template default when set.
+	Transport string
+	// Context is the dialplan context the contact's extension is written
+	// into and its endpoint's calls start in. Empty means
+	// dialplan.context.
+	Context string
+}
+
+// ContactVoicemail is a contact's voicemail box. PIN is the mailbox
+// password and Email, when set, receives new message notifications.
+type ContactVoicemail struct {
+	PIN   string
+	Email string
 }
 
 // Contact is the normalized representation of a user/extension.
 type Contact struct {
-	ID            string
-	FirstName     string
-	LastName      string
-	Extension     string
-	Password      string
-	GroupID       *int
-	AccountIndex  *int
-	Phones        []Phone
-	Nickname      string
+	ID           string
+	FirstName    string
+	LastName     string
+	Extension    string
+	Password     string
+	GroupID      *int
+	AccountIndex *int
+	SpeedDial    *int
+	Phones       []Phone
+	Nickname     string
+	Title        string
+	Department   string
+	// Ringtone names the ring tone Grandstream phones play when this
+	// contact calls. Empty keeps the phone's default.
+	Ringtone string
+	// Notes is free-form maintenance text for editors. It is shown on the
+	// debug page and in generate json, never written to phones or Asterisk.
+	Notes string
+	// MAC is the contact's desk phone hardware address as 12 lowercase hex
+	// digits, and Model selects its provisioning template.
+	MAC           string
+	Model         string
 	PhonebookOnly bool
 	Hidden        bool
+	// ExplicitPhones means Phones is exactly what the directory lists: an
+	// empty Phones is not replaced with Extension. Set when
+	// phonebook.extension_fallback is off.
+	ExplicitPhones bool
 
 	Auth     ContactAuth
 	AOR      ContactAOR
 	Endpoint ContactEndpoint
+	// Voicemail is nil for contacts without a mailbox.
+	Voicemail *ContactVoicemail
 
 	SourcePath string
 	SourceMod  time.Time
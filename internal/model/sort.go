@@ -0,0 +1,67 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortKey selects the ordering used for contact listings.
+type SortKey string
+
+const (
+	SortByExtension SortKey = "extension"
+	SortByName      SortKey = "name"
+	SortByGroup     SortKey = "group"
+	SortBySource    SortKey = "source"
+)
+
+// ParseSortKey validates a user-supplied sort key. Empty selects extension
+// order, which matches the loader output.
+func ParseSortKey(raw string) (SortKey, error) {
+	switch key := SortKey(strings.ToLower(strings.TrimSpace(raw))); key {
+	case "":
+		return SortByExtension, nil
+	case SortByExtension, SortByName, SortByGroup, SortBySource:
+		return key, nil
+	default:
+		return "", fmt.Errorf("unknown contact sort %q (want extension, name, group, or source)", raw)
+	}
+}
+
+// SortContacts orders contacts in place. Every key falls back to extension
+// and then source path so the result is deterministic.
+func SortContacts(contacts []Contact, key SortKey) {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return lessContact(contacts[i], contacts[j], key)
+	})
+}
+
+func lessContact(a, b Contact, key SortKey) bool {
+	switch key {
+	case SortByName:
+		if an, bn := sortName(a), sortName(b); an != bn {
+			return an < bn
+		}
+	case SortByGroup:
+		if a.GroupID == nil || b.GroupID == nil {
+			if (a.GroupID == nil) != (b.GroupID == nil) {
+				return a.GroupID != nil
+			}
+		} else if *a.GroupID != *b.GroupID {
+			return *a.GroupID < *b.GroupID
+		}
+	case SortBySource:
+		if a.SourcePath != b.SourcePath {
+			return a.SourcePath < b.SourcePath
+		}
+	}
+	if a.Extension != b.Extension {
+		return a.Extension < b.Extension
+	}
+	return a.SourcePath < b.SourcePath
+}
+
+func sortName(c Contact) string {
+	return strings.ToLower(strings.TrimSpace(c.LastName + " " + c.FirstName))
+}
@@ -0,0 +1,41 @@
+package model
+
+import "testing"
+
+func TestSortContacts(t *testing.T) {
+	one, two := 1, 2
+	contacts := []Contact{
+		{FirstName: "Zoe", LastName: "Yu", Extension: "202", GroupID: &one, SourcePath: "b.yaml"},
+		{FirstName: "Amir", LastName: "Khan", Extension: "201", SourcePath: "c.yaml"},
+		{FirstName: "Lily", LastName: "Lee", Extension: "102", GroupID: &two, SourcePath: "a.yaml"},
+	}
+	tests := []struct {
+		key  SortKey
+		want []string
+	}{
+		{SortByExtension, []string{"102", "201", "202"}},
+		{SortByName, []string{"201", "102", "202"}},
+		{SortByGroup, []string{"202", "102", "201"}},
+		{SortBySource, []string{"102", "202", "201"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.key), func(t *testing.T) {
+			got := append([]Contact(nil), contacts...)
+			SortContacts(got, tt.key)
+			for i, ext := range tt.want {
+				if got[i].Extension != ext {
+					t.Fatalf("position %d: expected %s, got %s", i, ext, got[i].Extension)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSortKey(t *testing.T) {
+	if key, err := ParseSortKey(""); err != nil || key != SortByExtension {
+		t.Fatalf("expected default extension sort, got %q, %v", key, err)
+	}
+	if _, err := ParseSortKey("phase-of-moon"); err == nil {
+		t.Fatalf("expected error for unknown sort key")
+	}
+}
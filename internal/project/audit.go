@@ -0,0 +1,112 @@
+package project
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Audit finding kinds.
+const (
+	FindingUnusedTemplate      = "unused_template"
+	FindingUnusedDefault       = "unused_default_template"
+	FindingUnusedTransport     = "unused_transport"
+	FindingOrphanStaticContact = "orphan_static_contact"
+)
+
+// Finding is one piece of dead or dangling configuration reported by Audit.
+type Finding struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+// Audit reports configuration a build accepts but nothing uses: endpoint
+// templates no SIP contact inherits, a defaults template that only satisfies
+// validation, transports no endpoint can end up on, and static contacts for
+// extensions that do not exist. Findings are sorted by kind, then name.
+func Audit(state State) []Finding {
+	cfg := state.Config
+	templateTransport := map[string]string{}
+	for _, tmpl := range cfg.EndpointTemplates {
+		if v, ok := tmpl.Extra["transport"]; ok {
+			if name := strings.TrimSpace(fmt.Sprint(v)); name != "" {
+				templateTransport[tmpl.Name] = name
+			}
+		}
+	}
+
+	usedTemplates := map[string]bool{}
+	pinned := map[string]bool{}
+	unpinned := 0
+	extensions := map[string]bool{}
+	for _, c := range state.Contacts {
+		extensions[c.Extension] = true
+		if c.PhonebookOnly {
+			continue
+		}
+		usedTemplates[c.Endpoint.Template] = true
+		switch name, ok := templateTransport[c.Endpoint.Template]; {
+		case c.Endpoint.Transport != "":
+			pinned[c.Endpoint.Transport] = true
+		case ok:
+			pinned[name] = true
+		default:
+			unpinned++
+		}
+	}
+	// The edge endpoint is written with the first transport.
+	if cfg.Asterisk.EdgeIn.Match != "" && len(cfg.Transports) > 0 {
+		pinned[cfg.Transports[0].Name] = true
+	}
+
+	var findings []Finding
+	defaultTemplate := state.Defaults.Endpoint.Template
+	for _, tmpl := range cfg.EndpointTemplates {
+		if usedTemplates[tmpl.Name] {
+			continue
+		}
+		if tmpl.Name == defaultTemplate {
+			findings = append(findings, Finding{
+				Kind:   FindingUnusedDefault,
+				Name:   tmpl.Name,
+				Detail: "defaults.yaml endpoint.template, but every SIP contact names another template",
+			})
+			continue
+		}
+		findings = append(findings, Finding{
+			Kind:   FindingUnusedTemplate,
+			Name:   tmpl.Name,
+			Detail: "no SIP contact uses this endpoint template",
+		})
+	}
+	// An endpoint without transport= may land on any transport, so
+	// transports are only dead once every SIP endpoint is pinned.
+	if unpinned == 0 {
+		for _, t := range cfg.Transports {
+			if !pinned[t.Name] {
+				findings = append(findings, Finding{
+					Kind:   FindingUnusedTransport,
+					Name:   t.Name,
+					Detail: "no contact, endpoint template, or edge endpoint uses this transport",
+				})
+			}
+		}
+	}
+	for _, sc := range cfg.Asterisk.StaticContacts {
+		if sc.Ext != "" && !extensions[sc.Ext] {
+			findings = append(findings, Finding{
+				Kind:   FindingOrphanStaticContact,
+				Name:   sc.Ext,
+				Detail: fmt.Sprintf("asterisk.static_contacts entry %s matches no contact", sc.Contact),
+			})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Kind != findings[j].Kind {
+			return findings[i].Kind < findings[j].Kind
+		}
+		return findings[i].Name < findings[j].Name
+	})
+	return findings
+}
@@ -2,6 +2,10 @@ package project
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/n3wscott/phonebook/internal/asterisk"
@@ -18,10 +22,33 @@ type Logger interface {
 	Info(msg string, args ...any)
 }
 
-// Builder compiles configuration + contacts into renderable assets.
-type Builder struct {
-	Dir    string
-	Logger Logger
+// Builder compiles a phonebook source into renderable assets.
+type Builder interface {
+	Build() (State, error)
+}
+
+// DirBuilder is the default Builder, reading a data directory on disk.
+type DirBuilder struct {
+	Dir string
+	// Overlays are applied on top of Dir in order; see config.LoadOverlay
+	// and load.NewOverlay for the merge rules.
+	Overlays []string
+	// ContactsDB, when set, overrides contacts_db.path in config.yaml.
+	ContactsDB string
+	// SQLite3 is the sqlite3 binary the contacts database is read with.
+	// Empty leaves contacts_db unread, as for uploaded trees.
+	SQLite3 string
+	// Incremental keeps parsed contacts/ files between builds and only
+	// re-parses files that changed; see load.Cache. The rendered output is
+	// the same as a full build.
+	Incremental bool
+	// StrictLoad fails the build when any contact is skipped for failing
+	// normalization, instead of logging a warning; see load.SkippedError.
+	StrictLoad bool
+	Logger     Logger
+
+	cacheOnce sync.Once
+	cache     *load.Cache
 }
 
 // State is the compiled view of the repository.
@@ -32,37 +59,116 @@ type State struct {
 	Phonebook  []byte
 	PJSIP      []byte
 	Extensions []byte
+	// Voicemail is voicemail.conf, or nil when no contact has a mailbox.
+	Voicemail  []byte
 	Provision  map[string][]byte
 	Files      []config.FileMeta
 	LastUpdate time.Time
+	Stats      BuildStats
+	// Conflicts are the duplicate extensions the loader resolved by
+	// keeping the last one.
+	Conflicts []load.ExtensionConflict
+	// ExternalContacts maps outside numbers to display names, from
+	// external_contacts in config.yaml.
+	ExternalContacts map[string]string
+}
+
+// BuildStats records how long each phase of a Build took and how much it
+// read, so reload latency can be watched as the data directory grows.
+type BuildStats struct {
+	ConfigLoad       time.Duration
+	ContactLoad      time.Duration
+	XMLRender        time.Duration
+	PJSIPRender      time.Duration
+	ExtensionsRender time.Duration
+	ProvisionRender  time.Duration
+	Total            time.Duration
+	Contacts         int
+	Files            int
+	// ReusedFiles counts contacts/ files an incremental build did not
+	// re-parse.
+	ReusedFiles int
+	// Conflicts counts duplicate extensions that were overridden.
+	Conflicts int
+}
+
+// LogArgs returns the stats as slog-style key/value pairs.
+func (s BuildStats) LogArgs() []any {
+	return []any{
+		"config", s.ConfigLoad,
+		"contacts_load", s.ContactLoad,
+		"xml", s.XMLRender,
+		"pjsip", s.PJSIPRender,
+		"extensions", s.ExtensionsRender,
+		"provision", s.ProvisionRender,
+		"total", s.Total,
+		"contacts", s.Contacts,
+		"files", s.Files,
+		"reused_files", s.ReusedFiles,
+		"conflicts", s.Conflicts,
+	}
 }
 
 // Build loads the repo and renders XML + Asterisk configs.
-func (b *Builder) Build() (State, error) {
-	cfg, defs, metas, err := config.Load(b.Dir)
+func (b *DirBuilder) Build() (State, error) {
+	var stats BuildStats
+	start := time.Now()
+	mark := start
+	lap := func(d *time.Duration) {
+		now := time.Now()
+		*d = now.Sub(mark)
+		mark = now
+	}
+
+	dirs := append([]string{b.Dir}, b.Overlays...)
+	cfg, defs, metas, err := config.LoadOverlay(dirs)
 	if err != nil {
 		return State{}, err
 	}
+	lap(&stats.ConfigLoad)
 
-	loader := load.New(b.Dir, b.Logger)
+	loader := load.NewOverlay(dirs, b.Logger).WithContactsDB(b.ContactsDB).WithSQLite3(b.SQLite3).WithStrict(b.StrictLoad)
+	if b.Incremental {
+		b.cacheOnce.Do(func() { b.cache = load.NewCache() })
+		loader.WithCache(b.cache)
+	}
 	contactRes, err := loader.LoadContacts(cfg, defs)
 	if err != nil {
 		return State{}, err
 	}
 	metas = append(metas, contactRes.Files...)
+	warnAmbiguousTransports(b.Logger, cfg, contactRes.Contacts)
+	external, externalMetas, err := load.LoadExternalContacts(cfg, b.Dir)
+	if err != nil {
+		return State{}, err
+	}
+	metas = append(metas, externalMetas...)
+	if cfg.ProvisionTemplates != "" {
+		if err := provision.CheckContacts(filepath.Join(b.Dir, cfg.ProvisionTemplates), contactRes.Contacts); err != nil {
+			return State{}, &config.ValidationError{Field: "provision_templates", Err: err}
+		}
+	}
+	lap(&stats.ContactLoad)
 
 	xmlBytes, err := xmlgen.Build(contactRes.Contacts)
 	if err != nil {
 		return State{}, err
 	}
+	lap(&stats.XMLRender)
 	pjsipBytes, err := asterisk.RenderPJSIP(cfg, contactRes.Contacts)
 	if err != nil {
 		return State{}, err
 	}
+	lap(&stats.PJSIPRender)
 	extensionsBytes, err := asterisk.RenderExtensions(cfg, contactRes.Contacts)
 	if err != nil {
 		return State{}, err
 	}
+	voicemailBytes, err := asterisk.RenderVoicemail(cfg, contactRes.Contacts)
+	if err != nil {
+		return State{}, err
+	}
+	lap(&stats.ExtensionsRender)
 
 	provHost := globalString(cfg.Global, "provision_host", "cash-pbx.lan")
 	provPort := globalString(cfg.Global, "provision_port", defaultPortFromAddr(cfg.Server.Addr))
@@ -85,22 +191,83 @@ func (b *Builder) Build() (State, error) {
 		return State{}, err
 	}
 	metas = append(metas, provMetas...)
+	lap(&stats.ProvisionRender)
+
+	xmlBytes = cfg.Output.Apply(xmlBytes)
+	pjsipBytes = cfg.Output.Apply(pjsipBytes)
+	extensionsBytes = cfg.Output.Apply(extensionsBytes)
+	if voicemailBytes != nil {
+		voicemailBytes = cfg.Output.Apply(voicemailBytes)
+	}
+	for name, body := range provFiles {
+		provFiles[name] = cfg.Output.Apply(body)
+	}
 
 	last := latest(metas)
+	stats.Total = time.Since(start)
+	stats.Contacts = len(contactRes.Contacts)
+	stats.Files = len(metas)
+	stats.ReusedFiles = contactRes.Reused
+	stats.Conflicts = len(contactRes.Conflicts)
 
 	return State{
-		Config:     cfg,
-		Defaults:   defs,
-		Contacts:   contactRes.Contacts,
-		Phonebook:  xmlBytes,
-		PJSIP:      pjsipBytes,
-		Extensions: extensionsBytes,
-		Provision:  provFiles,
-		Files:      metas,
-		LastUpdate: last,
+		Config:           cfg,
+		Defaults:         defs,
+		Contacts:         contactRes.Contacts,
+		Phonebook:        xmlBytes,
+		PJSIP:            pjsipBytes,
+		Extensions:       extensionsBytes,
+		Voicemail:        voicemailBytes,
+		Provision:        provFiles,
+		Conflicts:        contactRes.Conflicts,
+		ExternalContacts: external,
+		Files:            metas,
+		LastUpdate:       last,
+		Stats:            stats,
 	}, nil
 }
 
+// warnAmbiguousTransports reports protocols with more than one transport when
+// some SIP contact has no transport pinned by itself or its template; Asterisk
+// then picks one of them arbitrarily.
+func warnAmbiguousTransports(logger Logger, cfg config.Config, contacts []model.Contact) {
+	byProtocol := map[string][]string{}
+	for _, t := range cfg.Transports {
+		proto := strings.ToLower(strings.TrimSpace(t.Protocol))
+		if proto == "" {
+			proto = "udp"
+		}
+		byProtocol[proto] = append(byProtocol[proto], t.Name)
+	}
+	pinnedTemplates := map[string]bool{}
+	for _, tmpl := range cfg.EndpointTemplates {
+		if v, ok := tmpl.Extra["transport"]; ok && strings.TrimSpace(fmt.Sprint(v)) != "" {
+			pinnedTemplates[tmpl.Name] = true
+		}
+	}
+	unpinned := 0
+	for _, c := range contacts {
+		if c.PhonebookOnly || c.Endpoint.Transport != "" || pinnedTemplates[c.Endpoint.Template] {
+			continue
+		}
+		unpinned++
+	}
+	if unpinned == 0 {
+		return
+	}
+	protocols := make([]string, 0, len(byProtocol))
+	for proto := range byProtocol {
+		protocols = append(protocols, proto)
+	}
+	sort.Strings(protocols)
+	for _, proto := range protocols {
+		if names := byProtocol[proto]; len(names) > 1 {
+			logger.Warn("multiple transports share a protocol and contacts do not pin one; set transport on the endpoint template or contact",
+				"protocol", proto, "transports", strings.Join(names, ","), "unpinned_contacts", unpinned)
+		}
+	}
+}
+
 func latest(files []config.FileMeta) time.Time {
 	var t time.Time
 	for _, f := range files {
@@ -0,0 +1,43 @@
+package project
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// WarningRecorder forwards to another logger and keeps each Warn call as a
+// "msg key=value ..." line, so callers can report what a Build complained
+// about once it returns.
+type WarningRecorder struct {
+	next Logger
+
+	mu    sync.Mutex
+	lines []string
+}
+
+// NewWarningRecorder returns a WarningRecorder forwarding to next.
+func NewWarningRecorder(next Logger) *WarningRecorder {
+	return &WarningRecorder{next: next}
+}
+
+func (l *WarningRecorder) Info(msg string, args ...any) { l.next.Info(msg, args...) }
+
+func (l *WarningRecorder) Warn(msg string, args ...any) {
+	l.next.Warn(msg, args...)
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	l.mu.Lock()
+	l.lines = append(l.lines, b.String())
+	l.mu.Unlock()
+}
+
+// Warnings returns the recorded warnings in the order they were logged.
+func (l *WarningRecorder) Warnings() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.lines...)
+}
@@ -0,0 +1,121 @@
+package provision
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// DefaultContactTemplate renders contacts whose model has no template of its
+// own.
+const DefaultContactTemplate = "default"
+
+// contactTemplateExt is the file suffix for per-model contact templates.
+const contactTemplateExt = ".cfg.tmpl"
+
+// RenderContacts executes Go templates from templatesDir for every contact with
+// a MAC and returns the output keyed by "<mac>.cfg". A contact's Model picks
+// "<model>.cfg.tmpl" (normalized like phone types), falling back to
+// "default.cfg.tmpl". Templates see the model.Contact as dot. All templates
+// are parsed and every reference resolved before anything is rendered, so a
+// bad template or missing model fails the whole run.
+func RenderContacts(templatesDir string, contacts []model.Contact) (map[string][]byte, error) {
+	jobs, err := planContacts(templatesDir, contacts)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(jobs))
+	for _, j := range jobs {
+		var buf bytes.Buffer
+		if err := j.tmpl.Execute(&buf, j.contact); err != nil {
+			return nil, fmt.Errorf("render %s for contact %s: %w", j.tmpl.Name(), j.contact.Extension, err)
+		}
+		out[j.contact.MAC+".cfg"] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// CheckContacts runs every check RenderContacts would, including executing
+// each contact's template, without keeping the output. Builds call it so
+// validate and serve reject what generate provision would.
+func CheckContacts(templatesDir string, contacts []model.Contact) error {
+	jobs, err := planContacts(templatesDir, contacts)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if err := j.tmpl.Execute(io.Discard, j.contact); err != nil {
+			return fmt.Errorf("render %s for contact %s: %w", j.tmpl.Name(), j.contact.Extension, err)
+		}
+	}
+	return nil
+}
+
+type contactJob struct {
+	contact model.Contact
+	tmpl    *template.Template
+}
+
+// planContacts pairs every contact with a MAC with its template.
+func planContacts(templatesDir string, contacts []model.Contact) ([]contactJob, error) {
+	templates, err := loadContactTemplates(templatesDir)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []contactJob{}
+	owners := map[string]string{}
+	for _, c := range contacts {
+		if c.MAC == "" {
+			continue
+		}
+		if prev, ok := owners[c.MAC]; ok {
+			return nil, fmt.Errorf("mac %s assigned to both %s and %s", c.MAC, prev, c.Extension)
+		}
+		owners[c.MAC] = c.Extension
+
+		name := normalizeName(c.Model)
+		tmpl, ok := templates[name]
+		if !ok {
+			tmpl, ok = templates[DefaultContactTemplate]
+		}
+		if !ok {
+			return nil, fmt.Errorf("contact %s model %q has no %s%s or %s%s in %s",
+				c.Extension, c.Model, name, contactTemplateExt, DefaultContactTemplate, contactTemplateExt, templatesDir)
+		}
+		jobs = append(jobs, contactJob{contact: c, tmpl: tmpl})
+	}
+	return jobs, nil
+}
+
+func loadContactTemplates(dir string) (map[string]*template.Template, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read provisioning templates: %w", err)
+	}
+	templates := map[string]*template.Template{}
+	for _, ent := range entries {
+		if ent.IsDir() || !strings.HasSuffix(ent.Name(), contactTemplateExt) {
+			continue
+		}
+		path := filepath.Join(dir, ent.Name())
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read template %s: %w", path, err)
+		}
+		tmpl, err := template.New(ent.Name()).Option("missingkey=error").Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", path, err)
+		}
+		templates[normalizeName(strings.TrimSuffix(ent.Name(), contactTemplateExt))] = tmpl
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no *%s templates found in %s", contactTemplateExt, dir)
+	}
+	return templates, nil
+}
@@ -0,0 +1,59 @@
+package provision
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+func TestRenderContactsUsesModelTemplateWithDefaultFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "gxp2170.cfg.tmpl", "P35={{.Auth.Username}}\nP34={{.Auth.Password}}\n")
+	writeTemplate(t, dir, "default.cfg.tmpl", "account={{.Extension}} name={{.FirstName}}\n")
+
+	got, err := RenderContacts(dir, []model.Contact{
+		{FirstName: "Desk", Extension: "100", MAC: "000b82aabbcc", Model: "GXP2170", Auth: model.ContactAuth{Username: "100", Password: "pw"}},
+		{FirstName: "Lobby", Extension: "101", MAC: "000b82ddeeff"},
+		{FirstName: "Softphone", Extension: "102"},
+	})
+	if err != nil {
+		t.Fatalf("RenderContacts() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected files only for contacts with a MAC, got %v", got)
+	}
+	if string(got["000b82aabbcc.cfg"]) != "P35=100\nP34=pw\n" {
+		t.Fatalf("unexpected model render: %q", got["000b82aabbcc.cfg"])
+	}
+	if string(got["000b82ddeeff.cfg"]) != "account=101 name=Lobby\n" {
+		t.Fatalf("unexpected default render: %q", got["000b82ddeeff.cfg"])
+	}
+}
+
+func TestRenderContactsRejectsBadReferences(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "gxp2170.cfg.tmpl", "P35={{.NoSuchField}}\n")
+
+	if _, err := RenderContacts(dir, []model.Contact{{Extension: "100", MAC: "000b82aabbcc", Model: "wp816"}}); err == nil || !strings.Contains(err.Error(), "default.cfg.tmpl") {
+		t.Fatalf("expected missing template error, got %v", err)
+	}
+	if _, err := RenderContacts(dir, []model.Contact{{Extension: "100", MAC: "000b82aabbcc", Model: "gxp2170"}}); err == nil || !strings.Contains(err.Error(), "NoSuchField") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+	if _, err := RenderContacts(dir, []model.Contact{
+		{Extension: "100", MAC: "000b82aabbcc", Model: "gxp2170"},
+		{Extension: "101", MAC: "000b82aabbcc", Model: "gxp2170"},
+	}); err == nil || !strings.Contains(err.Error(), "assigned to both") {
+		t.Fatalf("expected duplicate mac error, got %v", err)
+	}
+}
+
+func writeTemplate(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
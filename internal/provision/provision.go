@@ -72,7 +72,7 @@ func Build(dir string, opts Options) (map[string][]byte, []config.FileMeta, erro
 			return nil, nil, fmt.Errorf("read %s: %w", userPath, err)
 		}
 		var user userEntry
-		if err := yaml.Unmarshal(raw, &user); err != nil {
+		if err := yaml.Unmarshal(config.CleanSource(raw), &user); err != nil {
 			return nil, nil, fmt.Errorf("parse %s: %w", userPath, err)
 		}
 
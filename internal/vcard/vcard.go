@@ -0,0 +1,90 @@
+// Package vcard exports contacts as vCard 3.0 for address books such as
+// mobile clients and Thunderbird.
+package vcard
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// maxLineOctets is the longest content line vCard allows before folding.
+const maxLineOctets = 75
+
+// Build returns one BEGIN:VCARD/END:VCARD block per visible contact,
+// concatenated, with CRLF line endings as the format requires. Every phone
+// becomes a TEL;TYPE=work line; a dialable extension is listed first and
+// marked pref, and is not repeated when it is also one of the phones.
+func Build(contacts []model.Contact) []byte {
+	var b strings.Builder
+	for _, c := range contacts {
+		if c.Hidden {
+			continue
+		}
+		first, last := strings.TrimSpace(c.FirstName), strings.TrimSpace(c.LastName)
+		full := strings.TrimSpace(first + " " + last)
+		if full == "" {
+			full = c.Extension
+		}
+		writeLine(&b, "BEGIN:VCARD")
+		writeLine(&b, "VERSION:3.0")
+		writeLine(&b, "N:"+escape(last)+";"+escape(first)+";;;")
+		writeLine(&b, "FN:"+escape(full))
+		if c.Nickname != "" {
+			writeLine(&b, "NICKNAME:"+escape(c.Nickname))
+		}
+		if c.Title != "" {
+			writeLine(&b, "TITLE:"+escape(c.Title))
+		}
+		if c.Department != "" {
+			writeLine(&b, "ORG:;"+escape(c.Department))
+		}
+		ext := ""
+		if dialable(c.Extension) {
+			ext = c.Extension
+			writeLine(&b, "TEL;TYPE=work,pref:"+escape(ext))
+		}
+		for _, p := range c.Phones {
+			if p.Number != ext {
+				writeLine(&b, "TEL;TYPE=work:"+escape(p.Number))
+			}
+		}
+		writeLine(&b, "END:VCARD")
+	}
+	return []byte(b.String())
+}
+
+// escape backslash-escapes the characters vCard treats as structure, so a
+// name like "Doe, Jr" stays one value.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// dialable reports whether ext is a phone number rather than a named SIP
+// account (extension.allow_alphanumeric).
+func dialable(ext string) bool {
+	if ext == "" {
+		return false
+	}
+	return strings.Trim(ext, "0123456789+*#,") == ""
+}
+
+// writeLine writes line folded at maxLineOctets, continuing on lines that
+// start with a space and never splitting a UTF-8 sequence.
+func writeLine(b *strings.Builder, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts towards the next line's length.
+		limit = maxLineOctets - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
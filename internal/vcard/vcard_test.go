@@ -0,0 +1,46 @@
+package vcard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+func TestBuildWritesOneCardPerContact(t *testing.T) {
+	got := string(Build([]model.Contact{
+		{
+			FirstName: "John",
+			LastName:  "Doe, Jr",
+			Extension: "8000",
+			Title:     "R&D; Lab",
+			Phones: []model.Phone{
+				{Number: "8000", AccountIndex: 1},
+				{Number: "+15551234567", AccountIndex: 2},
+			},
+		},
+		{FirstName: "Front", LastName: `Desk\Lobby`, Extension: "frontdesk", Phones: []model.Phone{{Number: "100"}}},
+		{FirstName: "Hidden", Extension: "5653", Hidden: true},
+	}))
+	want := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Doe\\, Jr;John;;;\r\nFN:John Doe\\, Jr\r\nTITLE:R&D\\; Lab\r\n" +
+		"TEL;TYPE=work,pref:8000\r\nTEL;TYPE=work:+15551234567\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nN:Desk\\\\Lobby;Front;;;\r\nFN:Front Desk\\\\Lobby\r\n" +
+		"TEL;TYPE=work:100\r\nEND:VCARD\r\n"
+	if got != want {
+		t.Fatalf("Build() mismatch\nGot:\n%q\nWant:\n%q", got, want)
+	}
+}
+
+func TestWriteLineFoldsLongLines(t *testing.T) {
+	var b strings.Builder
+	writeLine(&b, "FN:"+strings.Repeat("é", 80))
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Fatalf("line of %d octets exceeds %d: %q", len(line), maxLineOctets, line)
+		}
+	}
+	unfolded := strings.ReplaceAll(b.String(), "\r\n ", "")
+	if unfolded != "FN:"+strings.Repeat("é", 80)+"\r\n" {
+		t.Fatalf("folding changed the value: %q", unfolded)
+	}
+}
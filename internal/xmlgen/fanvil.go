@@ -0,0 +1,50 @@
+package xmlgen
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// BuildFanvil generates a Fanvil/Htek remote phonebook
+// (<PhoneBook><DirectoryEntry>) from contacts. The schema has three number
+// slots per entry, filled in phone order as Telephone, Mobile, and Other; a
+// contact with more numbers continues in further entries under the same name.
+func BuildFanvil(contacts []model.Contact) ([]byte, error) {
+	book := fanvilPhonebook{}
+	for _, c := range contacts {
+		if c.Hidden {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimSpace(c.FirstName) + " " + strings.TrimSpace(c.LastName))
+		if name == "" {
+			name = strings.TrimSpace(c.Extension)
+		}
+		phones := collectPhones(c)
+		for len(phones) > 0 {
+			entry := fanvilEntry{Name: name, Telephone: phones[0].Number}
+			if len(phones) > 1 {
+				entry.Mobile = phones[1].Number
+			}
+			if len(phones) > 2 {
+				entry.Other = phones[2].Number
+			}
+			book.Entries = append(book.Entries, entry)
+			phones = phones[min(len(phones), 3):]
+		}
+	}
+	return marshalDocument(book, true)
+}
+
+type fanvilPhonebook struct {
+	XMLName xml.Name      `xml:"PhoneBook"`
+	Entries []fanvilEntry `xml:"DirectoryEntry"`
+}
+
+type fanvilEntry struct {
+	Name      string `xml:"Name"`
+	Telephone string `xml:"Telephone"`
+	Mobile    string `xml:"Mobile,omitempty"`
+	Other     string `xml:"Other,omitempty"`
+}
@@ -0,0 +1,70 @@
+package xmlgen
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// BuildPolycom generates a Polycom/Obihai contact directory
+// (<directory><item_list>) from contacts. Each phone number becomes its own
+// <item>, and the contact's speed-dial slot is attached to the first one. The
+// schema has no per-entry line field, so account indexes are not carried over.
+func BuildPolycom(contacts []model.Contact) ([]byte, error) {
+	dir := polycomDirectory{}
+	for _, c := range contacts {
+		if c.Hidden {
+			continue
+		}
+		for i, p := range collectPhones(c) {
+			item := polycomItem{
+				LastName:  strings.TrimSpace(c.LastName),
+				FirstName: strings.TrimSpace(c.FirstName),
+				Contact:   p.Number,
+			}
+			if i == 0 && c.SpeedDial != nil {
+				slot := *c.SpeedDial
+				item.SpeedDial = &slot
+			}
+			dir.ItemList.Items = append(dir.ItemList.Items, item)
+		}
+	}
+	return marshalDocument(dir, true)
+}
+
+// marshalDocument renders v as an XML document with a trailing newline,
+// indented when indent is set.
+func marshalDocument(v any, indent bool) ([]byte, error) {
+	var payload []byte
+	var err error
+	if indent {
+		payload, err = xml.MarshalIndent(v, "", "  ")
+	} else {
+		payload, err = xml.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	final := append([]byte(xml.Header), payload...)
+	if len(final) == 0 || final[len(final)-1] != '\n' {
+		final = append(final, '\n')
+	}
+	return final, nil
+}
+
+type polycomDirectory struct {
+	XMLName  xml.Name        `xml:"directory"`
+	ItemList polycomItemList `xml:"item_list"`
+}
+
+type polycomItemList struct {
+	Items []polycomItem `xml:"item"`
+}
+
+type polycomItem struct {
+	LastName  string `xml:"ln,omitempty"`
+	FirstName string `xml:"fn,omitempty"`
+	Contact   string `xml:"ct"`
+	SpeedDial *int   `xml:"sd,omitempty"`
+}
@@ -7,38 +7,75 @@ import (
 	"github.com/n3wscott/phonebook/internal/model"
 )
 
-// Build generates Grandstream-compatible XML from contacts.
+// Formats maps phonebook format names, as accepted by generate xml --format,
+// to their builders.
+var Formats = map[string]func([]model.Contact) ([]byte, error){
+	"grandstream": Build,
+	"polycom":     BuildPolycom,
+	"fanvil":      BuildFanvil,
+	"yealink":     BuildYealink,
+}
+
+// BuildOptions controls how BuildWithOptions renders the phonebook.
+type BuildOptions struct {
+	// Indent nests each element two spaces per level. Without it the
+	// document is a single line after the XML header, which phones with
+	// little memory parse more easily for large directories.
+	Indent bool
+}
+
+// Build generates indented Grandstream-compatible XML from contacts.
 func Build(contacts []model.Contact) ([]byte, error) {
+	return BuildWithOptions(contacts, BuildOptions{Indent: true})
+}
+
+// BuildWithOptions generates Grandstream-compatible XML from contacts,
+// rendered per opts.
+func BuildWithOptions(contacts []model.Contact, opts BuildOptions) ([]byte, error) {
 	book := xmlPhonebook{Contacts: make([]xmlContact, 0, len(contacts))}
 	for _, c := range contacts {
 		if c.Hidden {
 			continue
 		}
 		phones := collectPhones(c)
+		if len(phones) == 0 {
+			continue
+		}
 		xc := xmlContact{
-			LastName:  strings.TrimSpace(c.LastName),
-			FirstName: strings.TrimSpace(c.FirstName),
-			Phones:    phones,
+			LastName:   strings.TrimSpace(c.LastName),
+			FirstName:  strings.TrimSpace(c.FirstName),
+			Department: c.Department,
+			JobTitle:   c.Title,
+			Phones:     phones,
 		}
 		if c.GroupID != nil {
 			xc.Groups = &xmlGroups{GroupID: *c.GroupID}
 		}
+		if c.SpeedDial != nil {
+			slot := *c.SpeedDial
+			xc.SpeedDial = &slot
+		}
+		// Primary is only needed to tell the phone which line the
+		// ringtone belongs to; leaving it out keeps other contacts as
+		// they were.
+		if ringtone := strings.TrimSpace(c.Ringtone); ringtone != "" {
+			primary := phones[0].AccountIndex
+			xc.Primary = &primary
+			xc.Ringtone = ringtone
+		}
 		book.Contacts = append(book.Contacts, xc)
 	}
 
-	payload, err := xml.MarshalIndent(book, "", "  ")
-	if err != nil {
-		return nil, err
-	}
-	final := append([]byte(xml.Header), payload...)
-	if len(final) == 0 || final[len(final)-1] != '\n' {
-		final = append(final, '\n')
-	}
-	return final, nil
+	return marshalDocument(book, opts.Indent)
 }
 
+// collectPhones lists c's numbers, primary first. A contact without phones
+// gets its extension on its own line unless c.ExplicitPhones is set.
 func collectPhones(c model.Contact) []xmlPhone {
 	if len(c.Phones) == 0 {
+		if c.ExplicitPhones {
+			return nil
+		}
 		idx := 1
 		if c.AccountIndex != nil {
 			idx = *c.AccountIndex
@@ -50,27 +87,43 @@ func collectPhones(c model.Contact) []xmlPhone {
 	}
 	out := make([]xmlPhone, 0, len(c.Phones))
 	for _, p := range c.Phones {
-		out = append(out, xmlPhone{
+		phone := xmlPhone{
 			Number:       strings.TrimSpace(p.Number),
 			AccountIndex: p.AccountIndex,
-		})
+			Type:         phoneTypes[p.Label],
+		}
+		// Handsets treat the first number as the contact's main one.
+		if p.Primary {
+			out = append([]xmlPhone{phone}, out...)
+			continue
+		}
+		out = append(out, phone)
 	}
 	return out
 }
 
+// phoneTypes maps model.PhoneLabels to Grandstream's Phone type attribute.
+var phoneTypes = map[string]string{"work": "Work", "mobile": "Cell", "home": "Home", "fax": "Fax"}
+
 type xmlPhonebook struct {
 	XMLName  xml.Name     `xml:"AddressBook"`
 	Contacts []xmlContact `xml:"Contact"`
 }
 
 type xmlContact struct {
-	LastName  string     `xml:"LastName,omitempty"`
-	FirstName string     `xml:"FirstName,omitempty"`
-	Phones    []xmlPhone `xml:"Phone"`
-	Groups    *xmlGroups `xml:"Groups,omitempty"`
+	LastName   string     `xml:"LastName,omitempty"`
+	FirstName  string     `xml:"FirstName,omitempty"`
+	Department string     `xml:"Department,omitempty"`
+	JobTitle   string     `xml:"JobTitle,omitempty"`
+	Phones     []xmlPhone `xml:"Phone"`
+	Groups     *xmlGroups `xml:"Groups,omitempty"`
+	SpeedDial  *int       `xml:"SpeedDial,omitempty"`
+	Primary    *int       `xml:"Primary,omitempty"`
+	Ringtone   string     `xml:"Ringtone,omitempty"`
 }
 
 type xmlPhone struct {
+	Type         string `xml:"type,attr,omitempty"`
 	Number       string `xml:"phonenumber"`
 	AccountIndex int    `xml:"accountindex"`
 }
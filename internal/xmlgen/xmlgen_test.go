@@ -3,6 +3,7 @@ package xmlgen
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/n3wscott/phonebook/internal/model"
@@ -55,3 +56,272 @@ func TestBuildMatchesGolden(t *testing.T) {
 		t.Fatalf("XML output mismatch\nGot:\n%s\nWant:\n%s", got, want)
 	}
 }
+
+func TestBuildWithOptionsCompact(t *testing.T) {
+	contacts := []model.Contact{
+		{FirstName: "Front", LastName: "Desk", Extension: "100"},
+		{FirstName: "Back", Extension: "101"},
+	}
+	got, err := BuildWithOptions(contacts, BuildOptions{})
+	if err != nil {
+		t.Fatalf("BuildWithOptions() error = %v", err)
+	}
+	out := string(got)
+	body, ok := strings.CutPrefix(out, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	if !ok || !strings.HasSuffix(body, "</AddressBook>\n") || strings.Count(body, "\n") != 1 || strings.Contains(body, "  ") {
+		t.Fatalf("expected the header, then one unindented line ending in a newline, got:\n%s", out)
+	}
+	pretty, err := Build(contacts)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if strings.Join(strings.Fields(string(pretty)), "") != strings.Join(strings.Fields(out), "") {
+		t.Fatalf("expected the same elements as the indented build\nPretty:\n%s\nCompact:\n%s", pretty, out)
+	}
+}
+
+func TestBuildEmitsSpeedDialSlot(t *testing.T) {
+	slot := 7
+	got, err := Build([]model.Contact{
+		{FirstName: "Front", LastName: "Desk", Extension: "100", SpeedDial: &slot},
+		{FirstName: "No", LastName: "Slot", Extension: "101"},
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	out := string(got)
+	if strings.Count(out, "<SpeedDial>") != 1 || !strings.Contains(out, "<SpeedDial>7</SpeedDial>") {
+		t.Fatalf("expected exactly one SpeedDial element with slot 7, got:\n%s", out)
+	}
+}
+
+func TestBuildEmitsTitleAndDepartment(t *testing.T) {
+	got, err := Build([]model.Contact{
+		{FirstName: "Ada", LastName: "Lovelace", Extension: "100", Title: "Engineer", Department: "R&D"},
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	out := string(got)
+	if !strings.Contains(out, "<Department>R&amp;D</Department>") || !strings.Contains(out, "<JobTitle>Engineer</JobTitle>") {
+		t.Fatalf("expected department and title elements, got:\n%s", out)
+	}
+}
+
+func TestBuildEmitsRingtoneWithPrimaryAccount(t *testing.T) {
+	got, err := Build([]model.Contact{
+		{FirstName: "On", LastName: "Call", Phones: []model.Phone{
+			{Number: "5551000", AccountIndex: 1},
+			{Number: "5552000", AccountIndex: 3, Primary: true},
+		}, Ringtone: "ring3"},
+		{FirstName: "Plain", LastName: "Contact", Extension: "101"},
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	out := string(got)
+	if strings.Count(out, "<Ringtone>") != 1 || !strings.Contains(out, "<Primary>3</Primary>\n    <Ringtone>ring3</Ringtone>") {
+		t.Fatalf("expected one Ringtone with the first phone's account as Primary, got:\n%s", out)
+	}
+	if strings.Count(out, "<Primary>") != 1 {
+		t.Fatalf("expected no Primary element without a ringtone, got:\n%s", out)
+	}
+}
+
+func TestBuildEmitsPhoneType(t *testing.T) {
+	got, err := Build([]model.Contact{
+		{FirstName: "Field", LastName: "Tech", Phones: []model.Phone{
+			{Number: "5551000", AccountIndex: 1, Label: "mobile"},
+			{Number: "5552000", AccountIndex: 1},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	out := string(got)
+	if !strings.Contains(out, `<Phone type="Cell">`) || strings.Count(out, "type=") != 1 {
+		t.Fatalf("expected a Cell type on the labeled phone only, got:\n%s", out)
+	}
+}
+
+func TestBuildPolycomMatchesGolden(t *testing.T) {
+	gid := 0
+	slot := 3
+	contacts := []model.Contact{
+		{
+			FirstName: "John",
+			LastName:  "Doe",
+			Extension: "8000",
+			GroupID:   &gid,
+			SpeedDial: &slot,
+			Phones: []model.Phone{
+				{Number: "8000", AccountIndex: 1},
+				{Number: "8100", AccountIndex: 2},
+			},
+		},
+		{
+			FirstName: "Lily",
+			LastName:  "Lee",
+			Extension: "6000",
+		},
+		{
+			FirstName: "Hidden",
+			LastName:  "Service",
+			Extension: "5653",
+			Hidden:    true,
+		},
+	}
+
+	got, err := BuildPolycom(contacts)
+	if err != nil {
+		t.Fatalf("BuildPolycom() error = %v", err)
+	}
+
+	goldenPath := filepath.Join("..", "..", "testdata", "xml", "polycom.xml")
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+
+	if string(got) != string(want) {
+		t.Fatalf("XML output mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestBuildFanvilMatchesGolden(t *testing.T) {
+	contacts := []model.Contact{
+		{
+			FirstName: "John",
+			LastName:  "Doe",
+			Extension: "8000",
+			Phones: []model.Phone{
+				{Number: "8000", AccountIndex: 1},
+				{Number: "8100", AccountIndex: 2},
+				{Number: "8200", AccountIndex: 1},
+				{Number: "8300", AccountIndex: 1},
+			},
+		},
+		{
+			FirstName: "Lily",
+			Extension: "6000",
+		},
+		{
+			FirstName: "Hidden",
+			LastName:  "Service",
+			Extension: "5653",
+			Hidden:    true,
+		},
+	}
+
+	got, err := BuildFanvil(contacts)
+	if err != nil {
+		t.Fatalf("BuildFanvil() error = %v", err)
+	}
+
+	goldenPath := filepath.Join("..", "..", "testdata", "xml", "fanvil.xml")
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+
+	if string(got) != string(want) {
+		t.Fatalf("XML output mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestBuildYealinkMatchesGolden(t *testing.T) {
+	contacts := []model.Contact{
+		{
+			FirstName: "John",
+			LastName:  "Doe",
+			Extension: "8000",
+			Phones: []model.Phone{
+				{Number: "8000", AccountIndex: 1},
+				{Number: "8100", AccountIndex: 2, Primary: true},
+				{Number: "8200", AccountIndex: 1},
+			},
+		},
+		{
+			FirstName: "Lily",
+			Extension: "6000",
+		},
+		{
+			Extension: "7000",
+		},
+		{
+			FirstName: "Hidden",
+			LastName:  "Service",
+			Extension: "5653",
+			Hidden:    true,
+		},
+	}
+
+	got, err := BuildYealink(contacts)
+	if err != nil {
+		t.Fatalf("BuildYealink() error = %v", err)
+	}
+
+	goldenPath := filepath.Join("..", "..", "testdata", "xml", "yealink.xml")
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+
+	if string(got) != string(want) {
+		t.Fatalf("XML output mismatch\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestBuildYealinkSkipsContactsWithoutName(t *testing.T) {
+	got, err := BuildYealink([]model.Contact{
+		{FirstName: "  ", LastName: "", Extension: "7000"},
+		{LastName: "Lovelace", Extension: "7001"},
+	})
+	if err != nil {
+		t.Fatalf("BuildYealink() error = %v", err)
+	}
+	if out := string(got); strings.Contains(out, "7000") || !strings.Contains(out, "<Name>Lovelace</Name>") {
+		t.Fatalf("expected only the named contact, got:\n%s", out)
+	}
+}
+
+func TestBuildListsPrimaryPhoneFirst(t *testing.T) {
+	got, err := Build([]model.Contact{
+		{
+			FirstName: "Ada",
+			Extension: "100",
+			Phones: []model.Phone{
+				{Number: "100", AccountIndex: 1},
+				{Number: "5551000", AccountIndex: 2, Primary: true},
+				{Number: "200", AccountIndex: 1},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	out := string(got)
+	first := strings.Index(out, "<phonenumber>5551000</phonenumber>")
+	if first < 0 || first > strings.Index(out, "<phonenumber>100</phonenumber>") || strings.Index(out, "<phonenumber>100</phonenumber>") > strings.Index(out, "<phonenumber>200</phonenumber>") {
+		t.Fatalf("expected primary first and the rest in list order, got:\n%s", out)
+	}
+}
+
+func TestFormatsSkipContactsWithExplicitNoPhones(t *testing.T) {
+	contacts := []model.Contact{
+		{FirstName: "Bare", Extension: "1001", ExplicitPhones: true},
+		{FirstName: "Implicit", Extension: "1002"},
+	}
+	for name, build := range Formats {
+		out, err := build(contacts)
+		if err != nil {
+			t.Fatalf("%s: build error = %v", name, err)
+		}
+		if strings.Contains(string(out), "Bare") || strings.Contains(string(out), "1001") {
+			t.Fatalf("%s: expected the phoneless contact to be left out:\n%s", name, out)
+		}
+		if !strings.Contains(string(out), "1002") {
+			t.Fatalf("%s: expected the ext fallback for the other contact:\n%s", name, out)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package xmlgen
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/n3wscott/phonebook/internal/model"
+)
+
+// BuildYealink generates a Yealink remote phonebook
+// (<IPPhoneDirectory><DirectoryEntry>) from contacts, one entry per contact
+// with a Telephone element for each number, primary first. Contacts without
+// a name are left out, since Name is the only label an entry has.
+func BuildYealink(contacts []model.Contact) ([]byte, error) {
+	dir := yealinkDirectory{}
+	for _, c := range contacts {
+		if c.Hidden {
+			continue
+		}
+		phones := collectPhones(c)
+		if len(phones) == 0 {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimSpace(c.FirstName) + " " + strings.TrimSpace(c.LastName))
+		if name == "" {
+			continue
+		}
+		entry := yealinkEntry{Name: name}
+		for _, p := range phones {
+			entry.Telephones = append(entry.Telephones, p.Number)
+		}
+		dir.Entries = append(dir.Entries, entry)
+	}
+	return marshalDocument(dir, true)
+}
+
+type yealinkDirectory struct {
+	XMLName xml.Name       `xml:"IPPhoneDirectory"`
+	Entries []yealinkEntry `xml:"DirectoryEntry"`
+}
+
+type yealinkEntry struct {
+	Name       string   `xml:"Name"`
+	Telephones []string `xml:"Telephone"`
+}
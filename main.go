@@ -1,25 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/n3wscott/phonebook/internal/asterisk"
 	"github.com/n3wscott/phonebook/internal/calls"
+	"github.com/n3wscott/phonebook/internal/config"
+	"github.com/n3wscott/phonebook/internal/csvgen"
+	"github.com/n3wscott/phonebook/internal/diff"
 	"github.com/n3wscott/phonebook/internal/fswatch"
 	"github.com/n3wscott/phonebook/internal/httpapi"
+	"github.com/n3wscott/phonebook/internal/ldap"
+	"github.com/n3wscott/phonebook/internal/model"
 	"github.com/n3wscott/phonebook/internal/project"
+	"github.com/n3wscott/phonebook/internal/provision"
+	"github.com/n3wscott/phonebook/internal/vcard"
+	"github.com/n3wscott/phonebook/internal/xmlgen"
 )
 
 const defaultDebounce = 250 * time.Millisecond
@@ -27,6 +42,10 @@ const defaultDebounce = 250 * time.Millisecond
 func main() {
 	if err := run(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		var exit exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
 		os.Exit(1)
 	}
 }
@@ -43,6 +62,10 @@ func run(args []string) error {
 		return cmdGenerate(args[1:])
 	case "validate":
 		return cmdValidate(args[1:])
+	case "build":
+		return cmdBuild(args[1:])
+	case "audit":
+		return cmdAudit(args[1:])
 	default:
 		// Backwards-compatible: treat as serve flags.
 		return cmdServe(args)
@@ -50,10 +73,12 @@ func run(args []string) error {
 }
 
 type serveFlags struct {
-	dir      string
+	dir      dirList
 	addr     string
 	basePath string
 	outDir   string
+	manifest string
+	noWatch  bool
 	tlsCert  string
 	tlsKey   string
 	logLevel string
@@ -62,9 +87,58 @@ type serveFlags struct {
 	amiPass  string
 	cdrCSV   string
 
+	amiTLS           bool
+	amiTLSInsecure   bool
+	amiTLSServerName string
+
+	// amiPassFile holds the AMI password, read once at startup.
+	amiPassFile string
+
+	// ARI replaces AMI for call tracking when ariUser and ariPass are set.
+	ariURL         string
+	ariUser        string
+	ariPass        string
+	ariPassFile    string
+	ariApp         string
+	ariTLSInsecure bool
+
+	cdrReload      time.Duration
+	cdrColumns     calls.CDRColumns
+	historyMax     int
+	historyKeep    time.Duration
+	ignoredTargets string
+	shortCall      time.Duration
+	presenceTTL    time.Duration
+	maskDigits     int
+	unknownLabel   string
+
 	broadcastEnabled  bool
 	broadcastFrom     string
 	broadcastMaxChars int
+
+	maxBodyBytes   int
+	adminToken     string
+	authToken      string
+	basicUser      string
+	basicPass      string
+	dashboardAddr  string
+	ldapAddr       string
+	ldapBaseDN     string
+	wsSubprotocols string
+	wsPingInterval time.Duration
+	wsIdleTimeout  time.Duration
+	startupGrace   time.Duration
+	metrics        bool
+	allowReload    bool
+
+	asteriskDest  string
+	asteriskApply bool
+	liveDir       string
+
+	incremental bool
+
+	onReload        string
+	onReloadTimeout time.Duration
 }
 
 func cmdServe(args []string) error {
@@ -74,20 +148,26 @@ func cmdServe(args []string) error {
 	}
 	logger, level := newLogger(flags.logLevel)
 
-	builder := &project.Builder{Dir: flags.dir, Logger: logger}
-	state, err := builder.Build()
-	if err != nil {
-		return fmt.Errorf("initial build failed: %w", err)
-	}
+	dirBuilder := flags.dir.builder(logger)
+	dirBuilder.Incremental = flags.incremental
+	var builder project.Builder = dirBuilder
 
 	addr := flags.addr
 	basePath := normalizeBasePath(flags.basePath)
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	ignoredTargets := splitList(flags.ignoredTargets)
+	if ignoredTargets == nil {
+		ignoredTargets = []string{}
+	}
 	callService := calls.NewService(calls.Options{
-		MaxHistory: 100,
-		Retention:  7 * 24 * time.Hour,
+		MaxHistory:         flags.historyMax,
+		Retention:          flags.historyKeep,
+		IgnoredTargets:     ignoredTargets,
+		ShortCallThreshold: flags.shortCall,
+		PresenceTTL:        flags.presenceTTL,
+		CDRColumns:         flags.cdrColumns,
 	}, logger)
 	if flags.cdrCSV != "" {
 		loaded, err := callService.LoadCDR(flags.cdrCSV)
@@ -96,28 +176,47 @@ func cmdServe(args []string) error {
 		} else if loaded > 0 {
 			logger.Info("loaded historical calls from CDR", "count", loaded, "path", flags.cdrCSV)
 		}
+		if flags.cdrReload > 0 {
+			go callService.WatchCDR(ctx, flags.cdrCSV, flags.cdrReload)
+		}
 	}
-	if flags.amiUser != "" && flags.amiPass != "" {
+	amiCfg := calls.AMIConfig{
+		Addr:                  flags.amiAddr,
+		Username:              flags.amiUser,
+		Password:              flags.amiPass,
+		TLS:                   flags.amiTLS,
+		TLSInsecureSkipVerify: flags.amiTLSInsecure,
+		TLSServerName:         flags.amiTLSServerName,
+	}
+	switch {
+	case flags.ariUser != "":
+		ariCfg := calls.ARIConfig{
+			URL:                   flags.ariURL,
+			Username:              flags.ariUser,
+			Password:              flags.ariPass,
+			App:                   flags.ariApp,
+			TLSInsecureSkipVerify: flags.ariTLSInsecure,
+		}
 		go func() {
-			if err := callService.RunAMI(ctx, calls.AMIConfig{
-				Addr:     flags.amiAddr,
-				Username: flags.amiUser,
-				Password: flags.amiPass,
-			}); err != nil && !errors.Is(err, context.Canceled) {
+			if err := callService.RunARI(ctx, ariCfg); err != nil && !errors.Is(err, context.Canceled) {
+				logger.Warn("ARI listener exited", "err", err)
+			}
+		}()
+		if flags.amiUser != "" && flags.amiPass != "" {
+			logger.Info("tracking calls over ARI; the AMI credentials are used only for broadcast sends")
+		}
+	case flags.amiUser != "" && flags.amiPass != "":
+		go func() {
+			if err := callService.RunAMI(ctx, amiCfg); err != nil && !errors.Is(err, context.Canceled) {
 				logger.Warn("AMI listener exited", "err", err)
 			}
 		}()
-	} else {
-		logger.Warn("AMI listener disabled; set --ami-user and --ami-pass to enable live call tracking")
+	default:
+		logger.Warn("live call tracking disabled; set --ami-user and --ami-pass, or --ari-user and --ari-pass")
 	}
 
 	var broadcastSender httpapi.MessageSender
 	if flags.broadcastEnabled && flags.amiUser != "" && flags.amiPass != "" {
-		amiCfg := calls.AMIConfig{
-			Addr:     flags.amiAddr,
-			Username: flags.amiUser,
-			Password: flags.amiPass,
-		}
 		broadcastSender = httpapi.MessageSenderFunc(func(ctx context.Context, msg calls.Message) error {
 			return calls.SendAMIMessage(ctx, amiCfg, msg)
 		})
@@ -125,13 +224,39 @@ func cmdServe(args []string) error {
 		logger.Warn("broadcast send disabled; set --ami-user and --ami-pass to enable AMI MessageSend")
 	}
 
-	server := httpapi.NewServer(httpapi.Config{
-		Addr:        addr,
-		BasePath:    basePath,
-		TLSCert:     flags.tlsCert,
-		TLSKey:      flags.tlsKey,
-		AllowDebug:  level <= slog.LevelDebug,
-		CallService: callService,
+	applier := newAsteriskApplier(flags)
+	// reloadMu keeps a POST /api/reload from racing a watcher rebuild.
+	var reloadMu sync.Mutex
+	var server *httpapi.Server
+	server = httpapi.NewServer(httpapi.Config{
+		Addr:          addr,
+		DashboardAddr: flags.dashboardAddr,
+		BasePath:      basePath,
+		TLSCert:       flags.tlsCert,
+		TLSKey:        flags.tlsKey,
+		AllowDebug:    level <= slog.LevelDebug,
+		CallService:   callService,
+		MaxBodyBytes:  int64(flags.maxBodyBytes),
+		AdminToken:    flags.adminToken,
+		AuthToken:     flags.authToken,
+		BasicAuthUser: flags.basicUser,
+		BasicAuthPass: flags.basicPass,
+		StartupGrace:  flags.startupGrace,
+		EnableMetrics: flags.metrics,
+		LiveDir:       flags.liveDir,
+		AllowReload:   flags.allowReload,
+		OnReload: func() error {
+			reloadMu.Lock()
+			defer reloadMu.Unlock()
+			return reloadServe(ctx, builder, server, applier, flags, logger, nil)
+		},
+		CallerPrivacy: httpapi.CallerPrivacy{
+			MaskDigits:   flags.maskDigits,
+			UnknownLabel: flags.unknownLabel,
+		},
+		WebSocketSubprotocols: splitList(flags.wsSubprotocols),
+		WebSocketPingInterval: flags.wsPingInterval,
+		WebSocketIdleTimeout:  flags.wsIdleTimeout,
 		Broadcast: httpapi.BroadcastConfig{
 			Enabled:  flags.broadcastEnabled,
 			From:     flags.broadcastFrom,
@@ -139,42 +264,81 @@ func cmdServe(args []string) error {
 			Sender:   broadcastSender,
 		},
 	}, logger)
+
+	// Listen before the first build so phones polling during a slow cold
+	// start get a 503 with Retry-After instead of a refused connection.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start(ctx)
+	}()
+	if flags.ldapAddr != "" {
+		directory := ldap.New(ldap.Config{Addr: flags.ldapAddr, BaseDN: flags.ldapBaseDN, Credentials: ldapCredentials(flags)}, server, logger)
+		ln, err := directory.Listen()
+		if err != nil {
+			stop()
+			<-errCh
+			return fmt.Errorf("LDAP listen on %s: %w", flags.ldapAddr, err)
+		}
+		go func() {
+			if err := directory.Serve(ctx, ln); err != nil {
+				logger.Warn("LDAP listener exited", "err", err)
+			}
+		}()
+	}
+
+	start := time.Now()
+	state, err := builder.Build()
+	server.RecordBuild(time.Since(start), err)
+	if err != nil {
+		stop()
+		<-errCh
+		if errors.Is(err, config.ErrMissingConfig) {
+			return fmt.Errorf("initial build failed: %w (does --dir point at a data root?)", err)
+		}
+		return fmt.Errorf("initial build failed: %w", err)
+	}
+	server.SetContactSort(contactSort(state.Config))
+	server.SetExtraHeaders(state.Config.Server.Headers)
+	server.SetPresenceAliases(state.Config.PresenceAliases)
+	server.SetExternalContacts(state.ExternalContacts)
+	server.SetOutput(state.Config.Output)
 	server.UpdateProvision(state.Contacts, state.Phonebook, state.Provision, state.LastUpdate)
+	server.SetBuildStats(state.Stats)
+	server.SetAsteriskConfigs(state.PJSIP, state.Extensions)
+	server.PublishReload(httpapi.ReloadEvent{Status: httpapi.ReloadOK})
+	logger.Debug("build timings", state.Stats.LogArgs()...)
 
 	if flags.outDir != "" {
-		if err := writeOutputs(flags.outDir, state); err != nil {
+		files, err := writeOutputs(flags.outDir, state)
+		if err != nil {
+			return err
+		}
+		if err := writeManifest(flags.manifest, files); err != nil {
 			return err
 		}
 	}
+	// Asterisk may not be up yet on boot; the phonebook is served anyway and
+	// the next rebuild retries the reload.
+	applyAsterisk(applier, state, flags, logger)
 
 	logger.Info("serving phonebook", "addr", addr, "basePath", basePath, "contacts", len(state.Contacts))
 
-	watcher, err := fswatch.New(flags.dir, defaultDebounce, logger)
-	if err != nil {
-		return err
-	}
-	if err := watcher.Start(ctx, func() {
-		next, err := builder.Build()
+	if flags.noWatch {
+		logger.Info("file watching disabled; serving a fixed snapshot", "dir", flags.dir.String())
+	} else {
+		watcher, err := fswatch.NewRoots(flags.dir.watchRoots(state.Config), defaultDebounce, logger)
 		if err != nil {
-			logger.Warn("rebuild failed", "err", err)
-			return
+			return err
 		}
-		server.UpdateProvision(next.Contacts, next.Phonebook, next.Provision, next.LastUpdate)
-		if flags.outDir != "" {
-			if err := writeOutputs(flags.outDir, next); err != nil {
-				logger.Warn("failed to write outputs", "err", err)
-			}
+		if err := watcher.Start(ctx, func(changed []string) {
+			reloadMu.Lock()
+			defer reloadMu.Unlock()
+			_ = reloadServe(ctx, builder, server, applier, flags, logger, changed)
+		}); err != nil {
+			return err
 		}
-		logger.Info("reloaded phonebook", "contacts", len(next.Contacts))
-	}); err != nil {
-		return err
 	}
 
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- server.Start(ctx)
-	}()
-
 	select {
 	case <-ctx.Done():
 		<-errCh
@@ -187,15 +351,135 @@ func cmdServe(args []string) error {
 	}
 }
 
+// reloadServe rebuilds from builder and publishes the result to server and,
+// when configured, the staged --out directory. Failures keep the previous
+// snapshot in place. A build that finishes after ctx is cancelled is
+// discarded, so shutdown never races a final publish or --out write. Once
+// everything is written, the --on-reload hook runs with changed, the paths
+// that triggered the rebuild. The returned error is the build's; write and
+// hook failures are only logged, since the new snapshot is already served.
+func reloadServe(ctx context.Context, builder project.Builder, server *httpapi.Server, applier *asteriskApplier, flags serveFlags, logger *slog.Logger, changed []string) error {
+	start := time.Now()
+	next, err := builder.Build()
+	server.RecordBuild(time.Since(start), err)
+	if err != nil {
+		// Keep serving the last good snapshot; the kind says whether the
+		// edit broke YAML syntax or a setting.
+		logger.Warn("rebuild failed", "kind", config.ErrorKind(err), "err", err)
+		server.PublishReload(httpapi.ReloadEvent{Changed: changed, Status: httpapi.ReloadFailed, Kind: config.ErrorKind(err), Error: err.Error()})
+		return err
+	}
+	if ctx.Err() != nil {
+		logger.Debug("discarding rebuild after shutdown")
+		return ctx.Err()
+	}
+	server.SetOutput(next.Config.Output)
+	server.SetContactSort(contactSort(next.Config))
+	server.UpdateProvision(next.Contacts, next.Phonebook, next.Provision, next.LastUpdate)
+	server.SetExtraHeaders(next.Config.Server.Headers)
+	server.SetPresenceAliases(next.Config.PresenceAliases)
+	server.SetExternalContacts(next.ExternalContacts)
+	server.SetBuildStats(next.Stats)
+	server.SetAsteriskConfigs(next.PJSIP, next.Extensions)
+	logger.Debug("build timings", next.Stats.LogArgs()...)
+	server.PublishReload(httpapi.ReloadEvent{Changed: changed, Status: httpapi.ReloadOK})
+	written := true
+	if flags.outDir != "" {
+		files, err := writeOutputs(flags.outDir, next)
+		if err != nil {
+			logger.Warn("failed to write outputs", "err", err)
+			written = false
+		} else if err := writeManifest(flags.manifest, files); err != nil {
+			logger.Warn("failed to write manifest", "err", err)
+			written = false
+		}
+	}
+	if !applyAsterisk(applier, next, flags, logger) {
+		written = false
+	}
+	logger.Info("reloaded phonebook", "contacts", len(next.Contacts))
+	if flags.onReload != "" {
+		if !written {
+			logger.Warn("skipping reload hook after failed writes", "command", flags.onReload)
+			return nil
+		}
+		runReloadHook(ctx, flags, next, changed, logger)
+	}
+	return nil
+}
+
+// applyAsterisk writes state's Asterisk configs through applier and logs the
+// outcome. Failures are only logged: a failed reload stays pending in the
+// applier and is retried on the next build. It reports whether the apply
+// succeeded.
+func applyAsterisk(applier *asteriskApplier, state project.State, flags serveFlags, logger *slog.Logger) bool {
+	applied, err := applier.apply(state)
+	if err != nil {
+		logger.Warn("failed to apply Asterisk config", "dest", flags.asteriskDest, "err", err)
+		return false
+	}
+	if applied {
+		logger.Info("applied Asterisk config", "dest", flags.asteriskDest, "reload", flags.asteriskApply)
+	}
+	return true
+}
+
+// defaultReloadHookTimeout bounds --on-reload when --on-reload-timeout is
+// unset.
+const defaultReloadHookTimeout = 30 * time.Second
+
+// runReloadHook runs the --on-reload command through sh after a successful
+// rebuild and logs its combined output. The command sees the build in its
+// environment: PHONEBOOK_CONTACTS is the contact count, PHONEBOOK_CHANGED
+// the changed paths one per line, and PHONEBOOK_OUT/PHONEBOOK_ASTERISK_DEST
+// the output directories. A hook still running after the timeout is killed,
+// so it cannot hold up the next rebuild.
+func runReloadHook(ctx context.Context, flags serveFlags, state project.State, changed []string, logger *slog.Logger) {
+	timeout := flags.onReloadTimeout
+	if timeout <= 0 {
+		timeout = defaultReloadHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", flags.onReload)
+	cmd.Env = append(os.Environ(),
+		"PHONEBOOK_CONTACTS="+strconv.Itoa(len(state.Contacts)),
+		"PHONEBOOK_CHANGED="+strings.Join(changed, "\n"),
+		"PHONEBOOK_OUT="+flags.outDir,
+		"PHONEBOOK_ASTERISK_DEST="+flags.asteriskDest,
+	)
+	// A killed shell can leave children holding the output pipe open.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		logger.Warn("reload hook timed out", "command", flags.onReload, "timeout", timeout, "output", output)
+	case err != nil:
+		logger.Warn("reload hook failed", "command", flags.onReload, "err", err, "output", output)
+	default:
+		logger.Info("reload hook finished", "command", flags.onReload, "output", output)
+	}
+}
+
 func cmdGenerate(args []string) error {
 	if len(args) == 0 {
-		return errors.New("generate requires a subcommand: xml or asterisk")
+		return errors.New("generate requires a subcommand: xml, json, vcard, csv, asterisk, or provision")
 	}
 	switch args[0] {
 	case "xml":
 		return cmdGenerateXML(args[1:])
+	case "json":
+		return cmdGenerateJSON(args[1:])
+	case "vcard":
+		return cmdGenerateVCard(args[1:])
+	case "csv":
+		return cmdGenerateCSV(args[1:])
 	case "asterisk":
 		return cmdGenerateAsterisk(args[1:])
+	case "provision":
+		return cmdGenerateProvision(args[1:])
 	default:
 		return fmt.Errorf("unknown generate target %q", args[0])
 	}
@@ -203,105 +487,736 @@ func cmdGenerate(args []string) error {
 
 func cmdGenerateXML(args []string) error {
 	fs := flag.NewFlagSet("generate xml", flag.ExitOnError)
-	dir := fs.String("dir", "", "data root directory")
-	out := fs.String("out", "", "output file or directory (phonebook.xml)")
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	out := fs.String("out", "", "output file or directory (phonebook.xml, or <format>.xml for other formats)")
+	format := fs.String("format", "grandstream", "phonebook format: grandstream, polycom, fanvil, or yealink")
+	fs.StringVar(format, "vendor", "grandstream", "alias for --format")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	pretty := fs.Bool("pretty", true, "indent the phonebook; --pretty=false is the same as --compact")
+	compact := fs.Bool("compact", false, "write the grandstream phonebook without indentation, for phones with little memory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	if *out == "" {
+		return errors.New("--out is required")
+	}
+	build, ok := xmlgen.Formats[*format]
+	if !ok {
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+	if *compact || !*pretty {
+		if *format != "grandstream" {
+			return fmt.Errorf("--compact only applies to --format grandstream, not %q", *format)
+		}
+		build = func(contacts []model.Contact) ([]byte, error) {
+			return xmlgen.BuildWithOptions(contacts, xmlgen.BuildOptions{})
+		}
+	}
+	logger, _ := newLogger("info")
+	state, err := dir.builder(logger).Build()
+	if err != nil {
+		return err
+	}
+	payload, err := build(state.Contacts)
+	if err != nil {
+		return err
+	}
+	payload = state.Config.Output.Apply(payload)
+	fileName := "phonebook.xml"
+	if *format != "grandstream" {
+		fileName = *format + ".xml"
+	}
+	dest, err := resolveOutputPath(*out, fileName)
+	if err != nil {
+		return err
+	}
+	if err := atomicWrite(dest, payload, 0o644); err != nil {
+		return err
+	}
+	return writeManifest(*manifest, []outputFile{{Path: dest, Role: "phonebook"}})
+}
+
+// contactJSON is a contact as generate json prints it. Secrets are left
+// out so the dump can be shared for review.
+type contactJSON struct {
+	ID            string      `json:"id"`
+	FirstName     string      `json:"first_name,omitempty"`
+	LastName      string      `json:"last_name,omitempty"`
+	Ext           string      `json:"ext"`
+	AccountIndex  *int        `json:"account_index,omitempty"`
+	GroupID       *int        `json:"group_id,omitempty"`
+	SpeedDial     *int        `json:"speed_dial,omitempty"`
+	Phones        []phoneJSON `json:"phones"`
+	Nickname      string      `json:"nickname,omitempty"`
+	Title         string      `json:"title,omitempty"`
+	Department    string      `json:"department,omitempty"`
+	MAC           string      `json:"mac,omitempty"`
+	Model         string      `json:"model,omitempty"`
+	PhonebookOnly bool        `json:"phonebook_only,omitempty"`
+	Hidden        bool        `json:"hidden,omitempty"`
+	Username      string      `json:"username,omitempty"`
+	Template      string      `json:"template,omitempty"`
+	Transport     string      `json:"transport,omitempty"`
+	Notes         string      `json:"notes,omitempty"`
+	Source        string      `json:"source"`
+}
+
+type phoneJSON struct {
+	Number       string `json:"number"`
+	AccountIndex int    `json:"account_index"`
+	Primary      bool   `json:"primary,omitempty"`
+}
+
+func newContactJSON(c model.Contact) contactJSON {
+	out := contactJSON{
+		ID:            c.ID,
+		FirstName:     c.FirstName,
+		LastName:      c.LastName,
+		Ext:           c.Extension,
+		AccountIndex:  c.AccountIndex,
+		GroupID:       c.GroupID,
+		SpeedDial:     c.SpeedDial,
+		Phones:        make([]phoneJSON, 0, len(c.Phones)),
+		Nickname:      c.Nickname,
+		Title:         c.Title,
+		Department:    c.Department,
+		MAC:           c.MAC,
+		Model:         c.Model,
+		PhonebookOnly: c.PhonebookOnly,
+		Hidden:        c.Hidden,
+		Username:      c.Auth.Username,
+		Template:      c.Endpoint.Template,
+		Transport:     c.Endpoint.Transport,
+		Notes:         c.Notes,
+		Source:        c.SourcePath,
+	}
+	for _, p := range c.Phones {
+		out.Phones = append(out.Phones, phoneJSON{Number: p.Number, AccountIndex: p.AccountIndex, Primary: p.Primary})
+	}
+	return out
+}
+
+func cmdGenerateJSON(args []string) error {
+	fs := flag.NewFlagSet("generate json", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	out := fs.String("out", "-", "output file or directory (contacts.json), or - for stdout")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	logger, _ := newLogger("info")
+	state, err := dir.builder(logger).Build()
+	if err != nil {
+		return err
+	}
+	contacts := make([]contactJSON, 0, len(state.Contacts))
+	for _, c := range sortedExport(state) {
+		contacts = append(contacts, newContactJSON(c))
+	}
+	payload, err := json.MarshalIndent(map[string]any{"contacts": contacts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	payload = append(payload, '\n')
+	if *out == "-" {
+		_, err := os.Stdout.Write(payload)
+		return err
+	}
+	dest, err := resolveOutputPath(*out, "contacts.json")
+	if err != nil {
+		return err
+	}
+	if err := atomicWrite(dest, payload, 0o644); err != nil {
+		return err
+	}
+	return writeManifest(*manifest, []outputFile{{Path: dest, Role: "contacts"}})
+}
+
+// contactSort is server.contact_sort as a key. The build has already
+// validated it, so only the empty default reaches the fallback.
+func contactSort(cfg config.Config) model.SortKey {
+	key, err := model.ParseSortKey(cfg.Server.ContactSort)
+	if err != nil {
+		return model.SortByExtension
+	}
+	return key
+}
+
+// sortedExport returns the contacts in server.contact_sort order, the order
+// serve lists them in, for the json, vcard and csv exports.
+func sortedExport(state project.State) []model.Contact {
+	out := append([]model.Contact(nil), state.Contacts...)
+	model.SortContacts(out, contactSort(state.Config))
+	return out
+}
+
+// cmdGenerateVCard writes every visible contact to one vCard 3.0 file for
+// importing into mobile clients and mail address books.
+func cmdGenerateVCard(args []string) error {
+	fs := flag.NewFlagSet("generate vcard", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	out := fs.String("out", "", "output file or directory (contacts.vcf)")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if *dir == "" {
+	if dir.empty() {
 		return errors.New("--dir is required")
 	}
 	if *out == "" {
 		return errors.New("--out is required")
 	}
 	logger, _ := newLogger("info")
-	state, err := (&project.Builder{Dir: *dir, Logger: logger}).Build()
+	state, err := dir.builder(logger).Build()
 	if err != nil {
 		return err
 	}
-	dest, err := resolveOutputPath(*out, "phonebook.xml")
+	dest, err := resolveOutputPath(*out, "contacts.vcf")
 	if err != nil {
 		return err
 	}
-	return atomicWrite(dest, state.Phonebook, 0o644)
+	// vCard requires CRLF, so output.newline does not apply.
+	if err := atomicWrite(dest, vcard.Build(sortedExport(state)), 0o644); err != nil {
+		return err
+	}
+	return writeManifest(*manifest, []outputFile{{Path: dest, Role: "vcard"}})
+}
+
+// cmdGenerateCSV writes every contact as one CSV row for reconciling the
+// directory against other records in a spreadsheet.
+func cmdGenerateCSV(args []string) error {
+	fs := flag.NewFlagSet("generate csv", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	out := fs.String("out", "-", "output file or directory (contacts.csv), or - for stdout")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	logger, _ := newLogger("info")
+	state, err := dir.builder(logger).Build()
+	if err != nil {
+		return err
+	}
+	payload := state.Config.Output.Apply(csvgen.Build(sortedExport(state)))
+	if *out == "-" {
+		_, err := os.Stdout.Write(payload)
+		return err
+	}
+	dest, err := resolveOutputPath(*out, "contacts.csv")
+	if err != nil {
+		return err
+	}
+	if err := atomicWrite(dest, payload, 0o644); err != nil {
+		return err
+	}
+	return writeManifest(*manifest, []outputFile{{Path: dest, Role: "csv"}})
 }
 
 func cmdGenerateAsterisk(args []string) error {
 	fs := flag.NewFlagSet("generate asterisk", flag.ExitOnError)
-	dir := fs.String("dir", "", "data root directory")
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
 	dest := fs.String("dest", "", "output directory for pjsip.conf and extensions.conf")
 	apply := fs.Bool("apply", false, "atomically write to dest and reload Asterisk")
+	dirSwap := fs.Bool("dir-swap", false, "render into a sibling directory and swap it into place as a whole")
+	singleFile := fs.String("single-file", "", "write pjsip.conf and extensions.conf concatenated into this one file instead of --dest")
+	splitPerContact := fs.Bool("split-per-contact", false, "write each contact's PJSIP sections to --dest/"+splitContactDir+"/<ext>.conf, included from pjsip.conf")
+	checkSyntax := fs.Bool("check-asterisk-syntax", false, "load the rendered configs into a scratch Asterisk before writing --dest")
+	asteriskBin := fs.String("asterisk-bin", "asterisk", "asterisk binary used by --check-asterisk-syntax")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	showDiff := fs.Bool("diff", false, "print a unified diff against the files in --dest; writes nothing unless --apply is also set, which then skips an unchanged reload")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if *dir == "" {
+	if dir.empty() {
 		return errors.New("--dir is required")
 	}
-	if *dest == "" {
+	if *singleFile != "" {
+		if *dest != "" || *apply || *dirSwap || *splitPerContact || *showDiff {
+			return errors.New("--single-file cannot be combined with --dest, --apply, --dir-swap, --split-per-contact, or --diff")
+		}
+	} else if *dest == "" {
 		return errors.New("--dest is required")
 	}
+	if *showDiff && *splitPerContact {
+		return errors.New("--diff cannot be combined with --split-per-contact")
+	}
 
 	logger, _ := newLogger("info")
-	state, err := (&project.Builder{Dir: *dir, Logger: logger}).Build()
+	state, err := dir.builder(logger).Build()
 	if err != nil {
 		return err
 	}
-	if err := writeOutputs(*dest, state); err != nil {
+	if *checkSyntax {
+		if err := checkAsteriskSyntax(*asteriskBin, state); err != nil {
+			return err
+		}
+	}
+	if *singleFile != "" {
+		if err := atomicWrite(*singleFile, state.Config.Output.Apply(asterisk.Combine(state.PJSIP, state.Extensions, state.Voicemail)), 0o644); err != nil {
+			return err
+		}
+		return writeManifest(*manifest, []outputFile{{Path: *singleFile, Role: "asterisk"}})
+	}
+	if *showDiff {
+		changed, err := writeAsteriskDiff(os.Stdout, *dest, state)
+		if err != nil {
+			return err
+		}
+		if !*apply {
+			return nil
+		}
+		if !changed {
+			logger.Info("no changes, skipping reload", "dest", *dest)
+			return nil
+		}
+	}
+	voicemail := voicemailChanged(*dest, state)
+	write := writeOutputs
+	if *splitPerContact {
+		write = writeSplitOutputs
+	}
+	if *dirSwap {
+		staged := write
+		write = func(dest string, state project.State) ([]outputFile, error) {
+			return swapInto(dest, state, staged)
+		}
+	}
+	files, err := write(*dest, state)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(*manifest, files); err != nil {
 		return err
 	}
 	if *apply {
-		if err := reloadAsterisk(); err != nil {
+		if err := reloadAsterisk(voicemail); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func cmdGenerateProvision(args []string) error {
+	fs := flag.NewFlagSet("generate provision", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	templates := fs.String("template", "", "directory of <model>.cfg.tmpl Go templates (default: provision_templates in config.yaml)")
+	out := fs.String("out", "", "output directory for <mac>.cfg files")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	if *out == "" {
+		return errors.New("--out is required")
+	}
+
+	logger, _ := newLogger("info")
+	state, err := dir.builder(logger).Build()
+	if err != nil {
+		return err
+	}
+	if *templates == "" {
+		if state.Config.ProvisionTemplates == "" {
+			return errors.New("--template is required when config.yaml sets no provision_templates")
+		}
+		*templates = filepath.Join(dir.dirs[0], state.Config.ProvisionTemplates)
+	}
+	rendered, err := provision.RenderContacts(*templates, state.Contacts)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]outputFile, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(*out, name)
+		if err := atomicWrite(path, state.Config.Output.Apply(rendered[name]), 0o644); err != nil {
+			return err
+		}
+		files = append(files, outputFile{Path: path, Role: "provisioning"})
+	}
+	logger.Info("generated provisioning files", "count", len(files), "out", *out)
+	return writeManifest(*manifest, files)
+}
+
 func cmdValidate(args []string) error {
 	fs := flag.NewFlagSet("validate", flag.ExitOnError)
-	dir := fs.String("dir", "", "data root directory")
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	strict := fs.Bool("strict", false, "fail when any contact is skipped as invalid, listing each one")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if *dir == "" {
+	if dir.empty() {
 		return errors.New("--dir is required")
 	}
 	logger, _ := newLogger("info")
-	state, err := (&project.Builder{Dir: *dir, Logger: logger}).Build()
+	builder := dir.builder(logger)
+	builder.StrictLoad = *strict
+	state, err := builder.Build()
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stdout, "ok: %d contacts\n", len(state.Contacts))
+	if len(state.Conflicts) == 0 {
+		fmt.Fprintf(os.Stdout, "ok: %d contacts\n", len(state.Contacts))
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "ok: %d contacts, %d conflicts\n", len(state.Contacts), len(state.Conflicts))
+	for _, c := range state.Conflicts {
+		fmt.Fprintf(os.Stdout, "  ext %s: %s overrides %s\n", c.Ext, c.Winner, c.Loser)
+	}
 	return nil
 }
 
+// exitWarnings is the exit status of a build that succeeded but logged
+// warnings.
+const exitWarnings = 2
+
+// exitError carries a process exit status other than 1 back to main.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string { return e.err.Error() }
+
+func (e exitError) Unwrap() error { return e.err }
+
+// cmdBuild is validate, generate xml, and generate asterisk in one pass: it
+// builds once, writes every output to --out, and prints the warnings. With
+// --diff it also prints how the Asterisk configs differ from a live
+// directory, which is only read. It exits 0 when clean, 2 when the build
+// logged warnings (unless --allow-warnings), and 1 on any error.
+func cmdBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	out := fs.String("out", "", "output directory for phonebook.xml, pjsip.conf, extensions.conf, and provisioning/")
+	manifest := fs.String("manifest", "", "write a JSON list of generated files here (- for stdout)")
+	allowWarnings := fs.Bool("allow-warnings", false, "exit 0 even when the build logged warnings")
+	diffDir := fs.String("diff", "", "print a unified diff of pjsip.conf, extensions.conf and voicemail.conf against this live directory, e.g. /etc/asterisk")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	if *out == "" {
+		return errors.New("--out is required")
+	}
+
+	logger, _ := newLogger("info")
+	recorder := project.NewWarningRecorder(logger)
+	state, err := dir.builder(recorder).Build()
+	if err != nil {
+		return err
+	}
+	if *diffDir != "" {
+		if _, err := writeAsteriskDiff(os.Stdout, *diffDir, state); err != nil {
+			return err
+		}
+	}
+	files, err := writeBuildOutputs(*out, state)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(*manifest, files); err != nil {
+		return err
+	}
+
+	warnings := recorder.Warnings()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stdout, "warning: %s\n", w)
+	}
+	fmt.Fprintf(os.Stdout, "ok: %d contacts, %d warnings, %d files written to %s\n", len(state.Contacts), len(warnings), len(files), *out)
+	if len(warnings) > 0 && !*allowWarnings {
+		return exitError{code: exitWarnings, err: fmt.Errorf("build logged %d warnings", len(warnings))}
+	}
+	return nil
+}
+
+// cmdAudit builds the tree and reports configuration nothing uses. It exits
+// 0 when clean and 2 when there are findings, like build with warnings.
+func cmdAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	var dir dirList
+	fs.Var(&dir, "dir", "data root directory; repeat to layer overlays on top")
+	dir.registerContactsDB(fs)
+	format := fs.String("format", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if dir.empty() {
+		return errors.New("--dir is required")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+	logger, _ := newLogger("error")
+	state, err := dir.builder(logger).Build()
+	if err != nil {
+		return err
+	}
+	findings := project.Audit(state)
+	if err := writeFindings(os.Stdout, *format, findings); err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		return exitError{code: exitWarnings, err: fmt.Errorf("audit found %d problems", len(findings))}
+	}
+	return nil
+}
+
+func writeFindings(w io.Writer, format string, findings []project.Finding) error {
+	if format == "json" {
+		if findings == nil {
+			findings = []project.Finding{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"findings": findings})
+	}
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s %s: %s\n", f.Kind, f.Name, f.Detail)
+	}
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "ok: no findings")
+	}
+	return nil
+}
+
+// writeBuildOutputs writes phonebook.xml next to the writeOutputs set.
+func writeBuildOutputs(dir string, state project.State) ([]outputFile, error) {
+	files, err := writeOutputs(dir, state)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "phonebook.xml")
+	if err := atomicWrite(path, state.Phonebook, 0o644); err != nil {
+		return nil, err
+	}
+	return append([]outputFile{{Path: path, Role: "phonebook"}}, files...), nil
+}
+
+// dirList collects repeated --dir flags: the first is the base tree and each
+// later one an overlay merged on top of it. Values from the environment are
+// only a default and are dropped on the first explicit --dir. contactsDB
+// carries --contacts-db, the other half of where contacts come from, and
+// sqlite3 the --sqlite3 shell it is read with.
+type dirList struct {
+	dirs       []string
+	explicit   bool
+	contactsDB string
+	sqlite3    string
+}
+
+func defaultDirList(raw string) dirList {
+	if raw == "" {
+		return dirList{}
+	}
+	return dirList{dirs: []string{raw}}
+}
+
+func (d *dirList) String() string { return strings.Join(d.dirs, ",") }
+
+func (d *dirList) Set(v string) error {
+	if !d.explicit {
+		d.dirs = nil
+		d.explicit = true
+	}
+	d.dirs = append(d.dirs, v)
+	return nil
+}
+
+func (d *dirList) empty() bool { return len(d.dirs) == 0 || d.dirs[0] == "" }
+
+func (d *dirList) builder(logger project.Logger) *project.DirBuilder {
+	return &project.DirBuilder{Dir: d.dirs[0], Overlays: d.dirs[1:], ContactsDB: d.contactsDB, SQLite3: d.sqlite3, Logger: logger}
+}
+
+func (d *dirList) registerContactsDB(fs *flag.FlagSet) {
+	fs.StringVar(&d.contactsDB, "contacts-db", getenv("PHONEBOOK_CONTACTS_DB", ""), "SQLite database to read contacts from on top of contacts/ (overrides contacts_db.path in config.yaml)")
+	fs.StringVar(&d.sqlite3, "sqlite3", getenv("PHONEBOOK_SQLITE3", "sqlite3"), "sqlite3 shell used to read the contacts database")
+}
+
+// watchRoots are the paths serve watches: every --dir plus the contacts
+// database when it lives outside them. contacts_dirs must sit inside a
+// --dir, so the recursive watch on it already covers them.
+func (d *dirList) watchRoots(cfg config.Config) []string {
+	roots := append([]string(nil), d.dirs...)
+	db := cfg.ContactsDB.Resolve(d.dirs[0], d.contactsDB)
+	if db == "" {
+		return roots
+	}
+	for _, dir := range d.dirs {
+		if rel, err := filepath.Rel(dir, db); err == nil && !strings.HasPrefix(rel, "..") {
+			return roots
+		}
+	}
+	return append(roots, db)
+}
+
 func parseServeFlags(args []string) (serveFlags, error) {
 	var flags serveFlags
 	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
-	fs.StringVar(&flags.dir, "dir", getenv("PHONEBOOK_DIR", ""), "root directory containing config.yaml")
-	fs.StringVar(&flags.dir, "d", getenv("PHONEBOOK_DIR", ""), "root directory containing config.yaml")
+	flags.dir = defaultDirList(getenv("PHONEBOOK_DIR", ""))
+	fs.Var(&flags.dir, "dir", "root directory containing config.yaml; repeat to layer overlays on top")
+	fs.Var(&flags.dir, "d", "root directory containing config.yaml; repeat to layer overlays on top")
+	flags.dir.registerContactsDB(fs)
 	fs.StringVar(&flags.addr, "addr", getenv("PHONEBOOK_ADDR", ":8080"), "HTTP listen address")
+	fs.StringVar(&flags.ldapAddr, "ldap-addr", getenv("PHONEBOOK_LDAP_ADDR", ""), "optional listen address for a read-only LDAP directory of the contacts, such as :389 (default: disabled)")
+	fs.StringVar(&flags.ldapBaseDN, "ldap-base-dn", getenv("PHONEBOOK_LDAP_BASE_DN", ldap.DefaultBaseDN), "base DN of the LDAP directory's entries")
+	fs.StringVar(&flags.dashboardAddr, "dashboard-addr", getenv("PHONEBOOK_DASHBOARD_ADDR", ""), "optional separate listen address for the /calls dashboard and /api/calls/* (default: share --addr)")
 	fs.StringVar(&flags.basePath, "base-path", getenv("PHONEBOOK_BASE_PATH", "/"), "base HTTP path prefix")
 	fs.StringVar(&flags.outDir, "out", getenv("PHONEBOOK_OUT", ""), "optional directory to stage pjsip.conf/extensions.conf")
+	fs.StringVar(&flags.asteriskDest, "asterisk-dest", getenv("PHONEBOOK_ASTERISK_DEST", ""), "live Asterisk config directory to write pjsip.conf/extensions.conf into after each successful build")
+	fs.StringVar(&flags.liveDir, "live-dir", getenv("PHONEBOOK_LIVE_DIR", ""), "directory GET /api/config/diff compares generated pjsip.conf/extensions.conf against (default: --asterisk-dest)")
+	fs.BoolVar(&flags.asteriskApply, "asterisk-apply", getenvBool("PHONEBOOK_ASTERISK_APPLY", false), "reload Asterisk after --asterisk-dest changes")
+	fs.BoolVar(&flags.incremental, "incremental-reload", getenvBool("PHONEBOOK_INCREMENTAL_RELOAD", false), "on reload, re-parse only contact files that changed; config.yaml/defaults.yaml edits still rebuild everything")
+	fs.StringVar(&flags.onReload, "on-reload", getenv("PHONEBOOK_ON_RELOAD", ""), "shell command to run after each successful rebuild and output write")
+	fs.DurationVar(&flags.onReloadTimeout, "on-reload-timeout", getenvDuration("PHONEBOOK_ON_RELOAD_TIMEOUT", defaultReloadHookTimeout), "kill an --on-reload command still running after this long")
+	fs.BoolVar(&flags.noWatch, "no-watch", getenvBool("PHONEBOOK_NO_WATCH", false), "serve the initial build only; do not watch --dir for changes")
+	fs.StringVar(&flags.manifest, "manifest", getenv("PHONEBOOK_MANIFEST", ""), "write a JSON list of files staged under --out here (- for stdout)")
 	fs.StringVar(&flags.tlsCert, "tls-cert", getenv("PHONEBOOK_TLS_CERT", ""), "TLS certificate path")
 	fs.StringVar(&flags.tlsKey, "tls-key", getenv("PHONEBOOK_TLS_KEY", ""), "TLS private key path")
 	fs.StringVar(&flags.logLevel, "log-level", getenv("PHONEBOOK_LOG_LEVEL", "info"), "log level (debug, info, error)")
 	fs.StringVar(&flags.amiAddr, "ami-addr", getenv("PHONEBOOK_AMI_ADDR", "127.0.0.1:5038"), "Asterisk AMI address")
 	fs.StringVar(&flags.amiUser, "ami-user", getenv("PHONEBOOK_AMI_USER", ""), "Asterisk AMI username")
 	fs.StringVar(&flags.amiPass, "ami-pass", getenv("PHONEBOOK_AMI_PASS", ""), "Asterisk AMI password")
+	fs.StringVar(&flags.amiPassFile, "ami-pass-file", getenv("PHONEBOOK_AMI_PASS_FILE", ""), "read the Asterisk AMI password from this file instead of --ami-pass")
+	fs.BoolVar(&flags.amiTLS, "ami-tls", getenvBool("PHONEBOOK_AMI_TLS", false), "connect to AMI over TLS (manager.conf tls.bindaddr, usually port 5039)")
+	fs.BoolVar(&flags.amiTLSInsecure, "ami-tls-insecure", getenvBool("PHONEBOOK_AMI_TLS_INSECURE", false), "with --ami-tls, accept any AMI server certificate")
+	fs.StringVar(&flags.amiTLSServerName, "ami-tls-server-name", getenv("PHONEBOOK_AMI_TLS_SERVER_NAME", ""), "with --ami-tls, the name to verify the AMI certificate against (default: the --ami-addr host)")
+	fs.StringVar(&flags.ariURL, "ari-url", getenv("PHONEBOOK_ARI_URL", "http://127.0.0.1:8088"), "Asterisk HTTP server for ARI (https:// connects over TLS)")
+	fs.StringVar(&flags.ariUser, "ari-user", getenv("PHONEBOOK_ARI_USER", ""), "Asterisk ARI username; with --ari-pass, track calls over ARI instead of AMI")
+	fs.StringVar(&flags.ariPass, "ari-pass", getenv("PHONEBOOK_ARI_PASS", ""), "Asterisk ARI password")
+	fs.StringVar(&flags.ariPassFile, "ari-pass-file", getenv("PHONEBOOK_ARI_PASS_FILE", ""), "read the Asterisk ARI password from this file instead of --ari-pass")
+	fs.StringVar(&flags.ariApp, "ari-app", getenv("PHONEBOOK_ARI_APP", calls.DefaultARIApp), "Stasis application name to register with ARI")
+	fs.BoolVar(&flags.ariTLSInsecure, "ari-tls-insecure", getenvBool("PHONEBOOK_ARI_TLS_INSECURE", false), "with an https --ari-url, accept any ARI server certificate")
 	fs.StringVar(&flags.cdrCSV, "cdr-csv", getenv("PHONEBOOK_CDR_CSV", "/var/log/asterisk/cdr-csv/Master.csv"), "CDR CSV path for startup history bootstrap")
+	fs.StringVar(&flags.cdrCSV, "cdr-path", flags.cdrCSV, "alias for --cdr-csv")
+	cdrColumns := fs.String("cdr-columns", getenv("PHONEBOOK_CDR_COLUMNS", ""), "comma-separated field=column map for a custom cdr.conf layout, by index or header name (e.g. src=0,dst=1,start=4,end=5)")
+	fs.DurationVar(&flags.cdrReload, "cdr-reload-interval", getenvDuration("PHONEBOOK_CDR_RELOAD_INTERVAL", 0), "reload the CDR CSV this often when it has changed (0 loads it only at startup)")
+	fs.IntVar(&flags.historyMax, "history-max", getenvInt("PHONEBOOK_HISTORY_MAX", calls.DefaultMaxHistory), "completed calls kept for the calls dashboard history")
+	fs.DurationVar(&flags.historyKeep, "history-retention", getenvDuration("PHONEBOOK_HISTORY_RETENTION", calls.DefaultRetention), "drop completed calls from the calls dashboard history after this long")
+	fs.StringVar(&flags.ignoredTargets, "calls-ignored-targets", getenv("PHONEBOOK_CALLS_IGNORED_TARGETS", strings.Join(calls.DefaultIgnoredTargets, ",")), "comma-separated dialed extensions never shown as a call's destination")
+	fs.IntVar(&flags.maskDigits, "mask-external-digits", getenvInt("PHONEBOOK_MASK_EXTERNAL_DIGITS", 0), "on the calls dashboard, show only this many trailing digits of numbers that match no contact (0 shows them in full)")
+	fs.StringVar(&flags.unknownLabel, "unknown-caller-label", getenv("PHONEBOOK_UNKNOWN_CALLER_LABEL", ""), "name shown on the calls dashboard for parties that match no contact")
+	fs.DurationVar(&flags.presenceTTL, "presence-ttl", getenvDuration("PHONEBOOK_PRESENCE_TTL", calls.DefaultPresenceTTL), "mark endpoint presence unknown after this long without AMI updates (negative keeps it forever)")
+	fs.DurationVar(&flags.shortCall, "short-call-threshold", getenvDuration("PHONEBOOK_SHORT_CALL_THRESHOLD", 0), "report answered calls with less talk time than this as short (0 disables)")
 	fs.BoolVar(&flags.broadcastEnabled, "broadcast", getenvBool("PHONEBOOK_BROADCAST_ENABLED", false), "enable the broadcast web page and API")
 	fs.StringVar(&flags.broadcastFrom, "broadcast-from", getenv("PHONEBOOK_BROADCAST_FROM", "Operator <sip:operator@localhost>"), "From header for broadcast SIP MESSAGEs")
 	fs.IntVar(&flags.broadcastMaxChars, "broadcast-max-chars", getenvInt("PHONEBOOK_BROADCAST_MAX_CHARS", 900), "maximum broadcast message characters")
+	fs.IntVar(&flags.maxBodyBytes, "max-body-bytes", getenvInt("PHONEBOOK_MAX_BODY_BYTES", 4096), "maximum request body accepted by GET/HEAD endpoints")
+	fs.StringVar(&flags.adminToken, "admin-token", getenv("PHONEBOOK_ADMIN_TOKEN", ""), "bearer token enabling POST /api/render (empty disables)")
+	fs.StringVar(&flags.basicUser, "basic-auth-user", getenv("PHONEBOOK_BASIC_AUTH_USER", ""), "HTTP Basic username accepted on the phonebook routes, for phones that cannot send a bearer token")
+	fs.StringVar(&flags.basicPass, "basic-auth-pass", getenv("PHONEBOOK_BASIC_AUTH_PASS", ""), "HTTP Basic password for --basic-auth-user")
+	fs.StringVar(&flags.authToken, "auth-token", getenv("PHONEBOOK_AUTH_TOKEN", ""), "bearer token required to read the phonebooks, contacts, debug page and dashboards (empty leaves them open)")
+	fs.DurationVar(&flags.wsPingInterval, "ws-ping-interval", getenvDuration("PHONEBOOK_WS_PING_INTERVAL", 25*time.Second), "calls WebSocket ping interval and per-frame write timeout")
+	fs.BoolVar(&flags.metrics, "metrics", getenvBool("PHONEBOOK_METRICS", false), "serve Prometheus metrics on /metrics")
+	fs.BoolVar(&flags.allowReload, "allow-reload", getenvBool("PHONEBOOK_ALLOW_RELOAD", false), "accept POST /api/reload to rebuild without waiting for a file change (needs --admin-token's bearer token when that is set)")
+	fs.DurationVar(&flags.startupGrace, "startup-grace", getenvDuration("PHONEBOOK_STARTUP_GRACE", 2*time.Second), "how long phonebook and provisioning requests wait for the first build before a 503 with Retry-After")
+	fs.DurationVar(&flags.wsIdleTimeout, "ws-idle-timeout", getenvDuration("PHONEBOOK_WS_IDLE_TIMEOUT", time.Minute), "close calls WebSockets after this long without client traffic")
+	fs.StringVar(&flags.wsSubprotocols, "ws-subprotocols", getenv("PHONEBOOK_WS_SUBPROTOCOLS", ""), "comma-separated WebSocket subprotocols the calls feed may negotiate")
 	if err := fs.Parse(args); err != nil {
 		return flags, err
 	}
-	if flags.dir == "" {
+	if flags.dir.empty() {
 		return flags, errors.New("--dir is required")
 	}
 	if (flags.tlsCert == "") != (flags.tlsKey == "") {
 		return flags, errors.New("both --tls-cert and --tls-key must be provided together")
 	}
+	if flags.asteriskApply && flags.asteriskDest == "" {
+		return flags, errors.New("--asterisk-apply requires --asterisk-dest")
+	}
+	if (flags.basicUser == "") != (flags.basicPass == "") {
+		return flags, errors.New("both --basic-auth-user and --basic-auth-pass must be provided together")
+	}
+	if flags.wsPingInterval > 0 && flags.wsIdleTimeout > 0 && flags.wsIdleTimeout <= flags.wsPingInterval {
+		// Pongs only arrive after a ping, so a shorter idle timeout closes
+		// healthy sockets between pings.
+		return flags, fmt.Errorf("--ws-idle-timeout %s must be longer than --ws-ping-interval %s", flags.wsIdleTimeout, flags.wsPingInterval)
+	}
+	if flags.historyMax < 1 {
+		return flags, fmt.Errorf("--history-max %d must be positive", flags.historyMax)
+	}
+	if flags.historyKeep <= 0 {
+		return flags, fmt.Errorf("--history-retention %s must be positive", flags.historyKeep)
+	}
+	if *cdrColumns != "" {
+		cols, err := calls.ParseCDRColumns(*cdrColumns)
+		if err != nil {
+			return flags, fmt.Errorf("--cdr-columns: %w", err)
+		}
+		flags.cdrColumns = cols
+	}
+	if flags.amiPassFile != "" {
+		if flags.amiPass != "" {
+			return flags, errors.New("--ami-pass and --ami-pass-file are mutually exclusive")
+		}
+		raw, err := os.ReadFile(flags.amiPassFile)
+		if err != nil {
+			return flags, fmt.Errorf("read --ami-pass-file: %w", err)
+		}
+		flags.amiPass = strings.TrimRight(string(raw), "\r\n")
+		if flags.amiPass == "" {
+			return flags, fmt.Errorf("--ami-pass-file %s is empty", flags.amiPassFile)
+		}
+	}
+	if flags.ariPassFile != "" {
+		if flags.ariPass != "" {
+			return flags, errors.New("--ari-pass and --ari-pass-file are mutually exclusive")
+		}
+		raw, err := os.ReadFile(flags.ariPassFile)
+		if err != nil {
+			return flags, fmt.Errorf("read --ari-pass-file: %w", err)
+		}
+		flags.ariPass = strings.TrimRight(string(raw), "\r\n")
+		if flags.ariPass == "" {
+			return flags, fmt.Errorf("--ari-pass-file %s is empty", flags.ariPassFile)
+		}
+	}
+	if (flags.ariUser == "") != (flags.ariPass == "") {
+		return flags, errors.New("--ari-user and --ari-pass must be set together")
+	}
+	if flags.ariUser != "" {
+		u, err := url.Parse(flags.ariURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return flags, fmt.Errorf("--ari-url %q must be http:// or https://host[:port]", flags.ariURL)
+		}
+	}
+	if flags.liveDir == "" {
+		flags.liveDir = flags.asteriskDest
+	}
 	return flags, nil
 }
 
@@ -330,22 +1245,39 @@ func normalizeBasePath(p string) string {
 	return p
 }
 
-func writeOutputs(dir string, state project.State) error {
+// outputFile is one generated file as reported by --manifest.
+type outputFile struct {
+	Path string `json:"path"`
+	Role string `json:"role"`
+}
+
+// writeOutputs stages the Asterisk configs and provisioning files under dir
+// and returns what it wrote, in write order.
+func writeOutputs(dir string, state project.State) ([]outputFile, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return err
+		return nil, err
 	}
-	pjsipPath := filepath.Join(dir, "pjsip.conf")
-	extensionsPath := filepath.Join(dir, "extensions.conf")
-	if err := atomicWrite(pjsipPath, state.PJSIP, 0o644); err != nil {
-		return err
+	files := []outputFile{
+		{Path: filepath.Join(dir, "pjsip.conf"), Role: "pjsip"},
+		{Path: filepath.Join(dir, "extensions.conf"), Role: "extensions"},
 	}
-	if err := atomicWrite(extensionsPath, state.Extensions, 0o644); err != nil {
-		return err
+	if err := atomicWrite(files[0].Path, state.PJSIP, 0o644); err != nil {
+		return nil, err
+	}
+	if err := atomicWrite(files[1].Path, state.Extensions, 0o644); err != nil {
+		return nil, err
+	}
+	if len(state.Voicemail) > 0 {
+		path := filepath.Join(dir, "voicemail.conf")
+		if err := atomicWrite(path, state.Voicemail, 0o644); err != nil {
+			return nil, err
+		}
+		files = append(files, outputFile{Path: path, Role: "voicemail"})
 	}
 	if len(state.Provision) > 0 {
 		provDir := filepath.Join(dir, "provisioning")
 		if err := os.MkdirAll(provDir, 0o755); err != nil {
-			return err
+			return nil, err
 		}
 		keys := make([]string, 0, len(state.Provision))
 		for name := range state.Provision {
@@ -353,12 +1285,211 @@ func writeOutputs(dir string, state project.State) error {
 		}
 		sort.Strings(keys)
 		for _, name := range keys {
-			if err := atomicWrite(filepath.Join(provDir, name), state.Provision[name], 0o644); err != nil {
-				return err
+			path := filepath.Join(provDir, name)
+			if err := atomicWrite(path, state.Provision[name], 0o644); err != nil {
+				return nil, err
 			}
+			files = append(files, outputFile{Path: path, Role: "provisioning"})
 		}
 	}
-	return nil
+	return files, nil
+}
+
+// writeAsteriskDiff prints a unified diff of each Asterisk file writeOutputs
+// would stage in dest against the copy already there, or "no changes", and
+// reports whether any file differs. A missing file diffs as empty.
+func writeAsteriskDiff(w io.Writer, dest string, state project.State) (bool, error) {
+	files := []struct {
+		name string
+		body []byte
+	}{
+		{"pjsip.conf", state.PJSIP},
+		{"extensions.conf", state.Extensions},
+		{"voicemail.conf", state.Voicemail},
+	}
+	changed := false
+	for _, f := range files {
+		// writeOutputs leaves voicemail.conf alone when nothing renders it.
+		if f.name == "voicemail.conf" && len(f.body) == 0 {
+			continue
+		}
+		path := filepath.Join(dest, f.name)
+		current, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if bytes.Equal(current, f.body) {
+			continue
+		}
+		changed = true
+		script := diff.Lines(diff.Split(string(current)), diff.Split(string(f.body)))
+		text := diff.Unified(path, f.name+" (generated)", script, 3)
+		if text == "" {
+			// Only line endings or the final newline differ.
+			text = fmt.Sprintf("--- %s\n+++ %s (generated)\n@@ line endings differ @@\n", path, f.name)
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			return false, err
+		}
+	}
+	if !changed {
+		_, err := fmt.Fprintln(w, "no changes")
+		return false, err
+	}
+	return true, nil
+}
+
+// splitContactDir is where --split-per-contact writes one file per contact,
+// relative to --dest.
+const splitContactDir = "pjsip.d"
+
+// writeSplitOutputs is writeOutputs with each SIP contact's PJSIP sections
+// moved into splitContactDir/<ext>.conf and pjsip.conf including them all.
+// Files there for contacts that no longer exist are removed.
+func writeSplitOutputs(dir string, state project.State) ([]outputFile, error) {
+	shared, perContact, err := asterisk.RenderPJSIPSplit(state.Config, state.Contacts)
+	if err != nil {
+		return nil, err
+	}
+	out := state.Config.Output
+	split := state
+	split.PJSIP = out.Apply(append(shared, "; One file per contact, written by --split-per-contact.\n#include \""+splitContactDir+"/*.conf\"\n"...))
+	files, err := writeOutputs(dir, split)
+	if err != nil {
+		return nil, err
+	}
+
+	contactDir := filepath.Join(dir, splitContactDir)
+	if err := os.MkdirAll(contactDir, 0o755); err != nil {
+		return nil, err
+	}
+	exts := make([]string, 0, len(perContact))
+	for ext := range perContact {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	keep := map[string]bool{}
+	for _, ext := range exts {
+		name := ext + ".conf"
+		path := filepath.Join(contactDir, name)
+		if err := atomicWrite(path, out.Apply(perContact[ext]), 0o644); err != nil {
+			return nil, err
+		}
+		keep[name] = true
+		files = append(files, outputFile{Path: path, Role: "pjsip-contact"})
+	}
+	entries, err := os.ReadDir(contactDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range entries {
+		if !ent.IsDir() && strings.HasSuffix(ent.Name(), ".conf") && !keep[ent.Name()] {
+			if err := os.Remove(filepath.Join(contactDir, ent.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// swapOutputs renders every output into a fresh sibling of dest and then
+// replaces dest with it, so readers of dest never see a mix of old and new
+// files. When dest is a symlink the swap is a single atomic rename of the
+// link. A real directory cannot be replaced atomically on every platform, so
+// it is renamed aside first and restored if the second rename fails; readers
+// may briefly find dest missing, but never partial.
+func swapOutputs(dest string, state project.State) ([]outputFile, error) {
+	return swapInto(dest, state, writeOutputs)
+}
+
+// swapInto is swapOutputs with write producing the staged directory.
+func swapInto(dest string, state project.State, write func(string, project.State) ([]outputFile, error)) ([]outputFile, error) {
+	dest = filepath.Clean(dest)
+	parent, base := filepath.Dir(dest), filepath.Base(dest)
+	stamp := time.Now().UnixNano()
+
+	info, err := os.Lstat(dest)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	symlinked := err == nil && info.Mode()&os.ModeSymlink != 0
+
+	staging := fmt.Sprintf("%s.new-%d", dest, stamp)
+	if symlinked {
+		staging = filepath.Join(parent, fmt.Sprintf(".%s-%d", base, stamp))
+	}
+	files, err := write(staging, state)
+	if err != nil {
+		_ = os.RemoveAll(staging)
+		return nil, err
+	}
+	for i := range files {
+		rel, err := filepath.Rel(staging, files[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		files[i].Path = filepath.Join(dest, rel)
+	}
+
+	switch {
+	case symlinked:
+		previous, _ := os.Readlink(dest)
+		link := fmt.Sprintf("%s.link-%d", dest, stamp)
+		if err := os.Symlink(filepath.Base(staging), link); err != nil {
+			_ = os.RemoveAll(staging)
+			return nil, err
+		}
+		if err := os.Rename(link, dest); err != nil {
+			_ = os.Remove(link)
+			_ = os.RemoveAll(staging)
+			return nil, err
+		}
+		// Only clean up directories this function created.
+		if prevBase := filepath.Base(previous); strings.HasPrefix(prevBase, "."+base+"-") {
+			if !filepath.IsAbs(previous) {
+				previous = filepath.Join(parent, previous)
+			}
+			_ = os.RemoveAll(previous)
+		}
+	case info != nil:
+		old := fmt.Sprintf("%s.old-%d", dest, stamp)
+		if err := os.Rename(dest, old); err != nil {
+			_ = os.RemoveAll(staging)
+			return nil, err
+		}
+		if err := os.Rename(staging, dest); err != nil {
+			if restoreErr := os.Rename(old, dest); restoreErr != nil {
+				return nil, fmt.Errorf("swap %s: %w (previous outputs left at %s: %v)", dest, err, old, restoreErr)
+			}
+			_ = os.RemoveAll(staging)
+			return nil, err
+		}
+		_ = os.RemoveAll(old)
+	default:
+		if err := os.Rename(staging, dest); err != nil {
+			_ = os.RemoveAll(staging)
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeManifest records files as JSON at dest, or on stdout when dest is "-".
+// An empty dest disables the manifest.
+func writeManifest(dest string, files []outputFile) error {
+	if dest == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if dest == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return atomicWrite(dest, data, 0o644)
 }
 
 func atomicWrite(path string, data []byte, perm os.FileMode) error {
@@ -395,8 +1526,119 @@ func resolveOutputPath(out, fileName string) (string, error) {
 	return out, nil
 }
 
-func reloadAsterisk() error {
+// ldapCredentials mirrors the HTTP auth onto the LDAP directory, so
+// --auth-token and --basic-auth-user do not leave every contact readable by
+// anonymous binds. The tokens bind under any name; the Basic credentials
+// bind as --basic-auth-user.
+func ldapCredentials(flags serveFlags) []ldap.Credential {
+	var creds []ldap.Credential
+	if flags.authToken != "" {
+		creds = append(creds, ldap.Credential{Password: flags.authToken})
+		if flags.adminToken != "" {
+			creds = append(creds, ldap.Credential{Password: flags.adminToken})
+		}
+	}
+	if flags.basicUser != "" {
+		creds = append(creds, ldap.Credential{Name: flags.basicUser, Password: flags.basicPass})
+	}
+	return creds
+}
+
+// asteriskApplier keeps a live Asterisk config directory in step with serve:
+// after each successful build it writes pjsip.conf, extensions.conf and,
+// when any contact has a mailbox, voicemail.conf into dest and, when reload
+// is set, reloads Asterisk. A build whose configs match what is already in
+// dest touches nothing, so unrelated edits (a phonebook label, a
+// provisioning template) never reload the PBX.
+type asteriskApplier struct {
+	dest string
+	// reload reloads Asterisk, including app_voicemail when voicemail is
+	// set.
+	reload func(voicemail bool) error
+	// pending is set when a reload failed after its files were written,
+	// so the next build retries it even though dest already matches;
+	// pendingVoicemail records whether that reload covered voicemail.conf.
+	pending          bool
+	pendingVoicemail bool
+}
+
+// newAsteriskApplier returns nil when --asterisk-dest is unset; a nil
+// applier's apply is a no-op.
+func newAsteriskApplier(flags serveFlags) *asteriskApplier {
+	if flags.asteriskDest == "" {
+		return nil
+	}
+	a := &asteriskApplier{dest: flags.asteriskDest}
+	if flags.asteriskApply {
+		a.reload = reloadAsterisk
+	}
+	return a
+}
+
+// apply writes state's Asterisk configs into dest if any differs from the
+// file on disk and reports whether it did.
+func (a *asteriskApplier) apply(state project.State) (bool, error) {
+	if a == nil {
+		return false, nil
+	}
+	files := []struct {
+		name string
+		body []byte
+	}{
+		{"pjsip.conf", state.PJSIP},
+		{"extensions.conf", state.Extensions},
+		{"voicemail.conf", state.Voicemail},
+	}
+	if len(state.Voicemail) == 0 {
+		files = files[:2]
+	}
+	voicemail := voicemailChanged(a.dest, state)
+	changed := false
+	for _, f := range files {
+		current, err := os.ReadFile(filepath.Join(a.dest, f.name))
+		if err != nil || !bytes.Equal(current, f.body) {
+			changed = true
+		}
+	}
+	if !changed && !a.pending {
+		return false, nil
+	}
+	if err := os.MkdirAll(a.dest, 0o755); err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		if err := atomicWrite(filepath.Join(a.dest, f.name), f.body, 0o644); err != nil {
+			return false, err
+		}
+	}
+	if a.reload != nil {
+		voicemail = voicemail || a.pendingVoicemail
+		if err := a.reload(voicemail); err != nil {
+			a.pending, a.pendingVoicemail = true, voicemail
+			return true, err
+		}
+	}
+	a.pending, a.pendingVoicemail = false, false
+	return true, nil
+}
+
+// voicemailChanged reports whether state carries a voicemail.conf that
+// differs from the one in dest.
+func voicemailChanged(dest string, state project.State) bool {
+	if len(state.Voicemail) == 0 {
+		return false
+	}
+	current, err := os.ReadFile(filepath.Join(dest, "voicemail.conf"))
+	return err != nil || !bytes.Equal(current, state.Voicemail)
+}
+
+// reloadAsterisk reloads PJSIP and the dialplan, and app_voicemail when
+// voicemail is set.
+func reloadAsterisk(voicemail bool) error {
 	commands := []string{"pjsip reload", "dialplan reload"}
+	if voicemail {
+		commands = append(commands, "voicemail reload")
+	}
 	for _, cmd := range commands {
 		c := exec.Command("asterisk", "-rx", cmd)
 		output, err := c.CombinedOutput()
@@ -407,6 +1649,93 @@ func reloadAsterisk() error {
 	return nil
 }
 
+// asteriskCheckTimeout bounds a --check-asterisk-syntax run, which boots a
+// scratch Asterisk and stops it straight away.
+const asteriskCheckTimeout = 30 * time.Second
+
+// checkAsteriskSyntax writes the rendered pjsip.conf, extensions.conf and
+// voicemail.conf into a temp dir next to a minimal asterisk.conf and
+// modules.conf, boots `asterisk -C <dir>/asterisk.conf -cng` against it, and
+// stops it again. Only the dialplan, PJSIP and, with mailboxes, voicemail
+// modules are loaded. Transports bind to a free loopback port, so the check
+// also runs next to a live PBX holding the configured ports. Any ERROR line
+// Asterisk logs while parsing fails the check, and the output is included in
+// the error.
+func checkAsteriskSyntax(binary string, state project.State) error {
+	dir, err := os.MkdirTemp("", "phonebook-astcheck-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, sub := range []string{"run", "log", "spool", "lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+	files := map[string][]byte{
+		"pjsip.conf":      scratchTransports(state.PJSIP),
+		"extensions.conf": state.Extensions,
+		"asterisk.conf": []byte(fmt.Sprintf(`[directories]
+astetcdir => %[1]s
+astrundir => %[1]s/run
+astlogdir => %[1]s/log
+astspooldir => %[1]s/spool
+astvarlibdir => %[1]s/lib
+astdbdir => %[1]s/lib
+`, dir)),
+		"modules.conf": []byte(`[modules]
+autoload = no
+load => res_sorcery_config.so
+load => res_sorcery_memory.so
+load => res_pjproject.so
+load => res_pjsip.so
+load => pbx_config.so
+`),
+	}
+	if len(state.Voicemail) > 0 {
+		files["voicemail.conf"] = state.Voicemail
+		files["modules.conf"] = append(files["modules.conf"], "load => app_voicemail.so\n"...)
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), body, 0o644); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), asteriskCheckTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, binary, "-C", filepath.Join(dir, "asterisk.conf"), "-cng")
+	c.Stdin = strings.NewReader("core stop now\n")
+	output, err := c.CombinedOutput()
+	var problems []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.Contains(line, "ERROR[") {
+			problems = append(problems, strings.TrimSpace(line))
+		}
+	}
+	switch {
+	case len(problems) > 0:
+		return fmt.Errorf("asterisk rejected the generated config:\n%s", strings.Join(problems, "\n"))
+	case err != nil:
+		return fmt.Errorf("asterisk syntax check failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// scratchTransports rewrites every bind= in pjsip.conf to 127.0.0.1:0 for
+// checkAsteriskSyntax. Only transports take a bind option.
+func scratchTransports(pjsip []byte) []byte {
+	lines := strings.Split(string(pjsip), "\n")
+	for i, line := range lines {
+		key, _, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(key) == "bind" {
+			lines[i] = "bind=127.0.0.1:0"
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
 func getenv(key, fallback string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -440,3 +1769,26 @@ func getenvInt(key string, fallback int) int {
 	}
 	return out
 }
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	out, err := time.ParseDuration(strings.TrimSpace(val))
+	if err != nil || out <= 0 {
+		return fallback
+	}
+	return out
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
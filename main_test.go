@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/phonebook/internal/httpapi"
+	"github.com/n3wscott/phonebook/internal/model"
+	"github.com/n3wscott/phonebook/internal/project"
+)
+
+type fakeBuilder struct {
+	state project.State
+	err   error
+}
+
+func (f *fakeBuilder) Build() (project.State, error) {
+	return f.state, f.err
+}
+
+func TestWriteOutputsManifest(t *testing.T) {
+	dir := t.TempDir()
+	state := project.State{
+		PJSIP:      []byte("[global]\n"),
+		Extensions: []byte("[internal]\n"),
+		Provision:  map[string][]byte{"cfg000b82000001.xml": []byte("<gs_provision/>")},
+	}
+	files, err := writeOutputs(dir, state)
+	if err != nil {
+		t.Fatalf("writeOutputs() error = %v", err)
+	}
+	want := []outputFile{
+		{Path: filepath.Join(dir, "pjsip.conf"), Role: "pjsip"},
+		{Path: filepath.Join(dir, "extensions.conf"), Role: "extensions"},
+		{Path: filepath.Join(dir, "provisioning", "cfg000b82000001.xml"), Role: "provisioning"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got %+v", len(want), files)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Fatalf("file %d = %+v, want %+v", i, files[i], want[i])
+		}
+		if _, err := os.Stat(files[i].Path); err != nil {
+			t.Fatalf("manifest lists missing file: %v", err)
+		}
+	}
+
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := writeManifest(manifest, files); err != nil {
+		t.Fatalf("writeManifest() error = %v", err)
+	}
+	raw, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var decoded []outputFile
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("manifest is not JSON: %v\n%s", err, raw)
+	}
+	if len(decoded) != len(files) || decoded[2].Role != "provisioning" {
+		t.Fatalf("unexpected manifest contents: %s", raw)
+	}
+}
+
+func TestWriteOutputsStagesVoicemailWhenRendered(t *testing.T) {
+	dir := t.TempDir()
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+	files, err := writeOutputs(dir, state)
+	if err != nil {
+		t.Fatalf("writeOutputs() error = %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected no voicemail.conf without mailboxes, got %+v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "voicemail.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected voicemail.conf absent, got %v", err)
+	}
+
+	state.Voicemail = []byte("[default]\n101 => 1234,Alpha User\n")
+	files, err = writeOutputs(dir, state)
+	if err != nil {
+		t.Fatalf("writeOutputs() error = %v", err)
+	}
+	want := outputFile{Path: filepath.Join(dir, "voicemail.conf"), Role: "voicemail"}
+	if len(files) != 3 || files[2] != want {
+		t.Fatalf("expected %+v staged after extensions.conf, got %+v", want, files)
+	}
+	if got, _ := os.ReadFile(want.Path); string(got) != string(state.Voicemail) {
+		t.Fatalf("voicemail.conf = %q, want %q", got, state.Voicemail)
+	}
+}
+
+func TestParseServeFlagsNoWatch(t *testing.T) {
+	flags, err := parseServeFlags([]string{"--dir", "examples", "--no-watch"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if !flags.noWatch || flags.outDir != "" {
+		t.Fatalf("expected preview flags with no --out, got %+v", flags)
+	}
+}
+
+func TestParseServeFlagsRepeatedDirReplacesEnvDefault(t *testing.T) {
+	t.Setenv("PHONEBOOK_DIR", "from-env")
+	flags, err := parseServeFlags([]string{"--dir", "base", "-d", "site"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	b := flags.dir.builder(nil)
+	if b.Dir != "base" || len(b.Overlays) != 1 || b.Overlays[0] != "site" {
+		t.Fatalf("expected base plus one overlay, got %+v", b)
+	}
+}
+
+func TestReloadServeKeepsSnapshotOnFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/"}, logger)
+	out := t.TempDir()
+	flags := serveFlags{outDir: out}
+	builder := &fakeBuilder{state: project.State{
+		Contacts:   []model.Contact{{FirstName: "Alpha", Extension: "1000"}},
+		Phonebook:  []byte("<AddressBook><Contact><FirstName>Alpha</FirstName></Contact></AddressBook>"),
+		PJSIP:      []byte("[global]\n"),
+		Extensions: []byte("[internal]\n"),
+		LastUpdate: time.Unix(100, 0),
+	}}
+
+	reloadServe(context.Background(), builder, srv, nil, flags, logger, nil)
+	if body := fetchPhonebook(t, srv); !strings.Contains(body, "Alpha") {
+		t.Fatalf("expected reloaded phonebook, got %q", body)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pjsip.conf")); err != nil {
+		t.Fatalf("expected staged pjsip.conf: %v", err)
+	}
+
+	builder.err = errors.New("broken yaml")
+	builder.state = project.State{Phonebook: []byte("<AddressBook/>")}
+	reloadServe(context.Background(), builder, srv, nil, flags, logger, nil)
+	if body := fetchPhonebook(t, srv); !strings.Contains(body, "Alpha") {
+		t.Fatalf("expected failed rebuild to keep previous snapshot, got %q", body)
+	}
+}
+
+func TestReloadServeDiscardsBuildAfterShutdown(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/"}, logger)
+	srv.Update(nil, []byte("<AddressBook/>"), time.Unix(100, 0))
+	out := t.TempDir()
+	builder := &fakeBuilder{state: project.State{
+		Phonebook:  []byte("<AddressBook><Contact><FirstName>Late</FirstName></Contact></AddressBook>"),
+		PJSIP:      []byte("[global]\n"),
+		Extensions: []byte("[internal]\n"),
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reloadServe(ctx, builder, srv, nil, serveFlags{outDir: out}, logger, nil)
+	if body := fetchPhonebook(t, srv); strings.Contains(body, "Late") {
+		t.Fatalf("expected a rebuild after shutdown to be dropped, got %q", body)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pjsip.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing staged after shutdown, got %v", err)
+	}
+}
+
+func TestReloadServeRunsHookAfterWrites(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httpapi.NewServer(httpapi.Config{Addr: ":0", BasePath: "/"}, logger)
+	out := t.TempDir()
+	record := filepath.Join(t.TempDir(), "hook.env")
+	flags := serveFlags{
+		outDir:   out,
+		onReload: `printf '%s|%s|%s' "$PHONEBOOK_CONTACTS" "$PHONEBOOK_CHANGED" "$PHONEBOOK_OUT" > "` + record + `"`,
+	}
+	builder := &fakeBuilder{state: project.State{
+		Contacts:   []model.Contact{{FirstName: "Alpha", Extension: "1000"}, {FirstName: "Beta", Extension: "1001"}},
+		Phonebook:  []byte("<AddressBook/>"),
+		PJSIP:      []byte("[global]\n"),
+		Extensions: []byte("[internal]\n"),
+	}}
+
+	reloadServe(context.Background(), builder, srv, nil, flags, logger, []string{"contacts/a.yaml", "contacts/b.yaml"})
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("expected the hook to run: %v", err)
+	}
+	if want := "2|contacts/a.yaml\ncontacts/b.yaml|" + out; string(got) != want {
+		t.Fatalf("hook environment = %q, want %q", got, want)
+	}
+
+	// A failed rebuild publishes nothing, so the hook stays quiet.
+	_ = os.Remove(record)
+	builder.err = errors.New("broken yaml")
+	reloadServe(context.Background(), builder, srv, nil, flags, logger, nil)
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Fatalf("expected no hook run after a failed rebuild, got %v", err)
+	}
+}
+
+func TestReloadHookTimesOut(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	flags := serveFlags{onReload: "sleep 30", onReloadTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	runReloadHook(context.Background(), flags, project.State{}, nil, logger)
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("expected a hung hook to be killed, took %s", took)
+	}
+}
+
+func fetchPhonebook(t *testing.T, srv *httpapi.Server) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/phonebook.xml", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("phonebook status = %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func TestSwapOutputsReplacesWholeDirectory(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "asterisk")
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "stale.conf"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write stale: %v", err)
+	}
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+
+	files, err := swapOutputs(dest, state)
+	if err != nil {
+		t.Fatalf("swapOutputs() error = %v", err)
+	}
+	if files[0].Path != filepath.Join(dest, "pjsip.conf") {
+		t.Fatalf("expected manifest paths under dest, got %+v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "stale.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected stale file to be swapped away, got %v", err)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Fatalf("expected staging and old directories to be cleaned up, got %v", entries)
+	}
+}
+
+func TestSwapOutputsFlipsSymlinkAtomically(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "asterisk")
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+	if err := os.MkdirAll(filepath.Join(root, ".asterisk-1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(".asterisk-1", dest); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	if _, err := swapOutputs(dest, state); err != nil {
+		t.Fatalf("swapOutputs() error = %v", err)
+	}
+	target, err := os.Readlink(dest)
+	if err != nil || target == ".asterisk-1" {
+		t.Fatalf("expected dest to point at a new directory, got %q (%v)", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "extensions.conf")); err != nil {
+		t.Fatalf("expected outputs through symlink: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".asterisk-1")); !os.IsNotExist(err) {
+		t.Fatalf("expected previous generated directory to be removed, got %v", err)
+	}
+}
+
+func TestCheckAsteriskSyntaxReportsErrors(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "asterisk")
+	script := `#!/bin/sh
+conf="$2"
+dir=$(dirname "$conf")
+if grep -q broken "$dir/extensions.conf"; then
+  echo '[Jan  1 00:00:00] ERROR[1]: pbx_config.c:1234 pbx_load_config: bad line 3'
+fi
+if grep -q app_voicemail "$dir/modules.conf" && grep -q broken "$dir/voicemail.conf"; then
+  echo '[Jan  1 00:00:00] ERROR[1]: app_voicemail.c:99 load_config: bad mailbox'
+fi
+cat >/dev/null
+`
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake asterisk: %v", err)
+	}
+
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+	if err := checkAsteriskSyntax(bin, state); err != nil {
+		t.Fatalf("expected clean config to pass, got %v", err)
+	}
+
+	state.Extensions = []byte("[internal]\nbroken\n")
+	err := checkAsteriskSyntax(bin, state)
+	if err == nil || !strings.Contains(err.Error(), "pbx_load_config: bad line 3") {
+		t.Fatalf("expected Asterisk's error line in the failure, got %v", err)
+	}
+
+	state.Extensions = []byte("[internal]\n")
+	state.Voicemail = []byte("[default]\nbroken\n")
+	err = checkAsteriskSyntax(bin, state)
+	if err == nil || !strings.Contains(err.Error(), "app_voicemail.c") {
+		t.Fatalf("expected voicemail.conf to be checked, got %v", err)
+	}
+}
+
+func TestCheckAsteriskSyntaxAvoidsBoundPorts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	taken := ln.Addr().String()
+
+	// The fake reports a bind failure the way res_pjsip does when a
+	// transport asks for the port the live PBX already holds.
+	bin := filepath.Join(t.TempDir(), "asterisk")
+	script := `#!/bin/sh
+dir=$(dirname "$2")
+if grep -q '` + taken + `' "$dir/pjsip.conf"; then
+  echo '[Jan  1 00:00:00] ERROR[1]: res_pjsip/config_transport.c:1 transport_apply: Transport could not be bound'
+fi
+cat >/dev/null
+`
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake asterisk: %v", err)
+	}
+	state := project.State{
+		PJSIP:      []byte("[transport-tcp]\ntype=transport\nprotocol=tcp\nbind = " + taken + "\n"),
+		Extensions: []byte("[internal]\n"),
+	}
+	if err := checkAsteriskSyntax(bin, state); err != nil {
+		t.Fatalf("expected the check to avoid the taken port %s, got %v", taken, err)
+	}
+	if got := string(scratchTransports(state.PJSIP)); !strings.Contains(got, "bind=127.0.0.1:0\n") || !strings.Contains(got, "protocol=tcp\n") {
+		t.Fatalf("expected only the bind to be rewritten, got %q", got)
+	}
+}
+
+func TestCmdBuildWritesOutputsAndFlagsWarnings(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	if err := cmdBuild([]string{"--dir", "examples", "--out", out}); err != nil {
+		t.Fatalf("build examples: %v", err)
+	}
+	for _, name := range []string{"phonebook.xml", "pjsip.conf", "extensions.conf"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Fatalf("expected %s in --out: %v", name, err)
+		}
+	}
+
+	overlay := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(overlay, "contacts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dup := `contacts:
+  - id: "a"
+    first_name: "A"
+    ext: "900"
+    password: "secret900"
+  - id: "b"
+    first_name: "B"
+    ext: "900"
+    password: "secret900"
+`
+	if err := os.WriteFile(filepath.Join(overlay, "contacts", "dup.yaml"), []byte(dup), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--dir", "examples", "--dir", overlay, "--out", out}
+	err := cmdBuild(args)
+	var exit exitError
+	if !errors.As(err, &exit) || exit.code != exitWarnings {
+		t.Fatalf("expected exit status %d for a build with warnings, got %v", exitWarnings, err)
+	}
+	if err := cmdBuild(append(args, "--allow-warnings")); err != nil {
+		t.Fatalf("--allow-warnings should succeed, got %v", err)
+	}
+}
+
+func TestCmdBuildDiffOnlyReadsTheLiveDirectory(t *testing.T) {
+	live := t.TempDir()
+	old := []byte("[global]\ntype=global\n")
+	if err := os.WriteFile(filepath.Join(live, "pjsip.conf"), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := cmdBuild([]string{"--dir", "examples", "--out", out, "--diff", live}); err != nil {
+		t.Fatalf("build --diff: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(live, "pjsip.conf")); !bytes.Equal(got, old) {
+		t.Fatalf("expected --diff to leave the live directory alone, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(live, "extensions.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing written to the live directory, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pjsip.conf")); err != nil {
+		t.Fatalf("expected --out to be written as usual: %v", err)
+	}
+}
+
+func TestCmdValidateStrictFailsOnSkippedContacts(t *testing.T) {
+	overlay := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(overlay, "contacts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bad := `contacts:
+  - id: "bad"
+    first_name: "Bad"
+    ext: "not valid!"
+    password: "secret"
+`
+	if err := os.WriteFile(filepath.Join(overlay, "contacts", "bad.yaml"), []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--dir", "examples", "--dir", overlay}
+	if err := cmdValidate(args); err != nil {
+		t.Fatalf("validate should stay lenient by default, got %v", err)
+	}
+	err := cmdValidate(append(args, "--strict"))
+	if err == nil || !strings.Contains(err.Error(), "bad.yaml ext not valid!") {
+		t.Fatalf("expected --strict to name the skipped contact, got %v", err)
+	}
+}
+
+func TestCmdAuditExitsOnFindings(t *testing.T) {
+	if err := cmdAudit([]string{"--dir", "examples"}); err != nil {
+		t.Fatalf("audit examples: %v", err)
+	}
+
+	overlay := t.TempDir()
+	cfg := "endpoint_templates:\n  - name: \"unused\"\n    context: \"internal\"\n"
+	if err := os.WriteFile(filepath.Join(overlay, "config.yaml"), []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := cmdAudit([]string{"--dir", "examples", "--dir", overlay, "--format", "json"})
+	var exit exitError
+	if !errors.As(err, &exit) || exit.code != exitWarnings {
+		t.Fatalf("expected exit status %d for findings, got %v", exitWarnings, err)
+	}
+
+	var buf strings.Builder
+	findings := []project.Finding{{Kind: project.FindingUnusedTemplate, Name: "unused", Detail: "no SIP contact uses this endpoint template"}}
+	if err := writeFindings(&buf, "text", findings); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "unused_template unused: no SIP contact uses this endpoint template\n" {
+		t.Fatalf("unexpected text output %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeFindings(&buf, "json", nil); err != nil {
+		t.Fatal(err)
+	}
+	var payload struct {
+		Findings []project.Finding `json:"findings"`
+	}
+	if err := json.Unmarshal([]byte(buf.String()), &payload); err != nil || payload.Findings == nil {
+		t.Fatalf("expected an empty findings array, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestApplyAsteriskWarnsAndRetriesWhenAsteriskIsDown(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	down := true
+	reloads := 0
+	applier := &asteriskApplier{dest: t.TempDir(), reload: func(bool) error {
+		reloads++
+		if down {
+			return errors.New("asterisk not running")
+		}
+		return nil
+	}}
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+
+	if applyAsterisk(applier, state, serveFlags{}, logger) {
+		t.Fatal("expected a failed reload to be reported")
+	}
+	if !strings.Contains(logs.String(), "failed to apply Asterisk config") {
+		t.Fatalf("expected a warning, got %q", logs.String())
+	}
+	down = false
+	if !applyAsterisk(applier, state, serveFlags{}, logger) || reloads != 2 {
+		t.Fatalf("expected the next build to retry the reload, got %d reloads", reloads)
+	}
+}
+
+func TestAsteriskApplierSkipsUnchangedConfigs(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "asterisk")
+	reloads := 0
+	failReload := false
+	voicemailReloads := 0
+	applier := &asteriskApplier{dest: dest, reload: func(voicemail bool) error {
+		reloads++
+		if voicemail {
+			voicemailReloads++
+		}
+		if failReload {
+			return errors.New("asterisk not running")
+		}
+		return nil
+	}}
+	state := project.State{PJSIP: []byte("[global]\n"), Extensions: []byte("[internal]\n")}
+
+	if applied, err := applier.apply(state); err != nil || !applied || reloads != 1 {
+		t.Fatalf("expected first build to write and reload, got applied=%v reloads=%d err=%v", applied, reloads, err)
+	}
+	if applied, err := applier.apply(state); err != nil || applied || reloads != 1 {
+		t.Fatalf("expected unchanged configs to be skipped, got applied=%v reloads=%d err=%v", applied, reloads, err)
+	}
+
+	state.Extensions = []byte("[internal]\nexten => 100,1,Dial(PJSIP/100)\n")
+	failReload = true
+	if _, err := applier.apply(state); err == nil {
+		t.Fatal("expected the reload failure to be reported")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "extensions.conf")); string(got) != string(state.Extensions) {
+		t.Fatalf("expected extensions.conf to be written before the reload, got %q", got)
+	}
+	failReload = false
+	if applied, err := applier.apply(state); err != nil || !applied || reloads != 3 {
+		t.Fatalf("expected a failed reload to be retried on the next build, got applied=%v reloads=%d err=%v", applied, reloads, err)
+	}
+	if voicemailReloads != 0 {
+		t.Fatalf("expected no voicemail reload without mailboxes, got %d", voicemailReloads)
+	}
+
+	state.Voicemail = []byte("[default]\n100 => 1234,Ada\n")
+	if applied, err := applier.apply(state); err != nil || !applied || voicemailReloads != 1 {
+		t.Fatalf("expected a new voicemail.conf to reload voicemail, got applied=%v voicemail reloads=%d err=%v", applied, voicemailReloads, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "voicemail.conf")); string(got) != string(state.Voicemail) {
+		t.Fatalf("expected voicemail.conf in dest, got %q", got)
+	}
+	state.Extensions = []byte("[internal]\n")
+	if applied, err := applier.apply(state); err != nil || !applied || voicemailReloads != 1 {
+		t.Fatalf("expected an unchanged voicemail.conf to skip the voicemail reload, got applied=%v voicemail reloads=%d err=%v", applied, voicemailReloads, err)
+	}
+}
+
+func TestParseServeFlagsReadsAMIPassFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ami.pass")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := parseServeFlags([]string{"--dir", "examples", "--ami-pass-file", path})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.amiPass != "s3cret" {
+		t.Fatalf("expected the password without its newline, got %q", flags.amiPass)
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ami-pass", "x", "--ami-pass-file", path}); err == nil {
+		t.Fatal("expected --ami-pass with --ami-pass-file to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ami-pass-file", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("expected a missing --ami-pass-file to fail")
+	}
+}
+
+func TestSortedExportUsesParsedContactSort(t *testing.T) {
+	var state project.State
+	state.Config.Server.ContactSort = "Name"
+	state.Contacts = []model.Contact{
+		{FirstName: "Amir", LastName: "Khan", Extension: "100"},
+		{FirstName: "Zoe", LastName: "Adams", Extension: "200"},
+	}
+	if got := sortedExport(state); got[0].Extension != "200" || state.Contacts[0].Extension != "100" {
+		t.Fatalf("expected a name-sorted copy for contact_sort: Name, got %+v", got)
+	}
+}
+
+func TestParseServeFlagsARI(t *testing.T) {
+	flags, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass", "s3cret"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.ariURL != "http://127.0.0.1:8088" || flags.ariApp != "phonebook" {
+		t.Fatalf("unexpected ARI defaults %q %q", flags.ariURL, flags.ariApp)
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass", "s3cret", "--ari-url", "127.0.0.1:8088"}); err == nil {
+		t.Fatal("expected an --ari-url without a scheme to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook"}); err == nil {
+		t.Fatal("expected --ari-user without --ari-pass to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ari-pass", "s3cret"}); err == nil {
+		t.Fatal("expected --ari-pass without --ari-user to fail")
+	}
+	both := []string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass", "s3cret", "--ami-user", "phonebook", "--ami-pass", "s3cret"}
+	if _, err := parseServeFlags(both); err != nil {
+		t.Fatalf("expected AMI credentials alongside ARI to be accepted, got %v", err)
+	}
+}
+
+func TestParseServeFlagsReadsARIPassFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ari.pass")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass-file", path})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.ariPass != "s3cret" {
+		t.Fatalf("expected the password without its newline, got %q", flags.ariPass)
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass", "x", "--ari-pass-file", path}); err == nil {
+		t.Fatal("expected --ari-pass with --ari-pass-file to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ari-user", "phonebook", "--ari-pass-file", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("expected a missing --ari-pass-file to fail")
+	}
+}
+
+func TestParseServeFlagsCDRPathAlias(t *testing.T) {
+	flags, err := parseServeFlags([]string{"--dir", "examples", "--cdr-path", "/tmp/Master.csv", "--cdr-reload-interval", "30s"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.cdrCSV != "/tmp/Master.csv" || flags.cdrReload != 30*time.Second {
+		t.Fatalf("expected --cdr-path to set the CDR CSV path, got %q every %s", flags.cdrCSV, flags.cdrReload)
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--cdr-columns", "start"}); err == nil {
+		t.Fatal("expected a malformed --cdr-columns to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--cdr-columns", "src=0"}); err == nil {
+		t.Fatal("expected a --cdr-columns without start and end to fail at startup")
+	}
+}
+
+func TestParseServeFlagsIdleTimeoutMustExceedPing(t *testing.T) {
+	for _, idle := range []string{"25s", "10s"} {
+		if _, err := parseServeFlags([]string{"--dir", "examples", "--ws-ping-interval", "25s", "--ws-idle-timeout", idle}); err == nil {
+			t.Fatalf("expected --ws-idle-timeout %s with a 25s ping interval to fail", idle)
+		}
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--ws-ping-interval", "25s", "--ws-idle-timeout", "26s"}); err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+}
+
+func TestParseServeFlagsHistoryLimits(t *testing.T) {
+	flags, err := parseServeFlags([]string{"--dir", "examples"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.historyMax != 100 || flags.historyKeep != 7*24*time.Hour {
+		t.Fatalf("expected the 100 / 7d defaults, got %d / %s", flags.historyMax, flags.historyKeep)
+	}
+	flags, err = parseServeFlags([]string{"--dir", "examples", "--history-max", "500", "--history-retention", "72h"})
+	if err != nil {
+		t.Fatalf("parseServeFlags() error = %v", err)
+	}
+	if flags.historyMax != 500 || flags.historyKeep != 72*time.Hour {
+		t.Fatalf("expected 500 / 72h, got %d / %s", flags.historyMax, flags.historyKeep)
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--history-max", "0"}); err == nil {
+		t.Fatal("expected --history-max 0 to fail")
+	}
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--history-retention", "-1h"}); err == nil {
+		t.Fatal("expected a negative --history-retention to fail")
+	}
+}
+
+func TestParseServeFlagsAsteriskApplyNeedsDest(t *testing.T) {
+	if _, err := parseServeFlags([]string{"--dir", "examples", "--asterisk-apply"}); err == nil {
+		t.Fatal("expected --asterisk-apply without --asterisk-dest to fail")
+	}
+}
+
+func TestCmdGenerateAsteriskSplitAndSingleFile(t *testing.T) {
+	dest := t.TempDir()
+	contactDir := filepath.Join(dest, splitContactDir)
+	if err := os.MkdirAll(contactDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(contactDir, "999.conf")
+	if err := os.WriteFile(stale, []byte("[999]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--dest", dest, "--split-per-contact"}); err != nil {
+		t.Fatalf("split generate: %v", err)
+	}
+	pjsip, err := os.ReadFile(filepath.Join(dest, "pjsip.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(pjsip), "#include \"pjsip.d/*.conf\"") || strings.Contains(string(pjsip), "type=auth") {
+		t.Fatalf("expected pjsip.conf to hold only shared sections and the include:\n%s", pjsip)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected stale contact file to be removed, got %v", err)
+	}
+	entries, _ := os.ReadDir(contactDir)
+	if len(entries) == 0 {
+		t.Fatal("expected one file per contact")
+	}
+	for _, ent := range entries {
+		body, _ := os.ReadFile(filepath.Join(contactDir, ent.Name()))
+		ext := strings.TrimSuffix(ent.Name(), ".conf")
+		if !strings.Contains(string(body), "["+ext+"]") {
+			t.Fatalf("%s does not hold endpoint %s:\n%s", ent.Name(), ext, body)
+		}
+	}
+
+	single := filepath.Join(t.TempDir(), "asterisk.conf")
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--single-file", single}); err != nil {
+		t.Fatalf("single-file generate: %v", err)
+	}
+	body, err := os.ReadFile(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "; ==== pjsip.conf ====") || !strings.Contains(string(body), "; ==== extensions.conf ====") {
+		t.Fatalf("expected both configs in the single file:\n%s", body)
+	}
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--single-file", single, "--dest", dest}); err == nil {
+		t.Fatal("expected --single-file with --dest to be rejected")
+	}
+}
+
+func TestWriteAsteriskDiff(t *testing.T) {
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dest, "pjsip.conf"), []byte("[global]\nuser_agent=old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	state := project.State{PJSIP: []byte("[global]\nuser_agent=new\n"), Extensions: []byte("[internal]\n")}
+
+	var out strings.Builder
+	changed, err := writeAsteriskDiff(&out, dest, state)
+	if err != nil || !changed {
+		t.Fatalf("writeAsteriskDiff() = %v, %v; want a change", changed, err)
+	}
+	pjsip := filepath.Join(dest, "pjsip.conf")
+	extensions := filepath.Join(dest, "extensions.conf")
+	want := "--- " + pjsip + "\n+++ pjsip.conf (generated)\n@@ -1,2 +1,2 @@\n [global]\n-user_agent=old\n+user_agent=new\n" +
+		"--- " + extensions + "\n+++ extensions.conf (generated)\n@@ -0,0 +1,1 @@\n+[internal]\n"
+	if out.String() != want {
+		t.Fatalf("diff mismatch\nGot:\n%s\nWant:\n%s", out.String(), want)
+	}
+
+	if _, err := writeOutputs(dest, state); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	changed, err = writeAsteriskDiff(&out, dest, state)
+	if err != nil || changed || out.String() != "no changes\n" {
+		t.Fatalf("expected no changes after writing, got %v, %v: %q", changed, err, out.String())
+	}
+}
+
+func TestCmdGenerateAsteriskDiffWritesNothing(t *testing.T) {
+	dest := t.TempDir()
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--dest", dest, "--diff"}); err != nil {
+		t.Fatalf("generate asterisk --diff: %v", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Fatalf("expected --diff to leave --dest untouched, got %v", entries)
+	}
+
+	// Once dest matches, --apply skips the reload, which would otherwise
+	// fail here without an asterisk binary on PATH.
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--dest", dest}); err != nil {
+		t.Fatalf("generate asterisk: %v", err)
+	}
+	t.Setenv("PATH", t.TempDir())
+	if err := cmdGenerateAsterisk([]string{"--dir", "examples", "--dest", dest, "--diff", "--apply"}); err != nil {
+		t.Fatalf("expected an unchanged --diff --apply to skip the reload, got %v", err)
+	}
+}
+
+func TestCmdGenerateJSONOmitsSecrets(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "dump")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdGenerateJSON([]string{"--dir", "examples", "--out", out}); err != nil {
+		t.Fatalf("generate json: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(out, "contacts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload struct {
+		Contacts []map[string]any `json:"contacts"`
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(payload.Contacts) == 0 {
+		t.Fatal("expected contacts in the dump")
+	}
+	for _, c := range payload.Contacts {
+		if c["ext"] == nil || c["source"] == nil {
+			t.Fatalf("expected ext and source on every contact, got %v", c)
+		}
+		if _, ok := c["password"]; ok {
+			t.Fatalf("password leaked into generate json: %v", c)
+		}
+	}
+}
+
+func TestCmdGenerateXMLVendorYealink(t *testing.T) {
+	out := t.TempDir()
+	if err := cmdGenerateXML([]string{"--dir", "examples", "--out", out, "--vendor", "yealink"}); err != nil {
+		t.Fatalf("generate xml: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(out, "yealink.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "<IPPhoneDirectory>") || !strings.Contains(string(raw), "<Telephone>") {
+		t.Fatalf("expected a Yealink directory, got:\n%s", raw)
+	}
+}
+
+func TestCmdGenerateXMLCompact(t *testing.T) {
+	out := t.TempDir()
+	if err := cmdGenerateXML([]string{"--dir", "examples", "--out", out, "--compact"}); err != nil {
+		t.Fatalf("generate xml: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(out, "phonebook.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "<AddressBook><Contact>") {
+		t.Fatalf("expected the header and one unindented line, got:\n%s", raw)
+	}
+	if err := cmdGenerateXML([]string{"--dir", "examples", "--out", out, "--pretty=false", "--format", "polycom"}); err == nil {
+		t.Fatal("expected --pretty=false to be rejected for polycom")
+	}
+}
+
+func TestCmdGenerateCSVWritesIntoDirectory(t *testing.T) {
+	out := t.TempDir()
+	if err := cmdGenerateCSV([]string{"--dir", "examples", "--out", out}); err != nil {
+		t.Fatalf("generate csv: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(out, "contacts.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if lines[0] != "id,first_name,last_name,extension,phones,group_id,template,source_path" || len(lines) < 2 {
+		t.Fatalf("expected a header and contact rows, got:\n%s", raw)
+	}
+}
+
+func TestCmdGenerateVCardWritesIntoDirectory(t *testing.T) {
+	out := t.TempDir()
+	if err := cmdGenerateVCard([]string{"--dir", "examples", "--out", out}); err != nil {
+		t.Fatalf("generate vcard: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(out, "contacts.vcf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(raw), "BEGIN:VCARD\r\nVERSION:3.0\r\n") || strings.Count(string(raw), "BEGIN:VCARD") != strings.Count(string(raw), "END:VCARD") {
+		t.Fatalf("expected a vCard stream, got:\n%s", raw)
+	}
+}